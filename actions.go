@@ -0,0 +1,185 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// Where a scan writes the frequency of every event name and event source.
+const (
+	actionsPath = "actions.csv"
+	sourcesPath = "sources.csv"
+)
+
+// action is an event name of an event source, names like ListTags exist in
+// several services.
+type action struct {
+	eventSource string
+	eventName   string
+}
+
+// actionCounts is what actions.csv tells of an event name.
+type actionCounts struct {
+	events int
+	// matched counts the events with a value under a key of the summary.
+	matched int
+	keys    map[string]struct{}
+}
+
+// actionStats counts the events of every event name, whether they held an
+// identifier or not, to tell which actions and services are worth writing
+// mappings for.
+type actionStats struct {
+	mu      sync.Mutex
+	actions map[action]*actionCounts
+	// keys is false when the distinct keys aren't counted, e.g. with
+	// --low-memory, the keys columns are then left empty.
+	keys bool
+}
+
+func newActionStats(keys bool) *actionStats {
+	return &actionStats{actions: make(map[action]*actionCounts), keys: keys}
+}
+
+// action returns the counts of the event name of event. The caller holds the
+// lock.
+func (a *actionStats) action(event scan.RawEvent) *actionCounts {
+	key := action{eventSource: event.EventSource, eventName: event.EventName}
+	counts, ok := a.actions[key]
+	if !ok {
+		counts = &actionCounts{keys: make(map[string]struct{})}
+		a.actions[key] = counts
+	}
+	return counts
+}
+
+// addEvent is a scan.WithOnEvent hook.
+func (a *actionStats) addEvent(event scan.RawEvent, hits int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	counts := a.action(event)
+	counts.events++
+	if hits > 0 {
+		counts.matched++
+	}
+}
+
+// addHit is a scan.WithOnHit hook.
+func (a *actionStats) addHit(event scan.RawEvent, key, _ string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.action(event).keys[key] = struct{}{}
+}
+
+// len is the number of event names counted.
+func (a *actionStats) len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return len(a.actions)
+}
+
+// write writes a row per event name to actionsPath and a row per event
+// source to sourcesPath, the most frequent first, with comma as the
+// delimiter of the csv summaries.
+func (a *actionStats) write(actionsPath, sourcesPath string, comma rune) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	actions := make([]action, 0, len(a.actions))
+	for act := range a.actions {
+		actions = append(actions, act)
+	}
+	slices.SortFunc(actions, func(x, y action) int {
+		return cmp.Or(
+			cmp.Compare(a.actions[y].events, a.actions[x].events),
+			cmp.Compare(x.eventName, y.eventName),
+			cmp.Compare(x.eventSource, y.eventSource),
+		)
+	})
+
+	rows := [][]string{{"eventName", "eventSource", "events", "matchedEvents", "keys"}}
+	for _, act := range actions {
+		counts := a.actions[act]
+		rows = append(rows, []string{act.eventName, act.eventSource, strconv.Itoa(counts.events), strconv.Itoa(counts.matched), a.count(counts.keys)})
+	}
+	if err := writeCSVFile(actionsPath, rows, comma); err != nil {
+		return err
+	}
+
+	type sourceCounts struct {
+		events     int
+		eventNames int
+		keys       map[string]struct{}
+	}
+	total := 0
+	sources := make(map[string]*sourceCounts)
+	for act, counts := range a.actions {
+		source, ok := sources[act.eventSource]
+		if !ok {
+			source = &sourceCounts{keys: make(map[string]struct{})}
+			sources[act.eventSource] = source
+		}
+		source.events += counts.events
+		source.eventNames++
+		for key := range counts.keys {
+			source.keys[key] = struct{}{}
+		}
+		total += counts.events
+	}
+
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(x, y string) int {
+		return cmp.Or(cmp.Compare(sources[y].events, sources[x].events), cmp.Compare(x, y))
+	})
+
+	rows = [][]string{{"eventSource", "events", "eventNames", "keys", "eventShare"}}
+	for _, name := range names {
+		source := sources[name]
+		share := float64(source.events) / float64(total)
+		rows = append(rows, []string{name, strconv.Itoa(source.events), strconv.Itoa(source.eventNames), a.count(source.keys), strconv.FormatFloat(share, 'f', 4, 64)})
+	}
+	if err := writeCSVFile(sourcesPath, rows, comma); err != nil {
+		return err
+	}
+
+	slog.Debug("Actions and sources written", slog.Int("actions", len(actions)), slog.Int("sources", len(names)))
+	return nil
+}
+
+// count formats the number of keys, empty when they weren't counted.
+func (a *actionStats) count(keys map[string]struct{}) string {
+	if !a.keys {
+		return ""
+	}
+	return strconv.Itoa(len(keys))
+}
+
+// writeCSVFile writes rows to path at once, comma being the delimiter.
+func writeCSVFile(path string, rows [][]string, comma rune) error {
+	file, err := createAtomic(path, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.abort()
+
+	wr := csv.NewWriter(file)
+	if comma != 0 {
+		wr.Comma = comma
+	}
+	if err := wr.WriteAll(rows); err != nil {
+		return err
+	}
+	return file.commit()
+}
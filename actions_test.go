@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// addActionEvents hands the events of TestActionStatsWrite to stats.
+func addActionEvents(stats *actionStats) {
+	getRole := scan.RawEvent{EventName: "GetRole", EventSource: "iam.amazonaws.com"}
+	iamTags := scan.RawEvent{EventName: "ListTags", EventSource: "iam.amazonaws.com"}
+	kmsTags := scan.RawEvent{EventName: "ListTags", EventSource: "kms.amazonaws.com"}
+	decrypt := scan.RawEvent{EventName: "Decrypt", EventSource: "kms.amazonaws.com"}
+
+	stats.addHit(getRole, "requestParameters.roleArn", "arn:aws:iam::123456789012:role/a")
+	stats.addEvent(getRole, 1)
+	stats.addHit(getRole, "requestParameters.roleArn", "arn:aws:iam::123456789012:role/b")
+	stats.addHit(getRole, "responseElements.role.arn", "arn:aws:iam::123456789012:role/b")
+	stats.addEvent(getRole, 2)
+	stats.addEvent(getRole, 0)
+	stats.addEvent(iamTags, 0)
+	stats.addHit(kmsTags, "requestParameters.keyId", "arn:aws:kms:eu-west-1:123456789012:key/k")
+	stats.addEvent(kmsTags, 1)
+	stats.addHit(decrypt, "requestParameters.keyId", "arn:aws:kms:eu-west-1:123456789012:key/k")
+	stats.addEvent(decrypt, 1)
+	stats.addEvent(decrypt, 0)
+}
+
+// TestActionStatsWrite counts the events, matched events and distinct keys
+// of every event name and event source, the most frequent first and ties by
+// name.
+func TestActionStatsWrite(t *testing.T) {
+	tests := []struct {
+		name                  string
+		comma                 rune
+		keys                  bool
+		wantActions, wantSrcs string
+	}{
+		{
+			name: "comma",
+			keys: true,
+			wantActions: "eventName,eventSource,events,matchedEvents,keys\n" +
+				"GetRole,iam.amazonaws.com,3,2,2\n" +
+				"Decrypt,kms.amazonaws.com,2,1,1\n" +
+				"ListTags,iam.amazonaws.com,1,0,0\n" +
+				"ListTags,kms.amazonaws.com,1,1,1\n",
+			wantSrcs: "eventSource,events,eventNames,keys,eventShare\n" +
+				"iam.amazonaws.com,4,2,2,0.5714\n" +
+				"kms.amazonaws.com,3,2,1,0.4286\n",
+		},
+		{
+			name:  "semicolon",
+			comma: ';',
+			keys:  true,
+			wantActions: "eventName;eventSource;events;matchedEvents;keys\n" +
+				"GetRole;iam.amazonaws.com;3;2;2\n" +
+				"Decrypt;kms.amazonaws.com;2;1;1\n" +
+				"ListTags;iam.amazonaws.com;1;0;0\n" +
+				"ListTags;kms.amazonaws.com;1;1;1\n",
+			wantSrcs: "eventSource;events;eventNames;keys;eventShare\n" +
+				"iam.amazonaws.com;4;2;2;0.5714\n" +
+				"kms.amazonaws.com;3;2;1;0.4286\n",
+		},
+		{
+			// With --low-memory the keys aren't counted.
+			name: "no keys",
+			wantActions: "eventName,eventSource,events,matchedEvents,keys\n" +
+				"GetRole,iam.amazonaws.com,3,2,\n" +
+				"Decrypt,kms.amazonaws.com,2,1,\n" +
+				"ListTags,iam.amazonaws.com,1,0,\n" +
+				"ListTags,kms.amazonaws.com,1,1,\n",
+			wantSrcs: "eventSource,events,eventNames,keys,eventShare\n" +
+				"iam.amazonaws.com,4,2,,0.5714\n" +
+				"kms.amazonaws.com,3,2,,0.4286\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := newActionStats(tt.keys)
+			addActionEvents(stats)
+
+			dir := t.TempDir()
+			actions, sources := filepath.Join(dir, actionsPath), filepath.Join(dir, sourcesPath)
+			if err := stats.write(actions, sources, tt.comma); err != nil {
+				t.Fatal(err)
+			}
+
+			for path, want := range map[string]string{actions: tt.wantActions, sources: tt.wantSrcs} {
+				got, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("%s is\n%s\nwant\n%s", filepath.Base(path), got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// analyzedLine is a line of logs.ndjson or matches.ndjson. Match logs and
+// match records name their fields differently, so it holds both. Older
+// matches files named the event fields eventAction and eventExampleId.
+type analyzedLine struct {
+	Msg       string `json:"msg"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Action    string `json:"action"`
+	EventID   string `json:"event-id"`
+	AccountID string `json:"account-id"`
+
+	EventName      string `json:"eventName"`
+	RecordEventID  string `json:"eventId"`
+	EventAction    string `json:"eventAction"`
+	EventExampleId string `json:"eventExampleId"`
+	AccountId      string `json:"accountId"`
+}
+
+// runAnalyze rebuilds summary.csv from the matches a previous run logged to
+// logs.ndjson, or wrote to matches.ndjson with --low-memory, without scanning
+// again. Every match goes through the current matchers, so values they no
+// longer accept are dropped.
+func runAnalyze(args []string) int {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	fs := newFlagSet("analyze", "[flags] [logs.ndjson|matches.ndjson ...]",
+		"find-cloudtrail-arn-fields analyze",
+		"find-cloudtrail-arn-fields analyze --keys '^requestParameters\\.' matches.ndjson",
+	)
+	keys := fs.String("keys", "", "Only keep keys matching this regular expression")
+	var patterns []scan.Matcher
+	fs.Func("pattern", "Also keep the values matching a regexp under a match type, like the --pattern of a scan", patternFlag(&patterns))
+
+	if err := fs.Parse(args); err != nil {
+		return parseExitCode(err)
+	}
+
+	var keyPattern *regexp.Regexp
+	if *keys != "" {
+		var err error
+		if keyPattern, err = regexp.Compile(*keys); err != nil {
+			slog.Error("Invalid arguments", slog.String("error", fmt.Sprintf("--keys must be a regular expression: %v", err)))
+			return exitConfig
+		}
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"logs.ndjson"}
+	}
+
+	cache := scan.NewMemoryStore(10000)
+	sc, err := scan.New(scan.WithStore(cache), scan.WithMatchers(scanMatchers(patterns)...))
+	if err != nil {
+		slog.Error("Couldn't set up scan", slog.String("error", err.Error()))
+		return exitFailure
+	}
+
+	for _, path := range paths {
+		if err := analyzeFile(path, keyPattern, sc); err != nil {
+			slog.Error("Couldn't analyze file", slog.String("path", path), slog.String("error", err.Error()))
+			return exitFailure
+		}
+	}
+
+	if err := writeSummaries(context.Background(), cache, []scan.SummaryWriter{&csvSummaryWriter{path: "summary.csv"}}); err != nil {
+		slog.Error("Couldn't write summary", slog.String("error", err.Error()))
+		return exitOutput
+	}
+	slog.Info("Summary rebuilt", slog.Int("keys", cache.Len()))
+
+	return exitOK
+}
+
+func analyzeFile(path string, keyPattern *regexp.Regexp, sc *scan.Scanner) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	matches, invalid := 0, 0
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line analyzedLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			invalid++
+			continue
+		}
+
+		// Match records have no message, any other log line isn't a match.
+		if line.Msg == "" {
+			line.Action, line.EventID, line.AccountID = line.EventName, line.RecordEventID, line.AccountId
+			if line.Action == "" && line.EventID == "" {
+				line.Action, line.EventID = line.EventAction, line.EventExampleId
+			}
+		} else if !strings.HasPrefix(line.Msg, "Has ") {
+			continue
+		}
+
+		if line.Key == "" {
+			invalid++
+			continue
+		}
+		matches++
+
+		if keyPattern != nil && !keyPattern.MatchString(line.Key) {
+			continue
+		}
+
+		event := scan.RawEvent{EventName: line.Action, EventID: line.EventID, AccountID: line.AccountID}
+		sc.RecordValue(event, line.Key, line.Value)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	slog.Info("File analyzed", slog.String("path", path), slog.Int("matches", matches), slog.Int("invalid-lines", invalid))
+
+	return nil
+}
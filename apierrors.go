@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/smithy-go"
+)
+
+// lookupEventsPolicy is the minimal IAM policy the scan needs.
+const lookupEventsPolicy = `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Effect": "Allow",
+      "Action": "cloudtrail:LookupEvents",
+      "Resource": "*"
+    }
+  ]
+}`
+
+// isAccessDenied reports whether err means the credentials aren't allowed to
+// call LookupEvents. Retrying such an error can never succeed.
+func isAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.ErrorCode() {
+	case "AccessDeniedException", "AccessDenied", "UnauthorizedOperation":
+		return true
+	default:
+		return false
+	}
+}
+
+// isExpiredCredentials reports whether err means the credentials expired, e.g.
+// because the SSO session ended. Unlike throttling, retrying only helps once
+// the credentials were refreshed.
+func isExpiredCredentials(err error) bool {
+	var tokenErr *ssocreds.InvalidTokenError
+	if errors.As(err, &tokenErr) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.ErrorCode() {
+	case "ExpiredToken", "ExpiredTokenException", "RequestExpired", "TokenRefreshRequired":
+		return true
+	default:
+		return false
+	}
+}
+
+// invalidRequestHint explains the LookupEvents errors that reject the request
+// itself. Retrying them with the same input can never succeed, unlike
+// throttling or a failing endpoint. It returns "" for any other error.
+func invalidRequestHint(err error) string {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return ""
+	}
+
+	switch apiErr.ErrorCode() {
+	case "InvalidNextTokenException":
+		return "The pagination token was rejected, e.g. it expired or the checkpoint is of another account or region. Scan again without --resume."
+	case "InvalidTimeRangeException":
+		return "The time range was rejected, --start-time must be before --end-time."
+	case "InvalidLookupAttributesException":
+		return "The lookup attributes were rejected."
+	default:
+		return ""
+	}
+}
+
+// refreshCredentials drops the cached credentials and fetches new ones from
+// the configured provider. It fails if e.g. the SSO session itself expired.
+func refreshCredentials(ctx context.Context, provider aws.CredentialsProvider) error {
+	if provider == nil {
+		return errors.New("no credentials provider configured")
+	}
+
+	if cache, ok := provider.(*aws.CredentialsCache); ok {
+		cache.Invalidate()
+	}
+
+	_, err := provider.Retrieve(ctx)
+	return err
+}
+
+func printAccessDeniedHelp() {
+	fmt.Fprintf(os.Stderr, "The configured AWS credentials are not allowed to call cloudtrail:LookupEvents.\n"+
+		"Attach a policy like the following to the identity and run the scan again:\n\n%s\n", lookupEventsPolicy)
+}
+
+func printCredentialsExpiredHelp(checkpointPath string) {
+	fmt.Fprintf(os.Stderr, "The AWS credentials expired and couldn't be refreshed, the scan was paused.\n"+
+		"summary.csv holds the fields found so far, a resumed scan reloads it and adds the fields of the remaining pages.\n"+
+		"Log in again, e.g. with `aws sso login`, and continue the scan with:\n\n"+
+		"    find-cloudtrail-arn-fields --resume --checkpoint %s [the same flags]\n", checkpointPath)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/smithy-go"
+)
+
+func TestAPIErrorClassification(t *testing.T) {
+	apiErr := func(code string) error {
+		// Wrapped like the SDK's operation errors.
+		return fmt.Errorf("operation error CloudTrail: LookupEvents: %w", &smithy.GenericAPIError{Code: code, Message: "message"})
+	}
+
+	tests := []struct {
+		name           string
+		err            error
+		accessDenied   bool
+		expired        bool
+		invalidRequest bool
+	}{
+		{name: "AccessDeniedException", err: apiErr("AccessDeniedException"), accessDenied: true},
+		{name: "AccessDenied", err: apiErr("AccessDenied"), accessDenied: true},
+		{name: "UnauthorizedOperation", err: apiErr("UnauthorizedOperation"), accessDenied: true},
+		{name: "ExpiredToken", err: apiErr("ExpiredToken"), expired: true},
+		{name: "ExpiredTokenException", err: apiErr("ExpiredTokenException"), expired: true},
+		{name: "RequestExpired", err: apiErr("RequestExpired"), expired: true},
+		{name: "TokenRefreshRequired", err: apiErr("TokenRefreshRequired"), expired: true},
+		{name: "sso token", err: fmt.Errorf("get credentials: %w", &ssocreds.InvalidTokenError{Err: errors.New("expired")}), expired: true},
+		{name: "InvalidNextTokenException", err: apiErr("InvalidNextTokenException"), invalidRequest: true},
+		{name: "InvalidTimeRangeException", err: apiErr("InvalidTimeRangeException"), invalidRequest: true},
+		{name: "InvalidLookupAttributesException", err: apiErr("InvalidLookupAttributesException"), invalidRequest: true},
+		{name: "ThrottlingException", err: apiErr("ThrottlingException")},
+		{name: "InternalFailure", err: apiErr("InternalFailure")},
+		{name: "not an api error", err: errors.New("connection reset by peer")},
+		{name: "nil", err: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAccessDenied(tt.err); got != tt.accessDenied {
+				t.Errorf("isAccessDenied = %v, want %v", got, tt.accessDenied)
+			}
+			if got := isExpiredCredentials(tt.err); got != tt.expired {
+				t.Errorf("isExpiredCredentials = %v, want %v", got, tt.expired)
+			}
+			if got := invalidRequestHint(tt.err); (got != "") != tt.invalidRequest {
+				t.Errorf("invalidRequestHint = %q, want a hint: %v", got, tt.invalidRequest)
+			}
+		})
+	}
+}
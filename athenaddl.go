@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/exp/maps"
+)
+
+// athenaStandardFields are the fields of every CloudTrail record, in the order
+// of the table AWS documents for trail logs. requestParameters and the other
+// payload columns are strings unless keys were found under them.
+var athenaStandardFields = []string{
+	"eventVersion",
+	"userIdentity.type", "userIdentity.principalId", "userIdentity.arn", "userIdentity.accountId",
+	"userIdentity.invokedBy", "userIdentity.accessKeyId", "userIdentity.userName",
+	"userIdentity.sessionContext.attributes.mfaAuthenticated", "userIdentity.sessionContext.attributes.creationDate",
+	"userIdentity.sessionContext.sessionIssuer.type", "userIdentity.sessionContext.sessionIssuer.principalId",
+	"userIdentity.sessionContext.sessionIssuer.arn", "userIdentity.sessionContext.sessionIssuer.accountId",
+	"userIdentity.sessionContext.sessionIssuer.userName",
+	"eventTime", "eventSource", "eventName", "awsRegion", "sourceIPAddress", "userAgent", "errorCode", "errorMessage",
+	"requestParameters", "responseElements", "additionalEventData", "requestID", "eventID",
+	"resources[].arn", "resources[].accountId", "resources[].type",
+	"eventType", "apiVersion", "readOnly", "recipientAccountId", "serviceEventDetails", "sharedEventID", "vpcEndpointId",
+}
+
+// athenaReserved are the reserved words of Athena DDL, which must be quoted
+// as names.
+var athenaReserved = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`all alter and array as authorization between bigint binary boolean both by
+		case cashe cast char column conf constraint commit create cross cube current current_date current_timestamp
+		cursor database date dayofweek decimal delete describe distinct double drop else end exchange exists extended
+		external extract false fetch float floor following for foreign from full function grant group grouping having
+		if import in inner insert int integer intersect interval into is join lateral left less like local macro map
+		more none not null numeric of on only or order out outer over partialscan partition percent preceding
+		precision preserve primary procedure range reads reduce regexp references revoke right rlike rollback rollup
+		row rows select set smallint start table tablesample then time timestamp to transform trigger true truncate
+		unbounded union uniquejoin update user using utc_tmestamp values varchar views when where window with`) {
+		athenaReserved[word] = true
+	}
+}
+
+// athenaPlainName is a name that needs no quoting.
+var athenaPlainName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// athenaSchema collects the keys found in every service, for --emit-athena-ddl
+// to declare them as columns of a table over the trail logs.
+type athenaSchema struct {
+	mu   sync.Mutex
+	keys map[string]map[string]struct{}
+}
+
+func newAthenaSchema() *athenaSchema {
+	return &athenaSchema{keys: make(map[string]map[string]struct{})}
+}
+
+// add is a scan.WithOnHit hook.
+func (a *athenaSchema) add(event scan.RawEvent, key, _ string) {
+	service := strings.TrimSuffix(event.EventSource, ".amazonaws.com")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	services, ok := a.keys[key]
+	if !ok {
+		services = make(map[string]struct{})
+		a.keys[key] = services
+	}
+	services[service] = struct{}{}
+}
+
+// write writes a CREATE EXTERNAL TABLE statement for table over location to
+// path, declaring the keys found as nested columns. With byService there is
+// a statement per service with its keys only, e.g. cloudtrail.s3.sql and the
+// table cloudtrail_logs_s3.
+func (a *athenaSchema) write(path, table, location string, byService bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !byService {
+		keys := maps.Keys(a.keys)
+		if err := writeFileAtomic(path, []byte(athenaDDL(table, location, keys)), 0o600); err != nil {
+			return err
+		}
+		slog.Debug("Athena DDL written", slog.String("path", path), slog.Int("keys", len(keys)))
+		return nil
+	}
+
+	byServiceKeys := make(map[string][]string)
+	for key, services := range a.keys {
+		for service := range services {
+			byServiceKeys[service] = append(byServiceKeys[service], key)
+		}
+	}
+	for service, keys := range byServiceKeys {
+		name := athenaIdentifier(service)
+		if name == "" {
+			name = "unknown"
+		}
+		if err := writeFileAtomic(regionPath(path, name), []byte(athenaDDL(table+"_"+name, location, keys)), 0o600); err != nil {
+			return fmt.Errorf("service %s: %w", service, err)
+		}
+	}
+	slog.Debug("Athena DDL written", slog.String("path", path), slog.Int("services", len(byServiceKeys)))
+	return nil
+}
+
+// athenaNode is a column or struct field. It is a struct if it has fields,
+// a string otherwise, within as many arrays as the key had [] after it.
+type athenaNode struct {
+	fields map[string]*athenaNode
+	arrays int
+}
+
+// addKey adds the fields of key below n, e.g. "items[].instanceId" is the
+// array of structs items with the field instanceid. Names are lowercased,
+// Athena matches the json fields regardless of case.
+func (n *athenaNode) addKey(key string) {
+	for _, segment := range keySegments(key) {
+		name := strings.TrimRight(segment, "[]")
+		arrays := (len(segment) - len(name)) / 2
+		name = strings.ToLower(name)
+		if name == "" || name == "$" {
+			return
+		}
+
+		if n.fields == nil {
+			n.fields = make(map[string]*athenaNode)
+		}
+		child, ok := n.fields[name]
+		if !ok {
+			child = &athenaNode{}
+			n.fields[name] = child
+		}
+		child.arrays = max(child.arrays, arrays)
+		n = child
+	}
+}
+
+// keySegments splits key on its unescaped dots and unescapes the segments,
+// e.g. the tag key "kubernetes\.io/cluster" is one segment.
+func keySegments(key string) []string {
+	var segments []string
+	var segment strings.Builder
+	escaped := false
+	for _, r := range key {
+		switch {
+		case escaped:
+			segment.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '.':
+			segments = append(segments, segment.String())
+			segment.Reset()
+		default:
+			segment.WriteRune(r)
+		}
+	}
+	return append(segments, segment.String())
+}
+
+func (n *athenaNode) typ() string {
+	t := "STRING"
+	if len(n.fields) > 0 {
+		names := maps.Keys(n.fields)
+		slices.Sort(names)
+		fields := make([]string, 0, len(names))
+		for _, name := range names {
+			fields = append(fields, athenaName(name)+":"+n.fields[name].typ())
+		}
+		t = "STRUCT<" + strings.Join(fields, ", ") + ">"
+	}
+	for range n.arrays {
+		t = "ARRAY<" + t + ">"
+	}
+	return t
+}
+
+// athenaDDL is the statement of a table with the standard CloudTrail columns
+// and keys, the columns of keys found outside of them last.
+func athenaDDL(table, location string, keys []string) string {
+	root := &athenaNode{}
+	var columns []string
+	for _, field := range athenaStandardFields {
+		root.addKey(field)
+		column := strings.ToLower(strings.TrimRight(strings.SplitN(field, ".", 2)[0], "[]"))
+		if !slices.Contains(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+
+	slices.Sort(keys)
+	for _, key := range keys {
+		root.addKey(key)
+	}
+	extra := maps.Keys(root.fields)
+	slices.Sort(extra)
+	for _, column := range extra {
+		if !slices.Contains(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+
+	var b strings.Builder
+	// The table may be in a database, e.g. db.cloudtrail_logs.
+	parts := strings.Split(strings.ToLower(table), ".")
+	for i, part := range parts {
+		parts[i] = athenaName(part)
+	}
+	fmt.Fprintf(&b, "CREATE EXTERNAL TABLE IF NOT EXISTS %s (\n", strings.Join(parts, "."))
+	for i, column := range columns {
+		sep := ","
+		if i == len(columns)-1 {
+			sep = ""
+		}
+		fmt.Fprintf(&b, "  %s %s%s\n", athenaName(column), root.fields[column].typ(), sep)
+	}
+	b.WriteString(")\n")
+	fmt.Fprintf(&b, "COMMENT %s\n", athenaString(fmt.Sprintf("CloudTrail logs with the %d keys found by find-cloudtrail-arn-fields", len(keys))))
+	b.WriteString("ROW FORMAT SERDE 'org.apache.hive.hcatalog.data.JsonSerDe'\n")
+	b.WriteString("STORED AS INPUTFORMAT 'com.amazon.emr.cloudtrail.CloudTrailInputFormat'\n")
+	b.WriteString("OUTPUTFORMAT 'org.apache.hadoop.hive.ql.io.HiveIgnoreKeyTextOutputFormat'\n")
+	fmt.Fprintf(&b, "LOCATION %s;\n", athenaString(location))
+	return b.String()
+}
+
+// athenaName quotes name with backticks if it is reserved or holds more than
+// lowercase letters, digits and underscores, e.g. the account id keys of
+// tags.
+func athenaName(name string) string {
+	if athenaPlainName.MatchString(name) && !athenaReserved[name] {
+		return name
+	}
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// athenaString quotes s as a string literal.
+func athenaString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// athenaIdentifier makes s, e.g. a service like sso-directory, usable in a
+// table name.
+func athenaIdentifier(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestAthenaDDLGolden declares keys needing every kind of quoting and
+// nesting next to the standard CloudTrail columns.
+func TestAthenaDDLGolden(t *testing.T) {
+	keys := []string{
+		"requestParameters.roleArn",
+		// Lowercased, Bucket and bucket are the same field.
+		"requestParameters.Bucket.Name",
+		"requestParameters.bucket.region",
+		// Reserved words.
+		"requestParameters.table.order",
+		"date",
+		// Arrays of structs, of arrays and into a standard column.
+		"requestParameters.instancesSet.items[].instanceId",
+		"responseElements.matrix[][]",
+		"resources[].ARN",
+		"serviceEventDetails.snapshotId",
+		// Escaped dots, digits and backticks.
+		`requestParameters.tags.kubernetes\.io/cluster`,
+		`requestParameters.tags.a\\b`,
+		"requestParameters.tags.123456789012",
+		"requestParameters.tags.a`b",
+		// Not a field.
+		"$",
+	}
+	checkGolden(t, "athena.sql", []byte(athenaDDL("db.cloudtrail_logs", "s3://bucket/AWSLogs/o-it's/", keys)))
+}
+
+func TestKeySegments(t *testing.T) {
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{"requestParameters.roleArn", []string{"requestParameters", "roleArn"}},
+		{"items[].instanceId", []string{"items[]", "instanceId"}},
+		{`tags.kubernetes\.io/cluster.name`, []string{"tags", "kubernetes.io/cluster", "name"}},
+		{`tags.a\\.b`, []string{"tags", `a\`, "b"}},
+		{"$", []string{"$"}},
+	}
+	for _, tt := range tests {
+		if got := keySegments(tt.key); !slices.Equal(got, tt.want) {
+			t.Errorf("keySegments(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/athena"
+	athenatypes "github.com/aws/aws-sdk-go-v2/service/athena/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// athenaColumns maps the lower case columns of the standard CloudTrail Athena
+// table to the field names of the CloudTrail record. Struct and array columns
+// are selected as json, their nested fields stay lower case.
+var athenaColumns = []struct {
+	column string
+	field  string
+	nested bool
+}{
+	{column: "eventid", field: "eventID"},
+	{column: "eventname", field: "eventName"},
+	{column: "eventtime", field: "eventTime"},
+	{column: "eventsource", field: "eventSource"},
+	{column: "awsregion", field: "awsRegion"},
+	{column: "recipientaccountid", field: "recipientAccountId"},
+	{column: "useridentity", field: "userIdentity", nested: true},
+	{column: "requestparameters", field: "requestParameters"},
+	{column: "responseelements", field: "responseElements"},
+	{column: "additionaleventdata", field: "additionalEventData"},
+	{column: "resources", field: "resources", nested: true},
+}
+
+// athenaSource queries an Athena table over the trail's S3 logs and streams
+// the result file into the pipeline.
+type athenaSource struct {
+	athena       *athena.Client
+	s3           *s3.Client
+	table        string
+	output       string
+	workGroup    string
+	datePart     string
+	window       timeWindow
+	pollInterval time.Duration
+	stats        *scanStats
+}
+
+func (a *athenaSource) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	query := buildAthenaQuery(a.table, a.datePart, a.window)
+	slog.Info("Starting Athena query", slog.String("query", query))
+
+	input := &athena.StartQueryExecutionInput{
+		QueryString:         &query,
+		ResultConfiguration: &athenatypes.ResultConfiguration{OutputLocation: &a.output},
+	}
+	if a.workGroup != "" {
+		input.WorkGroup = &a.workGroup
+	}
+
+	started, err := a.athena.StartQueryExecution(ctx, input)
+	if err != nil {
+		slog.Error("Couldn't start Athena query", slog.String("error", err.Error()))
+		return stopFailed
+	}
+	queryID := deRef(started.QueryExecutionId)
+
+	resultsURI, err := a.waitForQuery(ctx, queryID)
+	if err != nil {
+		if ctx.Err() != nil {
+			a.stopQuery(queryID)
+			return stopCanceled
+		}
+
+		// The Athena error message is logged verbatim, it usually names the
+		// offending column or partition.
+		slog.Error("Athena query failed", slog.String("query-id", queryID), slog.String("error", err.Error()))
+		return stopFailed
+	}
+
+	if err := a.readResults(ctx, resultsURI, emit); err != nil {
+		if ctx.Err() != nil {
+			return stopCanceled
+		}
+
+		slog.Error("Couldn't read Athena query results", slog.String("results", resultsURI), slog.String("error", err.Error()))
+		return stopFailed
+	}
+
+	return stopComplete
+}
+
+// waitForQuery polls the query execution until it succeeded and returns the
+// S3 location of its result file.
+func (a *athenaSource) waitForQuery(ctx context.Context, queryID string) (string, error) {
+	for {
+		out, err := a.athena.GetQueryExecution(ctx, &athena.GetQueryExecutionInput{QueryExecutionId: &queryID})
+		if err != nil {
+			return "", err
+		}
+
+		exec := out.QueryExecution
+		if exec.Statistics != nil {
+			a.stats.setAthenaBytesScanned(deRef(exec.Statistics.DataScannedInBytes))
+		}
+
+		switch exec.Status.State {
+		case athenatypes.QueryExecutionStateSucceeded:
+			return deRef(exec.ResultConfiguration.OutputLocation), nil
+		case athenatypes.QueryExecutionStateFailed, athenatypes.QueryExecutionStateCancelled:
+			message := deRef(exec.Status.StateChangeReason)
+			if exec.Status.AthenaError != nil && exec.Status.AthenaError.ErrorMessage != nil {
+				message = *exec.Status.AthenaError.ErrorMessage
+			}
+			return "", errors.New(message)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(a.pollInterval):
+		}
+	}
+}
+
+func (a *athenaSource) stopQuery(queryID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := a.athena.StopQueryExecution(ctx, &athena.StopQueryExecutionInput{QueryExecutionId: &queryID}); err != nil {
+		slog.Warn("Couldn't stop Athena query", slog.String("query-id", queryID), slog.String("error", err.Error()))
+	}
+}
+
+func (a *athenaSource) readResults(ctx context.Context, resultsURI string, emit func(scan.RawEvent)) error {
+	u, err := url.Parse(resultsURI)
+	if err != nil {
+		return err
+	}
+
+	out, err := a.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &u.Host,
+		Key:    ptr(strings.TrimPrefix(u.Path, "/")),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	rd := csv.NewReader(out.Body)
+	header, err := rd.Read()
+	if err != nil {
+		return fmt.Errorf("couldn't read result header: %w", err)
+	}
+
+	for {
+		row, err := rd.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		event, err := athenaRowToEvent(header, row)
+		if err != nil {
+			slog.Warn("Skipping Athena result row", slog.String("error", err.Error()))
+			a.stats.addInvalidLine()
+			continue
+		}
+
+		emit(event)
+		a.stats.addEvents(1)
+	}
+}
+
+// buildAthenaQuery selects the events of the window. eventtime is a string
+// column in ISO 8601 format, so it compares correctly as text. datePart is the
+// optional yyyy/MM/dd partition column, e.g. a projected "timestamp", used to
+// prune partitions.
+func buildAthenaQuery(table, datePart string, window timeWindow) string {
+	columns := make([]string, 0, len(athenaColumns))
+	for _, col := range athenaColumns {
+		if col.nested {
+			columns = append(columns, fmt.Sprintf("json_format(CAST(%s AS JSON)) AS %s", col.column, col.column))
+		} else {
+			columns = append(columns, col.column)
+		}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), table)
+
+	var conditions []string
+	if !window.start.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("eventtime >= '%s'", window.start.UTC().Format(time.RFC3339)))
+		if datePart != "" {
+			conditions = append(conditions, fmt.Sprintf("%q >= '%s'", datePart, window.start.UTC().Format("2006/01/02")))
+		}
+	}
+	if !window.end.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("eventtime <= '%s'", window.end.UTC().Format(time.RFC3339)))
+		if datePart != "" {
+			conditions = append(conditions, fmt.Sprintf("%q <= '%s'", datePart, window.end.UTC().Format("2006/01/02")))
+		}
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	return query
+}
+
+func athenaRowToEvent(header, row []string) (scan.RawEvent, error) {
+	fields := make(map[string]string, len(athenaColumns))
+	for _, col := range athenaColumns {
+		fields[col.column] = col.field
+	}
+
+	record := make(map[string]any, len(row))
+	for i, value := range row {
+		if i >= len(header) || value == "" {
+			continue
+		}
+
+		name, ok := fields[header[i]]
+		if !ok {
+			name = header[i]
+		}
+		record[name] = expandJSONStrings(value)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return scan.RawEvent{}, err
+	}
+
+	event, _, err := recordToEvent(data)
+	return event, err
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is written next to path and renamed over it on commit, so a
+// crash or a full disk while writing leaves the previous file intact instead
+// of a truncated one.
+type atomicFile struct {
+	*os.File
+	path string
+	perm os.FileMode
+}
+
+func createAtomic(path string, perm os.FileMode) (*atomicFile, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	return &atomicFile{File: tmp, path: path, perm: perm}, nil
+}
+
+// commit syncs the written data and replaces path with it.
+func (f *atomicFile) commit() error {
+	if err := f.Sync(); err != nil {
+		f.abort()
+		return err
+	}
+
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), f.perm); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// abort drops what was written, path is left as it was. After commit it
+// does nothing, the temporary file is gone.
+func (f *atomicFile) abort() {
+	f.File.Close()
+	os.Remove(f.Name())
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// over path, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := createAtomic(path, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.abort()
+		return err
+	}
+
+	return f.commit()
+}
+
+// warnLeftoverTemps logs the temporary files a crashed run left next to
+// paths. The files at paths are the last complete ones, the leftovers are
+// only kept for inspection.
+func warnLeftoverTemps(paths ...string) {
+	for _, path := range paths {
+		if path == "" || path == "-" {
+			continue
+		}
+		leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(path), filepath.Base(path)+".*.tmp"))
+		for _, leftover := range leftovers {
+			slog.Warn("Found the temporary file of an interrupted write, a previous run may have crashed while writing",
+				slog.String("path", path),
+				slog.String("temporary-file", leftover),
+			)
+		}
+	}
+}
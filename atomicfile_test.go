@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempFiles returns the temporary files left next to path.
+func tempFiles(t *testing.T, path string) []string {
+	t.Helper()
+
+	leftovers, err := filepath.Glob(path + ".*.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leftovers
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	for _, data := range []string{`{"run":1}`, `{"run":2}`} {
+		if err := writeFileAtomic(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Errorf("read %s, want %s", got, data)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("permissions %o, want 600", perm)
+	}
+	if leftovers := tempFiles(t, path); len(leftovers) != 0 {
+		t.Errorf("temporary files left: %q", leftovers)
+	}
+}
+
+// TestSummaryWriteFailed fails the csv summary after its first line was
+// written, the summary of the previous write must be left as it was.
+func TestSummaryWriteFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "summary.csv")
+	if err := (&csvSummaryWriter{path: path}).Write(context.Background(), goldenSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// encoding/csv refuses a quote as the delimiter once the rows are
+	// written.
+	if err := (&csvSummaryWriter{path: path, comma: '"'}).Write(context.Background(), goldenSnapshot()); err == nil {
+		t.Fatal("the write didn't fail")
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, previous) {
+		t.Errorf("the failed write changed the summary:\n%s", got)
+	}
+	if leftovers := tempFiles(t, path); len(leftovers) != 0 {
+		t.Errorf("temporary files left: %q", leftovers)
+	}
+}
+
+func TestWarnLeftoverTemps(t *testing.T) {
+	dir := t.TempDir()
+	summary := filepath.Join(dir, "summary.csv")
+	stats := filepath.Join(dir, "stats.json")
+	for _, name := range []string{"summary.csv.123.tmp", "summary.csv.456.tmp", "stats.json", "summary.csv", "other.csv.789.tmp"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer slog.SetDefault(previous)
+
+	warnLeftoverTemps(summary, stats, "", "-")
+
+	if n := strings.Count(logs.String(), "Found the temporary file of an interrupted write"); n != 2 {
+		t.Errorf("%d warnings, want one per leftover of summary.csv:\n%s", n, logs.String())
+	}
+	for _, leftover := range []string{"summary.csv.123.tmp", "summary.csv.456.tmp"} {
+		if !strings.Contains(logs.String(), leftover) {
+			t.Errorf("%s wasn't reported:\n%s", leftover, logs.String())
+		}
+	}
+	if strings.Contains(logs.String(), "other.csv") {
+		t.Errorf("the leftover of another file was reported:\n%s", logs.String())
+	}
+}
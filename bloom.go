@@ -0,0 +1,73 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// bloomFilter is a fixed size set membership sketch. It never reports a key
+// it was given as absent, but may report an unseen key as present with a
+// probability that grows with the number of keys added.
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64
+	hashes uint64
+}
+
+// newBloomFilter sizes a filter so that after expectedKeys insertions the
+// false positive rate is about fpRate.
+func newBloomFilter(expectedKeys int, fpRate float64) *bloomFilter {
+	n := math.Max(float64(expectedKeys), 1)
+	m := math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(math.Round(m/n*math.Ln2), 1)
+
+	words := (uint64(m) + 63) / 64
+	return &bloomFilter{
+		bits:   make([]uint64, words),
+		m:      words * 64,
+		hashes: uint64(k),
+	}
+}
+
+// add inserts key and reports whether it was possibly present before.
+func (b *bloomFilter) add(key string) bool {
+	h1, h2 := bloomHashes(key)
+
+	present := true
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.m
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if b.bits[word]&mask == 0 {
+			present = false
+			b.bits[word] |= mask
+		}
+	}
+
+	return present
+}
+
+func (b *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHashes(key)
+
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bloomHashes derives the two base hashes used for double hashing.
+func bloomHashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+
+	h2 := h1>>33 | h1<<31
+	h2 ^= 0x9e3779b97f4a7c15
+	h2 *= 0xbf58476d1ce4e5b9
+
+	return h1, h2 | 1
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilterHasNoFalseNegatives(t *testing.T) {
+	filter := newBloomFilter(1000, 0.01)
+	for i := range 5000 {
+		filter.add(fmt.Sprintf("requestParameters.key%d", i))
+	}
+
+	for i := range 5000 {
+		if key := fmt.Sprintf("requestParameters.key%d", i); !filter.mayContain(key) {
+			t.Fatalf("%s was added but isn't contained", key)
+		}
+	}
+}
+
+// TestBloomFilterFalsePositiveRate pins the rates the README documents for
+// --bloom-keys and --bloom-fp-rate.
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	tests := []struct {
+		name         string
+		expectedKeys int
+		fpRate       float64
+		added        int
+		maxRate      float64
+	}{
+		{name: "defaults at the expected keys", expectedKeys: 100000, fpRate: 0.001, added: 100000, maxRate: 0.002},
+		{name: "1% at the expected keys", expectedKeys: 10000, fpRate: 0.01, added: 10000, maxRate: 0.02},
+		{name: "half the expected keys", expectedKeys: 10000, fpRate: 0.01, added: 5000, maxRate: 0.01},
+		// More keys than the filter was sized for quickly raise the rate.
+		{name: "twice the expected keys", expectedKeys: 100000, fpRate: 0.001, added: 200000, maxRate: 0.07},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := newBloomFilter(tt.expectedKeys, tt.fpRate)
+			for i := range tt.added {
+				filter.add(fmt.Sprintf("requestParameters.added%d", i))
+			}
+
+			const probes = 100000
+			positives := 0
+			for i := range probes {
+				if filter.mayContain(fmt.Sprintf("responseElements.unseen%d", i)) {
+					positives++
+				}
+			}
+
+			if rate := float64(positives) / probes; rate > tt.maxRate {
+				t.Errorf("false positive rate %.4f, want at most %.4f", rate, tt.maxRate)
+			}
+		})
+	}
+}
+
+func TestBloomFilterAddReportsPresence(t *testing.T) {
+	filter := newBloomFilter(100, 0.001)
+	if filter.add("requestParameters.roleArn") {
+		t.Error("a new key was reported present")
+	}
+	if !filter.add("requestParameters.roleArn") {
+		t.Error("a known key was reported absent")
+	}
+}
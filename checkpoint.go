@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// checkpoint is the pagination state persisted after every page, so that an
+// interrupted scan can continue with --resume.
+type checkpoint struct {
+	NextToken  string `json:"nextToken"`
+	Pages      int    `json:"pages"`
+	Events     int    `json:"events"`
+	ConfigHash string `json:"configHash"`
+
+	// Shards holds the last handled sequence number per Kinesis shard.
+	Shards map[string]string `json:"shards,omitempty"`
+}
+
+func loadCheckpoint(path, configHash string) (checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return checkpoint{}, err
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return checkpoint{}, fmt.Errorf("couldn't parse checkpoint %s: %w", path, err)
+	}
+
+	if cp.ConfigHash != configHash {
+		return checkpoint{}, fmt.Errorf("checkpoint %s was written by a scan with a different configuration", path)
+	}
+
+	if cp.NextToken == "" && len(cp.Shards) == 0 {
+		return checkpoint{}, fmt.Errorf("checkpoint %s has no position to resume from", path)
+	}
+
+	return cp, nil
+}
+
+func writeCheckpoint(path string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data, 0o600)
+}
+
+func removeCheckpoint(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Couldn't remove checkpoint", slog.String("error", err.Error()))
+	}
+}
+
+// reloadSummary adds the matches of the summary an interrupted scan wrote to
+// store, a resumed scan only reads the pages after the checkpoint and would
+// otherwise write a summary without the keys found before. It reads the first
+// csv, json or yaml summary of outputs. A summary older than the checkpoint
+// wasn't written by the interrupted scan, e.g. because it crashed, and is
+// left alone with a warning. It returns the number of matches read.
+func reloadSummary(outputs []summaryOutput, checkpointPath string, matchers scan.Matcher, store scan.Store) (int, error) {
+	var path string
+	var comma rune
+	for _, output := range outputs {
+		if output.format != "xlsx" && output.path != "-" {
+			path, comma = output.path, output.comma
+			break
+		}
+	}
+	if path == "" {
+		slog.Warn("!!! No csv, json or yaml summary to reload, the summary of the resumed scan only has the keys found from the checkpoint on !!!")
+		return 0, nil
+	}
+
+	cp, err := os.Stat(checkpointPath)
+	if err != nil {
+		return 0, err
+	}
+	summary, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) || err == nil && summary.ModTime().Before(cp.ModTime()) {
+		slog.Warn("!!! The interrupted scan didn't write its summary, the summary of the resumed scan only has the keys found from the checkpoint on. Scan again without --resume for a complete one !!!",
+			slog.String("summary", path),
+			slog.String("checkpoint", checkpointPath),
+		)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	before := store.Len()
+	if err := readSummary(path, matchers, store, comma); err != nil {
+		return 0, fmt.Errorf("read %s: %w", path, err)
+	}
+	return store.Len() - before, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/aws/smithy-go"
+	"golang.org/x/exp/maps"
+)
+
+// The defaults of --retry-budget and --max-consecutive-failures.
+const (
+	defaultRetryBudget            = 500
+	defaultMaxConsecutiveFailures = 30
+)
+
+// retryBudget is shared by every LookupEvents call of a run. The retries of
+// a single call can hide an outage, e.g. a storm of ExpiredToken errors, so
+// once the run retried maxRetries times in total, or maxConsecutive calls
+// failed in a row whatever their account, the breaker trips and the scan
+// stops like after a failed call. 0 disables either limit.
+type retryBudget struct {
+	maxRetries     int
+	maxConsecutive int
+
+	mu          sync.Mutex
+	retries     int
+	consecutive int
+	// errors counts the failed calls by error code, for the diagnosis.
+	errors  map[string]int
+	tripped string
+}
+
+func newRetryBudget(maxRetries, maxConsecutive int) *retryBudget {
+	return &retryBudget{maxRetries: maxRetries, maxConsecutive: maxConsecutive, errors: make(map[string]int)}
+}
+
+// success resets the consecutive failures.
+func (b *retryBudget) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consecutive = 0
+}
+
+// failure records a failed call and reports whether it tripped the breaker.
+func (b *retryBudget) failure(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consecutive++
+	b.errors[apiErrorCode(err)]++
+	if b.tripped == "" && b.maxConsecutive > 0 && b.consecutive >= b.maxConsecutive {
+		b.trip(fmt.Sprintf("%d calls failed in a row, --max-consecutive-failures is %d", b.consecutive, b.maxConsecutive))
+	}
+	return b.tripped != ""
+}
+
+// retry takes a retry from the budget, it reports false and trips the
+// breaker once there is none left.
+func (b *retryBudget) retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tripped != "" {
+		return false
+	}
+	if b.maxRetries > 0 && b.retries >= b.maxRetries {
+		b.trip(fmt.Sprintf("the run retried %d times, --retry-budget is %d", b.retries, b.maxRetries))
+		return false
+	}
+
+	b.retries++
+	return true
+}
+
+// trip opens the breaker. The caller holds the lock.
+func (b *retryBudget) trip(reason string) {
+	b.tripped = reason
+	code, n := b.dominantError()
+	slog.Error("!!! Retry budget exhausted, stopping the scan !!!",
+		slog.String("reason", reason),
+		slog.String("dominant-error", code),
+		slog.Int("dominant-error-calls", n),
+	)
+}
+
+// isTripped reports whether the scan must stop.
+func (b *retryBudget) isTripped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.tripped != ""
+}
+
+// dominantError is the error code most failed calls had. The caller holds
+// the lock.
+func (b *retryBudget) dominantError() (string, int) {
+	codes := maps.Keys(b.errors)
+	slices.SortFunc(codes, func(x, y string) int {
+		return cmp.Or(cmp.Compare(b.errors[y], b.errors[x]), cmp.Compare(x, y))
+	})
+	if len(codes) == 0 {
+		return "", 0
+	}
+	return codes[0], b.errors[codes[0]]
+}
+
+// diagnosis tells why the breaker tripped and which error dominated.
+func (b *retryBudget) diagnosis() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failed := 0
+	for _, n := range b.errors {
+		failed += n
+	}
+	code, n := b.dominantError()
+	return fmt.Sprintf("%s, %d of the %d failed calls were %s", b.tripped, n, failed, code)
+}
+
+// logAttrs are the budget consumption of the progress logs.
+func (b *retryBudget) logAttrs() []any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return []any{
+		slog.Int("retries", b.retries),
+		slog.Int("retry-budget", b.maxRetries),
+		slog.Int("consecutive-failures", b.consecutive),
+	}
+}
+
+// budgetStats is what stats.json tells of the retry budget.
+type budgetStats struct {
+	Retries        int            `json:"retries"`
+	MaxRetries     int            `json:"maxRetries"`
+	MaxConsecutive int            `json:"maxConsecutiveFailures"`
+	Errors         map[string]int `json:"errors"`
+	// Tripped is why the breaker stopped the scan, empty if it didn't.
+	Tripped string `json:"tripped,omitempty"`
+}
+
+func (b *retryBudget) stats() *budgetStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return &budgetStats{
+		Retries:        b.retries,
+		MaxRetries:     b.maxRetries,
+		MaxConsecutive: b.maxConsecutive,
+		Errors:         maps.Clone(b.errors),
+		Tripped:        b.tripped,
+	}
+}
+
+// apiErrorCode is the error code of an AWS API error, "timeout" for calls
+// that timed out and "unknown" for other errors.
+func apiErrorCode(err error) string {
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.ErrorCode()
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return "unknown"
+}
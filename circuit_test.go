@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan/scantest"
+)
+
+var (
+	errThrottled    = &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	errTokenExpired = &smithy.GenericAPIError{Code: "ExpiredTokenException", Message: "The security token included in the request is expired"}
+)
+
+// TestRetryBudgetConsecutive trips the breaker once maxConsecutive calls
+// failed in a row, whatever the error.
+func TestRetryBudgetConsecutive(t *testing.T) {
+	b := newRetryBudget(0, 3)
+	for i, err := range []error{errThrottled, errTokenExpired} {
+		if b.failure(err) || b.isTripped() {
+			t.Fatalf("tripped after %d failures", i+1)
+		}
+	}
+	if !b.failure(errThrottled) || !b.isTripped() {
+		t.Fatal("not tripped after 3 failures in a row")
+	}
+
+	want := "3 calls failed in a row, --max-consecutive-failures is 3, 2 of the 3 failed calls were ThrottlingException"
+	if got := b.diagnosis(); got != want {
+		t.Errorf("diagnosis %q, want %q", got, want)
+	}
+	if stats := b.stats(); stats.Tripped == "" || stats.Errors["ThrottlingException"] != 2 || stats.Errors["ExpiredTokenException"] != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+// TestRetryBudgetSuccessResets only counts the failures since the last
+// successful call.
+func TestRetryBudgetSuccessResets(t *testing.T) {
+	b := newRetryBudget(0, 3)
+	for i := range 10 {
+		if b.failure(errThrottled) {
+			t.Fatalf("tripped after %d calls", i*3+1)
+		}
+		if b.failure(errThrottled) {
+			t.Fatalf("tripped after %d calls", i*3+2)
+		}
+		b.success()
+	}
+	if b.isTripped() {
+		t.Error("tripped with at most 2 failures in a row")
+	}
+	if stats := b.stats(); stats.Errors["ThrottlingException"] != 20 {
+		t.Errorf("%d failures counted, want 20", stats.Errors["ThrottlingException"])
+	}
+}
+
+// TestRetryBudgetExhausted trips the breaker on the first retry over the
+// budget, the calls of every scanner drawing from it.
+func TestRetryBudgetExhausted(t *testing.T) {
+	b := newRetryBudget(3, 0)
+	b.failure(errThrottled)
+	for i := range 3 {
+		if !b.retry() {
+			t.Fatalf("retry %d refused", i+1)
+		}
+		b.failure(context.DeadlineExceeded)
+	}
+	if b.isTripped() {
+		t.Fatal("tripped before the budget was used up")
+	}
+	if b.retry() || !b.isTripped() {
+		t.Fatal("retry over the budget allowed")
+	}
+	if b.retry() {
+		t.Error("retry allowed once tripped")
+	}
+
+	want := "the run retried 3 times, --retry-budget is 3, 3 of the 4 failed calls were timeout"
+	if got := b.diagnosis(); got != want {
+		t.Errorf("diagnosis %q, want %q", got, want)
+	}
+	if stats := b.stats(); stats.Retries != 3 || stats.MaxRetries != 3 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+// TestRetryBudgetDisabled never trips with both limits at 0.
+func TestRetryBudgetDisabled(t *testing.T) {
+	b := newRetryBudget(0, 0)
+	for range 1000 {
+		b.failure(errThrottled)
+		if !b.retry() {
+			t.Fatal("retry refused without a budget")
+		}
+	}
+	if b.isTripped() {
+		t.Error("tripped without limits")
+	}
+}
+
+func TestAPIErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errThrottled, "ThrottlingException"},
+		{fmt.Errorf("lookup: %w", errTokenExpired), "ExpiredTokenException"},
+		{fmt.Errorf("call: %w", context.DeadlineExceeded), "timeout"},
+		{errors.New("connection reset"), "unknown"},
+	}
+	for _, tt := range tests {
+		if got := apiErrorCode(tt.err); got != tt.want {
+			t.Errorf("apiErrorCode(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestScannerCircuitOpen stops a scan failing maxConsecutive times in a row,
+// although the call has retries left.
+func TestScannerCircuitOpen(t *testing.T) {
+	client := scantest.NewCloudTrail(scantest.Page{Err: errThrottled}, scantest.Page{Err: errThrottled}, scantest.Page{Events: lookupEvents(0, 1)})
+	s := newTestScanner(client, scantest.NewClock(time.Now()))
+	s.budget = newRetryBudget(defaultRetryBudget, 2)
+
+	if reason := s.run(context.Background(), func(scan.RawEvent) {}); reason != stopCircuitOpen {
+		t.Errorf("stop reason %s, want %s", reason, stopCircuitOpen)
+	}
+	if calls := len(client.Inputs()); calls != 2 {
+		t.Errorf("%d LookupEvents calls, want 2", calls)
+	}
+}
+
+// fakeOrganization serves ListAccounts and GetCallerIdentity of an
+// organization with accounts, the first one being the management account.
+func fakeOrganization(t *testing.T, accounts ...string) (*organizations.Client, *sts.Client) {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".ListAccounts") {
+			var list []string
+			for _, account := range accounts {
+				list = append(list, fmt.Sprintf(`{"Id":%q,"Status":"ACTIVE"}`, account))
+			}
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			fmt.Fprintf(w, `{"Accounts":[%s]}`, strings.Join(list, ","))
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), "Action=GetCallerIdentity") {
+			t.Errorf("unexpected call %s", body)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult><Arn>arn:aws:iam::%[1]s:user/scanner</Arn><UserId>AIDAEXAMPLE</UserId><Account>%[1]s</Account></GetCallerIdentityResult>
+  <ResponseMetadata><RequestId>request</RequestId></ResponseMetadata>
+</GetCallerIdentityResponse>`, accounts[0])
+	}))
+	t.Cleanup(server.Close)
+
+	cfg := aws.Config{
+		Region:       awsRegion,
+		Credentials:  credentials.NewStaticCredentialsProvider("AKIAEXAMPLE", "secret", ""),
+		BaseEndpoint: aws.String(server.URL),
+	}
+	return organizations.NewFromConfig(cfg), sts.NewFromConfig(cfg)
+}
+
+// TestOrgSourceCircuitOpen stops an organization scan once the scan of an
+// account tripped the breaker, the accounts left aren't scanned.
+func TestOrgSourceCircuitOpen(t *testing.T) {
+	const management, member = "111111111111", "222222222222"
+	orgs, stsClient := fakeOrganization(t, management, member)
+
+	budget := newRetryBudget(defaultRetryBudget, 2)
+	stats := &scanStats{}
+	var scanned []string
+	source := &orgSource{
+		orgs:        orgs,
+		sts:         stsClient,
+		sdkConfig:   aws.Config{Region: awsRegion, Credentials: credentials.NewStaticCredentialsProvider("AKIAEXAMPLE", "secret", "")},
+		role:        "OrganizationAccountAccessRole",
+		concurrency: 1,
+		stats:       stats,
+		budget:      budget,
+		newScanner: func(_ scan.CloudTrailClient, accountID string) *scanner {
+			scanned = append(scanned, accountID)
+			s := newTestScanner(scantest.NewCloudTrail(scantest.Page{Err: errThrottled}, scantest.Page{Err: errThrottled}), scantest.NewClock(time.Now()))
+			s.budget = budget
+			s.stats = stats
+			return s
+		},
+	}
+
+	if reason := source.run(context.Background(), func(scan.RawEvent) {}); reason != stopCircuitOpen {
+		t.Errorf("stop reason %s, want %s", reason, stopCircuitOpen)
+	}
+	if len(scanned) != 1 || scanned[0] != management {
+		t.Errorf("scanned %v, want only %s", scanned, management)
+	}
+	if _, ok := stats.FailedAccounts[member]; ok {
+		t.Errorf("%s counted as failed, it wasn't scanned: %v", member, stats.FailedAccounts)
+	}
+	if !budget.isTripped() {
+		t.Error("budget not tripped")
+	}
+}
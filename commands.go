@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// command is a subcommand of the binary. run gets the arguments after the
+// command name and returns the exit code.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+// commands are listed in this order by help. A bare invocation, or one
+// starting with a flag, runs scan.
+var commands = []command{
+	{name: "scan", summary: "Scan CloudTrail events for fields holding ARNs or resource ids (default)", run: runScan},
+	{name: "analyze", summary: "Rebuild the summary from the logs or matches of a previous run", run: runAnalyze},
+	{name: "reprocess", summary: "Handle the events a scan failed on again and update the summary", run: runReprocess},
+	{name: "merge", summary: "Merge the summaries of several runs into one", run: runMerge},
+	{name: "diff", summary: "List the keys added or removed between two summaries", run: runDiff},
+	{name: "patterns", summary: "Check --pattern definitions, see patterns validate", run: runPatterns},
+	{name: "serve", summary: "Serve the findings of existing summaries over HTTP", run: runServe},
+}
+
+// completion lists the commands, it can't be part of their initializer.
+func init() {
+	commands = append(commands, command{name: "completion", summary: "Print the bash, zsh or fish completion script", run: runCompletion})
+}
+
+// runCommand dispatches args, os.Args without the program name, to their
+// command.
+func runCommand(args []string) int {
+	if len(args) > 0 && (args[0] == "--version" || args[0] == "-version") {
+		printVersion(os.Stdout)
+		return exitOK
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runScan(args)
+	}
+
+	name := args[0]
+	if name == "help" {
+		if len(args) > 1 {
+			// help <command> is the same as <command> --help.
+			return runCommand([]string{args[1], "--help"})
+		}
+
+		printCommands(os.Stdout)
+		return exitOK
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(args[1:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	printCommands(os.Stderr)
+	return exitConfig
+}
+
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "Usage: find-cloudtrail-arn-fields [command] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run find-cloudtrail-arn-fields help <command> for the flags of a command, --version for the build.")
+}
+
+// newFlagSet returns the flag set of a command, whose help shows usage and
+// the examples before the flags.
+func newFlagSet(name, usage string, examples ...string) *flag.FlagSet {
+	return newGroupedFlagSet(name, usage, nil, examples...)
+}
+
+// describeFlags, if set, gets the flag set of a command asked for --help
+// instead of the help being printed. completion uses it to list the flags.
+var describeFlags func(fs *flag.FlagSet)
+
+// flagGroup is a heading of the help and the flags listed under it.
+type flagGroup struct {
+	title string
+	flags []string
+}
+
+// newGroupedFlagSet is newFlagSet for commands with many flags, whose help
+// lists them under groups. Flags that aren't in any group are listed last,
+// so a new flag is never left out of the help.
+func newGroupedFlagSet(name, usage string, groups []flagGroup, examples ...string) *flag.FlagSet {
+	fs := flag.NewFlagSet("find-cloudtrail-arn-fields "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		if describeFlags != nil {
+			describeFlags(fs)
+			return
+		}
+
+		w := fs.Output()
+		fmt.Fprintf(w, "Usage: find-cloudtrail-arn-fields %s %s\n", name, usage)
+		if len(examples) > 0 {
+			fmt.Fprintln(w, "\nExamples:")
+			for _, example := range examples {
+				fmt.Fprintf(w, "  %s\n", example)
+			}
+		}
+
+		listed := make(map[string]bool)
+		for _, group := range groups {
+			fmt.Fprintf(w, "\n%s:\n", group.title)
+			for _, name := range group.flags {
+				if f := fs.Lookup(name); f != nil {
+					printFlag(w, f)
+					listed[name] = true
+				}
+			}
+		}
+
+		title := "Flags"
+		if len(groups) > 0 {
+			title = "Other"
+		}
+		fs.VisitAll(func(f *flag.Flag) {
+			if listed[f.Name] {
+				return
+			}
+			if title != "" {
+				fmt.Fprintf(w, "\n%s:\n", title)
+				title = ""
+			}
+			printFlag(w, f)
+		})
+	}
+	return fs
+}
+
+// printFlag prints f the way flag.PrintDefaults does.
+func printFlag(w io.Writer, f *flag.Flag) {
+	name, usage := flag.UnquoteUsage(f)
+	line := "  -" + f.Name
+	if name != "" {
+		line += " " + name
+	}
+	if len(line) <= 4 {
+		// A short boolean flag fits on the line of its usage.
+		line += "\t"
+	} else {
+		line += "\n    \t"
+	}
+	line += strings.ReplaceAll(usage, "\n", "\n    \t")
+
+	switch f.DefValue {
+	case "", "0", "0s", "false", "[]":
+	default:
+		if name == "string" {
+			line += fmt.Sprintf(" (default %q)", f.DefValue)
+		} else {
+			line += fmt.Sprintf(" (default %v)", f.DefValue)
+		}
+	}
+	fmt.Fprintln(w, line)
+}
+
+// flagSet reports whether the flag name was given on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// parseExitCode is the exit code of a command whose flags failed to parse.
+// Asking for help isn't a failure.
+func parseExitCode(err error) int {
+	return exitCode(configError(err))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// captureOutput runs fn with stdout and stderr going to pipes and returns
+// what was written to them.
+func captureOutput(t *testing.T, fn func()) (stdout, stderr string) {
+	t.Helper()
+
+	capture := func(file **os.File) func() string {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous := *file
+		*file = w
+
+		read := make(chan string)
+		go func() {
+			var buf bytes.Buffer
+			io.Copy(&buf, r)
+			r.Close()
+			read <- buf.String()
+		}()
+		return func() string {
+			*file = previous
+			w.Close()
+			return <-read
+		}
+	}
+
+	restoreStdout := capture(&os.Stdout)
+	restoreStderr := capture(&os.Stderr)
+	defer func() {
+		stdout, stderr = restoreStdout(), restoreStderr()
+	}()
+	fn()
+	return
+}
+
+func TestCommandDispatch(t *testing.T) {
+	type dispatch struct {
+		args []string
+		code int
+		// usage is the start of the help of the command it was dispatched
+		// to, on stdout or stderr.
+		usage string
+	}
+	tests := []dispatch{
+		{[]string{"--help"}, exitOK, "Usage: find-cloudtrail-arn-fields scan"},
+		{[]string{"scan", "--help"}, exitOK, "Usage: find-cloudtrail-arn-fields scan"},
+		{[]string{"analyze", "--help"}, exitOK, "Usage: find-cloudtrail-arn-fields analyze"},
+		{[]string{"reprocess", "--help"}, exitOK, "Usage: find-cloudtrail-arn-fields reprocess"},
+		{[]string{"merge", "--help"}, exitOK, "Usage: find-cloudtrail-arn-fields merge"},
+		{[]string{"diff", "--help"}, exitOK, "Usage: find-cloudtrail-arn-fields diff"},
+		{[]string{"patterns", "--help"}, exitOK, "Usage: find-cloudtrail-arn-fields patterns"},
+		{[]string{"serve", "--help"}, exitOK, "Usage: find-cloudtrail-arn-fields serve"},
+		{[]string{"completion", "--help"}, exitOK, "Usage: find-cloudtrail-arn-fields completion"},
+		{[]string{"help", "diff"}, exitOK, "Usage: find-cloudtrail-arn-fields diff"},
+		{[]string{"help"}, exitOK, "Usage: find-cloudtrail-arn-fields [command] [flags]"},
+		{[]string{"unknown"}, exitConfig, `Unknown command "unknown"`},
+		{[]string{"--no-such-flag"}, exitConfig, "flag provided but not defined: -no-such-flag"},
+	}
+	for _, cmd := range commands {
+		args := []string{cmd.name, "--no-such-flag"}
+		if cmd.name == "patterns" {
+			// Its flags are the ones of patterns validate.
+			args = []string{cmd.name, "validate", "--no-such-flag"}
+		}
+		tests = append(tests, dispatch{args, exitConfig, "flag provided but not defined: -no-such-flag"})
+	}
+	tests = append(tests, dispatch{[]string{"patterns"}, exitConfig, "Usage: find-cloudtrail-arn-fields patterns validate"})
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			var code int
+			stdout, stderr := captureOutput(t, func() { code = runCommand(tt.args) })
+			if code != tt.code {
+				t.Errorf("exit code %d, want %d\n%s%s", code, tt.code, stdout, stderr)
+			}
+			if !strings.Contains(stdout+stderr, tt.usage) {
+				t.Errorf("output doesn't have %q:\n%s%s", tt.usage, stdout, stderr)
+			}
+		})
+	}
+}
+
+// TestHelpListsCommands lists every command with its summary.
+func TestHelpListsCommands(t *testing.T) {
+	stdout, _ := captureOutput(t, func() { runCommand([]string{"help"}) })
+	for _, cmd := range commands {
+		if !strings.Contains(stdout, cmd.name) || !strings.Contains(stdout, cmd.summary) {
+			t.Errorf("help doesn't list %s:\n%s", cmd.name, stdout)
+		}
+	}
+}
+
+// TestVersion prints the build as "name: value" lines on stdout, in the
+// order scripts may rely on, and exits 0.
+func TestVersion(t *testing.T) {
+	withVersion(t, "v1.2.3")
+
+	for _, arg := range []string{"--version", "-version"} {
+		t.Run(arg, func(t *testing.T) {
+			var code int
+			stdout, stderr := captureOutput(t, func() { code = runCommand([]string{arg}) })
+			if code != exitOK {
+				t.Errorf("exit code %d, want %d", code, exitOK)
+			}
+			if stderr != "" {
+				t.Errorf("unexpected output on stderr:\n%s", stderr)
+			}
+
+			var names []string
+			values := make(map[string]string)
+			for _, line := range strings.Split(strings.TrimSuffix(stdout, "\n"), "\n") {
+				name, value, ok := strings.Cut(line, ": ")
+				if !ok || name == "" || value == "" || strings.ContainsAny(value, " \t") {
+					t.Fatalf("line %q isn't \"name: value\":\n%s", line, stdout)
+				}
+				names = append(names, name)
+				values[name] = value
+			}
+
+			want := []string{"version", "go", "schema"}
+			if _, ok := values["revision"]; ok {
+				want = []string{"version", "revision", "modified", "go", "schema"}
+			}
+			if !slices.Equal(names, want) {
+				t.Errorf("lines %v, want %v", names, want)
+			}
+			if values["version"] != "v1.2.3" {
+				t.Errorf("version %q, want v1.2.3", values["version"])
+			}
+			if values["go"] != runtime.Version() {
+				t.Errorf("go %q, want %s", values["go"], runtime.Version())
+			}
+			if values["schema"] != strconv.Itoa(scan.SchemaVersion) {
+				t.Errorf("schema %q, want %d", values["schema"], scan.SchemaVersion)
+			}
+		})
+	}
+}
+
+// helpArgs are the arguments showing the help of cmd.
+func helpArgs(cmd string) []string {
+	if cmd == "patterns" {
+		// Its flags are the ones of patterns validate.
+		return []string{cmd, "validate", "--help"}
+	}
+	return []string{cmd, "--help"}
+}
+
+// commandFlags returns the names of the flags cmd registers.
+func commandFlags(t *testing.T, cmd string) []string {
+	t.Helper()
+
+	var described *flag.FlagSet
+	describeFlags = func(fs *flag.FlagSet) { described = fs }
+	defer func() { describeFlags = nil }()
+	captureOutput(t, func() { runCommand(helpArgs(cmd)) })
+	if described == nil {
+		t.Fatalf("%s didn't show its help", cmd)
+	}
+
+	var names []string
+	described.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	return names
+}
+
+// TestHelpListsFlags lists every flag a command registers in its --help, on
+// a line of its own.
+func TestHelpListsFlags(t *testing.T) {
+	for _, cmd := range commands {
+		t.Run(cmd.name, func(t *testing.T) {
+			flags := commandFlags(t, cmd.name)
+			if len(flags) == 0 && cmd.name != "completion" {
+				t.Fatalf("%s has no flags", cmd.name)
+			}
+
+			stdout, stderr := captureOutput(t, func() { runCommand(helpArgs(cmd.name)) })
+			help := stdout + stderr
+			for _, name := range flags {
+				listed := false
+				for _, line := range strings.Split(help, "\n") {
+					if line == "  -"+name || strings.HasPrefix(line, "  -"+name+" ") || strings.HasPrefix(line, "  -"+name+"\t") {
+						listed = true
+						break
+					}
+				}
+				if !listed {
+					t.Errorf("--help doesn't list -%s:\n%s", name, help)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/exp/maps"
+)
+
+const programName = "find-cloudtrail-arn-fields"
+
+// completionShells are the shells completion writes a script for.
+var completionShells = map[string]func(w io.Writer, cmds []completionCommand){
+	"bash": writeBashCompletion,
+	"zsh":  writeZshCompletion,
+	"fish": writeFishCompletion,
+}
+
+// completionCommand is a command with the flags its completion offers.
+type completionCommand struct {
+	name    string
+	summary string
+	flags   []completionFlag
+
+	// subcommands are completed as the first argument, e.g. validate of
+	// patterns.
+	subcommands []string
+	// args are the values completed as arguments instead of files.
+	args []string
+}
+
+type completionFlag struct {
+	name   string
+	usage  string
+	isBool bool
+	// values are the values the flag takes, nil if any.
+	values []string
+}
+
+// runCompletion prints the completion script of a shell.
+func runCompletion(args []string) int {
+	shells := maps.Keys(completionShells)
+	slices.Sort(shells)
+
+	fs := newFlagSet("completion", strings.Join(shells, "|"),
+		"source <(find-cloudtrail-arn-fields completion bash)",
+		"find-cloudtrail-arn-fields completion zsh > \"${fpath[1]}/_find-cloudtrail-arn-fields\"",
+		"find-cloudtrail-arn-fields completion fish > ~/.config/fish/completions/find-cloudtrail-arn-fields.fish",
+	)
+	if err := fs.Parse(args); err != nil {
+		return parseExitCode(err)
+	}
+
+	write, ok := completionShells[fs.Arg(0)]
+	if fs.NArg() != 1 || !ok {
+		fmt.Fprintf(os.Stderr, "completion needs one of %s\n", strings.Join(shells, ", "))
+		return exitConfig
+	}
+
+	write(os.Stdout, completionCommands())
+	return exitOK
+}
+
+// completionCommands lists the commands with their flags. The flags are only
+// defined by running a command, so every command is run with --help while
+// describeFlags takes the help's place.
+func completionCommands() []completionCommand {
+	var described *flag.FlagSet
+	describeFlags = func(fs *flag.FlagSet) { described = fs }
+	defer func() { describeFlags = nil }()
+
+	formats := maps.Keys(summaryFormats)
+	slices.Sort(formats)
+	values := map[string][]string{
+		"format":         formats,
+		"console-format": {"text", "json"},
+		"delimiter":      {"comma", "semicolon", "tab"},
+		"dedupe-by":      {dedupeByKey, dedupeByPair},
+		"group-by":       {"service"},
+	}
+
+	shells := maps.Keys(completionShells)
+	slices.Sort(shells)
+
+	var cmds []completionCommand
+	for _, cmd := range commands {
+		c := completionCommand{name: cmd.name, summary: cmd.summary}
+
+		run := cmd.run
+		switch cmd.name {
+		case "patterns":
+			run = runPatternsValidate
+			c.subcommands = []string{"validate"}
+		case "completion":
+			c.args = shells
+		}
+
+		described = nil
+		run([]string{"--help"})
+		if described != nil {
+			described.VisitAll(func(f *flag.Flag) {
+				_, usage := flag.UnquoteUsage(f)
+				bf, isBool := f.Value.(interface{ IsBoolFlag() bool })
+				c.flags = append(c.flags, completionFlag{
+					name:   f.Name,
+					usage:  usage,
+					isBool: isBool && bf.IsBoolFlag(),
+					values: values[f.Name],
+				})
+			})
+		}
+		cmds = append(cmds, c)
+	}
+
+	var names []string
+	for _, c := range cmds {
+		names = append(names, c.name)
+	}
+	cmds = append(cmds, completionCommand{name: "help", summary: "Show the flags and examples of a command", args: names})
+	return cmds
+}
+
+// shellFunction is the name of the completion function in the scripts.
+var shellFunction = "_" + strings.ReplaceAll(programName, "-", "_")
+
+func writeBashCompletion(w io.Writer, cmds []completionCommand) {
+	var names []string
+	for _, c := range cmds {
+		names = append(names, c.name)
+	}
+
+	fmt.Fprintf(w, `# bash completion of %[1]s, load it with
+#   source <(%[1]s completion bash)
+
+%[2]s() {
+    local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+    local cmd=scan first=1
+    if (( COMP_CWORD > 1 )) && [[ ${COMP_WORDS[1]} != -* ]]; then
+        cmd=${COMP_WORDS[1]}
+        first=2
+    fi
+
+    if (( COMP_CWORD == 1 )) && [[ $cur != -* ]]; then
+        COMPREPLY=($(compgen -W "%[3]s" -- "$cur"))
+        return
+    fi
+
+    # --flag=value is split at the =.
+    if [[ $cur == = ]]; then
+        cur=
+    elif [[ $prev == = ]]; then
+        prev=${COMP_WORDS[COMP_CWORD-2]}
+    fi
+    prev=${prev#-}
+    prev=${prev#-}
+
+    local flags values
+    case $cmd in
+`, programName, shellFunction, strings.Join(names, " "))
+
+	for _, c := range cmds {
+		fmt.Fprintf(w, "    %s)\n", c.name)
+		if len(c.subcommands) > 0 {
+			fmt.Fprintf(w, "        if (( COMP_CWORD == first )); then\n")
+			fmt.Fprintf(w, "            COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(c.subcommands, " "))
+			fmt.Fprintf(w, "            return\n        fi\n")
+		}
+		if len(c.args) > 0 {
+			fmt.Fprintf(w, "        if [[ $cur != -* ]]; then\n")
+			fmt.Fprintf(w, "            COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(c.args, " "))
+			fmt.Fprintf(w, "            return\n        fi\n")
+		}
+
+		var flags []string
+		for _, f := range c.flags {
+			flags = append(flags, "--"+f.name)
+		}
+		fmt.Fprintf(w, "        flags=\"%s\"\n", strings.Join(flags, " "))
+
+		var free []string
+		fmt.Fprintf(w, "        case $prev in\n")
+		for _, f := range c.flags {
+			switch {
+			case f.values != nil:
+				fmt.Fprintf(w, "        %s) values=\"%s\" ;;\n", f.name, strings.Join(f.values, " "))
+			case !f.isBool:
+				free = append(free, f.name)
+			}
+		}
+		if len(free) > 0 {
+			// Files, or whatever the value is.
+			fmt.Fprintf(w, "        %s) return ;;\n", strings.Join(free, "|"))
+		}
+		fmt.Fprintf(w, "        esac\n        ;;\n")
+	}
+
+	fmt.Fprintf(w, `    esac
+
+    if [[ -n $values ]]; then
+        COMPREPLY=($(compgen -W "$values" -- "$cur"))
+    elif [[ $cur == -* ]]; then
+        COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+    fi
+}
+
+complete -o default -F %s %s
+`, shellFunction, programName)
+}
+
+func writeZshCompletion(w io.Writer, cmds []completionCommand) {
+	fmt.Fprintf(w, `#compdef %[1]s
+# zsh completion of %[1]s, load it with
+#   source <(%[1]s completion zsh)
+# or save it as _%[1]s in a directory of $fpath.
+
+%[2]s() {
+    local -a commands
+    commands=(
+`, programName, shellFunction)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "        %s\n", zshQuote(strings.ReplaceAll(c.name, ":", "\\:")+":"+c.summary))
+	}
+	fmt.Fprintf(w, `    )
+
+    local cmd=scan
+    if (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then
+        _describe -t commands command commands
+        return
+    fi
+    if [[ $words[2] != -* ]]; then
+        cmd=$words[2]
+        shift words
+        (( CURRENT-- ))
+    fi
+
+    case $cmd in
+`)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "    %s)\n", c.name)
+		if len(c.subcommands) > 0 {
+			fmt.Fprintf(w, "        if (( CURRENT == 2 )); then\n")
+			fmt.Fprintf(w, "            _values subcommand %s\n", strings.Join(c.subcommands, " "))
+			fmt.Fprintf(w, "            return\n        fi\n")
+			fmt.Fprintf(w, "        shift words\n        (( CURRENT-- ))\n")
+		}
+
+		fmt.Fprintf(w, "        _arguments")
+		for _, f := range c.flags {
+			usage := zshEscape(f.usage)
+			switch {
+			case f.isBool:
+				fmt.Fprintf(w, " \\\n            %s", zshQuote("--"+f.name+"["+usage+"]"))
+			case f.values != nil:
+				fmt.Fprintf(w, " \\\n            %s", zshQuote("--"+f.name+"=["+usage+"]:"+f.name+":("+strings.Join(f.values, " ")+")"))
+			default:
+				fmt.Fprintf(w, " \\\n            %s", zshQuote("--"+f.name+"=["+usage+"]:"+f.name+":_files"))
+			}
+		}
+		if len(c.args) > 0 {
+			fmt.Fprintf(w, " \\\n            %s", zshQuote("*:argument:("+strings.Join(c.args, " ")+")"))
+		} else {
+			fmt.Fprintf(w, " \\\n            %s", zshQuote("*:file:_files"))
+		}
+		fmt.Fprintf(w, "\n        ;;\n")
+	}
+	fmt.Fprintf(w, `    esac
+}
+
+if [[ $funcstack[1] == _%[1]s ]]; then
+    %[2]s "$@"
+else
+    compdef %[2]s %[1]s
+fi
+`, programName, shellFunction)
+}
+
+// zshEscape escapes the characters _arguments gives a meaning in the
+// description of an option.
+func zshEscape(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "[", "\\[", "]", "\\]", ":", "\\:").Replace(s)
+}
+
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func writeFishCompletion(w io.Writer, cmds []completionCommand) {
+	var others []string
+	for _, c := range cmds {
+		if c.name != "scan" {
+			others = append(others, c.name)
+		}
+	}
+
+	fmt.Fprintf(w, "# fish completion of %[1]s, load it with\n#   %[1]s completion fish | source\n\n", programName)
+	fmt.Fprintf(w, "complete -c %s -f\n", programName)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a %s -d %s\n", programName, c.name, fishQuote(c.summary))
+	}
+
+	for _, c := range cmds {
+		// scan is also what runs without a command.
+		condition := "__fish_seen_subcommand_from " + c.name
+		if c.name == "scan" {
+			condition = "not __fish_seen_subcommand_from " + strings.Join(others, " ")
+		}
+		condition = fishQuote(condition)
+
+		fmt.Fprintln(w)
+		for _, sub := range c.subcommands {
+			fmt.Fprintf(w, "complete -c %s -n %s -a %s\n", programName, condition, sub)
+		}
+		switch {
+		case len(c.args) > 0:
+			fmt.Fprintf(w, "complete -c %s -n %s -a %s\n", programName, condition, fishQuote(strings.Join(c.args, " ")))
+		case c.name != "scan":
+			fmt.Fprintf(w, "complete -c %s -n %s -F\n", programName, condition)
+		}
+		for _, f := range c.flags {
+			line := fmt.Sprintf("complete -c %s -n %s -l %s -d %s", programName, condition, f.name, fishQuote(f.usage))
+			switch {
+			case f.isBool:
+			case f.values != nil:
+				line += " -x -a " + fishQuote(strings.Join(f.values, " "))
+			default:
+				line += " -r -F"
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
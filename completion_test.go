@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// completionSection is the part of a completion script handling cmd.
+func completionSection(t *testing.T, shell, script, cmd string) string {
+	t.Helper()
+
+	if shell == "fish" {
+		condition := "'__fish_seen_subcommand_from " + cmd + "'"
+		if cmd == "scan" {
+			condition = "'not __fish_seen_subcommand_from "
+		}
+		var lines []string
+		for _, line := range strings.Split(script, "\n") {
+			if strings.Contains(line, condition) {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	_, section, ok := strings.Cut(script, "\n    "+cmd+")\n")
+	if !ok {
+		return ""
+	}
+	section, _, _ = strings.Cut(section, "\n        ;;\n")
+	return section
+}
+
+// completesFlag reports whether the section of a command in a script
+// completes --name.
+func completesFlag(shell, section, name string) bool {
+	switch shell {
+	case "bash":
+		for _, line := range strings.Split(section, "\n") {
+			if flags, ok := strings.CutPrefix(strings.TrimSpace(line), "flags="); ok {
+				return strings.Contains(" "+strings.Trim(flags, `"`)+" ", " --"+name+" ")
+			}
+		}
+		return false
+	case "zsh":
+		return strings.Contains(section, "'--"+name+"[") || strings.Contains(section, "'--"+name+"=[")
+	default:
+		return strings.Contains(section+"\n", " -l "+name+" ")
+	}
+}
+
+// TestCompletionScripts completes every command, the subcommands of
+// patterns and every flag of a command in every shell.
+func TestCompletionScripts(t *testing.T) {
+	flags := make(map[string][]string)
+	for _, cmd := range commands {
+		flags[cmd.name] = commandFlags(t, cmd.name)
+	}
+
+	for shell := range completionShells {
+		t.Run(shell, func(t *testing.T) {
+			var code int
+			script, stderr := captureOutput(t, func() { code = runCommand([]string{"completion", shell}) })
+			if code != exitOK {
+				t.Fatalf("exit code %d, want %d\n%s", code, exitOK, stderr)
+			}
+
+			for _, cmd := range append(commands, command{name: "help"}) {
+				section := completionSection(t, shell, script, cmd.name)
+				if section == "" {
+					t.Errorf("%s isn't completed", cmd.name)
+					continue
+				}
+				for _, name := range flags[cmd.name] {
+					if !completesFlag(shell, section, name) {
+						t.Errorf("--%s of %s isn't completed", name, cmd.name)
+					}
+				}
+			}
+
+			if section := completionSection(t, shell, script, "patterns"); !strings.Contains(section, "validate") {
+				t.Errorf("patterns validate isn't completed:\n%s", section)
+			}
+		})
+	}
+}
+
+// TestCompletionValues completes the values of the enumerable flags in
+// every shell.
+func TestCompletionValues(t *testing.T) {
+	tests := []struct {
+		flag   string
+		values []string
+	}{
+		{"format", []string{"csv", "json", "markdown", "ndjson", "xlsx", "yaml"}},
+		{"console-format", []string{"text", "json"}},
+		{"delimiter", []string{"comma", "semicolon", "tab"}},
+		{"dedupe-by", []string{"key", "pair"}},
+		{"group-by", []string{"service"}},
+	}
+
+	for shell := range completionShells {
+		t.Run(shell, func(t *testing.T) {
+			var code int
+			script, stderr := captureOutput(t, func() { code = runCommand([]string{"completion", shell}) })
+			if code != exitOK {
+				t.Fatalf("exit code %d, want %d\n%s", code, exitOK, stderr)
+			}
+			section := completionSection(t, shell, script, "scan")
+
+			for _, tt := range tests {
+				var want string
+				switch shell {
+				case "bash":
+					want = "        " + tt.flag + ") values=\"" + strings.Join(tt.values, " ") + "\" ;;"
+				case "zsh":
+					want = "]:" + tt.flag + ":(" + strings.Join(tt.values, " ") + ")'"
+				default:
+					want = " -l " + tt.flag + " "
+				}
+				line := ""
+				for _, l := range strings.Split(section, "\n") {
+					if strings.Contains(l, want) {
+						line = l
+						break
+					}
+				}
+				if line == "" || shell == "fish" && !strings.HasSuffix(line, " -x -a "+fishQuote(strings.Join(tt.values, " "))) {
+					t.Errorf("--%s doesn't complete %v:\n%s", tt.flag, tt.values, line)
+				}
+			}
+		})
+	}
+}
+
+// TestCompletionScriptsLoad checks the syntax of the scripts with the shells
+// themselves, when they are installed.
+func TestCompletionScriptsLoad(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh"} {
+		t.Run(shell, func(t *testing.T) {
+			path, err := exec.LookPath(shell)
+			if err != nil {
+				t.Skipf("%s isn't installed", shell)
+			}
+
+			var code int
+			script, stderr := captureOutput(t, func() { code = runCommand([]string{"completion", shell}) })
+			if code != exitOK {
+				t.Fatalf("exit code %d, want %d\n%s", code, exitOK, stderr)
+			}
+			file := filepath.Join(t.TempDir(), "completion."+shell)
+			if err := os.WriteFile(file, []byte(script), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if out, err := exec.Command(path, "-n", file).CombinedOutput(); err != nil {
+				t.Errorf("%s -n: %v\n%s", shell, err, out)
+			}
+		})
+	}
+}
+
+func TestCompletionUnknownShell(t *testing.T) {
+	for _, args := range [][]string{{"completion"}, {"completion", "powershell"}, {"completion", "bash", "zsh"}} {
+		var code int
+		_, stderr := captureOutput(t, func() { code = runCommand(args) })
+		if code != exitConfig || !strings.Contains(stderr, "bash, fish, zsh") {
+			t.Errorf("%v: exit code %d, want %d\n%s", args, code, exitConfig, stderr)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/exp/maps"
+	"gopkg.in/yaml.v3"
+)
+
+// conceptsPath is where --report-concepts writes the keys grouped by the
+// concept they name.
+const conceptsPath = "concepts.csv"
+
+// conceptRules name the concept of a key from its last segment, e.g.
+// requestParameters.resourcesSet.items[].resourceId is a resourceId. The
+// name is looked up in Synonyms, ignoring case, else the first of Suffixes it
+// ends with is stripped, unless nothing would be left, and the rest looked
+// up. resourceArn, arn and resourceId are all the concept resource with the
+// default rules.
+type conceptRules struct {
+	Suffixes []string `yaml:"suffixes"`
+	// Synonyms are the names of every concept, which are concepts of their
+	// own if they aren't listed.
+	Synonyms map[string][]string `yaml:"synonyms"`
+
+	// synonyms is Synonyms by lowercased name.
+	synonyms map[string]string
+}
+
+// defaultConceptRules strip the arn, id and name suffixes and take the keys
+// that are nothing but one of them for the resource of the event.
+func defaultConceptRules() *conceptRules {
+	rules := &conceptRules{
+		Suffixes: []string{"Arns", "Arn", "Ids", "Id", "Names", "Name"},
+		Synonyms: map[string][]string{"resource": {"arn", "arns", "id", "ids", "name", "names", "resource", "resources"}},
+	}
+	if err := rules.compile(); err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// loadConceptRules reads the rules of a YAML file, which replace the
+// defaults.
+func loadConceptRules(path string) (*conceptRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := &conceptRules{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(rules); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if err := rules.compile(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// compile checks the rules and indexes the synonyms. The longest suffixes
+// are tried first, so Arns goes before Arn.
+func (r *conceptRules) compile() error {
+	for i, suffix := range r.Suffixes {
+		if suffix == "" {
+			return fmt.Errorf("suffix %d is empty", i+1)
+		}
+	}
+	slices.SortStableFunc(r.Suffixes, func(a, b string) int {
+		return cmp.Compare(len(b), len(a))
+	})
+
+	r.synonyms = make(map[string]string)
+	for concept, names := range r.Synonyms {
+		if concept == "" {
+			return errors.New("a concept has no name")
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if other, ok := r.synonyms[name]; ok && other != concept {
+				return fmt.Errorf("%q is a synonym of both %s and %s", name, other, concept)
+			}
+			r.synonyms[name] = concept
+		}
+	}
+	return nil
+}
+
+// concept names the concept of key.
+func (r *conceptRules) concept(key string) string {
+	name := strings.TrimRight(lastKeySegment(key), "[]")
+
+	lower := strings.ToLower(name)
+	if concept, ok := r.synonyms[lower]; ok {
+		return concept
+	}
+	for _, suffix := range r.Suffixes {
+		suffix = strings.ToLower(suffix)
+		if len(lower) > len(suffix) && strings.HasSuffix(lower, suffix) {
+			lower = strings.TrimSuffix(lower, suffix)
+			break
+		}
+	}
+
+	if concept, ok := r.synonyms[lower]; ok {
+		return concept
+	}
+	return lower
+}
+
+// lastKeySegment returns the part of key after its last dot, the escaped dots
+// of a segment, e.g. of the tag key kubernetes\.io/cluster/name, don't count.
+func lastKeySegment(key string) string {
+	start := 0
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '\\':
+			i++
+		case '.':
+			start = i + 1
+		}
+	}
+	return key[start:]
+}
+
+// conceptReport collects the services every key was seen in, for
+// --report-concepts to group the keys by concept.
+type conceptReport struct {
+	mu   sync.Mutex
+	keys map[string]map[string]struct{}
+}
+
+func newConceptReport() *conceptReport {
+	return &conceptReport{keys: make(map[string]map[string]struct{})}
+}
+
+// add is a scan.WithOnHit hook.
+func (c *conceptReport) add(event scan.RawEvent, key, _ string) {
+	service := strings.TrimSuffix(event.EventSource, ".amazonaws.com")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	services, ok := c.keys[key]
+	if !ok {
+		services = make(map[string]struct{})
+		c.keys[key] = services
+	}
+	services[service] = struct{}{}
+}
+
+// write writes a row per key to path, grouped by concept, the concepts with
+// the most keys first, and returns the number of concepts. The services of a
+// key are separated by spaces.
+func (c *conceptReport) write(path string, rules *conceptRules, comma rune) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	byConcept := make(map[string][]string)
+	for key := range c.keys {
+		concept := rules.concept(key)
+		byConcept[concept] = append(byConcept[concept], key)
+	}
+	concepts := maps.Keys(byConcept)
+	slices.SortFunc(concepts, func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(byConcept[b]), len(byConcept[a])), cmp.Compare(a, b))
+	})
+
+	rows := [][]string{{"concept", "keys", "key", "services"}}
+	for _, concept := range concepts {
+		keys := byConcept[concept]
+		slices.Sort(keys)
+		for _, key := range keys {
+			services := maps.Keys(c.keys[key])
+			slices.Sort(services)
+			rows = append(rows, []string{concept, strconv.Itoa(len(keys)), key, strings.Join(services, " ")})
+		}
+	}
+	if err := writeCSVFile(path, rows, comma); err != nil {
+		return 0, err
+	}
+
+	slog.Debug("Concepts written", slog.String("path", path), slog.Int("concepts", len(concepts)), slog.Int("keys", len(c.keys)))
+	return len(concepts), nil
+}
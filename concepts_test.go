@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+func TestConceptDefaults(t *testing.T) {
+	rules := defaultConceptRules()
+	tests := map[string]string{
+		// A suffix is stripped.
+		"requestParameters.roleArn":                         "role",
+		"requestParameters.policyArns":                      "policy",
+		"requestParameters.instancesSet.items[].instanceId": "instance",
+		"requestParameters.bucketName":                      "bucket",
+		"requestParameters.BucketNAME":                      "bucket",
+		"responseElements.credentials.accessKeyId":          "accesskey",
+		// Nothing but a suffix, or a synonym once stripped, is the resource.
+		"requestParameters.arn":                             "resource",
+		"responseElements.ARN":                              "resource",
+		"requestParameters.resourcesSet.items[].resourceId": "resource",
+		"requestParameters.resourceArns[]":                  "resource",
+		"requestParameters.resources":                       "resource",
+		// No suffix, the name is the concept.
+		"requestParameters.description": "description",
+		"$":                             "$",
+		// Escaped dots are part of the segment.
+		"requestParameters.tags.kubernetes\\.io/cluster/name": "kubernetes\\.io/cluster/",
+		`requestParameters.a\.roleArn`:                        "a\\.role",
+		// An escaped backslash before a dot.
+		`requestParameters.a\\.roleArn`: "role",
+		// Only the first suffix is stripped.
+		"requestParameters.keyIdArn": "keyid",
+	}
+	for key, want := range tests {
+		if got := rules.concept(key); got != want {
+			t.Errorf("%s is the concept %q, want %q", key, got, want)
+		}
+	}
+}
+
+// TestConceptPrecedence looks synonyms up before stripping a suffix, tries
+// the longest suffix first and looks the stripped name up again.
+func TestConceptPrecedence(t *testing.T) {
+	rules := &conceptRules{
+		Suffixes: []string{"Id", "ResourceId", "Arn"},
+		Synonyms: map[string][]string{
+			"secret":  {"bucketArn", "secretid"},
+			"compute": {"instance", "Function"},
+		},
+	}
+	if err := rules.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		// A synonym keeps its suffix.
+		"requestParameters.bucketArn": "secret",
+		"requestParameters.secretId":  "secret",
+		// ResourceId goes before Id.
+		"requestParameters.instanceResourceId": "compute",
+		"requestParameters.volumeResourceId":   "volume",
+		// The stripped name is a synonym.
+		"requestParameters.functionArn": "compute",
+		"requestParameters.instanceId":  "compute",
+		// The default synonyms are gone.
+		"requestParameters.arn": "arn",
+		"requestParameters.id":  "id",
+	}
+	for key, want := range tests {
+		if got := rules.concept(key); got != want {
+			t.Errorf("%s is the concept %q, want %q", key, got, want)
+		}
+	}
+	if !slices.Equal(rules.Suffixes, []string{"ResourceId", "Arn", "Id"}) {
+		t.Errorf("suffixes tried in the order %v", rules.Suffixes)
+	}
+}
+
+func TestLoadConceptRules(t *testing.T) {
+	tests := map[string]struct {
+		yaml string
+		// err is part of the error, empty for valid rules.
+		err string
+	}{
+		"valid": {yaml: "suffixes: [Arn, Id]\nsynonyms:\n  user: [userName, principal]\n"},
+		"empty": {yaml: ""},
+		"empty suffix": {
+			yaml: "suffixes: [Arn, \"\"]\n",
+			err:  "suffix 2 is empty",
+		},
+		"concept without name": {
+			yaml: "synonyms:\n  \"\": [arn]\n",
+			err:  "a concept has no name",
+		},
+		"synonym of two concepts": {
+			yaml: "synonyms:\n  role: [RoleArn]\n  user: [rolearn]\n",
+			err:  `"rolearn" is a synonym of both`,
+		},
+		"unknown field": {
+			yaml: "suffix: [Arn]\n",
+			err:  "field suffix not found",
+		},
+		"not yaml": {
+			yaml: "suffixes: [Arn\n",
+			err:  "yaml",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "concepts.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			rules, err := loadConceptRules(path)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want one about %s (rules %+v)", err, tt.err, rules)
+			}
+		})
+	}
+
+	rules, err := loadConceptRules(filepath.Join(t.TempDir(), "missing.yaml"))
+	if !os.IsNotExist(err) {
+		t.Errorf("missing file loaded as %+v, %v", rules, err)
+	}
+}
+
+// TestConceptReport writes a row per key, the concepts with the most keys
+// first, and the services every key was seen in.
+func TestConceptReport(t *testing.T) {
+	chdir(t, t.TempDir())
+
+	report := newConceptReport()
+	iam := scan.RawEvent{EventSource: "iam.amazonaws.com"}
+	sts := scan.RawEvent{EventSource: "sts.amazonaws.com"}
+	s3 := scan.RawEvent{EventSource: "s3.amazonaws.com"}
+	report.add(iam, "requestParameters.roleArn", "")
+	report.add(sts, "requestParameters.roleArn", "")
+	report.add(iam, "responseElements.role.arn", "")
+	report.add(s3, "requestParameters.bucketName", "")
+	report.add(iam, "requestParameters.roleName", "")
+	report.add(s3, "requestParameters.resourceArn", "")
+
+	concepts, err := report.write(conceptsPath, defaultConceptRules(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if concepts != 3 {
+		t.Errorf("%d concepts, want 3", concepts)
+	}
+
+	data, err := os.ReadFile(conceptsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `concept,keys,key,services
+resource,2,requestParameters.resourceArn,s3
+resource,2,responseElements.role.arn,iam
+role,2,requestParameters.roleArn,iam sts
+role,2,requestParameters.roleName,iam
+bucket,1,requestParameters.bucketName,s3
+`
+	if string(data) != want {
+		t.Errorf("concepts.csv:\n%s\nwant:\n%s", data, want)
+	}
+}
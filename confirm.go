@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// unboundedScope describes what a scan without a time window or any other
+// bound reads, e.g. "all events, region eu-west-1, last 90 days". It is empty
+// for a bounded scan, and for sources that are either small or consumed until
+// interrupted anyway.
+func unboundedScope(opts options) string {
+	if opts.window.bounded() || opts.staleLimit > 0 || opts.stopAfter > 0 {
+		return ""
+	}
+
+	switch {
+	case strings.HasPrefix(opts.source, "s3://"):
+		return "every trail file under " + opts.source
+	case opts.source != "", opts.lakeEventDataStore != "", opts.athenaTable != "", opts.kinesisStream != "",
+		opts.sqsQueueURL != "", opts.replayArchive != "", opts.esURL != "", len(opts.eventIDs) > 0:
+		return ""
+	case opts.orgRole != "":
+		return fmt.Sprintf("all events of every account of the organization, region %s, last 90 days", awsRegion)
+	default:
+		return fmt.Sprintf("all events, region %s, last 90 days", awsRegion)
+	}
+}
+
+// confirmUnbounded asks whether to go on with an unbounded scan when stdin is
+// a terminal, anything but y or yes aborts. Otherwise, or with --yes, it
+// only warns, as automation can't answer.
+func confirmUnbounded(opts options) error {
+	scope := unboundedScope(opts)
+	if scope == "" {
+		return nil
+	}
+
+	slog.Warn("!!! The scan is unbounded, set --start-time or --stop-after-stale-pages to limit it !!!", slog.String("scope", scope))
+	if opts.yes || !isTerminal(os.Stdin) {
+		return nil
+	}
+
+	if !askYes(os.Stdin, os.Stderr, fmt.Sprintf("Scan %s? [y/N] ", scope)) {
+		return configError(errors.New("the unbounded scan wasn't confirmed, pass --yes to skip the question"))
+	}
+	return nil
+}
+
+func askYes(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprint(out, question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// coOccurrencePath is where a scan writes the pairs of keys that held the
+// same value within an event.
+const coOccurrencePath = "co-occurrence.csv"
+
+// keyPair is a pair of keys, a sorting before b.
+type keyPair struct {
+	a, b string
+}
+
+// coOccurrence counts the events in which two keys held the same value, e.g.
+// requestParameters.instanceId and responseElements.instancesSet.items[].instanceId,
+// to tell which keys a mapping needs only one of. A key that always holds the
+// value of another has as many events with it as on its own.
+type coOccurrence struct {
+	mu    sync.Mutex
+	pairs map[keyPair]int
+	// events counts the events with a hit of every key.
+	events map[string]int
+
+	// maxPairs bounds the pairs counted, the pairs of keys that grow with
+	// the resources, e.g. tag keys, would otherwise grow without end. The
+	// pairs counted already go on being counted.
+	maxPairs int
+	stats    *scanStats
+}
+
+func newCoOccurrence(maxPairs int, stats *scanStats) *coOccurrence {
+	return &coOccurrence{pairs: make(map[keyPair]int), events: make(map[string]int), maxPairs: maxPairs, stats: stats}
+}
+
+// addEvent is a scan.WithOnEventHits hook. A pair counts once per event, even
+// if its keys shared several values, e.g. in arrays.
+func (c *coOccurrence) addEvent(_ scan.RawEvent, hits []scan.Hit) {
+	byValue := make(map[string][]string)
+	keys := make(map[string]struct{})
+	for _, hit := range hits {
+		keys[hit.Key] = struct{}{}
+		if hit.Value == "" || slices.Contains(byValue[hit.Value], hit.Key) {
+			continue
+		}
+		byValue[hit.Value] = append(byValue[hit.Value], hit.Key)
+	}
+
+	pairs := make(map[keyPair]struct{})
+	for _, sameValue := range byValue {
+		slices.Sort(sameValue)
+		for i, a := range sameValue {
+			for _, b := range sameValue[i+1:] {
+				pairs[keyPair{a: a, b: b}] = struct{}{}
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range keys {
+		c.events[key]++
+	}
+	for pair := range pairs {
+		if _, ok := c.pairs[pair]; !ok && c.maxPairs > 0 && len(c.pairs) >= c.maxPairs {
+			if c.stats.addDroppedPair() == 1 {
+				slog.Warn("!!! --max-co-occurrence-pairs reached, further pairs of keys are left out of co-occurrence.csv !!!",
+					slog.Int("max-co-occurrence-pairs", c.maxPairs),
+				)
+			}
+			continue
+		}
+		c.pairs[pair]++
+	}
+}
+
+// len is the number of pairs counted.
+func (c *coOccurrence) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.pairs)
+}
+
+// write writes a row per pair to path, the most frequent first, with the
+// events of each key next to the events of the pair.
+func (c *coOccurrence) write(path string, comma rune) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pairs := make([]keyPair, 0, len(c.pairs))
+	for pair := range c.pairs {
+		pairs = append(pairs, pair)
+	}
+	slices.SortFunc(pairs, func(x, y keyPair) int {
+		return cmp.Or(cmp.Compare(c.pairs[y], c.pairs[x]), cmp.Compare(x.a, y.a), cmp.Compare(x.b, y.b))
+	})
+
+	rows := [][]string{{"keyA", "keyB", "events", "keyAEvents", "keyBEvents"}}
+	for _, pair := range pairs {
+		rows = append(rows, []string{pair.a, pair.b, strconv.Itoa(c.pairs[pair]), strconv.Itoa(c.events[pair.a]), strconv.Itoa(c.events[pair.b])})
+	}
+	if err := writeCSVFile(path, rows, comma); err != nil {
+		return err
+	}
+
+	slog.Debug("Co-occurrences written", slog.String("path", path), slog.Int("pairs", len(pairs)))
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+func TestCoOccurrenceMaxPairs(t *testing.T) {
+	stats := &scanStats{}
+	pairs := newCoOccurrence(2, stats)
+
+	event := func(keys ...string) {
+		hits := make([]scan.Hit, len(keys))
+		for i, key := range keys {
+			hits[i] = scan.Hit{Key: key, Value: "arn:aws:iam::123456789012:role/r"}
+		}
+		pairs.addEvent(scan.RawEvent{}, hits)
+	}
+	event("a", "b")
+	event("c", "d")
+	// Over the limit, only a and b go on being counted.
+	event("a", "b", "e")
+	event("x", "y")
+
+	if got := pairs.len(); got != 2 {
+		t.Errorf("%d pairs counted, want 2", got)
+	}
+	if got := pairs.pairs[keyPair{a: "a", b: "b"}]; got != 2 {
+		t.Errorf("a and b counted in %d events, want 2", got)
+	}
+	// a-e, b-e and x-y.
+	if stats.DroppedPairs != 3 {
+		t.Errorf("%d pairs dropped, want 3", stats.DroppedPairs)
+	}
+	// The events of the keys are still counted.
+	if got := pairs.events["e"]; got != 1 {
+		t.Errorf("e counted in %d events, want 1", got)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/exp/maps"
+)
+
+// runDiff prints the keys only one of two summaries holds, e.g. to see what a
+// new matcher or a longer window found. Keys seen in both are not compared,
+// their example values differ from run to run.
+func runDiff(args []string) int {
+	fs := newFlagSet("diff", "[flags] old-summary new-summary",
+		"find-cloudtrail-arn-fields diff last-week/summary.csv summary.csv",
+		"find-cloudtrail-arn-fields diff --exit-code baseline.json summary.json",
+	)
+	exitCode := fs.Bool("exit-code", false, "Exit with 1 if the summaries differ")
+	var comma rune
+	fs.Func("delimiter", `Delimiter of csv summaries, ",", ";" or "\t" (default ",")`, delimiterFlag(&comma))
+	if err := fs.Parse(args); err != nil {
+		return parseExitCode(err)
+	}
+
+	if fs.NArg() != 2 {
+		slog.Error("Invalid arguments", slog.String("error", fmt.Sprintf("diff needs two summaries, got %d", fs.NArg())))
+		return exitConfig
+	}
+
+	old, err := summaryKeys(fs.Arg(0), comma)
+	if err != nil {
+		slog.Error("Couldn't read summary", slog.String("error", err.Error()))
+		return exitFailure
+	}
+	updated, err := summaryKeys(fs.Arg(1), comma)
+	if err != nil {
+		slog.Error("Couldn't read summary", slog.String("error", err.Error()))
+		return exitFailure
+	}
+
+	changes := 0
+	for _, key := range sortedKeys(old) {
+		if _, ok := updated[key]; !ok {
+			fmt.Printf("- %s %s\n", key, old[key].Value)
+			changes++
+		}
+	}
+	for _, key := range sortedKeys(updated) {
+		if _, ok := old[key]; !ok {
+			fmt.Printf("+ %s %s\n", key, updated[key].Value)
+			changes++
+		}
+	}
+
+	if *exitCode && changes > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// summaryKeys reads a summary into a map by key.
+func summaryKeys(path string, comma rune) (map[string]scan.Match, error) {
+	cache := scan.NewMemoryStore(10000)
+	if err := readSummaries([]string{path}, cache, comma); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]scan.Match, cache.Len())
+	err := cache.Each(func(m scan.Match) error {
+		keys[m.Key] = m
+		return nil
+	})
+	return keys, err
+}
+
+func sortedKeys(matches map[string]scan.Match) []string {
+	keys := maps.Keys(matches)
+	slices.Sort(keys)
+	return keys
+}
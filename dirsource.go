@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// dirSource reads CloudTrail log files from a local directory, e.g. one filled
+// by aws s3 sync. It needs no AWS credentials.
+type dirSource struct {
+	root     string
+	window   timeWindow
+	stats    *scanStats
+	progress *progress
+}
+
+func (d *dirSource) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	var files []string
+	err := filepath.WalkDir(d.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.IsDir() && (strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".json.gz")) {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		slog.Error("Couldn't list cloudtrail log files", slog.String("error", err.Error()))
+		return stopFailed
+	}
+
+	d.progress.totalFiles.Store(int64(len(files)))
+	slog.Info("Found cloudtrail log files", slog.String("path", d.root), slog.Int("files", len(files)))
+
+	for _, path := range files {
+		if ctx.Err() != nil {
+			return stopCanceled
+		}
+
+		events, err := d.readFile(path)
+		if err != nil {
+			slog.Warn("Skipping cloudtrail log file", slog.String("path", path), slog.String("error", err.Error()))
+			d.stats.addSkippedFile()
+			d.progress.files.Add(1)
+			continue
+		}
+
+		for _, event := range events {
+			emit(event)
+		}
+		d.stats.addFile(len(events))
+		d.progress.files.Add(1)
+	}
+
+	return stopComplete
+}
+
+func (d *dirSource) readFile(path string) ([]scan.RawEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readTrailFile(file, path, d.window)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// dotEdge is an event name of a service leading to a key.
+type dotEdge struct {
+	service   string
+	eventName string
+	key       string
+}
+
+// dotGraph counts which event names produce which keys, for --emit-dot.
+type dotGraph struct {
+	mu    sync.Mutex
+	edges map[dotEdge]int
+}
+
+func newDOTGraph() *dotGraph {
+	return &dotGraph{edges: make(map[dotEdge]int)}
+}
+
+// add is a scan.WithOnHit hook.
+func (g *dotGraph) add(event scan.RawEvent, key, _ string) {
+	edge := dotEdge{
+		service:   strings.TrimSuffix(event.EventSource, ".amazonaws.com"),
+		eventName: event.EventName,
+		key:       key,
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.edges[edge]++
+}
+
+// len is the number of edges counted.
+func (g *dotGraph) len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return len(g.edges)
+}
+
+// write writes the graph to path as a DOT digraph: a cluster per service
+// holding its event names, and the keys they lead to with edges weighted by
+// the values seen. Edges seen less than minCount times are left out, and
+// edges are added by count until the graph has maxNodes nodes, so it stays
+// renderable.
+func (g *dotGraph) write(path string, minCount, maxNodes int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	counts := g.edges
+	edges := make([]dotEdge, 0, len(counts))
+	for edge, n := range counts {
+		if n >= minCount {
+			edges = append(edges, edge)
+		}
+	}
+
+	slices.SortFunc(edges, func(a, b dotEdge) int {
+		return cmp.Or(
+			cmp.Compare(counts[b], counts[a]),
+			cmp.Compare(a.service, b.service),
+			cmp.Compare(a.eventName, b.eventName),
+			cmp.Compare(a.key, b.key),
+		)
+	})
+
+	// Services aren't nodes, only the event names and keys count.
+	actions := make(map[dotEdge]bool)
+	keys := make(map[string]bool)
+	var kept []dotEdge
+	for _, edge := range edges {
+		action := dotEdge{service: edge.service, eventName: edge.eventName}
+		added := 0
+		if !actions[action] {
+			added++
+		}
+		if !keys[edge.key] {
+			added++
+		}
+		if maxNodes > 0 && len(actions)+len(keys)+added > maxNodes {
+			continue
+		}
+
+		actions[action] = true
+		keys[edge.key] = true
+		kept = append(kept, edge)
+	}
+	if dropped := len(edges) - len(kept); dropped > 0 {
+		slog.Warn("Graph is truncated, edges were left out to stay within the node limit",
+			slog.String("path", path),
+			slog.Int("max-nodes", maxNodes),
+			slog.Int("dropped-edges", dropped),
+		)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph findings {\n")
+	buf.WriteString("  rankdir=LR;\n")
+	buf.WriteString("  node [fontname=\"Helvetica\"];\n")
+
+	byService := make(map[string][]string)
+	for action := range actions {
+		byService[action.service] = append(byService[action.service], action.eventName)
+	}
+	services := make([]string, 0, len(byService))
+	for service := range byService {
+		services = append(services, service)
+	}
+	slices.Sort(services)
+	for i, service := range services {
+		eventNames := byService[service]
+		slices.Sort(eventNames)
+
+		fmt.Fprintf(&buf, "\n  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(&buf, "    label=%s;\n", dotQuote(service))
+		buf.WriteString("    node [shape=box];\n")
+		for _, eventName := range eventNames {
+			fmt.Fprintf(&buf, "    %s [label=%s];\n", dotQuote(dotActionID(service, eventName)), dotQuote(eventName))
+		}
+		buf.WriteString("  }\n")
+	}
+
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	slices.Sort(sortedKeys)
+	buf.WriteString("\n  node [shape=ellipse];\n")
+	for _, key := range sortedKeys {
+		fmt.Fprintf(&buf, "  %s [label=%s];\n", dotQuote("key:"+key), dotQuote(key))
+	}
+
+	buf.WriteString("\n")
+	for _, edge := range kept {
+		n := counts[edge]
+		fmt.Fprintf(&buf, "  %s -> %s [weight=%d, label=\"%d\", penwidth=%.1f];\n",
+			dotQuote(dotActionID(edge.service, edge.eventName)), dotQuote("key:"+edge.key), n, n, 1+math.Log10(float64(n)))
+	}
+	buf.WriteString("}\n")
+
+	if err := writeFileAtomic(path, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+
+	slog.Debug("Graph written", slog.String("path", path), slog.Int("nodes", len(actions)+len(keys)), slog.Int("edges", len(kept)))
+	return nil
+}
+
+// dotActionID is the node id of an event name, event names of different
+// services are different nodes.
+func dotActionID(service, eventName string) string {
+	return "action:" + service + ":" + eventName
+}
+
+// dotQuote quotes s as a DOT id. The dots and brackets of keys need nothing
+// within quotes, backslashes and double quotes are escaped and line breaks
+// written as \n. DOT reads a backslash before the closing quote as escaping
+// it, so a trailing one is followed by a line continuation, which DOT drops.
+func dotQuote(s string) string {
+	quoted := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", "").Replace(s)
+	if strings.HasSuffix(quoted, `\`) {
+		quoted += "\\\n"
+	}
+	return `"` + quoted + `"`
+}
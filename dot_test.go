@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// dotTokens splits a DOT file into its tokens the way the DOT language
+// reads them. Quoted ids are returned with their quotes and the escapes the
+// lexer applies: \" is a quote and a backslash before a line break drops
+// both, every other backslash is kept for the label.
+func dotTokens(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"':
+			var id strings.Builder
+			id.WriteByte('"')
+			i++
+			for {
+				if i >= len(src) {
+					return nil, fmt.Errorf("unterminated id %s", id.String())
+				}
+				if src[i] == '\\' && i+1 < len(src) && src[i+1] == '"' {
+					id.WriteByte('"')
+					i += 2
+					continue
+				}
+				if src[i] == '\\' && i+1 < len(src) && src[i+1] == '\n' {
+					i += 2
+					continue
+				}
+				if src[i] == '"' {
+					i++
+					break
+				}
+				id.WriteByte(src[i])
+				i++
+			}
+			tokens = append(tokens, id.String()+`"`)
+		case strings.HasPrefix(src[i:], "->"):
+			tokens = append(tokens, "->")
+			i += 2
+		case strings.ContainsRune("{}[];=,", rune(c)):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] == '.' || src[i] >= '0' && src[i] <= '9' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= 'A' && src[i] <= 'Z') {
+				i++
+			}
+			tokens = append(tokens, src[start:i])
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+// dotLabel is the text Graphviz shows for a lexed quoted id: \\ is a
+// backslash and \n a line break.
+func dotLabel(id string) string {
+	id = strings.TrimSuffix(strings.TrimPrefix(id, `"`), `"`)
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(id)
+}
+
+// dotKeys are keys DOT gives a meaning to, or which are told apart by an
+// escape only: an escaped dot is a single field, the nested keys aren't.
+var dotKeys = []string{
+	"requestParameters.bucketName",
+	`requestParameters.tags.kubernetes\.io/cluster/name`,
+	"requestParameters.tags.kubernetes.io/cluster/name",
+	`requestParameters.a\.b`,
+	"requestParameters.a.b",
+	`requestParameters."quoted"`,
+	`requestParameters.say \"hi\"`,
+	`requestParameters.trailing\`,
+	`requestParameters.trailing\\`,
+	"requestParameters.items[].id",
+	"requestParameters.line\nbreak",
+	"requestParameters.a;b->c {d} [e]",
+}
+
+func TestDOTQuote(t *testing.T) {
+	seen := make(map[string]string)
+	for _, key := range dotKeys {
+		quoted := dotQuote(key)
+		tokens, err := dotTokens(quoted)
+		if err != nil || len(tokens) != 1 {
+			t.Errorf("%q is quoted as %q, which reads as %q, %v", key, quoted, tokens, err)
+			continue
+		}
+		if label := dotLabel(tokens[0]); label != key {
+			t.Errorf("%q is shown as %q", key, label)
+		}
+		if other, ok := seen[tokens[0]]; ok {
+			t.Errorf("%q and %q have the same id %s", key, other, tokens[0])
+		}
+		seen[tokens[0]] = key
+	}
+}
+
+// TestDOTGraph writes a graph of keys holding quotes, dots and DOT syntax,
+// which must read as a node per key and an edge per key.
+func TestDOTGraph(t *testing.T) {
+	g := newDOTGraph()
+	event := scan.RawEvent{EventName: `Get"Object"`, EventSource: "s3.amazonaws.com"}
+	for i, key := range dotKeys {
+		for n := 0; n <= i; n++ {
+			g.add(event, key, "")
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "graph.dot")
+	if err := g.write(path, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := dotTokens(string(data))
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, data)
+	}
+	if len(tokens) < 3 || tokens[0] != "digraph" || tokens[1] != "findings" || tokens[2] != "{" || tokens[len(tokens)-1] != "}" {
+		t.Fatalf("not a digraph:\n%s", data)
+	}
+
+	// The node statements are id [label=...]; and the edges id -> id [...];
+	labels := make(map[string]string)
+	edges := make(map[string]string)
+	depth := 0
+	for i, token := range tokens {
+		switch token {
+		case "{":
+			depth++
+		case "}":
+			depth--
+		case "->":
+			edges[tokens[i+1]] = tokens[i-1]
+		case "label":
+			if tokens[i-1] == "[" && tokens[i+1] == "=" {
+				labels[tokens[i-2]] = dotLabel(tokens[i+2])
+			}
+		}
+	}
+	if depth != 0 {
+		t.Errorf("unbalanced braces:\n%s", data)
+	}
+
+	action, _ := dotTokens(dotQuote(dotActionID("s3", `Get"Object"`)))
+	if len(labels) != len(dotKeys)+1 || labels[action[0]] != `Get"Object"` {
+		t.Errorf("%d nodes, want the action and %d keys:\n%s", len(labels), len(dotKeys), data)
+	}
+	for _, key := range dotKeys {
+		id, _ := dotTokens(dotQuote("key:" + key))
+		if labels[id[0]] != key {
+			t.Errorf("%q has the node %s labelled %q", key, id[0], labels[id[0]])
+		}
+		if edges[id[0]] != action[0] {
+			t.Errorf("%q has no edge from %s", key, action[0])
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+const (
+	dynamoDBWriters = 4
+	dynamoDBRetries = 5
+)
+
+// dynamoDBWriter records matches in a DynamoDB table keyed by the cleaned
+// key. Writes only fill attributes that are missing and count the scans that
+// found a key, so scanners of several accounts can share a table. UpdateItem
+// can't be batched, so matches are written by a few goroutines instead.
+type dynamoDBWriter struct {
+	client  *dynamodb.Client
+	table   string
+	stats   *scanStats
+	matches chan scan.Match
+	wg      sync.WaitGroup
+}
+
+func newDynamoDBWriter(client *dynamodb.Client, table string, stats *scanStats) *dynamoDBWriter {
+	return &dynamoDBWriter{
+		client:  client,
+		table:   table,
+		stats:   stats,
+		matches: make(chan scan.Match, 1000),
+	}
+}
+
+// createTable creates the table with on-demand capacity unless it exists, and
+// waits until it can be written to.
+func (d *dynamoDBWriter) createTable(ctx context.Context) error {
+	_, err := d.client.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:            &d.table,
+		BillingMode:          ddbtypes.BillingModePayPerRequest,
+		AttributeDefinitions: []ddbtypes.AttributeDefinition{{AttributeName: ptr("key"), AttributeType: ddbtypes.ScalarAttributeTypeS}},
+		KeySchema:            []ddbtypes.KeySchemaElement{{AttributeName: ptr("key"), KeyType: ddbtypes.KeyTypeHash}},
+	})
+
+	var inUse *ddbtypes.ResourceInUseException
+	switch {
+	case errors.As(err, &inUse):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	slog.Info("Created DynamoDB table, waiting until it is active", slog.String("table", d.table))
+	return dynamodb.NewTableExistsWaiter(d.client).Wait(ctx, &dynamodb.DescribeTableInput{TableName: &d.table}, 5*time.Minute)
+}
+
+func (d *dynamoDBWriter) start() {
+	for range dynamoDBWriters {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for m := range d.matches {
+				d.write(m)
+			}
+		}()
+	}
+}
+
+func (d *dynamoDBWriter) add(m scan.Match) {
+	d.matches <- m
+}
+
+// close writes the queued matches and waits until they were written.
+func (d *dynamoDBWriter) close() {
+	close(d.matches)
+	d.wg.Wait()
+}
+
+// write upserts m. The example of a key is kept from the scan that found it
+// first, lastSeen and count are updated by every scan.
+func (d *dynamoDBWriter) write(m scan.Match) {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: &d.table,
+		Key:       map[string]ddbtypes.AttributeValue{"key": &ddbtypes.AttributeValueMemberS{Value: m.Key}},
+		UpdateExpression: ptr("SET #value = if_not_exists(#value, :value), matchType = if_not_exists(matchType, :matchType), " +
+			"eventName = if_not_exists(eventName, :eventName), eventId = if_not_exists(eventId, :eventId), " +
+			"firstSeen = if_not_exists(firstSeen, :now), lastSeen = :now ADD #count :one"),
+		ExpressionAttributeNames: map[string]string{"#value": "value", "#count": "count"},
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":value":     &ddbtypes.AttributeValueMemberS{Value: m.Value},
+			":matchType": &ddbtypes.AttributeValueMemberS{Value: m.MatchType},
+			":eventName": &ddbtypes.AttributeValueMemberS{Value: m.EventName},
+			":eventId":   &ddbtypes.AttributeValueMemberS{Value: m.EventID},
+			":now":       &ddbtypes.AttributeValueMemberS{Value: now},
+			":one":       &ddbtypes.AttributeValueMemberN{Value: "1"},
+		},
+	}
+
+	backoff := time.Second
+	for retry := 0; ; retry++ {
+		_, err := d.client.UpdateItem(context.Background(), input)
+		if err == nil {
+			d.stats.addDynamoDBWrite()
+			return
+		}
+
+		// The SDK already retries throttling a few times, this rides out
+		// longer bursts of it.
+		var throttled *ddbtypes.ProvisionedThroughputExceededException
+		if !errors.As(err, &throttled) || retry == dynamoDBRetries {
+			slog.Error("Couldn't write match to DynamoDB", slog.String("key", m.Key), slog.String("error", err.Error()))
+			d.stats.addDynamoDBFailure()
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
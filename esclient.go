@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// esClient sends requests to an Elasticsearch or OpenSearch endpoint, either
+// with basic auth or SigV4 signed for Amazon OpenSearch Service.
+type esClient struct {
+	http *http.Client
+	url  string
+
+	username string
+	password string
+
+	// credentials are only set to sign requests with SigV4.
+	credentials aws.CredentialsProvider
+	signer      *v4.Signer
+}
+
+// esStatusError is returned for responses with an error status.
+type esStatusError struct {
+	status int
+	msg    string
+}
+
+func (e *esStatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.status, http.StatusText(e.status), e.msg)
+}
+
+func (e *esClient) do(ctx context.Context, method, path string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(e.url, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if err := e.authorize(ctx, req, body); err != nil {
+		return err
+	}
+
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s %s: %w", method, path, &esStatusError{status: resp.StatusCode, msg: string(msg)})
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (e *esClient) authorize(ctx context.Context, req *http.Request, body []byte) error {
+	if e.credentials == nil {
+		if e.username != "" {
+			req.SetBasicAuth(e.username, e.password)
+		}
+		return nil
+	}
+
+	creds, err := e.credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(body)
+	return e.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(sum[:]), "es", awsRegion, time.Now())
+}
+
+// newESClient returns a client of url authenticating as configured with
+// --es-username or --es-sigv4.
+func newESClient(url string, opts options, sdkConfig aws.Config) *esClient {
+	client := &esClient{
+		http:     &http.Client{Timeout: opts.callTimeout},
+		url:      url,
+		username: opts.esUsername,
+		password: os.Getenv("ES_PASSWORD"),
+	}
+
+	if opts.esSigV4 {
+		client.credentials = sdkConfig.Credentials
+		client.signer = v4.NewSigner()
+	}
+
+	return client
+}
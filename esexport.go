@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+const (
+	esExportBatchSize     = 500
+	esExportFlushInterval = 5 * time.Second
+	esExportRetries       = 5
+)
+
+// esMatchMapping is the mapping the export index is created with.
+const esMatchMapping = `{
+  "mappings": {
+    "properties": {
+      "@timestamp": {"type": "date"},
+      "runId":      {"type": "keyword"},
+      "key":        {"type": "keyword"},
+      "value":      {"type": "keyword"},
+      "matchType":  {"type": "keyword"},
+      "eventName":  {"type": "keyword"},
+      "eventId":    {"type": "keyword"},
+      "eventTime":  {"type": "date"},
+      "accountId":  {"type": "keyword"},
+      "region":     {"type": "keyword"}
+    }
+  }
+}`
+
+// esMatchDocument is a match as it is indexed.
+type esMatchDocument struct {
+	scan.Match
+	Timestamp time.Time `json:"@timestamp"`
+	RunID     string    `json:"runId"`
+}
+
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// esExporter bulk indexes matches into an Elasticsearch or OpenSearch index,
+// in batches sent from its own goroutine.
+type esExporter struct {
+	client  *esClient
+	index   string
+	runID   string
+	stats   *scanStats
+	matches chan esMatchDocument
+	done    chan struct{}
+}
+
+func newESExporter(client *esClient, index, runID string, stats *scanStats) *esExporter {
+	return &esExporter{
+		client:  client,
+		index:   index,
+		runID:   runID,
+		stats:   stats,
+		matches: make(chan esMatchDocument, esExportBatchSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// ensureIndex creates the index with esMatchMapping unless it exists.
+func (x *esExporter) ensureIndex(ctx context.Context) error {
+	path := "/" + url.PathEscape(x.index)
+
+	err := x.client.do(ctx, http.MethodHead, path, nil, nil)
+	var statusErr *esStatusError
+	if !errors.As(err, &statusErr) || statusErr.status != http.StatusNotFound {
+		return err
+	}
+
+	slog.Info("Creating export index", slog.String("index", x.index))
+	return x.client.do(ctx, http.MethodPut, path, []byte(esMatchMapping), nil)
+}
+
+func (x *esExporter) add(m scan.Match) {
+	x.matches <- esMatchDocument{Match: m, Timestamp: time.Now(), RunID: x.runID}
+}
+
+// run sends the matches until close was called. Batches are sent once full or
+// after esExportFlushInterval.
+func (x *esExporter) run() {
+	defer close(x.done)
+
+	ticker := time.NewTicker(esExportFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]esMatchDocument, 0, esExportBatchSize)
+	for {
+		select {
+		case doc, ok := <-x.matches:
+			if !ok {
+				x.flush(batch)
+				return
+			}
+
+			batch = append(batch, doc)
+			if len(batch) < esExportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		x.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// close sends the remaining matches and waits until they were indexed.
+func (x *esExporter) close() {
+	close(x.matches)
+	<-x.done
+}
+
+// flush indexes batch, retrying the documents rejected with 429 Too Many
+// Requests with exponential backoff.
+func (x *esExporter) flush(batch []esMatchDocument) {
+	backoff := time.Second
+	for retry := 0; len(batch) > 0; retry++ {
+		if retry > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		rejected, failed, err := x.bulk(batch)
+		if err != nil {
+			var statusErr *esStatusError
+			if errors.As(err, &statusErr) && statusErr.status == http.StatusTooManyRequests && retry < esExportRetries {
+				continue
+			}
+
+			slog.Error("Couldn't export matches", slog.Int("matches", len(batch)), slog.String("error", err.Error()))
+			x.stats.addExportFailures(len(batch))
+			return
+		}
+
+		x.stats.addExportFailures(failed)
+		x.stats.addExportedMatches(len(batch) - len(rejected) - failed)
+		if len(rejected) > 0 && retry == esExportRetries {
+			slog.Error("Couldn't export matches, the index kept rejecting them", slog.Int("matches", len(rejected)))
+			x.stats.addExportFailures(len(rejected))
+			return
+		}
+		batch = rejected
+	}
+}
+
+// bulk indexes batch with a single _bulk request. It returns the documents
+// rejected with 429, which can be retried, and the number of other failures.
+func (x *esExporter) bulk(batch []esMatchDocument) ([]esMatchDocument, int, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, doc := range batch {
+		// The id makes retries idempotent, a key is only matched once per run.
+		action := map[string]map[string]string{"index": {"_index": x.index, "_id": x.runID + ":" + doc.Key}}
+		if err := enc.Encode(action); err != nil {
+			return nil, 0, err
+		}
+		if err := enc.Encode(doc); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var resp esBulkResponse
+	if err := x.client.do(context.Background(), http.MethodPost, "/_bulk", body.Bytes(), &resp); err != nil {
+		return nil, 0, err
+	}
+
+	if !resp.Errors {
+		return nil, 0, nil
+	}
+
+	var rejected []esMatchDocument
+	failed := 0
+	for i, item := range resp.Items {
+		for _, result := range item {
+			switch {
+			case result.Status == http.StatusTooManyRequests:
+				rejected = append(rejected, batch[i])
+			case result.Status >= 300:
+				slog.Error("Couldn't export match", slog.String("key", batch[i].Key), slog.String("error", string(result.Error)))
+				failed++
+			}
+		}
+	}
+
+	return rejected, failed, nil
+}
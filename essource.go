@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// esScrollKeepAlive is how long the search context is kept between pages.
+const esScrollKeepAlive = "5m"
+
+// esSource scrolls through an Elasticsearch or OpenSearch index of CloudTrail
+// events.
+type esSource struct {
+	client      *esClient
+	index       string
+	query       json.RawMessage
+	timeField   string
+	sourceField string
+	window      timeWindow
+	stats       *scanStats
+}
+
+type esSearchResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			ID     string          `json:"_id"`
+			Source json.RawMessage `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+func (e *esSource) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	body, err := e.searchBody()
+	if err != nil {
+		slog.Error("Invalid OpenSearch query", slog.String("error", err.Error()))
+		return stopFailed
+	}
+	slog.Info("Searching OpenSearch index", slog.String("index", e.index), slog.String("query", string(body)))
+
+	var page esSearchResponse
+	err = e.client.do(ctx, http.MethodPost, "/"+url.PathEscape(e.index)+"/_search?scroll="+esScrollKeepAlive, body, &page)
+
+	var scrollID string
+	defer func() {
+		if scrollID != "" {
+			e.clearScroll(context.WithoutCancel(ctx), scrollID)
+		}
+	}()
+
+	for {
+		if err != nil {
+			if ctx.Err() != nil {
+				return stopCanceled
+			}
+
+			slog.Error("Couldn't search OpenSearch index", slog.String("index", e.index), slog.String("error", err.Error()))
+			return stopFailed
+		}
+		scrollID = page.ScrollID
+
+		if len(page.Hits.Hits) == 0 {
+			return stopComplete
+		}
+
+		for _, hit := range page.Hits.Hits {
+			event, err := e.hitToEvent(hit.Source)
+			if err != nil {
+				slog.Warn("Skipping OpenSearch document", slog.String("id", hit.ID), slog.String("error", err.Error()))
+				e.stats.addInvalidLine()
+				continue
+			}
+
+			emit(event)
+		}
+		e.stats.addPage("", len(page.Hits.Hits))
+
+		scroll, _ := json.Marshal(map[string]string{"scroll": esScrollKeepAlive, "scroll_id": scrollID})
+		page = esSearchResponse{}
+		err = e.client.do(ctx, http.MethodPost, "/_search/scroll", scroll, &page)
+	}
+}
+
+// searchBody combines --es-query with the time window.
+func (e *esSource) searchBody() ([]byte, error) {
+	filters := []any{}
+	if len(e.query) > 0 {
+		if !json.Valid(e.query) {
+			return nil, fmt.Errorf("--es-query is not valid json")
+		}
+		filters = append(filters, e.query)
+	}
+
+	if e.window.bounded() {
+		bounds := map[string]string{}
+		if !e.window.start.IsZero() {
+			bounds["gte"] = e.window.start.Format(time.RFC3339)
+		}
+		if !e.window.end.IsZero() {
+			bounds["lte"] = e.window.end.Format(time.RFC3339)
+		}
+		filters = append(filters, map[string]any{"range": map[string]any{e.timeField: bounds}})
+	}
+
+	return json.Marshal(map[string]any{
+		"size":  1000,
+		"sort":  []string{"_doc"},
+		"query": map[string]any{"bool": map[string]any{"filter": filters}},
+	})
+}
+
+// hitToEvent extracts the CloudTrail record from a document. sourceField is
+// a dotted path into the document whose value is the record, either as an
+// object or as a json string.
+func (e *esSource) hitToEvent(source json.RawMessage) (scan.RawEvent, error) {
+	raw := source
+	if e.sourceField != "" {
+		for _, name := range strings.Split(e.sourceField, ".") {
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &fields); err != nil {
+				return scan.RawEvent{}, err
+			}
+
+			field, ok := fields[name]
+			if !ok {
+				return scan.RawEvent{}, fmt.Errorf("document has no %s field", e.sourceField)
+			}
+			raw = field
+		}
+
+		var encoded string
+		if err := json.Unmarshal(raw, &encoded); err == nil {
+			raw = json.RawMessage(encoded)
+		}
+	}
+
+	return unwrapEventBridge(raw)
+}
+
+// clearScroll frees the search context instead of waiting for it to expire.
+func (e *esSource) clearScroll(ctx context.Context, scrollID string) {
+	body, _ := json.Marshal(map[string][]string{"scroll_id": {scrollID}})
+	if err := e.client.do(ctx, http.MethodDelete, "/_search/scroll", body, nil); err != nil {
+		slog.Warn("Couldn't clear OpenSearch scroll", slog.String("error", err.Error()))
+	}
+}
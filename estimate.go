@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// estimateSamples is the number of pages --estimate fetches, ending at
+	// the end of each third of the window.
+	estimateSamples = 3
+
+	// lookupPageSize is the most events LookupEvents returns per page.
+	lookupPageSize = 50
+)
+
+// estimateSample is a page of the events before at.
+type estimateSample struct {
+	at      time.Time
+	events  int
+	latency time.Duration
+
+	// oldest is the time of the oldest event of the page. last is set when
+	// there was no next page, the page then holds every event from the
+	// start of the window to at.
+	oldest time.Time
+	last   bool
+}
+
+// scanEstimate is the projected size of a LookupEvents scan.
+type scanEstimate struct {
+	window  timeWindow
+	samples []estimateSample
+	rps     float64
+
+	eventsPerHour float64
+	events        int
+	calls         int
+	latency       time.Duration
+	duration      time.Duration
+}
+
+// runEstimate fetches a few pages spread over the window of a LookupEvents
+// scan and prints how big the scan would be, without scanning.
+func runEstimate(opts options) error {
+	ctx := context.Background()
+
+	window, err := lookupWindow(opts, &scanStats{})
+	if err != nil {
+		return err
+	}
+	window = estimateWindow(window, time.Now())
+
+	sdkConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return configError(fmt.Errorf("load default configuration, have you set up your AWS account? %w", err))
+	}
+	client := cloudtrail.NewFromConfig(sdkConfig, func(o *cloudtrail.Options) {
+		o.Region = awsRegion
+	})
+
+	limiter := rate.NewLimiter(rate.Limit(opts.rps), 1)
+	samples, err := sampleScan(ctx, client, limiter, opts.callTimeout, window, samplePoints(window, estimateSamples))
+	if err != nil {
+		if isAccessDenied(err) {
+			printAccessDeniedHelp()
+			return &exitError{code: exitAccessDenied, err: err}
+		}
+		return apiError(fmt.Errorf("sample LookupEvents: %w", err))
+	}
+
+	estimate := projectScan(samples, window, opts.rps)
+	slog.Info("Estimated scan",
+		slog.Int("events", estimate.events),
+		slog.Int("calls", estimate.calls),
+		slog.Duration("duration", estimate.duration),
+		slog.Int("sampled-pages", len(samples)),
+	)
+	estimate.print(os.Stdout)
+	return nil
+}
+
+// estimateWindow closes the open bounds of a LookupEvents window: it starts
+// at the retention horizon and ends at now.
+func estimateWindow(w timeWindow, now time.Time) timeWindow {
+	if w.end.IsZero() || w.end.After(now) {
+		w.end = now
+	}
+	if horizon := now.Add(-lookupRetention); w.start.IsZero() || w.start.Before(horizon) {
+		w.start = horizon
+	}
+	return w
+}
+
+// samplePoints splits the window in n parts and returns the end of each, the
+// last being the end of the window. A page ending at a point holds the
+// events just before it, LookupEvents returns the newest first.
+func samplePoints(w timeWindow, n int) []time.Time {
+	points := make([]time.Time, 0, n)
+	span := w.end.Sub(w.start)
+	for i := 1; i <= n; i++ {
+		points = append(points, w.start.Add(span*time.Duration(i)/time.Duration(n)))
+	}
+	return points
+}
+
+// sampleScan fetches the page of the events before every point, within the
+// window. There are no retries, an estimate can simply be run again.
+func sampleScan(ctx context.Context, client scan.CloudTrailClient, limiter *rate.Limiter, callTimeout time.Duration, w timeWindow, points []time.Time) ([]estimateSample, error) {
+	samples := make([]estimateSample, 0, len(points))
+	for _, at := range points {
+		if err := limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, callTimeout)
+		start := time.Now()
+		out, err := client.LookupEvents(callCtx, &cloudtrail.LookupEventsInput{
+			StartTime:  aws.Time(w.start),
+			EndTime:    aws.Time(at),
+			MaxResults: aws.Int32(lookupPageSize),
+		})
+		latency := time.Since(start)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+
+		sample := estimateSample{at: at, events: len(out.Events), latency: latency, oldest: at, last: out.NextToken == nil}
+		for _, evt := range out.Events {
+			if evt.EventTime != nil && evt.EventTime.Before(sample.oldest) {
+				sample.oldest = *evt.EventTime
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// projectScan extrapolates the event rate of the samples to the window. A
+// page takes the longer of the rate limit and the measured latency, the
+// scan calls LookupEvents one page after the other.
+func projectScan(samples []estimateSample, w timeWindow, rps float64) scanEstimate {
+	e := scanEstimate{window: w, samples: samples, rps: rps}
+	if len(samples) == 0 {
+		return e
+	}
+
+	var rates float64
+	var latency time.Duration
+	for _, s := range samples {
+		latency += s.latency
+
+		// A last page holds every event since the start, otherwise the
+		// events fill the time back to the oldest one, n events being
+		// n-1 gaps.
+		from, events := s.oldest, float64(max(s.events-1, 0))
+		if s.last {
+			from, events = w.start, float64(s.events)
+		}
+		if hours := s.at.Sub(from).Hours(); hours > 0 {
+			rates += events / hours
+		} else if s.events > 0 {
+			// A full page within the same second, a burst.
+			rates += float64(s.events) * 3600
+		}
+	}
+	e.eventsPerHour = rates / float64(len(samples))
+	e.latency = latency / time.Duration(len(samples))
+
+	e.events = int(math.Round(e.eventsPerHour * w.end.Sub(w.start).Hours()))
+	e.calls = max(1, int(math.Ceil(float64(e.events)/lookupPageSize)))
+
+	perCall := e.latency
+	if limit := time.Duration(float64(time.Second) / rps); limit > perCall {
+		perCall = limit
+	}
+	e.duration = time.Duration(e.calls) * perCall
+	return e
+}
+
+func (e scanEstimate) print(w io.Writer) {
+	points := make([]string, 0, len(e.samples))
+	for _, s := range e.samples {
+		points = append(points, fmt.Sprintf("%s (%d events)", s.at.UTC().Format(time.RFC3339), s.events))
+	}
+
+	fmt.Fprintf(w, "Estimate of the LookupEvents scan from %s to %s\n\n",
+		e.window.start.UTC().Format(time.RFC3339), e.window.end.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "  Events     ~%d (%.0f per hour)\n", e.events, e.eventsPerHour)
+	fmt.Fprintf(w, "  API calls  ~%d, of up to %d events each\n", e.calls, lookupPageSize)
+	fmt.Fprintf(w, "  Duration   ~%s at --rps %g and %s per call\n", e.duration.Round(time.Second), e.rps, e.latency.Round(time.Millisecond))
+	fmt.Fprintf(w, "\nThese are estimates, extrapolated from %d pages of the events before %s.\n"+
+		"Bursts and quiet periods between the samples aren't seen, retries and throttling aren't counted.\n",
+		len(e.samples), strings.Join(points, ", "))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan/scantest"
+	"golang.org/x/time/rate"
+)
+
+func TestEstimateWindow(t *testing.T) {
+	now := time.Date(2024, 7, 1, 12, 30, 0, 0, time.UTC)
+	horizon := now.Add(-lookupRetention)
+	start := now.AddDate(0, 0, -7)
+
+	tests := map[string]struct {
+		window timeWindow
+		want   timeWindow
+	}{
+		"open":                 {timeWindow{}, timeWindow{start: horizon, end: now}},
+		"closed":               {timeWindow{start: start, end: now.Add(-time.Hour)}, timeWindow{start: start, end: now.Add(-time.Hour)}},
+		"end after now":        {timeWindow{start: start, end: now.Add(time.Hour)}, timeWindow{start: start, end: now}},
+		"start before horizon": {timeWindow{start: horizon.Add(-time.Hour)}, timeWindow{start: horizon, end: now}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := estimateWindow(tt.window, now); got != tt.want {
+				t.Errorf("window %v - %v, want %v - %v", got.start, got.end, tt.want.start, tt.want.end)
+			}
+		})
+	}
+}
+
+func TestSamplePoints(t *testing.T) {
+	start := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	w := timeWindow{start: start, end: start.Add(9 * time.Hour)}
+
+	got := samplePoints(w, 3)
+	want := []time.Time{start.Add(3 * time.Hour), start.Add(6 * time.Hour), w.end}
+	if len(got) != len(want) {
+		t.Fatalf("points %v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("point %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestProjectScan(t *testing.T) {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	month := timeWindow{start: start, end: start.AddDate(0, 0, 30)}
+	// page is a full page of events a minute apart, ending at at.
+	page := func(at time.Time, latency time.Duration) estimateSample {
+		return estimateSample{at: at, events: lookupPageSize, latency: latency, oldest: at.Add(-(lookupPageSize - 1) * time.Minute)}
+	}
+	points := samplePoints(month, 3)
+
+	tests := map[string]struct {
+		samples []estimateSample
+		window  timeWindow
+		rps     float64
+
+		eventsPerHour float64
+		events        int
+		calls         int
+		duration      time.Duration
+	}{
+		"no samples": {
+			window: month,
+			rps:    2,
+		},
+		// 60 events an hour over 720 hours, 864 pages at 2 a second.
+		"steady rate": {
+			samples:       []estimateSample{page(points[0], 100*time.Millisecond), page(points[1], 100*time.Millisecond), page(points[2], 100*time.Millisecond)},
+			window:        month,
+			rps:           2,
+			eventsPerHour: 60,
+			events:        43200,
+			calls:         864,
+			duration:      432 * time.Second,
+		},
+		// The calls take longer than the rate limit allows.
+		"latency bound": {
+			samples:       []estimateSample{page(points[0], 200*time.Millisecond), page(points[1], 400*time.Millisecond), page(points[2], 300*time.Millisecond)},
+			window:        month,
+			rps:           100,
+			eventsPerHour: 60,
+			events:        43200,
+			calls:         864,
+			duration:      864 * 300 * time.Millisecond,
+		},
+		// A page without a next one holds the whole window.
+		"last page": {
+			samples:       []estimateSample{{at: start.Add(10 * time.Hour), events: 10, oldest: start.Add(9 * time.Hour), last: true}},
+			window:        timeWindow{start: start, end: start.Add(10 * time.Hour)},
+			rps:           2,
+			eventsPerHour: 1,
+			events:        10,
+			calls:         1,
+			duration:      500 * time.Millisecond,
+		},
+		"no events": {
+			samples:  []estimateSample{{at: points[0], oldest: points[0], last: true}},
+			window:   month,
+			rps:      2,
+			calls:    1,
+			duration: 500 * time.Millisecond,
+		},
+		// A full page within a second is counted as an hour of it.
+		"burst": {
+			samples:       []estimateSample{{at: start.Add(time.Hour), events: lookupPageSize, oldest: start.Add(time.Hour)}},
+			window:        timeWindow{start: start, end: start.Add(time.Hour)},
+			rps:           2,
+			eventsPerHour: lookupPageSize * 3600,
+			events:        lookupPageSize * 3600,
+			calls:         3600,
+			duration:      1800 * time.Second,
+		},
+		// The rates of the samples are averaged.
+		"quiet and busy": {
+			samples: []estimateSample{
+				{at: points[0], events: 11, oldest: points[0].Add(-10 * time.Hour)},
+				page(points[1], 0),
+				page(points[2], 0),
+			},
+			window:        month,
+			rps:           2,
+			eventsPerHour: (1 + 60 + 60) / 3.0,
+			events:        29040,
+			calls:         581,
+			duration:      290500 * time.Millisecond,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			e := projectScan(tt.samples, tt.window, tt.rps)
+			if e.eventsPerHour != tt.eventsPerHour || e.events != tt.events || e.calls != tt.calls || e.duration != tt.duration {
+				t.Errorf("projected %.2f events per hour, %d events, %d calls and %s, want %.2f, %d, %d and %s",
+					e.eventsPerHour, e.events, e.calls, e.duration, tt.eventsPerHour, tt.events, tt.calls, tt.duration)
+			}
+		})
+	}
+}
+
+// TestSampleScan fetches a page per point and reads the oldest event of each.
+func TestSampleScan(t *testing.T) {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	w := timeWindow{start: start, end: start.Add(9 * time.Hour)}
+	points := samplePoints(w, 3)
+
+	page := func(at time.Time, n int) scantest.Page {
+		events := lookupEvents(0, n)
+		for i := range events {
+			events[i].EventTime = aws.Time(at.Add(-time.Duration(i) * time.Minute))
+		}
+		return scantest.Page{Events: events}
+	}
+	client := scantest.NewCloudTrail(page(points[0], 50), page(points[1], 20), scantest.Page{Events: []types.Event{}})
+
+	samples, err := sampleScan(context.Background(), client, rate.NewLimiter(rate.Inf, 1), time.Minute, w, points)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []estimateSample{
+		{at: points[0], events: 50, oldest: points[0].Add(-49 * time.Minute)},
+		{at: points[1], events: 20, oldest: points[1].Add(-19 * time.Minute)},
+		// The last page of the client has no next one.
+		{at: points[2], oldest: points[2], last: true},
+	}
+	if len(samples) != len(want) {
+		t.Fatalf("%d samples, want %d", len(samples), len(want))
+	}
+	for i, s := range samples {
+		s.latency = 0
+		if s != want[i] {
+			t.Errorf("sample %d is %+v, want %+v", i, s, want[i])
+		}
+	}
+
+	for i, input := range client.Inputs() {
+		if !input.StartTime.Equal(w.start) || !input.EndTime.Equal(points[i]) || *input.MaxResults != lookupPageSize {
+			t.Errorf("call %d looked up %v - %v by %d, want %v - %v by %d", i, input.StartTime, input.EndTime, *input.MaxResults, w.start, points[i], lookupPageSize)
+		}
+	}
+}
+
+func TestEstimatePrint(t *testing.T) {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	w := timeWindow{start: start, end: start.AddDate(0, 0, 30)}
+	samples := []estimateSample{{at: w.end, events: lookupPageSize, latency: 120 * time.Millisecond, oldest: w.end.Add(-49 * time.Minute)}}
+
+	var out bytes.Buffer
+	projectScan(samples, w, 2).print(&out)
+	for _, want := range []string{
+		"from 2024-06-01T00:00:00Z to 2024-07-01T00:00:00Z",
+		"Events     ~43200 (60 per hour)",
+		"API calls  ~864, of up to 50 events each",
+		"Duration   ~7m12s at --rps 2 and 120ms per call",
+		"1 pages of the events before 2024-07-01T00:00:00Z (50 events)",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("estimate doesn't have %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/time/rate"
+)
+
+// eventIDSource fetches the events of --event-id, one LookupEvents call per
+// id. There is no pagination, checkpoint or saturation, an id that can't be
+// fetched is recorded in stats.json and the others are still read.
+type eventIDSource struct {
+	client      scan.CloudTrailClient
+	limiter     *rate.Limiter
+	clock       scan.Clock
+	callTimeout time.Duration
+	ids         []string
+	stats       *scanStats
+	budget      *retryBudget
+}
+
+func (e *eventIDSource) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	slog.Info("Looking up events by id", slog.Int("event-ids", len(e.ids)))
+
+	for _, id := range e.ids {
+		events, reason, err := e.lookup(ctx, id)
+		if reason != "" {
+			return reason
+		}
+		if err != nil {
+			slog.Warn("Couldn't look up event", slog.String("event-id", id), slog.String("error", err.Error()))
+			e.stats.addMissingEventID(id, err.Error())
+			continue
+		}
+		if len(events) == 0 {
+			slog.Warn("Event not found, it may be older than the 90 days LookupEvents keeps", slog.String("event-id", id))
+			e.stats.addMissingEventID(id, "not found")
+			continue
+		}
+
+		for _, evt := range events {
+			emit(scan.FromLookupEvent(evt))
+		}
+		e.stats.addEvents(len(events))
+	}
+
+	return stopComplete
+}
+
+// lookup fetches the events of id, retrying failed calls. A stop reason is
+// returned for the errors no other id would get past, e.g. missing
+// permissions, an error for the ones of this id only.
+func (e *eventIDSource) lookup(ctx context.Context, id string) ([]types.Event, stopReason, error) {
+	input := &cloudtrail.LookupEventsInput{
+		LookupAttributes: []types.LookupAttribute{{
+			AttributeKey:   types.LookupAttributeKeyEventId,
+			AttributeValue: aws.String(id),
+		}},
+	}
+
+	for retry := 0; ; retry++ {
+		if _, err := waitForLimiter(ctx, e.clock, e.limiter, e.stats); err != nil {
+			return nil, stopCanceled, nil
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, e.callTimeout)
+		out, err := e.client.LookupEvents(callCtx, input)
+		cancel()
+		if err == nil {
+			e.budget.success()
+			return out.Events, "", nil
+		}
+
+		countAPIError("lookup-events", err)
+		if ctx.Err() != nil {
+			return nil, stopCanceled, nil
+		}
+		tripped := e.budget.failure(err)
+		switch {
+		case isAccessDenied(err):
+			slog.Error("Not allowed to lookup cloudtrail events, cloudtrail:LookupEvents permission is required",
+				slog.String("required-policy", lookupEventsPolicy),
+			)
+			return nil, stopAccessDenied, nil
+		case tripped:
+			return nil, stopCircuitOpen, nil
+		case isExpiredCredentials(err):
+			return nil, stopCredentialsExpired, nil
+		case invalidRequestHint(err) != "":
+			return nil, "", fmt.Errorf("%w (%s)", err, invalidRequestHint(err))
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			e.stats.addCallTimeout()
+		}
+		if retry == lookupRetries {
+			return nil, "", err
+		}
+		if !e.budget.retry() {
+			return nil, stopCircuitOpen, nil
+		}
+
+		e.stats.addRetry()
+		delay := retryDelay(retry + 1)
+		slog.Warn("Retrying request", slog.String("event-id", id), slog.Duration("delay", delay))
+		if err := e.clock.Sleep(ctx, delay); err != nil {
+			return nil, stopCanceled, nil
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// exampleRecord is a line of --save-examples, the event that introduced Key.
+// Like failures.ndjson it has the shape of a LookupEvents Event, so --stdin
+// reads the examples back, e.g. to run improved matchers over them.
+type exampleRecord struct {
+	Key             string
+	EventId         string
+	EventName       string
+	EventSource     string
+	EventTime       *time.Time `json:",omitempty"`
+	CloudTrailEvent string
+}
+
+// exampleStats is what stats.json tells of --save-examples.
+type exampleStats struct {
+	Saved int `json:"saved"`
+	// Oversized counts the events over --examples-max-event-size.
+	Oversized int `json:"oversized"`
+	// Dropped counts the events left out once the file reached
+	// --examples-max-size or couldn't be written.
+	Dropped int    `json:"dropped"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// exampleWriter appends the raw event of every new key to a file, one line
+// per key. Events larger than maxEventSize are skipped, and once the file
+// would grow beyond maxSize or a write failed the examples are only counted.
+type exampleWriter struct {
+	path         string
+	maxEventSize uint64
+	maxSize      uint64
+	redact       bool
+
+	mu     sync.Mutex
+	file   *os.File
+	full   bool
+	broken bool
+	stats  exampleStats
+}
+
+func newExampleWriter(path string, maxEventSize, maxSize uint64, redact bool) *exampleWriter {
+	return &exampleWriter{path: path, maxEventSize: maxEventSize, maxSize: maxSize, redact: redact}
+}
+
+// add is a scan.WithOnNewKey hook.
+func (w *exampleWriter) add(event scan.RawEvent, m scan.Match) {
+	if w.maxEventSize > 0 && uint64(len(event.Payload)) > w.maxEventSize {
+		w.mu.Lock()
+		w.stats.Oversized++
+		w.mu.Unlock()
+		return
+	}
+
+	record := exampleRecord{
+		Key:             redactValue(m.Key, w.redact),
+		EventId:         event.EventID,
+		EventName:       event.EventName,
+		EventSource:     event.EventSource,
+		CloudTrailEvent: redactValue(event.Payload, w.redact),
+	}
+	if !event.EventTime.IsZero() {
+		record.EventTime = &event.EventTime
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		w.mu.Lock()
+		w.stats.Dropped++
+		w.mu.Unlock()
+		return
+	}
+	data = append(data, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.broken || w.full {
+		w.stats.Dropped++
+		return
+	}
+	if w.maxSize > 0 && w.stats.Bytes+uint64(len(data)) > w.maxSize {
+		slog.Warn("!!! --examples-max-size reached, the events of further new keys aren't saved !!!",
+			slog.String("path", w.path),
+			slog.Uint64("examples-max-size", w.maxSize),
+		)
+		w.full = true
+		w.stats.Dropped++
+		return
+	}
+
+	if w.file == nil {
+		w.file, err = os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	}
+	if err == nil {
+		_, err = w.file.Write(data)
+	}
+	if err != nil {
+		slog.Error("Couldn't save example event, only counting examples from now on", slog.String("path", w.path), slog.String("error", err.Error()))
+		w.broken = true
+		w.stats.Dropped++
+		return
+	}
+	w.stats.Saved++
+	w.stats.Bytes += uint64(len(data))
+}
+
+// close closes the file and returns the counts. The events of the workers
+// still running after a drain timeout are only counted.
+func (w *exampleWriter) close() *exampleStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.broken = true
+	stats := w.stats
+	return &stats
+}
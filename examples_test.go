@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+func exampleEvent(id, payload string) scan.RawEvent {
+	return scan.RawEvent{
+		EventID:     id,
+		EventName:   "GetRole",
+		EventSource: "iam.amazonaws.com",
+		EventTime:   time.Date(2024, 7, 1, 12, 30, 0, 0, time.UTC),
+		Payload:     payload,
+	}
+}
+
+// TestExampleWriter saves an event per new key that --stdin reads back, and
+// counts the events left out.
+func TestExampleWriter(t *testing.T) {
+	small := `{"eventID":"1","requestParameters":{"roleArn":"arn:aws:iam::123456789012:role/a"}}`
+	large := `{"eventID":"2","requestParameters":{"roleName":"` + strings.Repeat("a", 200) + `"}}`
+
+	tests := []struct {
+		name         string
+		maxEventSize uint64
+		maxSize      uint64
+		redact       bool
+		events       []scan.RawEvent
+		wantIDs      []string
+		wantStats    exampleStats
+		wantAccount  bool
+	}{
+		{
+			name:        "all",
+			events:      []scan.RawEvent{exampleEvent("1", small), exampleEvent("2", large)},
+			wantIDs:     []string{"1", "2"},
+			wantStats:   exampleStats{Saved: 2},
+			wantAccount: true,
+		},
+		{
+			name:         "oversized",
+			maxEventSize: 100,
+			events:       []scan.RawEvent{exampleEvent("1", small), exampleEvent("2", large)},
+			wantIDs:      []string{"1"},
+			wantStats:    exampleStats{Saved: 1, Oversized: 1},
+			wantAccount:  true,
+		},
+		{
+			name:        "full",
+			maxSize:     300,
+			events:      []scan.RawEvent{exampleEvent("1", small), exampleEvent("2", large), exampleEvent("3", small)},
+			wantIDs:     []string{"1"},
+			wantStats:   exampleStats{Saved: 1, Dropped: 2},
+			wantAccount: true,
+		},
+		{
+			name:      "redacted",
+			redact:    true,
+			events:    []scan.RawEvent{exampleEvent("1", small)},
+			wantIDs:   []string{"1"},
+			wantStats: exampleStats{Saved: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "examples.ndjson")
+			w := newExampleWriter(path, tt.maxEventSize, tt.maxSize, tt.redact)
+			for _, event := range tt.events {
+				w.add(event, scan.Match{Key: "requestParameters.roleArn." + event.EventID})
+			}
+			stats := w.close()
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+				var record exampleRecord
+				if err := json.Unmarshal(line, &record); err != nil {
+					t.Fatalf("line %s: %v", line, err)
+				}
+				if record.Key != "requestParameters.roleArn."+record.EventId {
+					t.Errorf("event %s saved for key %s", record.EventId, record.Key)
+				}
+
+				event, err := parseEventLine(line)
+				if err != nil {
+					t.Fatalf("--stdin can't read line %s back: %v", line, err)
+				}
+				if event.EventID != record.EventId || event.Payload != record.CloudTrailEvent || !event.EventTime.Equal(*record.EventTime) {
+					t.Errorf("--stdin reads line %s back as %+v", line, event)
+				}
+				ids = append(ids, record.EventId)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("saved events %v, want %v", ids, tt.wantIDs)
+			}
+			if hasAccount := bytes.Contains(data, []byte("123456789012")); hasAccount != tt.wantAccount {
+				t.Errorf("examples hold the account id: %t, want %t", hasAccount, tt.wantAccount)
+			}
+
+			tt.wantStats.Bytes = uint64(len(data))
+			if *stats != tt.wantStats {
+				t.Errorf("stats are %+v, want %+v", *stats, tt.wantStats)
+			}
+		})
+	}
+}
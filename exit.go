@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+// Exit codes of the process.
+const (
+	exitOK                 = 0
+	exitFailure            = 1
+	exitConfig             = 2
+	exitAccessDenied       = 3
+	exitCredentialsExpired = 4
+	exitAPI                = 5
+	exitPartial            = 6
+	exitOutput             = 7
+	// exitUnmapped is --fail-on-unmapped finding keys missing from the
+	// --mappings file.
+	exitUnmapped = 8
+	// exitCircuitOpen is the retry budget of --retry-budget or
+	// --max-consecutive-failures running out.
+	exitCircuitOpen = 9
+	// exitInterrupted is the shell convention for SIGINT. Only a second
+	// signal exits with it, the first one ends the scan as usual.
+	exitInterrupted = 130
+)
+
+// exitError is a failure that exits with code. Failures that aren't one exit
+// with exitFailure.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// configError is a failure before scanning caused by the flags or the
+// environment, e.g. no AWS configuration.
+func configError(err error) error {
+	return &exitError{code: exitConfig, err: err}
+}
+
+// apiError is an AWS or other API call the run couldn't do without, whose
+// retries were exhausted.
+func apiError(err error) error {
+	return &exitError{code: exitAPI, err: err}
+}
+
+// partialError is a scan that finished, but skipped part of what it should
+// have scanned, e.g. accounts of an organization.
+func partialError(err error) error {
+	return &exitError{code: exitPartial, err: err}
+}
+
+// outputError is a summary, stats or other output file that couldn't be
+// written.
+func outputError(err error) error {
+	return &exitError{code: exitOutput, err: err}
+}
+
+// exitCode is the exit code of the process when a command failed with err.
+func exitCode(err error) int {
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+
+	var exit *exitError
+	if errors.As(err, &exit) {
+		return exit.code
+	}
+	return exitFailure
+}
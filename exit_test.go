@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"testing"
+)
+
+// TestExitCode pins the exit codes the README documents, scripts and CI jobs
+// branch on them.
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, 0},
+		{"help", flag.ErrHelp, 0},
+		{"wrapped help", fmt.Errorf("parse: %w", flag.ErrHelp), 0},
+		{"other failure", errors.New("boom"), 1},
+		{"config", configError(errors.New("no region")), 2},
+		{"access denied", &exitError{code: exitAccessDenied, err: errors.New("denied")}, 3},
+		{"credentials expired", &exitError{code: exitCredentialsExpired, err: errors.New("expired")}, 4},
+		{"api", apiError(errors.New("throttled")), 5},
+		{"partial", partialError(errors.New("terminated")), 6},
+		{"output", outputError(errors.New("disk full")), 7},
+		{"unmapped", &exitError{code: exitUnmapped, err: errors.New("unmapped")}, 8},
+		{"circuit open", &exitError{code: exitCircuitOpen, err: errors.New("budget")}, 9},
+		{"interrupted", &exitError{code: exitInterrupted, err: errors.New("interrupted")}, 130},
+		{"wrapped", fmt.Errorf("scan: %w", outputError(errors.New("disk full"))), 7},
+		{"joined", errors.Join(errors.New("boom"), partialError(errors.New("terminated"))), 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
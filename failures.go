@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// failuresPath is where a scan records the events it failed on.
+const failuresPath = "failures.ndjson"
+
+// failureRecord is a line of failures.ndjson. It has the shape of a
+// LookupEvents Event, so reprocess and --stdin read it back like any other
+// event.
+type failureRecord struct {
+	EventId         string
+	EventName       string
+	EventSource     string
+	EventTime       *time.Time `json:",omitempty"`
+	CloudTrailEvent string
+	Error           string
+}
+
+// failureWriter appends the events the scan failed on to a file, which is
+// only created with the first failure. Once a write failed, e.g. because the
+// disk is full, the failures are only counted.
+type failureWriter struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	broken bool
+	stats  *scanStats
+}
+
+func newFailureWriter(path string, stats *scanStats) *failureWriter {
+	return &failureWriter{path: path, stats: stats}
+}
+
+func (w *failureWriter) record(event scan.RawEvent, err error) {
+	record := failureRecord{
+		EventId:         event.EventID,
+		EventName:       event.EventName,
+		EventSource:     event.EventSource,
+		CloudTrailEvent: event.Payload,
+		Error:           err.Error(),
+	}
+	if !event.EventTime.IsZero() {
+		record.EventTime = &event.EventTime
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		w.stats.addUnrecordedFailure()
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.broken {
+		w.stats.addUnrecordedFailure()
+		return
+	}
+
+	if w.file == nil {
+		w.file, err = os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	}
+	if err == nil {
+		_, err = w.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		slog.Error("Couldn't record failed event, only counting failures from now on", slog.String("path", w.path), slog.String("error", err.Error()))
+		w.broken = true
+		w.stats.addUnrecordedFailure()
+	}
+}
+
+func (w *failureWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file != nil {
+		w.file.Close()
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// eventFilter keeps the events of the given event names and event sources.
+// An empty list doesn't filter.
+type eventFilter struct {
+	names   []string
+	sources []string
+}
+
+func (f eventFilter) active() bool {
+	return len(f.names) > 0 || len(f.sources) > 0
+}
+
+func (f eventFilter) matches(eventName, eventSource string) bool {
+	if len(f.names) > 0 && !slices.Contains(f.names, eventName) {
+		return false
+	}
+
+	if len(f.sources) > 0 && !slices.Contains(f.sources, eventSource) {
+		return false
+	}
+
+	return true
+}
+
+// listFlag appends the comma separated values of a repeatable flag to list.
+func listFlag(list *[]string) func(string) error {
+	return func(value string) error {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*list = append(*list, v)
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+)
+
+// healthState backs /healthz and /readyz of --serve and --metrics-addr, for
+// orchestrators to restart a scan that stopped or keeps failing. It is fed
+// the outcome of every AWS API call by its SDK middleware.
+type healthState struct {
+	// readyWindow is how long API calls may fail in a row before the scan
+	// isn't ready, 0 for never.
+	readyWindow time.Duration
+
+	mu           sync.Mutex
+	stopped      bool
+	lastSuccess  time.Time
+	failingSince time.Time
+	// credentialsErr is the last access denied or expired credentials error
+	// since the last successful call.
+	credentialsErr string
+}
+
+func newHealthState(readyWindow time.Duration) *healthState {
+	return &healthState{readyWindow: readyWindow}
+}
+
+// setStopped marks the workers as done, the summary is written next.
+func (h *healthState) setStopped() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stopped = true
+}
+
+// apiCall records the outcome of an API call, after its retries.
+func (h *healthState) apiCall(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if err == nil {
+		h.lastSuccess = now
+		h.failingSince = time.Time{}
+		h.credentialsErr = ""
+		return
+	}
+
+	if h.failingSince.IsZero() {
+		h.failingSince = now
+	}
+	if isAccessDenied(err) || isExpiredCredentials(err) {
+		h.credentialsErr = err.Error()
+	}
+}
+
+// healthy reports whether the workers are still running.
+func (h *healthState) healthy() (bool, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stopped {
+		return false, "the scan stopped"
+	}
+	return true, "ok"
+}
+
+// ready reports whether the credentials work and API calls didn't only fail
+// for the ready window. A scan that made no API call yet is ready.
+func (h *healthState) ready() (bool, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.credentialsErr != "" {
+		return false, "the credentials were rejected: " + h.credentialsErr
+	}
+	if h.readyWindow > 0 && !h.failingSince.IsZero() {
+		if failing := time.Since(h.failingSince); failing >= h.readyWindow {
+			last := "never"
+			if !h.lastSuccess.IsZero() {
+				last = h.lastSuccess.UTC().Format(time.RFC3339)
+			}
+			return false, fmt.Sprintf("API calls failed for %v, the last one succeeded %s", failing.Round(time.Second), last)
+		}
+	}
+	return true, "ok"
+}
+
+// register adds /healthz and /readyz to mux, answering 200 or 503 with the
+// reason.
+func (h *healthState) register(mux *http.ServeMux) {
+	handle := func(check func() (bool, string)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ok, reason := check()
+			if !ok {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			io.WriteString(w, reason+"\n")
+		}
+	}
+	mux.HandleFunc("GET /healthz", handle(h.healthy))
+	mux.HandleFunc("GET /readyz", handle(h.ready))
+}
+
+// middleware records the outcome of every API call of an SDK client. Calls
+// canceled by the scan don't count.
+func (h *healthState) middleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("HealthState", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		out, metadata, err := next.HandleInitialize(ctx, in)
+		if ctx.Err() == nil {
+			h.apiCall(err)
+		}
+		return out, metadata, err
+	}), middleware.After)
+}
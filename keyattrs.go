@@ -0,0 +1,106 @@
+package main
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/exp/maps"
+)
+
+// maxAttributeValues is how many distinct values of an attribute are kept
+// per key, there are a few hundred event sources.
+const maxAttributeValues = 100
+
+// Attributes of the events a key was seen in.
+const attributeEventSource = "eventSource"
+
+// keyAttributes collects the distinct values of secondary attributes of the
+// events every key was seen in, e.g. its event sources, to tell whether a
+// mapping of the key holds across services. The values of known keys count
+// too, every hit is added.
+type keyAttributes struct {
+	mu   sync.Mutex
+	keys map[string]map[string]map[string]struct{}
+}
+
+func newKeyAttributes() *keyAttributes {
+	return &keyAttributes{keys: make(map[string]map[string]map[string]struct{})}
+}
+
+// add is a scan.WithOnHit hook.
+func (k *keyAttributes) add(event scan.RawEvent, key, _ string) {
+	if event.EventSource == "" {
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.addValue(key, attributeEventSource, event.EventSource)
+}
+
+// restore adds the event sources of m, a match read back from a summary, e.g.
+// when resuming a scan.
+func (k *keyAttributes) restore(m scan.Match) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, source := range m.EventSources {
+		k.addValue(m.Key, attributeEventSource, source)
+	}
+}
+
+// addValue adds value to the values of attribute of key. The caller holds the
+// lock.
+func (k *keyAttributes) addValue(key, attribute, value string) {
+	attributes, ok := k.keys[key]
+	if !ok {
+		attributes = make(map[string]map[string]struct{})
+		k.keys[key] = attributes
+	}
+	values, ok := attributes[attribute]
+	if !ok {
+		values = make(map[string]struct{})
+		attributes[attribute] = values
+	}
+	if _, known := values[value]; known || len(values) >= maxAttributeValues {
+		return
+	}
+
+	values[value] = struct{}{}
+}
+
+// values returns the values of attribute of key, sorted.
+func (k *keyAttributes) values(key, attribute string) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	values := maps.Keys(k.keys[key][attribute])
+	slices.Sort(values)
+	return values
+}
+
+// len is the number of keys with attributes.
+func (k *keyAttributes) len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return len(k.keys)
+}
+
+// attributedStore hands the matches of its store over with the attributes
+// collected for their key, for the summaries to have them.
+type attributedStore struct {
+	scan.Store
+	attributes *keyAttributes
+}
+
+func (s attributedStore) Each(fn func(m scan.Match) error) error {
+	return s.Store.Each(func(m scan.Match) error {
+		if sources := s.attributes.values(m.Key, attributeEventSource); len(sources) > 0 {
+			m.EventSources = sources
+		}
+		return fn(m)
+	})
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// kinesisSource consumes CloudTrail events from a Kinesis data stream, either
+// as plain records or in the gzipped CloudWatch Logs subscription format. It
+// runs until ctx is canceled and checkpoints the position of every shard.
+type kinesisSource struct {
+	client      *kinesis.Client
+	stream      string
+	startTime   time.Time
+	concurrency int
+	stats       *scanStats
+
+	checkpointPath string
+	configHash     string
+
+	// positions is only touched by run's goroutine.
+	positions map[string]string
+}
+
+// kinesisBatch is the handled part of a single GetRecords call.
+type kinesisBatch struct {
+	shardID        string
+	sequenceNumber string
+	events         []scan.RawEvent
+}
+
+// cloudWatchLogsData is the payload a CloudWatch Logs subscription writes to
+// Kinesis, with one CloudTrail record per log event.
+type cloudWatchLogsData struct {
+	MessageType string `json:"messageType"`
+	LogEvents   []struct {
+		Message string `json:"message"`
+	} `json:"logEvents"`
+}
+
+func (k *kinesisSource) resume() error {
+	cp, err := loadCheckpoint(k.checkpointPath, k.configHash)
+	if err != nil {
+		return err
+	}
+
+	k.positions = cp.Shards
+	slog.Info("Resuming from checkpoint", slog.String("checkpoint", k.checkpointPath), slog.Int("shards", len(cp.Shards)))
+
+	return nil
+}
+
+func (k *kinesisSource) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	if k.positions == nil {
+		k.positions = make(map[string]string)
+	}
+
+	shards, err := k.listShards(ctx)
+	if err != nil {
+		slog.Error("Couldn't list Kinesis shards", slog.String("stream", k.stream), slog.String("error", err.Error()))
+		return stopFailed
+	}
+	slog.Info("Consuming events from Kinesis", slog.String("stream", k.stream), slog.Int("shards", len(shards)))
+
+	// Every reader owns an equal share of the shards and polls them in turn,
+	// so open shards can't starve each other when there are more shards than
+	// readers.
+	readers := min(k.concurrency, len(shards))
+	batches := make(chan kinesisBatch)
+
+	var wg sync.WaitGroup
+	for i := range readers {
+		var owned []string
+		for j := i; j < len(shards); j += readers {
+			owned = append(owned, shards[j])
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k.readShards(ctx, owned, batches)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(batches)
+	}()
+
+	for batch := range batches {
+		for _, event := range batch.events {
+			emit(event)
+		}
+		k.stats.addEvents(len(batch.events))
+
+		k.positions[batch.shardID] = batch.sequenceNumber
+		k.saveCheckpoint()
+	}
+
+	if ctx.Err() != nil {
+		return stopCanceled
+	}
+
+	return stopComplete
+}
+
+func (k *kinesisSource) listShards(ctx context.Context) ([]string, error) {
+	var shards []string
+
+	input := &kinesis.ListShardsInput{StreamName: &k.stream}
+	for {
+		out, err := k.client.ListShards(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, shard := range out.Shards {
+			shards = append(shards, deRef(shard.ShardId))
+		}
+
+		if out.NextToken == nil {
+			return shards, nil
+		}
+		input = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+}
+
+// readShards polls the given shards until ctx is canceled or all of them were
+// closed by resharding.
+func (k *kinesisSource) readShards(ctx context.Context, shards []string, batches chan<- kinesisBatch) {
+	iterators := make(map[string]*string, len(shards))
+	for _, shardID := range shards {
+		iterator, err := k.shardIterator(ctx, shardID)
+		if err != nil {
+			slog.Error("Couldn't get Kinesis shard iterator", slog.String("shard", shardID), slog.String("error", err.Error()))
+			continue
+		}
+		iterators[shardID] = iterator
+	}
+
+	for len(iterators) > 0 {
+		for _, shardID := range shards {
+			iterator, open := iterators[shardID]
+			if !open {
+				continue
+			}
+
+			out, err := k.client.GetRecords(ctx, &kinesis.GetRecordsInput{ShardIterator: iterator})
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.Warn("Couldn't get Kinesis records", slog.String("shard", shardID), slog.String("error", err.Error()))
+				countAPIError("kinesis", err)
+				continue
+			}
+			pagesFetched.WithLabelValues("kinesis", shardID).Inc()
+
+			if out.NextShardIterator == nil {
+				slog.Info("Kinesis shard closed", slog.String("shard", shardID))
+				delete(iterators, shardID)
+			} else {
+				iterators[shardID] = out.NextShardIterator
+			}
+
+			if len(out.Records) == 0 {
+				continue
+			}
+
+			batch := kinesisBatch{
+				shardID:        shardID,
+				sequenceNumber: deRef(out.Records[len(out.Records)-1].SequenceNumber),
+			}
+			for _, record := range out.Records {
+				events, err := decodeKinesisRecord(record.Data)
+				if err != nil {
+					slog.Warn("Skipping Kinesis record", slog.String("shard", shardID), slog.String("sequence-number", deRef(record.SequenceNumber)), slog.String("error", err.Error()))
+					k.stats.addInvalidLine()
+					continue
+				}
+				batch.events = append(batch.events, events...)
+			}
+
+			select {
+			case batches <- batch:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// GetRecords is limited to 5 calls per second per shard.
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (k *kinesisSource) shardIterator(ctx context.Context, shardID string) (*string, error) {
+	input := &kinesis.GetShardIteratorInput{StreamName: &k.stream, ShardId: &shardID}
+
+	switch seq, ok := k.positions[shardID]; {
+	case ok:
+		input.ShardIteratorType = kinesistypes.ShardIteratorTypeAfterSequenceNumber
+		input.StartingSequenceNumber = &seq
+	case !k.startTime.IsZero():
+		input.ShardIteratorType = kinesistypes.ShardIteratorTypeAtTimestamp
+		input.Timestamp = &k.startTime
+	default:
+		input.ShardIteratorType = kinesistypes.ShardIteratorTypeTrimHorizon
+	}
+
+	out, err := k.client.GetShardIterator(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	return out.ShardIterator, nil
+}
+
+func (k *kinesisSource) saveCheckpoint() {
+	if k.checkpointPath == "" {
+		return
+	}
+
+	cp := checkpoint{Shards: k.positions, ConfigHash: k.configHash}
+	if err := writeCheckpoint(k.checkpointPath, cp); err != nil {
+		slog.Error("Couldn't write checkpoint", slog.String("error", err.Error()))
+	}
+}
+
+// decodeKinesisRecord accepts a CloudTrail record or EventBridge event, and
+// the gzipped CloudWatch Logs subscription format. Producers that base64
+// encode the payload themselves are supported too.
+func decodeKinesisRecord(data []byte) ([]scan.RawEvent, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] != '{' && data[0] != 0x1f {
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return nil, errors.New("record is neither json, gzip nor base64")
+		}
+		data = decoded
+	}
+
+	if len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		data, err = io.ReadAll(gz)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var logs cloudWatchLogsData
+	if err := json.Unmarshal(data, &logs); err != nil {
+		return nil, err
+	}
+
+	if logs.MessageType == "" {
+		event, err := unwrapEventBridge(data)
+		if err != nil {
+			return nil, err
+		}
+		return []scan.RawEvent{event}, nil
+	}
+
+	// CloudWatch Logs sends a CONTROL_MESSAGE to check the destination.
+	if logs.MessageType != "DATA_MESSAGE" {
+		return nil, nil
+	}
+
+	events := make([]scan.RawEvent, 0, len(logs.LogEvents))
+	for _, logEvent := range logs.LogEvents {
+		event, err := unwrapEventBridge([]byte(logEvent.Message))
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
+	"github.com/aws/smithy-go"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// lakeSource queries a CloudTrail Lake event data store, which holds far more
+// history than LookupEvents serves.
+type lakeSource struct {
+	client         *cloudtrail.Client
+	eventDataStore string
+	window         timeWindow
+	pollInterval   time.Duration
+	stats          *scanStats
+}
+
+// lakeColumns are the event fields selected from the event data store. Nested
+// columns are selected as json so the event can be rebuilt from the rows.
+var lakeColumns = []struct {
+	name   string
+	nested bool
+}{
+	{name: "eventID"},
+	{name: "eventName"},
+	{name: "eventTime"},
+	{name: "eventSource"},
+	{name: "awsRegion"},
+	{name: "recipientAccountId"},
+	{name: "userIdentity", nested: true},
+	{name: "requestParameters", nested: true},
+	{name: "responseElements", nested: true},
+	{name: "additionalEventData", nested: true},
+	{name: "resources", nested: true},
+}
+
+func (l *lakeSource) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	query := buildLakeQuery(l.eventDataStore, l.window)
+	slog.Info("Starting CloudTrail Lake query", slog.String("query", query))
+
+	started, err := l.client.StartQuery(ctx, &cloudtrail.StartQueryInput{QueryStatement: &query})
+	if err != nil {
+		slog.Error("Couldn't start CloudTrail Lake query", slog.String("error", err.Error()))
+		return stopFailed
+	}
+	queryID := deRef(started.QueryId)
+
+	if err := l.waitForQuery(ctx, queryID); err != nil {
+		if ctx.Err() != nil {
+			l.cancelQuery(queryID)
+			return stopCanceled
+		}
+
+		slog.Error("CloudTrail Lake query failed", slog.String("query-id", queryID), slog.String("error", err.Error()))
+		return stopFailed
+	}
+
+	input := &cloudtrail.GetQueryResultsInput{QueryId: &queryID}
+	for {
+		out, err := l.client.GetQueryResults(ctx, input)
+		if err != nil {
+			if ctx.Err() != nil {
+				return stopCanceled
+			}
+
+			slog.Error("Couldn't get CloudTrail Lake query results", slog.String("query-id", queryID), slog.String("error", err.Error()))
+			return stopFailed
+		}
+
+		for _, row := range out.QueryResultRows {
+			event, err := lakeRowToEvent(row)
+			if err != nil {
+				slog.Warn("Skipping CloudTrail Lake row", slog.String("error", err.Error()))
+				l.stats.addInvalidLine()
+				continue
+			}
+
+			emit(event)
+		}
+		l.stats.addEvents(len(out.QueryResultRows))
+
+		if out.NextToken == nil {
+			return stopComplete
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// waitForQuery polls the query status until it finished. Right after
+// StartQuery the query may not be visible yet, so a missing query is retried.
+func (l *lakeSource) waitForQuery(ctx context.Context, queryID string) error {
+	for notFound := 0; ; {
+		out, err := l.client.DescribeQuery(ctx, &cloudtrail.DescribeQueryInput{QueryId: &queryID})
+		if err != nil {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode() == "QueryIdNotFoundException" && notFound < 5 {
+				notFound++
+			} else {
+				return err
+			}
+		} else {
+			if stats := out.QueryStatistics; stats != nil {
+				l.stats.setLakeStatistics(deRef(stats.EventsScanned), deRef(stats.BytesScanned))
+			}
+
+			switch out.QueryStatus {
+			case types.QueryStatusFinished:
+				slog.Info("CloudTrail Lake query finished", slog.String("query-id", queryID))
+				return nil
+			case types.QueryStatusFailed, types.QueryStatusCancelled, types.QueryStatusTimedOut:
+				return fmt.Errorf("query %s: %s", strings.ToLower(string(out.QueryStatus)), deRef(out.ErrorMessage))
+			}
+
+			slog.Debug("Waiting for CloudTrail Lake query", slog.String("query-id", queryID), slog.String("status", string(out.QueryStatus)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.pollInterval):
+		}
+	}
+}
+
+func (l *lakeSource) cancelQuery(queryID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := l.client.CancelQuery(ctx, &cloudtrail.CancelQueryInput{QueryId: &queryID}); err != nil {
+		slog.Warn("Couldn't cancel CloudTrail Lake query", slog.String("query-id", queryID), slog.String("error", err.Error()))
+	}
+}
+
+// buildLakeQuery selects all events of the window. The event data store may be
+// given as ARN or id, the query needs the id.
+func buildLakeQuery(eventDataStore string, window timeWindow) string {
+	id := eventDataStore[strings.LastIndex(eventDataStore, "/")+1:]
+
+	columns := make([]string, 0, len(lakeColumns))
+	for _, col := range lakeColumns {
+		if col.nested {
+			columns = append(columns, fmt.Sprintf("json_format(CAST(%s AS JSON)) AS %s", col.name, col.name))
+		} else {
+			columns = append(columns, col.name)
+		}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), id)
+
+	var conditions []string
+	if !window.start.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("eventTime >= '%s'", window.start.UTC().Format(time.DateTime)))
+	}
+	if !window.end.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("eventTime <= '%s'", window.end.UTC().Format(time.DateTime)))
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	return query
+}
+
+// lakeRowToEvent rebuilds the event json from a result row, a list of single
+// column maps.
+func lakeRowToEvent(row []map[string]string) (scan.RawEvent, error) {
+	record := make(map[string]any, len(row))
+	for _, column := range row {
+		for name, value := range column {
+			record[name] = expandJSONStrings(value)
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return scan.RawEvent{}, err
+	}
+
+	event, _, err := recordToEvent(data)
+	return event, err
+}
+
+// expandJSONStrings decodes values holding json objects or arrays. Lake keeps
+// nested request parameters as json strings inside maps, so decoded values are
+// expanded recursively.
+func expandJSONStrings(value any) any {
+	switch v := value.(type) {
+	case string:
+		trimmed := strings.TrimSpace(v)
+		if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+			return v
+		}
+
+		var decoded any
+		if err := json.Unmarshal([]byte(trimmed), &decoded); err != nil {
+			return v
+		}
+		return expandJSONStrings(decoded)
+	case map[string]any:
+		for k, nested := range v {
+			v[k] = expandJSONStrings(nested)
+		}
+		return v
+	case []any:
+		for i, nested := range v {
+			v[i] = expandJSONStrings(nested)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,226 @@
+//go:build lambda
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/time/rate"
+)
+
+// lambdaDeadlineMargin is kept free at the end of an invocation to save the
+// checkpoint and the summary.
+const lambdaDeadlineMargin = 30 * time.Second
+
+// lambdaRequest is the invocation payload.
+type lambdaRequest struct {
+	Region    string    `json:"region"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+
+	// Output is where summary.csv, stats.json and, until the window was
+	// scanned completely, checkpoint.json are kept, e.g. s3://bucket/scan/.
+	Output string `json:"output"`
+}
+
+func init() {
+	lambdaMain = func() { lambda.Start(handleLambda) }
+}
+
+// handleLambda scans LookupEvents until the invocation is about to time out.
+// The checkpoint and the summary so far live in S3, so every invocation of a
+// scheduled chain continues where the previous one stopped.
+func handleLambda(ctx context.Context, req lambdaRequest) (*scanStats, error) {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	u, err := url.Parse(req.Output)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid output %q, expected s3://bucket/prefix/", req.Output)
+	}
+	bucket, prefix := u.Host, strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	// Only /tmp is writable in Lambda.
+	if err := os.Chdir(os.TempDir()); err != nil {
+		return nil, err
+	}
+
+	if req.Region != "" {
+		awsRegion = req.Region
+	}
+
+	sdkConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s3Client := s3.NewFromConfig(sdkConfig, func(o *s3.Options) {
+		o.Region = awsRegion
+	})
+
+	opts := options{window: timeWindow{start: req.StartTime, end: req.EndTime}}
+	const checkpointPath = "checkpoint.json"
+	os.Remove(checkpointPath)
+
+	resume, err := downloadObject(ctx, s3Client, bucket, prefix+checkpointPath, checkpointPath)
+	if err != nil {
+		return nil, fmt.Errorf("download checkpoint: %w", err)
+	}
+
+	cache := scan.NewMemoryStore(10000)
+	if resume {
+		if err := loadSummary(ctx, s3Client, bucket, prefix+"summary.csv", cache); err != nil {
+			return nil, fmt.Errorf("load summary: %w", err)
+		}
+	}
+
+	stats := &scanStats{RunID: newRunID(), Build: readBuildInfo()}
+	prog := &progress{}
+
+	window, err := lookupWindow(opts, stats)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := &scanner{
+		client: cloudtrail.NewFromConfig(sdkConfig, func(o *cloudtrail.Options) {
+			o.Region = awsRegion
+		}),
+		credentials:    sdkConfig.Credentials,
+		limiter:        rate.NewLimiter(rate.Limit(defaultRPS), 1),
+		clock:          scan.SystemClock,
+		stats:          stats,
+		progress:       prog,
+		budget:         newRetryBudget(defaultRetryBudget, defaultMaxConsecutiveFailures),
+		callTimeout:    30 * time.Second,
+		window:         window,
+		cache:          cache,
+		checkpointPath: checkpointPath,
+		configHash:     opts.scanHash(),
+	}
+	if resume {
+		if err := lookup.resume(); err != nil {
+			return nil, err
+		}
+	}
+
+	scanCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		scanCtx, cancel = context.WithDeadline(ctx, deadline.Add(-lambdaDeadlineMargin))
+		defer cancel()
+	}
+
+	var reason stopReason
+	sc, err := scan.New(
+		scan.WithStore(cache),
+		scan.WithSource(scan.SourceFunc(func(ctx context.Context, emit func(scan.RawEvent)) error {
+			reason = lookup.run(ctx, emit)
+			return nil
+		})),
+		scan.WithEventWrapper(func(event scan.RawEvent, handle func()) {
+			observeEvent(ctx, event, handle)
+			prog.events.Add(1)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	scanned, _ := sc.Run(scanCtx)
+	stats.addScan(scanned)
+	stats.setStopReason(reason)
+	stats.setRetryBudget(lookup.budget.stats())
+
+	if reason == stopAccessDenied {
+		return stats, errors.New("not allowed to call cloudtrail:LookupEvents")
+	}
+
+	if err := writeSummaries(ctx, cache, []scan.SummaryWriter{&csvSummaryWriter{path: "summary.csv"}}); err != nil {
+		return stats, fmt.Errorf("write summary: %w", err)
+	}
+	if err := writeStats(stats); err != nil {
+		return stats, err
+	}
+
+	uploads := []string{"summary.csv", "stats.json"}
+	if reason == stopComplete {
+		if _, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &bucket, Key: ptr(prefix + checkpointPath)}); err != nil {
+			return stats, fmt.Errorf("delete checkpoint: %w", err)
+		}
+	} else if _, err := os.Stat(checkpointPath); err == nil {
+		uploads = append(uploads, checkpointPath)
+	}
+
+	for _, name := range uploads {
+		if err := uploadFile(ctx, s3Client, bucket, prefix+name, name); err != nil {
+			return stats, fmt.Errorf("upload %s: %w", name, err)
+		}
+	}
+
+	slog.Info("Invocation done", slog.String("stop-reason", string(reason)), slog.Int("keys", cache.Len()))
+
+	return stats, nil
+}
+
+// downloadObject copies an object to path and reports whether it existed.
+func downloadObject(ctx context.Context, client *s3.Client, bucket, key, path string) (bool, error) {
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	var noSuchKey *s3types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return false, err
+	}
+
+	return true, writeFileAtomic(path, data, 0o600)
+}
+
+func uploadFile(ctx context.Context, client *s3.Client, bucket, key, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{Bucket: &bucket, Key: &key, Body: file})
+	return err
+}
+
+// loadSummary adds the rows of the summary written by previous invocations
+// to cache.
+func loadSummary(ctx context.Context, client *s3.Client, bucket, key string, cache scan.Store) error {
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	var noSuchKey *s3types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	return readSummaryCSV(out.Body, scan.NewRegistry(scan.DefaultMatchers()...), cache, 0)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// fanoutHandler sends each record to several handlers, e.g. the JSON of
+// logs.ndjson and the console.
+type fanoutHandler []slog.Handler
+
+func (f fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(fanoutHandler, len(f))
+	for i, h := range f {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (f fanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := make(fanoutHandler, len(f))
+	for i, h := range f {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// consoleHandler writes a record as one short line for a human reading the
+// console: the time, the level and the message followed by the attributes.
+// Matches read as "key → value (eventName)".
+type consoleHandler struct {
+	mu    *sync.Mutex
+	out   io.Writer
+	color bool
+
+	// attrs were added with WithAttrs, already rendered, group is the prefix
+	// of the keys of the following ones.
+	attrs string
+	group string
+}
+
+func newConsoleHandler(out io.Writer, color bool) *consoleHandler {
+	return &consoleHandler{mu: &sync.Mutex{}, out: out, color: color}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	buf.WriteString(r.Time.Format(time.TimeOnly))
+	buf.WriteByte(' ')
+	buf.WriteString(h.level(r.Level))
+	buf.WriteByte(' ')
+	buf.WriteString(r.Message)
+
+	if strings.HasPrefix(r.Message, "Has ") {
+		// The ids are only in logs.ndjson, the console line stays short.
+		var key, value, action string
+		r.Attrs(func(a slog.Attr) bool {
+			switch a.Key {
+			case "key":
+				key = a.Value.String()
+			case "value":
+				value = a.Value.String()
+			case "action":
+				action = a.Value.String()
+			}
+			return true
+		})
+		fmt.Fprintf(&buf, ": %s → %s", key, value)
+		if action != "" {
+			fmt.Fprintf(&buf, " (%s)", action)
+		}
+	} else {
+		buf.WriteString(h.attrs)
+		r.Attrs(func(a slog.Attr) bool {
+			appendAttr(&buf, h.group, a)
+			return true
+		})
+	}
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.out.Write(buf.Bytes())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	for _, a := range attrs {
+		appendAttr(&buf, h.group, a)
+	}
+
+	c := *h
+	c.attrs += buf.String()
+	return &c
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	c := *h
+	c.group += name + "."
+	return &c
+}
+
+// level is the level of a line, colored on a terminal.
+func (h *consoleHandler) level(level slog.Level) string {
+	text := fmt.Sprintf("%-5s", level.String())
+	if !h.color {
+		return text
+	}
+
+	switch {
+	case level >= slog.LevelError:
+		return "\x1b[31m" + text + "\x1b[0m"
+	case level >= slog.LevelWarn:
+		return "\x1b[33m" + text + "\x1b[0m"
+	case level >= slog.LevelInfo:
+		return "\x1b[32m" + text + "\x1b[0m"
+	default:
+		return "\x1b[90m" + text + "\x1b[0m"
+	}
+}
+
+// appendAttr writes a as key=value, a group as its attributes with the
+// group's name as prefix, like slog's text handler does.
+func appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(buf, prefix, ga)
+		}
+		return
+	}
+
+	var value string
+	switch a.Value.Kind() {
+	case slog.KindTime:
+		value = a.Value.Time().Format(time.RFC3339)
+	default:
+		value = a.Value.String()
+	}
+	if value == "" || strings.ContainsFunc(value, func(r rune) bool { return unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) }) {
+		value = strconv.Quote(value)
+	}
+
+	buf.WriteByte(' ')
+	buf.WriteString(prefix)
+	buf.WriteString(a.Key)
+	buf.WriteByte('=')
+	buf.WriteString(value)
+}
+
+// A scan logs every Warn and Error line logSampleFirst times, then rolls the
+// repeated ones up every logSampleInterval.
+const (
+	logSampleFirst    = 10
+	logSampleInterval = time.Minute
+)
+
+// samplingHandler logs the first few Warn and Error records of every message
+// and error, then only a "Repeated log line" record with their count every
+// interval, so an event shape failing thousands of times doesn't flood the
+// logs. The counts of the records left out are kept for stats.json.
+type samplingHandler struct {
+	inner slog.Handler
+	s     *logSampler
+}
+
+// logSampler is the state shared by a samplingHandler and the handlers
+// derived from it with WithAttrs and WithGroup.
+type logSampler struct {
+	first    int
+	interval time.Duration
+	// base gets the rollups of flush, which aren't logged through a handler.
+	base slog.Handler
+
+	mu    sync.Mutex
+	lines map[string]*sampledLine
+}
+
+type sampledLine struct {
+	level   slog.Level
+	message string
+	err     string
+
+	count int
+	// pending were left out since the last rollup, dropped in total.
+	pending    int
+	dropped    int
+	lastRollup time.Time
+}
+
+func newSamplingHandler(inner slog.Handler, first int, interval time.Duration) *samplingHandler {
+	return &samplingHandler{
+		inner: inner,
+		s: &logSampler{
+			first:    first,
+			interval: interval,
+			base:     inner,
+			lines:    make(map[string]*sampledLine),
+		},
+	}
+}
+
+func (h *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.inner.Handle(ctx, r)
+	}
+
+	var errText string
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "error" {
+			errText = a.Value.String()
+			return false
+		}
+		return true
+	})
+
+	h.s.mu.Lock()
+	key := r.Message + "\x00" + errText
+	line, ok := h.s.lines[key]
+	if !ok {
+		line = &sampledLine{level: r.Level, message: r.Message, err: errText, lastRollup: r.Time}
+		h.s.lines[key] = line
+	}
+	line.count++
+	if line.count <= h.s.first {
+		h.s.mu.Unlock()
+		return h.inner.Handle(ctx, r)
+	}
+
+	line.pending++
+	line.dropped++
+	var rollup slog.Record
+	if r.Time.Sub(line.lastRollup) >= h.s.interval {
+		rollup = line.rollup(r.Time)
+	}
+	h.s.mu.Unlock()
+
+	if rollup.Message == "" {
+		return nil
+	}
+	return h.inner.Handle(ctx, rollup)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{inner: h.inner.WithAttrs(attrs), s: h.s}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{inner: h.inner.WithGroup(name), s: h.s}
+}
+
+// rollup is the record of the lines left out since the last one. The caller
+// holds the lock.
+func (l *sampledLine) rollup(now time.Time) slog.Record {
+	r := slog.NewRecord(now, l.level, "Repeated log line", 0)
+	r.AddAttrs(
+		slog.String("repeated-msg", l.message),
+		slog.Int("repeated", l.pending),
+		slog.Int("total", l.count),
+	)
+	if l.err != "" {
+		r.AddAttrs(slog.String("error", l.err))
+	}
+
+	l.pending = 0
+	l.lastRollup = now
+	return r
+}
+
+// flush logs the rollups still pending, e.g. once the scan finished.
+func (h *samplingHandler) flush() {
+	h.s.mu.Lock()
+	var rollups []slog.Record
+	for _, line := range h.s.lines {
+		if line.pending > 0 {
+			rollups = append(rollups, line.rollup(time.Now()))
+		}
+	}
+	h.s.mu.Unlock()
+
+	for _, r := range rollups {
+		if h.s.base.Enabled(context.Background(), r.Level) {
+			_ = h.s.base.Handle(context.Background(), r)
+		}
+	}
+}
+
+// dropped counts the records left out per message, or message and error as
+// "message: error".
+func (h *samplingHandler) dropped() map[string]int {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	var dropped map[string]int
+	for _, line := range h.s.lines {
+		if line.dropped == 0 {
+			continue
+		}
+		if dropped == nil {
+			dropped = make(map[string]int)
+		}
+		key := line.message
+		if line.err != "" {
+			key += ": " + line.err
+		}
+		dropped[key] = line.dropped
+	}
+	return dropped
+}
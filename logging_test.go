@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// loggedLines decodes the lines of a slog JSON handler, without their time.
+func loggedLines(t *testing.T, out *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var lines []map[string]any
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		delete(line, "time")
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// TestSamplingHandler logs the first records of a message and error, then a
+// rollup once per interval and the rest on flush.
+func TestSamplingHandler(t *testing.T) {
+	var out bytes.Buffer
+	h := newSamplingHandler(slog.NewJSONHandler(&out, nil), 3, time.Minute)
+
+	start := time.Date(2024, 7, 1, 12, 30, 0, 0, time.UTC)
+	log := func(level slog.Level, at time.Duration, msg, err string) {
+		r := slog.NewRecord(start.Add(at), level, msg, 0)
+		if err != "" {
+			r.AddAttrs(slog.String("error", err))
+		}
+		if err := h.Handle(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One every 10 seconds, the rollup comes with the one a minute after the
+	// first.
+	for i := 0; i < 10; i++ {
+		log(slog.LevelError, time.Duration(i)*10*time.Second, "Failed", "boom")
+	}
+	// Another error, another level and Info aren't counted with them.
+	for i := 0; i < 4; i++ {
+		log(slog.LevelError, 0, "Failed", "bang")
+		log(slog.LevelWarn, 0, "Slow", "")
+		log(slog.LevelInfo, 0, "Page", "")
+	}
+
+	want := []map[string]any{
+		{"level": "ERROR", "msg": "Failed", "error": "boom"},
+		{"level": "ERROR", "msg": "Failed", "error": "boom"},
+		{"level": "ERROR", "msg": "Failed", "error": "boom"},
+		{"level": "ERROR", "msg": "Repeated log line", "repeated-msg": "Failed", "repeated": 4.0, "total": 7.0, "error": "boom"},
+	}
+	for i := 0; i < 4; i++ {
+		if i < 3 {
+			want = append(want,
+				map[string]any{"level": "ERROR", "msg": "Failed", "error": "bang"},
+				map[string]any{"level": "WARN", "msg": "Slow"},
+			)
+		}
+		want = append(want, map[string]any{"level": "INFO", "msg": "Page"})
+	}
+	if got := loggedLines(t, &out); !reflect.DeepEqual(got, want) {
+		t.Errorf("logged\n%v\nwant\n%v", got, want)
+	}
+
+	h.flush()
+	got := make(map[string]map[string]any)
+	for _, line := range loggedLines(t, &out) {
+		msg, _ := line["repeated-msg"].(string)
+		err, _ := line["error"].(string)
+		got[msg+" "+err] = line
+	}
+	wantFlushed := map[string]map[string]any{
+		"Failed boom": {"level": "ERROR", "msg": "Repeated log line", "repeated-msg": "Failed", "repeated": 3.0, "total": 10.0, "error": "boom"},
+		"Failed bang": {"level": "ERROR", "msg": "Repeated log line", "repeated-msg": "Failed", "repeated": 1.0, "total": 4.0, "error": "bang"},
+		"Slow ":       {"level": "WARN", "msg": "Repeated log line", "repeated-msg": "Slow", "repeated": 1.0, "total": 4.0},
+	}
+	if !reflect.DeepEqual(got, wantFlushed) {
+		t.Errorf("flushed\n%v\nwant\n%v", got, wantFlushed)
+	}
+
+	wantDropped := map[string]int{"Failed: boom": 7, "Failed: bang": 1, "Slow": 1}
+	if dropped := h.dropped(); !reflect.DeepEqual(dropped, wantDropped) {
+		t.Errorf("dropped %v, want %v", dropped, wantDropped)
+	}
+}
+
+// TestSamplingHandlerDerived counts the records of the handlers derived with
+// WithAttrs and WithGroup with the ones of their parent, and keeps their
+// attributes and groups.
+func TestSamplingHandlerDerived(t *testing.T) {
+	var out bytes.Buffer
+	h := newSamplingHandler(slog.NewJSONHandler(&out, nil), 3, time.Hour)
+	logger := slog.New(h)
+	worker := logger.With(slog.Int("worker", 1))
+	event := worker.WithGroup("event")
+
+	logger.Error("Failed", slog.String("error", "boom"))
+	worker.Error("Failed", slog.String("error", "boom"))
+	event.Error("Failed", slog.String("error", "boom"))
+	event.Error("Failed", slog.String("error", "boom"))
+	worker.Error("Failed", slog.String("error", "boom"))
+
+	want := []map[string]any{
+		{"level": "ERROR", "msg": "Failed", "error": "boom"},
+		{"level": "ERROR", "msg": "Failed", "worker": 1.0, "error": "boom"},
+		{"level": "ERROR", "msg": "Failed", "worker": 1.0, "event": map[string]any{"error": "boom"}},
+	}
+	if got := loggedLines(t, &out); !reflect.DeepEqual(got, want) {
+		t.Errorf("logged\n%v\nwant\n%v", got, want)
+	}
+	if dropped := h.dropped(); dropped["Failed: boom"] != 2 {
+		t.Errorf("dropped %v, want 2 Failed: boom", dropped)
+	}
+
+	if !event.Enabled(context.Background(), slog.LevelInfo) || event.Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("the derived handlers don't have the level of the inner one")
+	}
+}
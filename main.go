@@ -2,194 +2,1043 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"os/signal"
-	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/athena"
 	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
 	"github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
-	"github.com/jeremywohl/flatten"
-	"golang.org/x/exp/maps"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 )
 
 var (
-	resourcePattern  *regexp.Regexp = regexp.MustCompile(`^[a-zA-Z]+-([a-zA-Z0-9]{17}|[a-zA-Z0-9]{8})$`)
-	jsonArrayPattern *regexp.Regexp = regexp.MustCompile(`\.[0-9]+`)
-
 	awsRegion = "eu-west-1"
 )
 
+// lambdaMain is only set in builds with the lambda tag, see lambda.go.
+var lambdaMain func()
+
 func main() {
-	file, err := os.OpenFile("logs.ndjson", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
-	if err != nil {
-		slog.Error("Couldn't open log file", slog.String("error", err.Error()))
+	if lambdaMain != nil {
+		lambdaMain()
 		return
 	}
-	defer file.Close()
 
-	slog.SetDefault(slog.New(slog.NewJSONHandler(io.MultiWriter(file, os.Stdout), nil)))
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// runScan is the scan command, also run by a bare invocation.
+func runScan(args []string) int {
+	opts, err := parseOptions(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	if err != nil {
+		slog.Error("Invalid arguments", slog.String("error", err.Error()))
+		return exitConfig
+	}
+
+	// In machine mode stdout only carries the findings, every log line goes
+	// to stderr as JSON and nothing is written to files.
+	var logs *samplingHandler
+	var bar *progressBar
+	if opts.machine {
+		logs = newSamplingHandler(slog.NewJSONHandler(os.Stderr, nil), logSampleFirst, logSampleInterval)
+	} else {
+		file, err := os.OpenFile("logs.ndjson", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			slog.Error("Couldn't open log file", slog.String("error", err.Error()))
+			return exitOutput
+		}
+		defer file.Close()
+
+		// On a terminal stdout shows the progress line, the console logs go to
+		// stderr around it. The terminal UI takes the whole terminal, the logs
+		// then only go to the file.
+		var console io.Writer = os.Stdout
+		color := isTerminal(os.Stdout)
+		if opts.tui {
+			if !isTerminal(os.Stdout) {
+				slog.Error("Invalid arguments", slog.String("error", "--tui needs stdout to be a terminal"))
+				return exitConfig
+			}
+			console = io.Discard
+		} else if !opts.noProgress && isTerminal(os.Stdout) {
+			bar = newProgressBar(os.Stdout)
+			defer bar.finish()
+			console = bar.logWriter(os.Stderr)
+			color = isTerminal(os.Stderr)
+		}
+
+		consoleHandler := slog.Handler(newConsoleHandler(console, color))
+		if opts.consoleFormat == "json" {
+			consoleHandler = slog.NewJSONHandler(console, nil)
+		}
+		logs = newSamplingHandler(fanoutHandler{slog.NewJSONHandler(file, nil), consoleHandler}, logSampleFirst, logSampleInterval)
+	}
+	slog.SetDefault(slog.New(logs))
 	slog.SetLogLoggerLevel(slog.LevelDebug)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	if opts.estimate {
+		if err := runEstimate(opts); err != nil {
+			code := exitCode(err)
+			slog.Error("Estimate failed", slog.String("error", err.Error()), slog.Int("exit-code", code))
+			return code
+		}
+		return exitOK
+	}
 
-	sdkConfig, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		slog.Error("Couldn't load default configuration. Have you set up your AWS account?", slog.String("error", err.Error()))
-		return
+	if err := confirmUnbounded(opts); err != nil {
+		slog.Error("Scan aborted", slog.String("error", err.Error()))
+		return exitCode(err)
 	}
 
-	cache := make(map[string][]string, 10000)
-	eventsCh := make(chan types.Event)
-	go startWorker(ctx, eventsCh, cache)
+	if err := run(opts, bar, logs); err != nil {
+		code := exitCode(err)
+		slog.Error("Scan failed", slog.String("error", err.Error()), slog.Int("exit-code", code))
+		return code
+	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for range c {
-			writeUpSummary(cache)
-			os.Exit(0)
+	return exitOK
+}
+
+// run scans with opts. The kind of failure its error is decides the exit
+// code, see exitCode.
+func run(opts options, bar *progressBar, logs *samplingHandler) (err error) {
+	slog.Info("Starting scan", slog.Any("options", opts))
+	start := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if opts.pprofAddr != "" {
+		if err := startPprof(ctx, opts.pprofAddr); err != nil {
+			return configError(fmt.Errorf("start pprof server: %w", err))
 		}
-	}()
+	}
 
-	trailClient := cloudtrail.NewFromConfig(sdkConfig, func(o *cloudtrail.Options) {
-		o.Region = awsRegion
-	})
+	var mapped mappings
+	if opts.mappingsPath != "" {
+		var err error
+		if mapped, err = loadMappings(opts.mappingsPath); err != nil {
+			return configError(fmt.Errorf("read mappings %s: %w", opts.mappingsPath, err))
+		}
+	}
 
-	input := &cloudtrail.LookupEventsInput{}
+	var rules *conceptRules
+	if opts.reportConcepts {
+		rules = defaultConceptRules()
+		if opts.conceptRulesPath != "" {
+			var err error
+			if rules, err = loadConceptRules(opts.conceptRulesPath); err != nil {
+				return configError(fmt.Errorf("read concept rules %s: %w", opts.conceptRulesPath, err))
+			}
+		}
+	}
 
-	retry := 0
+	stats := &scanStats{RunID: newRunID(), Build: readBuildInfo()}
+	var cache scan.Store = scan.NewMemoryStore(10000)
+	if opts.lowMemory {
+		matches, err := newStreamingStore("matches.ndjson", opts.bloomKeys, opts.bloomFPRate)
+		if err != nil {
+			return outputError(fmt.Errorf("open matches file: %w", err))
+		}
+		defer matches.close()
 
-	for {
-		slog.Info("Looking up events", slog.String("next-token", deRef(input.NextToken)))
+		cache = matches
+	}
+
+	var capped *cappedStore
+	if opts.maxKeys > 0 || opts.memLimitSoft > 0 {
+		capped = newCappedStore(cache, opts.maxKeys, stats)
+		cache = capped
+	}
+	mem := newMemoryMonitor(opts.memLimitSoft, capped)
+	mem.track("cache-keys", cache.Len)
 
-		out, err := trailClient.LookupEvents(ctx, input)
+	if opts.otelEndpoint != "" {
+		shutdown, err := setupTracing(ctx, opts.otelEndpoint)
 		if err != nil {
-			slog.Error("Couldn't Lookup cloudtrail events", slog.String("error", err.Error()))
-			if retry < 3 {
-				retry++
-				slog.Warn("Retrying request", slog.String("req-token", deRef(input.NextToken)))
-				time.Sleep(time.Duration(100^(retry+1)) * time.Millisecond)
-				continue
-			} else {
-				break
+			return configError(fmt.Errorf("set up tracing: %w", err))
+		}
+
+		// Runs after cancel, so the spans of an interrupted scan are sent too.
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(shutdownCtx); err != nil {
+				slog.Error("Couldn't flush traces", slog.String("error", err.Error()))
 			}
+		}()
+	}
+
+	health := newHealthState(opts.readyWindow)
+	if opts.metricsAddr != "" {
+		if err := startMetrics(ctx, opts.metricsAddr, cache, health); err != nil {
+			return configError(fmt.Errorf("start metrics server: %w", err))
 		}
+	}
 
-		for _, evt := range out.Events {
-			eventsCh <- evt
+	if opts.serveAddr != "" {
+		stopServer, err := startServer(opts.serveAddr, cache, stats, health)
+		if err != nil {
+			return configError(fmt.Errorf("start server: %w", err))
 		}
 
-		if out.NextToken == nil {
-			break
+		// Deferred, so the findings can be fetched until the summary was
+		// written.
+		defer stopServer()
+	}
+
+	prog := &progress{}
+
+	scanOpts := []scan.Option{
+		scan.WithStore(cache),
+		scan.WithMatchers(scanMatchers(opts.patterns)...),
+		scan.WithMaxEventSize(opts.maxEventSize),
+	}
+	if opts.skipKnownActions {
+		scanOpts = append(scanOpts, scan.WithSkipKnownActions(opts.knownActionWindow))
+	}
+	if opts.bestExamples {
+		scanOpts = append(scanOpts, scan.WithBestExamples())
+	}
+	if !opts.logMatches {
+		scanOpts = append(scanOpts, scan.WithoutMatchLogs())
+	}
+	// The sources that can filter do so first, e.g. S3 Select, the scan then
+	// drops the events of other sources that are left.
+	if len(opts.filter.sources) > 0 {
+		scanOpts = append(scanOpts, scan.WithEventSources(opts.filter.sources...))
+	}
+	if len(opts.accountIDs) > 0 {
+		scanOpts = append(scanOpts, scan.WithAccounts(opts.accountIDs...))
+	}
+
+	// Every event counts towards actions.csv and sources.csv, also those
+	// without a match. With --low-memory the distinct keys of every action
+	// and the pairs of keys, which grow with the keys, aren't kept.
+	var actions *actionStats
+	var pairs *coOccurrence
+	if !opts.machine {
+		actions = newActionStats(!opts.lowMemory)
+		scanOpts = append(scanOpts, scan.WithOnEvent(actions.addEvent))
+		if !opts.lowMemory {
+			scanOpts = append(scanOpts, scan.WithOnHit(actions.addHit))
 		}
+		mem.track("action-names", actions.len)
 
-		input.NextToken = out.NextToken
-		retry = 0
+		// Pairs of keys holding the same value within an event.
+		if !opts.lowMemory {
+			pairs = newCoOccurrence(opts.maxPairs, stats)
+			scanOpts = append(scanOpts, scan.WithOnEventHits(pairs.addEvent))
+			mem.track("co-occurrence-pairs", pairs.len)
+		}
 	}
 
-	cancel()
+	var graph *dotGraph
+	if opts.emitDOT != "" {
+		graph = newDOTGraph()
+		scanOpts = append(scanOpts, scan.WithOnHit(graph.add))
+		mem.track("graph-edges", graph.len)
+	}
 
-	writeUpSummary(cache)
-}
+	var schema *athenaSchema
+	if opts.emitAthenaDDL != "" {
+		schema = newAthenaSchema()
+		scanOpts = append(scanOpts, scan.WithOnHit(schema.add))
+	}
 
-func writeUpSummary(cache map[string][]string) {
-	file, err := os.OpenFile("summary.csv", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
-	if err != nil {
-		slog.Error("Couldn't open summary file", slog.String("error", err.Error()))
-		return
+	var examples *exampleWriter
+	if opts.saveExamples != "" {
+		// The file is only created with the first new key, the one of a
+		// previous run must not be taken for this run's.
+		if err := os.Remove(opts.saveExamples); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return outputError(fmt.Errorf("remove previous examples file: %w", err))
+		}
+		examples = newExampleWriter(opts.saveExamples, opts.examplesMaxEvent, opts.examplesMaxSize, opts.redactExamples)
+		scanOpts = append(scanOpts, scan.WithOnNewKey(examples.add))
 	}
-	defer file.Close()
 
-	wr := csv.NewWriter(file)
-	if err := wr.Write([]string{"key", "value", "eventAction", "eventExampleId"}); err != nil {
-		slog.Error("Couldn't write csv header", slog.String("error", err.Error()))
-		return
+	var concepts *conceptReport
+	if rules != nil {
+		concepts = newConceptReport()
+		scanOpts = append(scanOpts, scan.WithOnHit(concepts.add))
 	}
 
-	if err := wr.WriteAll(maps.Values(cache)); err != nil {
-		slog.Error("Couldn't write all files to csv", slog.String("error", err.Error()))
-		return
+	// With --dedupe-by pair the summaries are written from pairs instead of
+	// the store of the scan.
+	summaryStore := scan.Store(cache)
+	if opts.dedupeBy == dedupeByPair {
+		byPair := newPairStore(scan.NewRegistry(scanMatchers(opts.patterns)...), opts.maxValuesPerKey, stats)
+		scanOpts = append(scanOpts, scan.WithOnHit(byPair.add))
+		mem.track("pair-values", byPair.Len)
+		summaryStore = byPair
 	}
 
-	wr.Flush()
-}
+	// The event sources of every key, also of the events of known keys. They
+	// grow with the keys, --low-memory leaves them out of the summaries.
+	var attributes *keyAttributes
+	if !opts.lowMemory {
+		attributes = newKeyAttributes()
+		scanOpts = append(scanOpts, scan.WithOnHit(attributes.add))
+		mem.track("key-attributes", attributes.len)
+	}
+	if opts.resume {
+		// The pair summary has every value of a key, the scan's store only
+		// one.
+		n, err := reloadSummary(opts.summaries, opts.checkpointPath, scan.NewRegistry(scanMatchers(opts.patterns)...), summaryStore)
+		if err != nil {
+			return configError(fmt.Errorf("reload the summary of the interrupted scan: %w", err))
+		}
+		if summaryStore != cache {
+			summaryStore.Each(func(m scan.Match) error {
+				cache.Add(m)
+				return nil
+			})
+		}
+		if attributes != nil {
+			summaryStore.Each(func(m scan.Match) error {
+				attributes.restore(m)
+				return nil
+			})
+		}
+		if n > 0 {
+			slog.Info("Reloaded the summary of the interrupted scan", slog.Int("matches", n))
+		}
+	}
+	if attributes != nil {
+		summaryStore = attributedStore{Store: summaryStore, attributes: attributes}
+	}
+
+	var regions *regionSplit
+	if opts.splitByRegion {
+		regions = newRegionSplit(scan.NewRegistry(scanMatchers(opts.patterns)...))
+		scanOpts = append(scanOpts, scan.WithOnHit(regions.add))
+		mem.track("region-keys", regions.len)
+	}
 
-func startWorker(ctx context.Context, eventsCh chan types.Event, cache map[string][]string) {
-	slog.Debug("Starting worker")
+	summaryPaths := make([]string, 0, len(opts.summaries))
+	for _, output := range opts.summaries {
+		summaryPaths = append(summaryPaths, output.path)
+	}
+	warnLeftoverTemps(append(summaryPaths, "stats.json", actionsPath, sourcesPath, coOccurrencePath, opts.checkpointPath, opts.emitDOT)...)
 
-	for {
-		select {
-		case <-ctx.Done():
-			slog.Debug("Stopping worker")
-			return
-		case event := <-eventsCh:
-			handleEvent(event, cache)
+	if !opts.machine {
+		// The failures file is only created on the first failure, the one of
+		// a previous run must not be taken for this run's.
+		if err := os.Remove(failuresPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return outputError(fmt.Errorf("remove previous failures file: %w", err))
 		}
+		failures := newFailureWriter(failuresPath, stats)
+		defer failures.close()
+		scanOpts = append(scanOpts, scan.WithOnFailure(failures.record))
 	}
-}
 
-func handleEvent(event types.Event, cache map[string][]string) {
-	flat, err := flatten.FlattenString(deRef(event.CloudTrailEvent), "", flatten.DotStyle)
-	if err != nil {
-		slog.Error("Failed to flatten json", slog.String("error", err.Error()), slog.String("event-id", deRef(event.EventId)))
-		return
+	// In machine mode the findings are streamed to stdout, unless a summary
+	// is written there.
+	if opts.machine && !slices.Contains(summaryPaths, "-") {
+		scanOpts = append(scanOpts, onMatch(newMatchStream(os.Stdout)))
 	}
 
-	fields := make(map[string]any, 200)
-	if err := json.Unmarshal([]byte(flat), &fields); err != nil {
-		slog.Error("Failed to unmarshall flat json", slog.String("error", err.Error()), slog.String("event-id", deRef(event.EventId)))
-		return
+	var sdkConfig aws.Config
+	if !opts.isLocalSource() || opts.esSigV4 || opts.dynamoDBTable != "" {
+		var err error
+		sdkConfig, err = config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return configError(fmt.Errorf("load default configuration, have you set up your AWS account? %w", err))
+		}
+
+		if opts.otelEndpoint != "" {
+			otelaws.AppendMiddlewares(&sdkConfig.APIOptions)
+		}
+		sdkConfig.APIOptions = append(sdkConfig.APIOptions, health.middleware)
 	}
 
-	for key, value := range fields {
-		switch castV := value.(type) {
-		case string:
-			findIndentifiers(event, key, castV, cache)
+	var exporter *esExporter
+	if opts.esExportURL != "" {
+		exporter = newESExporter(newESClient(opts.esExportURL, opts, sdkConfig), opts.esExportIndex, stats.RunID, stats)
+		if err := exporter.ensureIndex(ctx); err != nil {
+			return apiError(fmt.Errorf("create export index %s: %w", opts.esExportIndex, err))
 		}
+
+		go exporter.run()
+		scanOpts = append(scanOpts, onMatch(exporter.add))
 	}
-}
 
-func findIndentifiers(event types.Event, key, value string, cache map[string][]string) {
-	cleanKey := cleanKey(key)
+	var dynamoDB *dynamoDBWriter
+	if opts.dynamoDBTable != "" {
+		dynamoDB = newDynamoDBWriter(dynamodb.NewFromConfig(sdkConfig, func(o *dynamodb.Options) {
+			o.Region = awsRegion
+		}), opts.dynamoDBTable, stats)
 
-	if _, exists := cache[cleanKey]; exists {
-		return
+		if opts.dynamoDBCreateTable {
+			if err := dynamoDB.createTable(ctx); err != nil {
+				return apiError(fmt.Errorf("create DynamoDB table %s: %w", opts.dynamoDBTable, err))
+			}
+		}
+
+		dynamoDB.start()
+		scanOpts = append(scanOpts, onMatch(dynamoDB.add))
+	}
+
+	var webhook *webhookNotifier
+	if opts.webhookURL != "" {
+		webhook = newWebhookNotifier(opts.webhookURL, opts.webhookSecret, opts.webhookPerMinute, opts.callTimeout, stats)
+		go webhook.run()
+		scanOpts = append(scanOpts, onMatch(webhook.add))
+	}
+
+	var slack *slackNotifier
+	if opts.slackWebhook != "" {
+		slack = newSlackNotifier(opts.slackWebhook, opts.slackDiscoveries, opts.slackRedact, opts.callTimeout)
+		go slack.run()
+		scanOpts = append(scanOpts, onMatch(slack.add))
 	}
 
-	if strings.HasPrefix(value, "arn:") {
-		slog.Info("Has arn",
-			slog.String("key", cleanKey),
-			slog.String("value", value),
-			slog.String("action", deRef(event.EventName)),
-			slog.String("event-id", deRef(event.EventId)),
+	writers := make([]scan.SummaryWriter, 0, len(opts.summaries))
+	for _, output := range opts.summaries {
+		writers = append(writers, output.writer())
+	}
+
+	var ui *scanTUI
+	if opts.tui {
+		ui = newScanTUI(prog, stats, func() error {
+			return writeSummaries(context.Background(), summaryStore, writers)
+		}, cancel)
+		scanOpts = append(scanOpts, onMatch(ui.add))
+	}
+
+	var scanEvents func(context.Context, func(scan.RawEvent)) stopReason
+	// budget is only set for the LookupEvents sources.
+	var budget *retryBudget
+	if opts.source == "-" {
+		src := &readerSource{reader: os.Stdin, window: opts.window, stats: stats}
+		scanEvents = src.run
+	} else if opts.isLocalSource() {
+		src := &dirSource{root: opts.source, window: opts.window, stats: stats, progress: prog}
+		scanEvents = src.run
+	} else if opts.lakeEventDataStore != "" {
+		src := &lakeSource{
+			client: cloudtrail.NewFromConfig(sdkConfig, func(o *cloudtrail.Options) {
+				o.Region = awsRegion
+			}),
+			eventDataStore: opts.lakeEventDataStore,
+			window:         opts.window,
+			pollInterval:   opts.queryPollInterval,
+			stats:          stats,
+		}
+		scanEvents = src.run
+	} else if opts.kinesisStream != "" {
+		src := &kinesisSource{
+			client: kinesis.NewFromConfig(sdkConfig, func(o *kinesis.Options) {
+				o.Region = awsRegion
+			}),
+			stream:         opts.kinesisStream,
+			startTime:      opts.window.start,
+			concurrency:    opts.workers,
+			stats:          stats,
+			checkpointPath: opts.checkpointPath,
+			configHash:     opts.scanHash(),
+		}
+
+		if opts.resume {
+			if err := src.resume(); err != nil {
+				return configError(fmt.Errorf("resume from checkpoint: %w", err))
+			}
+		}
+		scanEvents = src.run
+	} else if opts.esURL != "" {
+		src := &esSource{
+			client:      newESClient(opts.esURL, opts, sdkConfig),
+			index:       opts.esIndex,
+			query:       json.RawMessage(opts.esQuery),
+			timeField:   opts.esTimeField,
+			sourceField: opts.esSourceField,
+			window:      opts.window,
+			stats:       stats,
+		}
+		scanEvents = src.run
+	} else if opts.replayArchive != "" {
+		src := &replaySource{
+			eventBridge: eventbridge.NewFromConfig(sdkConfig, func(o *eventbridge.Options) {
+				o.Region = awsRegion
+			}),
+			sqs: sqs.NewFromConfig(sdkConfig, func(o *sqs.Options) {
+				o.Region = awsRegion
+			}),
+			archive:           opts.replayArchive,
+			window:            opts.window,
+			visibilityTimeout: opts.sqsVisibilityTimeout,
+			stats:             stats,
+		}
+		scanEvents = src.run
+	} else if opts.sqsQueueURL != "" {
+		src := &sqsSource{
+			client: sqs.NewFromConfig(sdkConfig, func(o *sqs.Options) {
+				o.Region = awsRegion
+			}),
+			queueURL:          opts.sqsQueueURL,
+			dlqURL:            opts.sqsDLQURL,
+			visibilityTimeout: opts.sqsVisibilityTimeout,
+			stats:             stats,
+		}
+		scanEvents = src.run
+	} else if opts.athenaTable != "" {
+		src := &athenaSource{
+			athena: athena.NewFromConfig(sdkConfig, func(o *athena.Options) {
+				o.Region = awsRegion
+			}),
+			s3: s3.NewFromConfig(sdkConfig, func(o *s3.Options) {
+				o.Region = awsRegion
+			}),
+			table:        opts.athenaTable,
+			output:       opts.athenaOutput,
+			workGroup:    opts.athenaWorkGroup,
+			datePart:     opts.athenaDatePart,
+			window:       opts.window,
+			pollInterval: opts.queryPollInterval,
+			stats:        stats,
+		}
+		scanEvents = src.run
+	} else if strings.HasPrefix(opts.source, "s3://") {
+		s3Client := s3.NewFromConfig(sdkConfig, func(o *s3.Options) {
+			o.Region = awsRegion
+		})
+
+		src, err := newS3Source(s3Client, opts.source, opts.window, opts.s3Concurrency, stats, prog)
+		if err != nil {
+			return configError(fmt.Errorf("invalid source: %w", err))
+		}
+		src.filter = opts.filter
+		scanEvents = src.run
+	} else if len(opts.eventIDs) > 0 {
+		budget = newRetryBudget(opts.retryBudget, opts.maxConsecutive)
+		src := &eventIDSource{
+			client: cloudtrail.NewFromConfig(sdkConfig, func(o *cloudtrail.Options) {
+				o.Region = awsRegion
+			}),
+			limiter:     rate.NewLimiter(rate.Limit(opts.rps), 1),
+			clock:       scan.SystemClock,
+			callTimeout: opts.callTimeout,
+			ids:         opts.eventIDs,
+			stats:       stats,
+			budget:      budget,
+		}
+		scanEvents = src.run
+	} else {
+		window, err := lookupWindow(opts, stats)
+		if err != nil {
+			return err
+		}
+		prog.lookupWindow = window
+
+		if attr := opts.lookupAttribute(); attr != nil {
+			value := *attr.AttributeValue
+			if attr.AttributeKey == types.LookupAttributeKeyAccessKeyId {
+				value = redactAccessKey(value)
+			}
+			slog.Info("LookupEvents is filtered", slog.String("attribute", string(attr.AttributeKey)), slog.String("value", value))
+		}
+
+		// The deadline is shared by the accounts of an organization.
+		var deadline time.Time
+		if opts.stopAfter > 0 {
+			deadline = start.Add(opts.stopAfter)
+		}
+
+		// Every account gets its own limiter, the LookupEvents quota is per
+		// account and region, but they share the retry budget.
+		budget = newRetryBudget(opts.retryBudget, opts.maxConsecutive)
+		newScanner := func(client scan.CloudTrailClient, accountID string) *scanner {
+			return &scanner{
+				client:          client,
+				limiter:         rate.NewLimiter(rate.Limit(opts.rps), 1),
+				clock:           scan.SystemClock,
+				stats:           stats,
+				progress:        prog,
+				budget:          budget,
+				callTimeout:     opts.callTimeout,
+				window:          window,
+				cache:           cache,
+				staleLimit:      opts.staleLimit,
+				deadline:        deadline,
+				checkpointPath:  opts.checkpointPath,
+				configHash:      opts.scanHash(),
+				accountID:       accountID,
+				lookupAttribute: opts.lookupAttribute(),
+			}
+		}
+
+		if opts.orgRole != "" {
+			src := &orgSource{
+				orgs:        organizations.NewFromConfig(sdkConfig),
+				sts:         sts.NewFromConfig(sdkConfig),
+				sdkConfig:   sdkConfig,
+				role:        opts.orgRole,
+				concurrency: opts.orgConcurrency,
+				stats:       stats,
+				budget:      budget,
+				newScanner: func(client scan.CloudTrailClient, accountID string) *scanner {
+					lookup := newScanner(client, accountID)
+					lookup.checkpointPath = ""
+					return lookup
+				},
+			}
+			scanEvents = src.run
+		} else {
+			lookup := newScanner(cloudtrail.NewFromConfig(sdkConfig, func(o *cloudtrail.Options) {
+				o.Region = awsRegion
+			}), "")
+			lookup.credentials = sdkConfig.Credentials
+
+			if opts.resume {
+				if err := lookup.resume(); err != nil {
+					return configError(fmt.Errorf("resume from checkpoint: %w", err))
+				}
+			}
+			scanEvents = lookup.run
+		}
+
+		if opts.regionsWithTrails {
+			coverage, err := describeTrailCoverage(ctx, cloudtrail.NewFromConfig(sdkConfig, func(o *cloudtrail.Options) {
+				o.Region = awsRegion
+			}), awsRegion)
+			if err != nil {
+				if isAccessDenied(err) {
+					return configError(fmt.Errorf("--regions-with-trails needs cloudtrail:DescribeTrails: %w", err))
+				}
+				return apiError(fmt.Errorf("describe trails: %w", err))
+			}
+			stats.setTrails(coverage)
+
+			if !coverage.CoversRegion {
+				slog.Warn("Skipping region, no trail logs its events",
+					slog.String("region", awsRegion),
+					slog.String("reason", "no trail has it as home region and no multi-region trail exists"),
+				)
+				scanEvents = func(context.Context, func(scan.RawEvent)) stopReason {
+					return stopNoTrail
+				}
+			} else {
+				slog.Info("Region is logged by trails",
+					slog.String("region", awsRegion),
+					slog.Any("trails", coverage.Trails),
+					slog.Any("home-regions", coverage.HomeRegions),
+					slog.Bool("multi-region", coverage.MultiRegion),
+					slog.Bool("organization-trail", coverage.OrganizationTrail),
+				)
+			}
+		}
+	}
+
+	go reportProgress(ctx, opts.progressInterval, prog, cache, mem, budget)
+
+	scanCtx, scanSpan := tracer.Start(ctx, "scan")
+
+	workers := opts.workers
+	if opts.sync {
+		workers = 1
+	}
+
+	var sourceReason stopReason
+	scanOpts = append(scanOpts,
+		scan.WithConcurrency(workers),
+		scan.WithSource(scan.SourceFunc(func(ctx context.Context, emit func(scan.RawEvent)) error {
+			sourceReason = scanEvents(ctx, func(event scan.RawEvent) {
+				eventsInFlight.Inc()
+				if !opts.sync {
+					emit(event)
+					return
+				}
+
+				// The source only continues once the event was handled, e.g.
+				// the SQS source deletes the message then.
+				handled := make(chan struct{})
+				done := event.Done
+				event.Done = func() {
+					if done != nil {
+						done()
+					}
+					close(handled)
+				}
+				emit(event)
+				select {
+				case <-handled:
+				case <-ctx.Done():
+					// The event may have been dropped.
+				}
+			})
+			return nil
+		})),
+		scan.WithEventWrapper(func(event scan.RawEvent, handle func()) {
+			observeEvent(scanCtx, event, handle)
+			prog.events.Add(1)
+			if !event.EventTime.IsZero() {
+				prog.lastEventTime.Store(event.EventTime.UnixNano())
+			}
+			eventsInFlight.Dec()
+		}),
+	)
+
+	sc, err := scan.New(scanOpts...)
+	if err != nil {
+		return configError(fmt.Errorf("set up scan: %w", err))
+	}
+
+	// The scan and the signal handling run side by side, the scan ends the
+	// signal handling once it returns. A signal cancels the scan, which then
+	// drains and returns as usual, a second one exits at once. A drain that
+	// takes longer than --drain-timeout is given up on, the summary is then
+	// written with the events handled so far while the rest still are.
+	type scanResult struct {
+		stats  scan.Stats
+		err    error
+		reason stopReason
+	}
+	results := make(chan scanResult, 1)
+	scanDone, endScan := context.WithCancel(context.Background())
+	if bar != nil {
+		go bar.run(scanDone, prog, cache)
+	}
+	var uiDone chan struct{}
+	if ui != nil {
+		uiDone = make(chan struct{})
+		go func() {
+			defer close(uiDone)
+			if err := ui.run(); err != nil {
+				slog.Error("Terminal UI failed", slog.String("error", err.Error()))
+			}
+		}()
+	}
+	go func() {
+		defer endScan()
+		scanned, err := sc.Run(scanCtx)
+		// The source returned before Run did.
+		results <- scanResult{stats: scanned, err: err, reason: sourceReason}
+	}()
+	var signaled os.Signal
+	var g errgroup.Group
+	g.Go(func() error {
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(interrupts)
+
+		var drainTimeout <-chan time.Time
+		for {
+			select {
+			case sig := <-interrupts:
+				if signaled != nil {
+					slog.Error("Interrupted again, exiting without writing summary", slog.String("signal", sig.String()))
+					os.Exit(exitInterrupted)
+				}
+				signaled = sig
+				slog.Warn("Interrupted, draining pending events before writing summary", slog.String("signal", sig.String()), slog.Duration("drain-timeout", opts.drainTimeout))
+				cancel()
+				drainTimeout = time.After(opts.drainTimeout)
+			case <-drainTimeout:
+				return nil
+			case <-scanDone.Done():
+				return nil
+			}
+		}
+	})
+	g.Wait()
+
+	var scanned scan.Stats
+	var scanErr error
+	var reason stopReason
+	drainTimedOut := false
+	select {
+	case result := <-results:
+		scanned, scanErr, reason = result.stats, result.err, result.reason
+	default:
+		slog.Error("Draining took longer than --drain-timeout, writing the summary of the events handled so far",
+			slog.Duration("drain-timeout", opts.drainTimeout),
 		)
+		scanned, reason = sc.Stats(), stopCanceled
+		drainTimedOut = true
+	}
+	health.setStopped()
+	if bar != nil {
+		bar.finish()
+	}
+	if ui != nil {
+		ui.close()
+		<-uiDone
+	}
 
-		cache[cleanKey] = []string{cleanKey, value, deRef(event.EventName), deRef(event.EventId)}
-		return
+	stats.addScan(scanned)
+	stats.setStopReason(reason)
+	stats.setMemory(mem.peaks())
+	if examples != nil {
+		stats.setExamples(examples.close())
+	}
+	if budget != nil {
+		stats.setRetryBudget(budget.stats())
+	}
+
+	// Whatever the scan ends with, the recap tells how far it got.
+	defer func() {
+		artifacts := append(slices.Clone(summaryPaths), opts.emitDOT)
+		if opts.reportUnmapped {
+			artifacts = append(artifacts, unmappedPath)
+		}
+		if opts.reportConcepts {
+			artifacts = append(artifacts, conceptsPath)
+		}
+		if opts.saveExamples != "" {
+			artifacts = append(artifacts, opts.saveExamples)
+		}
+		if opts.groupBy == "" {
+			artifacts = append(artifacts, opts.emitAthenaDDL)
+		}
+		if regions != nil {
+			artifacts = append(artifacts, regionPath(opts.regionSummaryBase(), "regions"))
+		}
+		if !opts.machine {
+			artifacts = append(artifacts, actionsPath, sourcesPath, coOccurrencePath, "stats.json", "logs.ndjson", failuresPath)
+		}
+		if opts.lowMemory {
+			artifacts = append(artifacts, "matches.ndjson")
+		}
+		if reason != stopComplete {
+			artifacts = append(artifacts, opts.checkpointPath)
+		}
+
+		recap := newRecap(stats, scanned, time.Since(start), existingArtifacts(artifacts...), err)
+		slog.Info("Scan recap", slog.Any("recap", recap))
+		if !opts.machine {
+			recap.print(os.Stderr)
+		}
+	}()
+	scanSpan.SetAttributes(attribute.String("stop.reason", string(reason)))
+	scanSpan.End()
+	cancel()
+
+	// Events still being handled after a drain timeout may yet send matches
+	// to the exporters, they are left to the exit.
+	if !drainTimedOut {
+		if exporter != nil {
+			exporter.close()
+		}
+		if dynamoDB != nil {
+			dynamoDB.close()
+		}
+		if webhook != nil {
+			webhook.close()
+		}
+	}
+	if slack != nil {
+		slack.close()
+	}
+
+	if reason == stopAccessDenied {
+		// Nothing was scanned, an empty summary would only hide the problem.
+		printAccessDeniedHelp()
+		return &exitError{code: exitAccessDenied, err: errors.New("the credentials lack cloudtrail:LookupEvents")}
+	}
+
+	if reason == stopComplete && opts.checkpointPath != "" {
+		removeCheckpoint(opts.checkpointPath)
 	}
 
-	if resourcePattern.Match([]byte(value)) {
-		slog.Info("Has resource Id",
-			slog.String("key", cleanKey),
-			slog.String("value", value),
-			slog.String("action", deRef(event.EventName)),
-			slog.String("event-id", deRef(event.EventId)),
+	if dropped := stats.droppedMatches(); dropped > 0 {
+		slog.Warn("!!! Summary is truncated, matches were dropped after reaching the maximum number of keys or the soft memory limit !!!",
+			slog.Int("max-keys", opts.maxKeys),
+			slog.Uint64("mem-limit-soft", opts.memLimitSoft),
+			slog.Int("dropped-matches", dropped),
 		)
+	}
 
-		cache[cleanKey] = []string{cleanKey, value, deRef(event.EventName), deRef(event.EventId)}
-		return
+	// ctx is canceled by now, the summary is written anyway.
+	summaryErr := writeSummaries(context.Background(), summaryStore, writers)
+	if summaryErr != nil {
+		summaryErr = fmt.Errorf("write summary: %w", summaryErr)
+	}
+	if regions != nil {
+		if err := regions.write(context.Background(), opts.regionSummaryBase(), opts.delimiter); err != nil {
+			summaryErr = errors.Join(summaryErr, fmt.Errorf("write region summaries: %w", err))
+		}
+	}
+	if actions != nil {
+		if err := actions.write(actionsPath, sourcesPath, opts.delimiter); err != nil {
+			summaryErr = errors.Join(summaryErr, fmt.Errorf("write event frequencies: %w", err))
+		}
+	}
+	if pairs != nil {
+		if err := pairs.write(coOccurrencePath, opts.delimiter); err != nil {
+			summaryErr = errors.Join(summaryErr, fmt.Errorf("write co-occurrences: %w", err))
+		}
+	}
+	if concepts != nil {
+		if n, err := concepts.write(conceptsPath, rules, opts.delimiter); err != nil {
+			summaryErr = errors.Join(summaryErr, fmt.Errorf("write concepts: %w", err))
+		} else {
+			slog.Info("Grouped the keys by concept", slog.String("path", conceptsPath), slog.Int("concepts", n))
+		}
+	}
+	unmapped := 0
+	if opts.reportUnmapped {
+		var stale int
+		var err error
+		if unmapped, stale, err = writeUnmappedReport(unmappedPath, cache, mapped, opts.delimiter); err != nil {
+			summaryErr = errors.Join(summaryErr, fmt.Errorf("write unmapped keys: %w", err))
+		} else {
+			slog.Info("Compared the keys with the mappings", slog.String("path", unmappedPath), slog.Int("unmapped", unmapped), slog.Int("stale", stale))
+		}
+	}
+	var graphErr error
+	if graph != nil {
+		if err := graph.write(opts.emitDOT, opts.dotMinCount, opts.dotMaxNodes); err != nil {
+			graphErr = fmt.Errorf("write graph: %w", err)
+		}
+	}
+	if schema != nil {
+		if err := schema.write(opts.emitAthenaDDL, opts.athenaDDLTable, opts.athenaDDLLocation(), opts.groupBy == "service"); err != nil {
+			graphErr = errors.Join(graphErr, fmt.Errorf("write Athena DDL: %w", err))
+		}
+	}
+	logs.flush()
+	stats.setDroppedLogs(logs.dropped())
+	var statsErr error
+	if !opts.machine {
+		statsErr = writeStats(stats)
+	}
+
+	if slack != nil {
+		slack.sendSummary(stats, cache, opts.slackTop)
+	}
+
+	if err := errors.Join(summaryErr, graphErr, statsErr); err != nil {
+		return outputError(err)
+	}
+
+	switch reason {
+	case stopCredentialsExpired:
+		// Without a checkpoint there is nothing to resume from.
+		if opts.checkpointPath != "" {
+			printCredentialsExpiredHelp(opts.checkpointPath)
+		}
+		return &exitError{code: exitCredentialsExpired, err: errors.New("the credentials expired")}
+	case stopFailed:
+		return apiError(errors.New("the scan stopped on failed calls, the summary only holds the events read before"))
+	case stopInvalidRequest:
+		return configError(errors.New("LookupEvents rejected the request, see the hint logged before"))
+	case stopCircuitOpen:
+		return &exitError{code: exitCircuitOpen, err: errors.New("the retry budget was exhausted: " + budget.diagnosis())}
+	}
+
+	if drainTimedOut {
+		return partialError(errors.New("the scan was interrupted and didn't drain within --drain-timeout, the summary only holds the events handled before"))
+	}
+
+	if signaled == syscall.SIGTERM {
+		return partialError(errors.New("the scan was terminated, the summary only holds the events read before"))
+	}
+
+	if scanErr != nil {
+		return fmt.Errorf("scan: %w", scanErr)
+	}
+
+	if failed := stats.failedAccounts(); failed > 0 {
+		return partialError(fmt.Errorf("%d accounts couldn't be scanned, see failedAccounts in stats.json", failed))
+	}
+
+	if missing := stats.missingEventIDs(); missing > 0 {
+		return partialError(fmt.Errorf("%d event ids couldn't be looked up, see missingEventIds in stats.json", missing))
+	}
+
+	if opts.failOnUnmapped && unmapped > 0 {
+		return &exitError{code: exitUnmapped, err: fmt.Errorf("%d keys aren't in %s, see %s", unmapped, opts.mappingsPath, unmappedPath)}
+	}
+
+	return nil
+}
+
+// lookupWindow is the window a LookupEvents scan covers. LookupEvents only
+// keeps 90 days, a --start-time beyond that is moved to the retention horizon
+// with a warning, or refused with --strict-window.
+func lookupWindow(opts options, stats *scanStats) (timeWindow, error) {
+	window, clamped := opts.window.clampRetention(time.Now())
+	if !clamped {
+		return window, nil
+	}
+
+	if !window.end.IsZero() && !window.start.Before(window.end) {
+		return timeWindow{}, configError(fmt.Errorf("--end-time %s is beyond the 90 days LookupEvents keeps, read older events from a trail with --source s3://... or --lake-event-data-store",
+			window.end.Format(time.RFC3339)))
 	}
+
+	if opts.strictWindow {
+		return timeWindow{}, configError(fmt.Errorf("--start-time %s is beyond the 90 days LookupEvents keeps, scan from %s or read older events from a trail with --source s3://... or --lake-event-data-store",
+			opts.window.start.Format(time.RFC3339), window.start.Format(time.RFC3339)))
+	}
+
+	slog.Warn("!!! --start-time is beyond the 90 days LookupEvents keeps, only the events since the retention horizon are scanned. Read older events from a trail with --source s3://... or --lake-event-data-store !!!",
+		slog.Time("start-time", opts.window.start),
+		slog.Time("effective-start-time", window.start),
+	)
+	stats.setEffectiveWindow(window)
+	return window, nil
 }
 
-func cleanKey(key string) string {
-	return string(jsonArrayPattern.ReplaceAll([]byte(key), []byte("[]")))
+// onMatch hands the matches to the add method of an exporter or notifier,
+// which queue them and never fail.
+func onMatch(add func(scan.Match)) scan.Option {
+	return scan.WithOnMatch(func(ctx context.Context, m scan.Match) error {
+		add(m)
+		return nil
+	})
+}
+
+// newMatchStream writes every match as a line of JSON to w, e.g. the
+// findings of --machine to stdout.
+func newMatchStream(w io.Writer) func(scan.Match) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(m scan.Match) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(m); err != nil {
+			slog.Error("Couldn't write match", slog.String("key", m.Key), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// observeEvent handles event in its span and records the processing metrics.
+func observeEvent(ctx context.Context, event scan.RawEvent, handle func()) {
+	span := startEventSpan(ctx, event.EventName)
+	start := time.Now()
+	handle()
+	processingDuration.Observe(time.Since(start).Seconds())
+	span.End()
+
+	eventsProcessed.Inc()
 }
 
 func deRef[T any](ref *T) T {
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// chdir runs the test in a directory of its own, the scan writes its outputs
+// to the working directory.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// watchHandler tells when a message was first logged.
+type watchHandler struct {
+	channels map[string]chan struct{}
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func newWatchHandler(messages ...string) *watchHandler {
+	h := &watchHandler{channels: make(map[string]chan struct{}), seen: make(map[string]bool)}
+	for _, message := range messages {
+		h.channels[message] = make(chan struct{})
+	}
+	return h
+}
+
+func (h *watchHandler) logged(message string) <-chan struct{} {
+	return h.channels[message]
+}
+
+func (h *watchHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *watchHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if ch, ok := h.channels[r.Message]; ok && !h.seen[r.Message] {
+		h.seen[r.Message] = true
+		close(ch)
+	}
+	return nil
+}
+
+func (h *watchHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *watchHandler) WithGroup(string) slog.Handler      { return h }
+
+// stdinEvent is a raw CloudTrail record with an ARN under a key of its own.
+func stdinEvent(i int) string {
+	return fmt.Sprintf(`{"eventID":"event-%d","eventName":"GetObject","eventSource":"s3.amazonaws.com","requestParameters":{"bucket%d":"arn:aws:s3:::bucket-%d"}}`+"\n", i, i, i)
+}
+
+// scanStdin runs a scan of events piped to stdin and sends sig once the first
+// key was found, while the scan is still waiting for the rest of its events.
+func scanStdin(t *testing.T, sig os.Signal, args ...string) error {
+	t.Helper()
+	chdir(t, t.TempDir())
+
+	events, done := interruptStdinScan(t, sig, args...)
+
+	// The source only notices the cancelation with its next line.
+	events.WriteString(stdinEvent(100))
+	events.Close()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(30 * time.Second):
+		t.Fatal("the scan didn't return")
+		return nil
+	}
+}
+
+// interruptStdinScan starts a scan of events piped to stdin in the working
+// directory and sends sig once the first key was found. It returns once the
+// scan is draining, with the pipe of its events and the result of the scan.
+func interruptStdinScan(t *testing.T, sig os.Signal, args ...string) (*os.File, <-chan error) {
+	t.Helper()
+
+	// The process must not die of the signal if it comes before the scan
+	// listens for it.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+	t.Cleanup(func() { signal.Stop(signals) })
+
+	stdin, events, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stdin.Close()
+		events.Close()
+	})
+	previous := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() { os.Stdin = previous })
+
+	opts, err := parseOptions(append([]string{"--source", "-", "--no-progress", "--drain-timeout", "5s"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watch := newWatchHandler("Has arn", "Interrupted, draining pending events before writing summary")
+	logs := newSamplingHandler(watch, logSampleFirst, logSampleInterval)
+	previousLogger := slog.Default()
+	slog.SetDefault(slog.New(logs))
+	t.Cleanup(func() { slog.SetDefault(previousLogger) })
+
+	done := make(chan error, 1)
+	go func() { done <- run(opts, nil, logs) }()
+
+	for i := range 100 {
+		if _, err := events.WriteString(stdinEvent(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-watch.logged("Has arn"):
+	case <-time.After(10 * time.Second):
+		t.Fatal("no key was found")
+	}
+	// The scan listens for signals by the time the first events are handled,
+	// give it a moment anyway.
+	time.Sleep(100 * time.Millisecond)
+	if err := syscall.Kill(os.Getpid(), sig.(syscall.Signal)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-watch.logged("Interrupted, draining pending events before writing summary"):
+	case <-time.After(10 * time.Second):
+		t.Fatal("the scan didn't see the signal")
+	}
+
+	return events, done
+}
+
+func readStatsFile(t *testing.T) *scanStats {
+	t.Helper()
+
+	data, err := os.ReadFile("stats.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := &scanStats{}
+	if err := json.Unmarshal(data, stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+// readSummaryKeys returns the keys of summary.csv.
+func readSummaryKeys(t *testing.T) []string {
+	t.Helper()
+
+	data, err := os.ReadFile("summary.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n")[2:] {
+		keys = append(keys, strings.SplitN(line, ",", 2)[0])
+	}
+	return keys
+}
+
+// TestScanInterrupted runs with -race to show the signal handling doesn't
+// read the store while the workers write it.
+func TestScanInterrupted(t *testing.T) {
+	err := scanStdin(t, os.Interrupt, "--workers", "4")
+	if code := exitCode(err); code != exitOK {
+		t.Fatalf("exit code %d (%v), want %d", code, err, exitOK)
+	}
+
+	stats := readStatsFile(t)
+	if stats.StopReason != stopCanceled {
+		t.Errorf("stop reason %q, want %q", stats.StopReason, stopCanceled)
+	}
+	// Every event handed to the workers is in the summary, each has a key
+	// of its own.
+	if keys := readSummaryKeys(t); len(keys) == 0 || len(keys) != stats.Events {
+		t.Errorf("summary has %d keys of %d events", len(keys), stats.Events)
+	}
+}
+
+// TestScanTerminated stops the scan like Kubernetes stops a pod, the summary
+// is written but the exit code tells the scan didn't end on its own.
+func TestScanTerminated(t *testing.T) {
+	err := scanStdin(t, syscall.SIGTERM)
+	if code := exitCode(err); code != exitPartial {
+		t.Fatalf("exit code %d (%v), want %d", code, err, exitPartial)
+	}
+
+	stats := readStatsFile(t)
+	if stats.StopReason != stopCanceled {
+		t.Errorf("stop reason %q, want %q", stats.StopReason, stopCanceled)
+	}
+	if keys := readSummaryKeys(t); len(keys) == 0 || len(keys) != stats.Events {
+		t.Errorf("summary has %d keys of %d events", len(keys), stats.Events)
+	}
+}
+
+// TestScanInterruptedTwice runs itself in a process of its own, the second
+// signal exits the process.
+func TestScanInterruptedTwice(t *testing.T) {
+	if os.Getenv("SCAN_INTERRUPTED_TWICE") != "" {
+		// The drain waits for the next line, which never comes.
+		interruptStdinScan(t, os.Interrupt)
+		if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Second)
+		t.Fatal("the second signal didn't exit")
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestScanInterruptedTwice$")
+	cmd.Env = append(os.Environ(), "SCAN_INTERRUPTED_TWICE=1")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != exitInterrupted {
+		t.Fatalf("exited with %v, want %d:\n%s", err, exitInterrupted, out)
+	}
+	for _, name := range []string{"summary.csv", "stats.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was written: %v", name, err)
+		}
+	}
+}
+
+// runStdin runs a scan of events piped to stdin until they run out.
+func runStdin(t *testing.T, events []string, args ...string) error {
+	t.Helper()
+	chdir(t, t.TempDir())
+
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	previous := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = previous }()
+
+	go func() {
+		defer w.Close()
+		for _, event := range events {
+			w.WriteString(event)
+		}
+	}()
+
+	opts, err := parseOptions(append([]string{"--source", "-", "--no-progress"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := newSamplingHandler(slog.NewTextHandler(io.Discard, nil), logSampleFirst, logSampleInterval)
+	previousLogger := slog.Default()
+	slog.SetDefault(slog.New(logs))
+	defer slog.SetDefault(previousLogger)
+
+	return run(opts, nil, logs)
+}
+
+// readCSV returns the rows of path without its header.
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows[1:]
+}
+
+// TestScanLowMemory leaves out what grows with the keys besides the store.
+func TestScanLowMemory(t *testing.T) {
+	// The role is both requested and returned, a pair of keys.
+	var events []string
+	for i := range 10 {
+		events = append(events, fmt.Sprintf(`{"eventID":"event-%d","eventName":"GetRole","eventSource":"iam.amazonaws.com","requestParameters":{"roleArn":"arn:aws:iam::123456789012:role/r%d"},"responseElements":{"role":{"arn":"arn:aws:iam::123456789012:role/r%d"}}}`+"\n", i, i, i))
+	}
+
+	t.Run("default", func(t *testing.T) {
+		if err := runStdin(t, events); err != nil {
+			t.Fatal(err)
+		}
+		if rows := readCSV(t, coOccurrencePath); len(rows) != 1 || rows[0][2] != "10" {
+			t.Errorf("co-occurrence rows %q, want the role pair in 10 events", rows)
+		}
+		if rows := readCSV(t, actionsPath); len(rows) != 1 || rows[0][4] != "2" {
+			t.Errorf("actions rows %q, want GetRole with 2 keys", rows)
+		}
+		data, err := os.ReadFile("summary.csv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "iam.amazonaws.com") {
+			t.Errorf("summary.csv has no event sources:\n%s", data)
+		}
+	})
+
+	t.Run("low memory", func(t *testing.T) {
+		if err := runStdin(t, events, "--low-memory"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(coOccurrencePath); !os.IsNotExist(err) {
+			t.Errorf("%s was written: %v", coOccurrencePath, err)
+		}
+		if rows := readCSV(t, actionsPath); len(rows) != 1 || rows[0][2] != "10" || rows[0][4] != "" {
+			t.Errorf("actions rows %q, want GetRole in 10 events without keys", rows)
+		}
+		if rows := readCSV(t, sourcesPath); len(rows) != 1 || rows[0][3] != "" {
+			t.Errorf("sources rows %q, want iam without keys", rows)
+		}
+		if keys := readSummaryKeys(t); len(keys) != 2 {
+			t.Errorf("summary keys %q, want the two role keys", keys)
+		}
+	})
+}
+
+// TestScanMachine streams the findings as JSON lines on stdout, logs as JSON
+// on stderr and writes no file.
+func TestScanMachine(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	previousStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = previousStdin }()
+	go func() {
+		defer w.Close()
+		for i := range 3 {
+			w.WriteString(stdinEvent(i))
+		}
+	}()
+
+	// The scan sets the default logger to stderr.
+	previousLogger := slog.Default()
+	defer slog.SetDefault(previousLogger)
+	defer slog.SetLogLoggerLevel(slog.LevelInfo)
+
+	var code int
+	stdout, stderr := captureOutput(t, func() { code = runCommand([]string{"--source", "-", "--machine"}) })
+	if code != exitOK {
+		t.Fatalf("exit code %d, want %d\n%s", code, exitOK, stderr)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("%d lines on stdout, want a finding per key:\n%s", len(lines), stdout)
+	}
+	for _, line := range lines {
+		var finding map[string]any
+		if err := json.Unmarshal([]byte(line), &finding); err != nil {
+			t.Errorf("stdout line %q isn't JSON: %v", line, err)
+		} else if key, _ := finding["key"].(string); !strings.HasPrefix(key, "requestParameters.bucket") {
+			t.Errorf("finding %q has no key", line)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(stderr, "\n"), "\n") {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("stderr line %q isn't JSON", line)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("%s was written", entry.Name())
+	}
+}
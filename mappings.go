@@ -0,0 +1,103 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/exp/maps"
+	"gopkg.in/yaml.v3"
+)
+
+// unmappedPath is where --report-unmapped writes the keys missing from the
+// --mappings file and the mapped paths the scan never saw.
+const unmappedPath = "unmapped.csv"
+
+// mappingIndex matches the array indices and wildcards of mapped paths, e.g.
+// "items[0].id" and "items[*].id" are the key "items[].id".
+var mappingIndex = regexp.MustCompile(`\[(\d+|\*)\]`)
+
+// mappings are the paths of a --mappings file with their target entity
+// field, empty when the file only lists paths.
+type mappings map[string]string
+
+// loadMappings reads a YAML file that is either a list of paths, or a map of
+// paths to their target field.
+func loadMappings(path string) (mappings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	m := make(mappings)
+	switch doc := doc.(type) {
+	case nil:
+	case []any:
+		for i, entry := range doc {
+			source, ok := entry.(string)
+			if !ok {
+				return nil, fmt.Errorf("entry %d is a %T, not a path", i+1, entry)
+			}
+			m[normalizeMappingPath(source)] = ""
+		}
+	case map[string]any:
+		for source, target := range doc {
+			m[normalizeMappingPath(source)] = fmt.Sprint(target)
+		}
+	default:
+		return nil, fmt.Errorf("a mappings file is a list of paths or a map of paths to fields, not a %T", doc)
+	}
+	return m, nil
+}
+
+// normalizeMappingPath writes a mapped path like the keys of the summary.
+func normalizeMappingPath(path string) string {
+	return mappingIndex.ReplaceAllString(path, "[]")
+}
+
+// writeUnmappedReport writes a row per key of store missing from m, with its
+// example, then a row per mapped path no key of store has, and returns how
+// many of each there were.
+func writeUnmappedReport(path string, store scan.Store, m mappings, comma rune) (unmapped, stale int, err error) {
+	seen := make(map[string]bool)
+	rows := [][]string{{"status", "key", "target", "matchType", "service", "eventName", "value"}}
+	err = store.Each(func(match scan.Match) error {
+		seen[match.Key] = true
+		if _, ok := m[match.Key]; !ok {
+			rows = append(rows, []string{"unmapped", match.Key, "", match.MatchType, match.Service, match.EventName, match.Value})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	unmapped = len(rows) - 1
+	slices.SortFunc(rows[1:], func(a, b []string) int {
+		return cmp.Compare(a[1], b[1])
+	})
+
+	sources := maps.Keys(m)
+	slices.Sort(sources)
+	for _, source := range sources {
+		if !seen[source] {
+			rows = append(rows, []string{"stale", source, m[source], "", "", "", ""})
+			stale++
+		}
+	}
+
+	if err := writeCSVFile(path, rows, comma); err != nil {
+		return 0, 0, err
+	}
+
+	slog.Debug("Unmapped keys written", slog.String("path", path), slog.Int("unmapped", unmapped), slog.Int("stale", stale))
+	return unmapped, stale, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+func TestLoadMappings(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    mappings
+		wantErr string
+	}{
+		{
+			name: "paths",
+			yaml: "- requestParameters.roleArn\n- requestParameters.items[0].id\n- responseElements.items[*].arn\n",
+			want: mappings{"requestParameters.roleArn": "", "requestParameters.items[].id": "", "responseElements.items[].arn": ""},
+		},
+		{
+			name: "targets",
+			yaml: "requestParameters.roleArn: role.arn\nrequestParameters.items[3].instanceId: instance.id\n",
+			want: mappings{"requestParameters.roleArn": "role.arn", "requestParameters.items[].instanceId": "instance.id"},
+		},
+		{name: "empty", yaml: "", want: mappings{}},
+		{name: "not a path", yaml: "- requestParameters.roleArn\n- [a, b]\n", wantErr: "entry 2 is a []interface {}, not a path"},
+		{name: "scalar", yaml: "requestParameters.roleArn\n", wantErr: "not a string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mappings.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadMappings(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadMappings failed with %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("loadMappings = %v, want %v", got, tt.want)
+			}
+			for source, target := range tt.want {
+				if got[source] != target {
+					t.Errorf("loadMappings = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+// TestWriteUnmappedReport lists the keys missing from the mappings by key,
+// then the mapped paths the scan never saw.
+func TestWriteUnmappedReport(t *testing.T) {
+	store := scan.NewMemoryStore(0)
+	for _, m := range []scan.Match{
+		{Key: "requestParameters.roleArn", Value: "arn:aws:iam::123456789012:role/a", MatchType: scan.MatchTypeARN, Service: "iam", EventName: "GetRole"},
+		{Key: "requestParameters.subnetId", Value: "subnet-12345678", MatchType: scan.MatchTypeResourceID, Service: "ec2", EventName: "CreateNetworkInterface"},
+		{Key: "requestParameters.items[].instanceId", Value: "i-0123456789abcdef0", MatchType: scan.MatchTypeResourceID, Service: "ec2", EventName: "StartInstances"},
+		{Key: "requestParameters.bucketName", Value: "arn:aws:s3:::a,b", MatchType: scan.MatchTypeARN, Service: "s3", EventName: "CreateBucket"},
+	} {
+		store.Add(m)
+	}
+	m := mappings{
+		"requestParameters.items[].instanceId": "instance.id",
+		"requestParameters.roleArn":            "",
+		"responseElements.keyId":               "key.id",
+		"requestParameters.topicArn":           "",
+	}
+
+	path := filepath.Join(t.TempDir(), unmappedPath)
+	unmapped, stale, err := writeUnmappedReport(path, store, m, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unmapped != 2 || stale != 2 {
+		t.Errorf("%d unmapped and %d stale, want 2 and 2", unmapped, stale)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "status,key,target,matchType,service,eventName,value\n" +
+		"unmapped,requestParameters.bucketName,,arn,s3,CreateBucket,\"arn:aws:s3:::a,b\"\n" +
+		"unmapped,requestParameters.subnetId,,resource-id,ec2,CreateNetworkInterface,subnet-12345678\n" +
+		"stale,requestParameters.topicArn,,,,,\n" +
+		"stale,responseElements.keyId,key.id,,,,\n"
+	if string(got) != want {
+		t.Errorf("%s is\n%s\nwant\n%s", unmappedPath, got, want)
+	}
+}
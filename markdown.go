@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/exp/maps"
+)
+
+// markdownSummaryWriter writes the matches as a table, e.g. to paste into a
+// ticket or a wiki page. It can't be read back, see readSummary.
+type markdownSummaryWriter struct {
+	path string
+	// out, if set, is written to instead of the file at path.
+	out io.Writer
+}
+
+func (w *markdownSummaryWriter) Write(ctx context.Context, snapshot scan.Snapshot) error {
+	if w.out != nil {
+		return writeMarkdownSummary(w.out, snapshot)
+	}
+
+	file, err := createAtomic(w.path, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.abort()
+
+	if err := writeMarkdownSummary(file, snapshot); err != nil {
+		return err
+	}
+
+	if err := file.commit(); err != nil {
+		return err
+	}
+
+	slog.Debug("Summary written", slog.String("path", w.path), slog.Int("keys", len(snapshot.Matches)))
+	return nil
+}
+
+func writeMarkdownSummary(out io.Writer, snapshot scan.Snapshot) error {
+	wr := bufio.NewWriter(out)
+
+	fmt.Fprintf(wr, "# Summary\n\n%d keys", len(snapshot.Matches))
+	types := maps.Keys(snapshot.Counts)
+	slices.Sort(types)
+	for i, matchType := range types {
+		sep := ", "
+		if i == 0 {
+			sep = ": "
+		}
+		fmt.Fprintf(wr, "%s%d %s", sep, snapshot.Counts[matchType], markdownCell(matchType))
+	}
+	fmt.Fprint(wr, ".\n\n")
+
+	fmt.Fprintln(wr, "| Key | Value | Match type | Event action | Example event | Account | Event sources |")
+	fmt.Fprintln(wr, "| --- | --- | --- | --- | --- | --- | --- |")
+	for _, m := range snapshot.Matches {
+		fmt.Fprintf(wr, "| %s | %s | %s | %s | %s | %s | %s |\n",
+			markdownCell(m.Key), markdownCell(m.Value), markdownCell(m.MatchType), markdownCell(m.EventName), markdownCell(m.EventID), markdownCell(m.AccountID),
+			markdownCell(strings.Join(m.EventSources, " ")))
+	}
+
+	return wr.Flush()
+}
+
+// markdownEscaper escapes what would end a table cell or read as markup, and
+// turns line breaks into <br>, a row must stay on one line.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"|", `\|`,
+	"`", "\\`",
+	"*", `\*`,
+	"_", `\_`,
+	"[", `\[`,
+	"]", `\]`,
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"\r\n", "<br>",
+	"\n", "<br>",
+	"\r", "<br>",
+)
+
+func markdownCell(value string) string {
+	return markdownEscaper.Replace(value)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/maps"
+)
+
+// memoryStats are the high-water marks of stats.json, sampled with every
+// progress log and once the scan ended.
+type memoryStats struct {
+	PeakHeapAllocBytes uint64 `json:"peakHeapAllocBytes"`
+	PeakHeapInuseBytes uint64 `json:"peakHeapInuseBytes"`
+	PeakSysBytes       uint64 `json:"peakSysBytes"`
+	NumGC              uint32 `json:"numGC"`
+	// PeakSizes are the largest sizes of the big maps, e.g. "cache-keys".
+	PeakSizes map[string]int `json:"peakSizes"`
+	// SoftLimitReached is set once --mem-limit-soft made the store drop new
+	// keys.
+	SoftLimitReached bool `json:"softLimitReached,omitempty"`
+}
+
+// memoryMonitor samples the memory of the process and the sizes of the maps
+// growing with the scan. Once the heap in use reaches softLimit the store
+// stops taking new keys, like after --max-keys, before the kernel kills the
+// process.
+type memoryMonitor struct {
+	softLimit uint64
+	store     *cappedStore
+
+	mu    sync.Mutex
+	sizes map[string]func() int
+	stats memoryStats
+}
+
+// newMemoryMonitor returns a monitor, store is only needed with a soft limit.
+func newMemoryMonitor(softLimit uint64, store *cappedStore) *memoryMonitor {
+	return &memoryMonitor{
+		softLimit: softLimit,
+		store:     store,
+		sizes:     make(map[string]func() int),
+		stats:     memoryStats{PeakSizes: make(map[string]int)},
+	}
+}
+
+// track adds a map to the samples, size must be safe to call concurrently.
+func (m *memoryMonitor) track(name string, size func() int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sizes[name] = size
+}
+
+// sample updates the high-water marks and applies the soft limit, logging
+// the sample if log is set.
+func (m *memoryMonitor) sample(log bool) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats.PeakHeapAllocBytes = max(m.stats.PeakHeapAllocBytes, mem.HeapAlloc)
+	m.stats.PeakHeapInuseBytes = max(m.stats.PeakHeapInuseBytes, mem.HeapInuse)
+	m.stats.PeakSysBytes = max(m.stats.PeakSysBytes, mem.Sys)
+	m.stats.NumGC = mem.NumGC
+
+	names := maps.Keys(m.sizes)
+	slices.Sort(names)
+	attrs := []any{
+		slog.Uint64("heap-alloc-bytes", mem.HeapAlloc),
+		slog.Uint64("heap-inuse-bytes", mem.HeapInuse),
+		slog.Uint64("sys-bytes", mem.Sys),
+		slog.Uint64("num-gc", uint64(mem.NumGC)),
+	}
+	for _, name := range names {
+		size := m.sizes[name]()
+		m.stats.PeakSizes[name] = max(m.stats.PeakSizes[name], size)
+		attrs = append(attrs, slog.Int(name, size))
+	}
+	if log {
+		slog.Info("Memory", attrs...)
+	}
+
+	if m.softLimit > 0 && mem.HeapInuse >= m.softLimit && !m.stats.SoftLimitReached {
+		m.stats.SoftLimitReached = true
+		m.store.stopAccepting()
+		slog.Warn("!!! Soft memory limit reached, new keys are dropped and the summary will be incomplete !!!",
+			slog.Uint64("mem-limit-soft", m.softLimit),
+			slog.Uint64("heap-inuse-bytes", mem.HeapInuse),
+		)
+	}
+}
+
+// peaks returns the high-water marks after a last sample.
+func (m *memoryMonitor) peaks() *memoryStats {
+	m.sample(false)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peaks := m.stats
+	peaks.PeakSizes = maps.Clone(m.stats.PeakSizes)
+	return &peaks
+}
+
+// byteSizes are the units of byteSizeFlag, the longest suffixes first.
+var byteSizes = []struct {
+	suffix string
+	bytes  uint64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// byteSizeFlag parses a size like 512MiB, 2GiB or 1500000000 into n.
+func byteSizeFlag(n *uint64) func(string) error {
+	return func(value string) error {
+		number, unit := value, uint64(1)
+		for _, size := range byteSizes {
+			if strings.HasSuffix(value, size.suffix) {
+				number, unit = strings.TrimSpace(strings.TrimSuffix(value, size.suffix)), size.bytes
+				break
+			}
+		}
+
+		parsed, err := strconv.ParseFloat(number, 64)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("%q is not a size like 512MiB or 2GiB", value)
+		}
+
+		*n = uint64(parsed * float64(unit))
+		return nil
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// runMerge combines the summaries of several runs, e.g. of different regions
+// or accounts, into one. Inputs are read in order and the first match of a
+// key wins, like within a scan.
+func runMerge(args []string) int {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	fs := newFlagSet("merge", "[flags] summary.csv|summary.json|summary.ndjson|summary.yaml ...",
+		"find-cloudtrail-arn-fields merge --format csv=merged.csv eu-west-1/summary.csv us-east-1/summary.csv",
+		"find-cloudtrail-arn-fields merge --format json=all.json */summary.json",
+	)
+	var formats []string
+	fs.Func("format", "Formats of the merged summary, like the --format of a scan (default csv=merged.csv)", listFlag(&formats))
+	var comma rune
+	fs.Func("delimiter", `Delimiter of the csv summaries read and written, ",", ";" or "\t" (default ",")`, delimiterFlag(&comma))
+	if err := fs.Parse(args); err != nil {
+		return parseExitCode(err)
+	}
+
+	if fs.NArg() == 0 {
+		slog.Error("Invalid arguments", slog.String("error", "merge needs at least one summary"))
+		return exitConfig
+	}
+
+	writers, err := summaryWriters(formats, "csv=merged.csv", comma)
+	if err != nil {
+		slog.Error("Invalid arguments", slog.String("error", err.Error()))
+		return exitConfig
+	}
+
+	cache := scan.NewMemoryStore(10000)
+	if err := readSummaries(fs.Args(), cache, comma); err != nil {
+		slog.Error("Couldn't read summary", slog.String("error", err.Error()))
+		return exitFailure
+	}
+
+	if err := writeSummaries(context.Background(), cache, writers); err != nil {
+		slog.Error("Couldn't write summary", slog.String("error", err.Error()))
+		return exitOutput
+	}
+	slog.Info("Summaries merged", slog.Int("summaries", fs.NArg()), slog.Int("keys", cache.Len()))
+
+	return exitOK
+}
+
+// readSummaries reads every summary at paths into cache with the default
+// matchers, comma being the delimiter of csv summaries.
+func readSummaries(paths []string, cache scan.Store, comma rune) error {
+	matchers := scan.NewRegistry(scan.DefaultMatchers()...)
+	for _, path := range paths {
+		if err := readSummary(path, matchers, cache, comma); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// summaryWriters returns the writers of --format values, or of fallback if
+// none were given. csv summaries are written with comma as delimiter.
+func summaryWriters(formats []string, fallback string, comma rune) ([]scan.SummaryWriter, error) {
+	if len(formats) == 0 {
+		formats = []string{fallback}
+	}
+
+	var writers []scan.SummaryWriter
+	for _, format := range formats {
+		output, err := parseSummaryOutput(format)
+		if err != nil {
+			return nil, err
+		}
+		output.comma = comma
+		writers = append(writers, output.writer())
+	}
+	return writers, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// writeMatchesSummary writes matches as a summary in format to path.
+func writeMatchesSummary(t *testing.T, format, path string, matches []scan.Match) {
+	t.Helper()
+
+	cache := scan.NewMemoryStore(0)
+	for _, m := range matches {
+		cache.Add(m)
+	}
+	output, err := parseSummaryOutput(format + "=" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSummaries(context.Background(), cache, []scan.SummaryWriter{output.writer()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSummaryFile reads a summary back by key.
+func readSummaryFile(t *testing.T, path string) map[string]scan.Match {
+	t.Helper()
+
+	cache := scan.NewMemoryStore(0)
+	if err := readSummary(path, scan.NewRegistry(scan.DefaultMatchers()...), cache, 0); err != nil {
+		t.Fatal(err)
+	}
+	read := make(map[string]scan.Match)
+	cache.Each(func(m scan.Match) error {
+		read[m.Key] = m
+		return nil
+	})
+	return read
+}
+
+// roundTripped is what a summary in format keeps of m. A csv summary holds
+// neither the match type nor the details of the event, the match type is
+// found again by the matchers, values no matcher accepts are dropped.
+func roundTripped(format string, m scan.Match) (scan.Match, bool) {
+	if format != "csv" {
+		return m, true
+	}
+
+	match, ok := scan.NewRegistry(scan.DefaultMatchers()...).Match(m.Key, m.Value)
+	if !ok {
+		return scan.Match{}, false
+	}
+	// encoding/csv reads the line break \r\n of a quoted value as \n.
+	match.Value = strings.ReplaceAll(m.Value, "\r\n", "\n")
+	match.EventName, match.EventID, match.AccountID = m.EventName, m.EventID, m.AccountID
+	match.EventSources = strings.Fields(strings.Join(m.EventSources, " "))
+	return match, true
+}
+
+// TestMergeRoundTrip merges two summaries sharing keys in every format that
+// can be read back. The first summary wins the shared keys.
+func TestMergeRoundTrip(t *testing.T) {
+	matches := goldenSnapshot().Matches
+	first := matches[:8]
+	second := append([]scan.Match(nil), matches[5:]...)
+	for i := range second[:3] {
+		second[i].EventID = "later-run"
+	}
+
+	for _, format := range []string{"csv", "json", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			chdir(t, t.TempDir())
+			writeMatchesSummary(t, format, "a."+format, first)
+			writeMatchesSummary(t, format, "b."+format, second)
+
+			var code int
+			stdout, stderr := captureOutput(t, func() {
+				code = runCommand([]string{"merge", "--format", format + "=merged." + format, "a." + format, "b." + format})
+			})
+			if code != exitOK {
+				t.Fatalf("exit code %d, want %d\n%s%s", code, exitOK, stdout, stderr)
+			}
+
+			want := make(map[string]scan.Match)
+			for _, m := range matches {
+				if m, ok := roundTripped(format, m); ok {
+					want[m.Key] = m
+				}
+			}
+			got := readSummaryFile(t, "merged."+format)
+			if len(got) != len(want) {
+				t.Errorf("merged %d keys, want %d", len(got), len(want))
+			}
+			for key, w := range want {
+				if g := got[key]; !reflect.DeepEqual(g, w) {
+					t.Errorf("%s merged as\n%+v\nwant\n%+v", key, g, w)
+				}
+			}
+		})
+	}
+}
+
+// TestReprocessRoundTrip adds the keys of the recorded failures to the
+// summary and keeps the ones it had.
+func TestReprocessRoundTrip(t *testing.T) {
+	chdir(t, t.TempDir())
+	matches := goldenSnapshot().Matches
+	writeMatchesSummary(t, "csv", "summary.csv", matches)
+
+	at := time.Date(2024, 7, 1, 12, 30, 0, 0, time.UTC)
+	failure, err := json.Marshal(failureRecord{
+		EventId:         "failed-event",
+		EventName:       "GetRole",
+		EventSource:     "iam.amazonaws.com",
+		EventTime:       &at,
+		CloudTrailEvent: `{"eventID":"failed-event","requestParameters":{"reprocessedArn":"arn:aws:iam::123456789012:role/fixed"}}`,
+		Error:           "unexpected end of JSON input",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(failuresPath, append(failure, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var code int
+	stdout, stderr := captureOutput(t, func() { code = runCommand([]string{"reprocess"}) })
+	if code != exitOK {
+		t.Fatalf("exit code %d, want %d\n%s%s", code, exitOK, stdout, stderr)
+	}
+
+	got := readSummaryFile(t, "summary.csv")
+	for _, m := range matches {
+		want, ok := roundTripped("csv", m)
+		if !ok {
+			continue
+		}
+		if g := got[m.Key]; !reflect.DeepEqual(g, want) {
+			t.Errorf("%s read back as\n%+v\nwant\n%+v", m.Key, g, want)
+		}
+	}
+	if m, ok := got["requestParameters.reprocessedArn"]; !ok || m.Value != "arn:aws:iam::123456789012:role/fixed" || m.EventID != "failed-event" {
+		t.Errorf("the key of the failure wasn't added: %+v", m)
+	}
+	if _, err := os.Stat(failuresPath); err == nil {
+		t.Errorf("%s was written again, no event failed", failuresPath)
+	}
+}
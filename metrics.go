@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// pageMetrics collects where the time went while fetching and handing over a
+// single page of events.
+type pageMetrics struct {
+	page    int
+	events  int
+	limiter time.Duration
+	api     time.Duration
+	backoff time.Duration
+	handoff time.Duration
+	process time.Duration
+}
+
+func (m pageMetrics) log() {
+	slog.Debug("Page processed",
+		slog.Int("page", m.page),
+		slog.Int("events", m.events),
+		slog.Int64("limiter_ms", m.limiter.Milliseconds()),
+		slog.Int64("api_ms", m.api.Milliseconds()),
+		slog.Int64("backoff_ms", m.backoff.Milliseconds()),
+		slog.Int64("handoff_ms", m.handoff.Milliseconds()),
+		slog.Int64("process_ms", m.process.Milliseconds()),
+	)
+}
+
+// timingSummary aggregates one of the page timings over the whole run.
+type timingSummary struct {
+	MinMs int64 `json:"minMs"`
+	AvgMs int64 `json:"avgMs"`
+	P95Ms int64 `json:"p95Ms"`
+}
+
+func summarizeTimings(durations []time.Duration) timingSummary {
+	if len(durations) == 0 {
+		return timingSummary{}
+	}
+
+	sorted := slices.Clone(durations)
+	slices.Sort(sorted)
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+
+	p95 := sorted[(len(sorted)*95+99)/100-1]
+
+	return timingSummary{
+		MinMs: sorted[0].Milliseconds(),
+		AvgMs: (total / time.Duration(len(sorted))).Milliseconds(),
+		P95Ms: p95.Milliseconds(),
+	}
+}
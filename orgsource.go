@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	orgtypes "github.com/aws/aws-sdk-go-v2/service/organizations/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// orgSource scans LookupEvents of every active account of an organization.
+// Member accounts are scanned by assuming role in them, the management
+// account with the configured credentials. Accounts that can't be scanned are
+// recorded in the stats and skipped.
+type orgSource struct {
+	orgs        *organizations.Client
+	sts         *sts.Client
+	sdkConfig   aws.Config
+	role        string
+	concurrency int
+	stats       *scanStats
+	budget      *retryBudget
+
+	// newScanner returns the LookupEvents scanner of a single account.
+	newScanner func(client scan.CloudTrailClient, accountID string) *scanner
+}
+
+func (o *orgSource) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	accounts, err := o.listAccounts(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return stopCanceled
+		}
+
+		slog.Error("Couldn't list organization accounts", slog.String("error", err.Error()))
+		if isAccessDenied(err) {
+			return stopAccessDenied
+		}
+		return stopFailed
+	}
+
+	identity, err := o.sts.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		slog.Error("Couldn't get caller identity", slog.String("error", err.Error()))
+		return stopFailed
+	}
+	management := deRef(identity.Account)
+
+	slog.Info("Scanning organization", slog.Int("accounts", len(accounts)), slog.String("role", o.role))
+
+	// Accounts are scanned concurrently, but emit is only called from here.
+	events := make(chan scan.RawEvent)
+	sem := make(chan struct{}, o.concurrency)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	scanned := 0
+
+	go func() {
+		for _, account := range accounts {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil || o.budget.isTripped() {
+				break
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				if err := o.scanAccount(ctx, account, account == management, events); err != nil {
+					slog.Error("Skipping account", slog.String("account-id", account), slog.String("error", err.Error()))
+					o.stats.addFailedAccount(account, err)
+					return
+				}
+
+				mu.Lock()
+				scanned++
+				mu.Unlock()
+			}()
+		}
+
+		wg.Wait()
+		close(events)
+	}()
+
+	for event := range events {
+		emit(event)
+	}
+
+	if ctx.Err() != nil {
+		return stopCanceled
+	}
+
+	// The accounts left aren't failed ones, the whole scan stopped.
+	if o.budget.isTripped() {
+		return stopCircuitOpen
+	}
+
+	if scanned == 0 && len(accounts) > 0 {
+		return stopFailed
+	}
+
+	if o.stats.isTimeBounded() {
+		return stopDeadline
+	}
+
+	return stopComplete
+}
+
+func (o *orgSource) listAccounts(ctx context.Context) ([]string, error) {
+	var accounts []string
+
+	paginator := organizations.NewListAccountsPaginator(o.orgs, &organizations.ListAccountsInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, account := range page.Accounts {
+			if account.Status == orgtypes.AccountStatusActive {
+				accounts = append(accounts, deRef(account.Id))
+			}
+		}
+	}
+
+	return accounts, nil
+}
+
+// scanAccount runs a full LookupEvents scan of a single account and sends its
+// events to events.
+func (o *orgSource) scanAccount(ctx context.Context, account string, management bool, events chan<- scan.RawEvent) error {
+	cfg := o.sdkConfig.Copy()
+	if !management {
+		roleARN := fmt.Sprintf("arn:aws:iam::%s:role/%s", account, o.role)
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(o.sts, roleARN, func(opts *stscreds.AssumeRoleOptions) {
+			opts.RoleSessionName = "find-cloudtrail-arn-fields"
+		}))
+
+		// Fail before scanning if the role can't be assumed.
+		if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+			return fmt.Errorf("assume %s: %w", roleARN, err)
+		}
+	}
+
+	client := cloudtrail.NewFromConfig(cfg, func(opts *cloudtrail.Options) {
+		opts.Region = awsRegion
+	})
+
+	slog.Info("Scanning account", slog.String("account-id", account))
+	lookup := o.newScanner(client, account)
+	lookup.credentials = cfg.Credentials
+
+	reason := lookup.run(ctx, func(event scan.RawEvent) {
+		select {
+		case events <- event:
+		case <-ctx.Done():
+		}
+	})
+
+	switch reason {
+	case stopComplete, stopSaturated, stopCanceled, stopDeadline:
+		slog.Info("Account scanned", slog.String("account-id", account), slog.String("stop-reason", string(reason)))
+		return nil
+	default:
+		return fmt.Errorf("scan stopped: %s", reason)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/exp/maps"
+)
+
+// Values of --dedupe-by.
+const (
+	dedupeByKey  = "key"
+	dedupeByPair = "pair"
+)
+
+// pairStore keeps a match per distinct value of every key for
+// --dedupe-by pair, e.g. every role ARN seen under requestParameters.roleArn,
+// up to maxValues per key. It is the store the summaries are written from
+// then, the scan's own store still has one match per key. It is in memory
+// whatever the store of the scan is.
+type pairStore struct {
+	matchers  scan.Matcher
+	maxValues int
+	stats     *scanStats
+
+	mu     sync.Mutex
+	values map[string]map[string]scan.Match
+	pairs  int
+}
+
+func newPairStore(matchers scan.Matcher, maxValues int, stats *scanStats) *pairStore {
+	return &pairStore{matchers: matchers, maxValues: maxValues, stats: stats, values: make(map[string]map[string]scan.Match)}
+}
+
+// add is a scan.WithOnHit hook. The values of known keys didn't go through
+// the matchers, every new value does, so only identifiers are kept.
+func (p *pairStore) add(event scan.RawEvent, key, value string) {
+	p.mu.Lock()
+	values := p.values[key]
+	_, known := values[value]
+	full := p.maxValues > 0 && len(values) >= p.maxValues
+	p.mu.Unlock()
+
+	if known {
+		return
+	}
+	m, ok := p.matchers.Match(key, value)
+	if !ok {
+		return
+	}
+	if full {
+		if p.stats.addCappedValue(key) == 1 {
+			slog.Warn("!!! --max-values-per-key reached, further values of the key are dropped from the summary !!!",
+				slog.String("key", key),
+				slog.Int("max-values-per-key", p.maxValues),
+			)
+		}
+		return
+	}
+
+	m.Key = key
+	m.Service = strings.TrimSuffix(event.EventSource, ".amazonaws.com")
+	m.EventName = event.EventName
+	m.EventID = event.EventID
+	m.EventTime = event.EventTime
+	m.AccountID = event.AccountID
+	m.Region = event.Region
+	p.Add(m)
+}
+
+// Has reports whether a value of key is known.
+func (p *pairStore) Has(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.values[key]) > 0
+}
+
+// Add stores m unless its value is known for its key or the key has
+// maxValues already.
+func (p *pairStore) Add(m scan.Match) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	values, ok := p.values[m.Key]
+	if !ok {
+		values = make(map[string]scan.Match)
+		p.values[m.Key] = values
+	}
+	if _, known := values[m.Value]; known || p.maxValues > 0 && len(values) >= p.maxValues {
+		return false
+	}
+
+	values[m.Value] = m
+	p.pairs++
+	return true
+}
+
+// Len returns the number of pairs stored.
+func (p *pairStore) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pairs
+}
+
+// Each iterates over a copy of the matches, by key and value.
+func (p *pairStore) Each(fn func(m scan.Match) error) error {
+	p.mu.Lock()
+	matches := make([]scan.Match, 0, p.pairs)
+	for _, values := range p.values {
+		matches = append(matches, maps.Values(values)...)
+	}
+	p.mu.Unlock()
+
+	slices.SortFunc(matches, func(a, b scan.Match) int {
+		return cmp.Or(cmp.Compare(a.Key, b.Key), cmp.Compare(a.Value, b.Value))
+	})
+	for _, m := range matches {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// TestPairStore keeps every distinct identifier of a key up to maxValues,
+// sorted by key and value, and counts the values left out.
+func TestPairStore(t *testing.T) {
+	stats := &scanStats{}
+	pairs := newPairStore(scan.NewRegistry(scanMatchers(nil)...), 2, stats)
+	event := scan.RawEvent{EventSource: "iam.amazonaws.com", EventName: "GetRole", EventID: "1", AccountID: "123456789012", Region: "eu-west-1"}
+
+	hits := []struct{ key, value string }{
+		{"requestParameters.roleArn", "arn:aws:iam::123456789012:role/b"},
+		{"requestParameters.roleArn", "arn:aws:iam::123456789012:role/a"},
+		// Known value.
+		{"requestParameters.roleArn", "arn:aws:iam::123456789012:role/b"},
+		// Not an identifier.
+		{"requestParameters.roleArn", "deploy"},
+		// Over maxValues, twice.
+		{"requestParameters.roleArn", "arn:aws:iam::123456789012:role/c"},
+		{"requestParameters.roleArn", "arn:aws:iam::123456789012:role/d"},
+		{"requestParameters.subnetId", "subnet-12345678"},
+	}
+	for _, hit := range hits {
+		pairs.add(event, hit.key, hit.value)
+	}
+
+	if pairs.Len() != 3 {
+		t.Errorf("%d pairs, want 3", pairs.Len())
+	}
+	if !pairs.Has("requestParameters.subnetId") || pairs.Has("requestParameters.policyArn") {
+		t.Error("Has doesn't report the keys with values")
+	}
+
+	var got []string
+	pairs.Each(func(m scan.Match) error {
+		got = append(got, m.Key+"="+m.Value)
+		if m.Service != "iam" || m.EventName != "GetRole" || m.AccountID != "123456789012" || m.Region != "eu-west-1" {
+			t.Errorf("%s=%s misses the event: %+v", m.Key, m.Value, m)
+		}
+		return nil
+	})
+	want := []string{
+		"requestParameters.roleArn=arn:aws:iam::123456789012:role/a",
+		"requestParameters.roleArn=arn:aws:iam::123456789012:role/b",
+		"requestParameters.subnetId=subnet-12345678",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("pairs are %v, want %v", got, want)
+	}
+
+	if wantCapped := map[string]int{"requestParameters.roleArn": 2}; !maps.Equal(stats.CappedValues, wantCapped) {
+		t.Errorf("capped values are %v, want %v", stats.CappedValues, wantCapped)
+	}
+}
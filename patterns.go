@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// patternFlag adds a matcher for every "type=regexp" value of --pattern. They
+// are evaluated after the ARN and resource id matchers.
+func patternFlag(matchers *[]scan.Matcher) func(string) error {
+	return func(value string) error {
+		matchType, expr, ok := strings.Cut(value, "=")
+		if !ok || matchType == "" || expr == "" {
+			return fmt.Errorf("must be type=regexp, got %q", value)
+		}
+
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+
+		*matchers = append(*matchers, scan.RegexpMatcher{MatchType: matchType, Pattern: pattern, Confidence: 1})
+		return nil
+	}
+}
+
+// scanMatchers are the matchers of a scan with the --pattern matchers.
+func scanMatchers(patterns []scan.Matcher) []scan.Matcher {
+	return append(scan.DefaultMatchers(), patterns...)
+}
+
+// runPatterns runs the subcommands of patterns, only validate so far.
+func runPatterns(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "Usage: find-cloudtrail-arn-fields patterns validate [flags] type=regexp ...")
+		if len(args) > 0 && (args[0] == "-h" || args[0] == "--help") {
+			return exitOK
+		}
+		return exitConfig
+	}
+
+	return runPatternsValidate(args[1:])
+}
+
+// runPatternsValidate checks --pattern definitions before a long scan and
+// shows which matcher, if any, records sample values.
+func runPatternsValidate(args []string) int {
+	fs := newFlagSet("patterns validate", "[flags] type=regexp ...",
+		"find-cloudtrail-arn-fields patterns validate 'account-id=^[0-9]{12}$'",
+		"find-cloudtrail-arn-fields patterns validate --value 123456789012 --value sg-0123456789abcdef0 'account-id=^[0-9]{12}$'",
+	)
+	var values []string
+	fs.Func("value", "Sample value to match against the defaults and the patterns. Repeatable", func(value string) error {
+		values = append(values, value)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return parseExitCode(err)
+	}
+
+	var patterns []scan.Matcher
+	invalid := 0
+	for _, value := range fs.Args() {
+		if err := patternFlag(&patterns)(value); err != nil {
+			fmt.Printf("invalid %s: %v\n", value, err)
+			invalid++
+			continue
+		}
+		fmt.Printf("ok %s\n", value)
+	}
+
+	matchers := scan.NewRegistry(scanMatchers(patterns)...)
+	for _, value := range values {
+		if m, ok := matchers.Match("", value); ok {
+			fmt.Printf("%s: %s\n", value, m.MatchType)
+		} else {
+			fmt.Printf("%s: no match\n", value)
+		}
+	}
+
+	if invalid > 0 {
+		return exitConfig
+	}
+	return exitOK
+}
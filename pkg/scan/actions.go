@@ -0,0 +1,35 @@
+package scan
+
+import "sync"
+
+// actionTracker remembers, per event name, how many consecutive events found
+// no new keys. Once window events in a row found nothing, the event name is
+// considered saturated and further events of that name are skipped.
+type actionTracker struct {
+	mu     sync.Mutex
+	window int
+	stale  map[string]int
+}
+
+func newActionTracker(window int) *actionTracker {
+	return &actionTracker{window: window, stale: make(map[string]int, 1000)}
+}
+
+func (t *actionTracker) saturated(eventName string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.stale[eventName] >= t.window
+}
+
+func (t *actionTracker) record(eventName string, newKeys int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if newKeys > 0 {
+		t.stale[eventName] = 0
+		return
+	}
+
+	t.stale[eventName]++
+}
@@ -0,0 +1,88 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidARN is wrapped by the errors of ParseARN.
+var ErrInvalidARN = errors.New("invalid ARN")
+
+// ARN is a parsed ARN, arn:partition:service:region:account-id:resource.
+type ARN struct {
+	Partition string
+	Service   string
+	Region    string
+	AccountID string
+
+	// Resource is everything after the account id. It is split into
+	// ResourceType and ResourceID at the first "/" or ":", e.g.
+	// role/path/name is of type role with id path/name. Resources without a
+	// separator, and S3 objects, only have a ResourceID.
+	Resource     string
+	ResourceType string
+	ResourceID   string
+}
+
+// ParseARN parses s. Region and account id may be empty, as in S3 bucket
+// ARNs, partition, service and resource may not.
+func ParseARN(s string) (ARN, error) {
+	arn, problem := parseARN(s)
+	if problem != "" {
+		return ARN{}, fmt.Errorf("%w: %q %s", ErrInvalidARN, s, problem)
+	}
+
+	return arn, nil
+}
+
+// parseARN is ParseARN without the error, which the matchers would build for
+// nearly every value they see. It returns what is wrong with s instead.
+func parseARN(s string) (ARN, string) {
+	rest, ok := strings.CutPrefix(s, "arn:")
+	if !ok {
+		return ARN{}, "doesn't start with arn:"
+	}
+
+	var sections [4]string
+	for i := range sections {
+		if sections[i], rest, ok = strings.Cut(rest, ":"); !ok {
+			return ARN{}, "has fewer than 6 sections"
+		}
+	}
+
+	arn := ARN{
+		Partition: sections[0],
+		Service:   sections[1],
+		Region:    sections[2],
+		AccountID: sections[3],
+		Resource:  rest,
+	}
+	switch {
+	case arn.Partition == "":
+		return ARN{}, "has no partition"
+	case arn.Service == "":
+		return ARN{}, "has no service"
+	case arn.Resource == "":
+		return ARN{}, "has no resource"
+	}
+
+	// Bucket ARNs hold bucket/key, the key isn't a resource id.
+	if arn.Service == "s3" && arn.AccountID == "" {
+		arn.ResourceID = arn.Resource
+		return arn, ""
+	}
+
+	if i := strings.IndexAny(arn.Resource, "/:"); i > 0 {
+		arn.ResourceType, arn.ResourceID = arn.Resource[:i], arn.Resource[i+1:]
+	} else {
+		arn.ResourceID = arn.Resource
+	}
+
+	return arn, ""
+}
+
+// String returns the ARN as it was parsed.
+func (a ARN) String() string {
+	return "arn:" + a.Partition + ":" + a.Service + ":" + a.Region + ":" + a.AccountID + ":" + a.Resource
+}
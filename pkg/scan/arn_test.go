@@ -0,0 +1,149 @@
+package scan_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// arnTests are ARNs of the services CloudTrail events hold most, followed by
+// values that look like ARNs but aren't. want is the zero ARN for those.
+var arnTests = []struct {
+	arn  string
+	want scan.ARN
+}{
+	// IAM, global and with paths.
+	{"arn:aws:iam::123456789012:user/alice", scan.ARN{Partition: "aws", Service: "iam", AccountID: "123456789012", Resource: "user/alice", ResourceType: "user", ResourceID: "alice"}},
+	{"arn:aws:iam::123456789012:role/service-role/deploy", scan.ARN{Partition: "aws", Service: "iam", AccountID: "123456789012", Resource: "role/service-role/deploy", ResourceType: "role", ResourceID: "service-role/deploy"}},
+	{"arn:aws:iam::123456789012:role/aws-service-role/ecs.amazonaws.com/AWSServiceRoleForECS", scan.ARN{Partition: "aws", Service: "iam", AccountID: "123456789012", Resource: "role/aws-service-role/ecs.amazonaws.com/AWSServiceRoleForECS", ResourceType: "role", ResourceID: "aws-service-role/ecs.amazonaws.com/AWSServiceRoleForECS"}},
+	{"arn:aws:iam::123456789012:policy/team/a/b/ReadOnly", scan.ARN{Partition: "aws", Service: "iam", AccountID: "123456789012", Resource: "policy/team/a/b/ReadOnly", ResourceType: "policy", ResourceID: "team/a/b/ReadOnly"}},
+	{"arn:aws:iam::aws:policy/AdministratorAccess", scan.ARN{Partition: "aws", Service: "iam", AccountID: "aws", Resource: "policy/AdministratorAccess", ResourceType: "policy", ResourceID: "AdministratorAccess"}},
+	{"arn:aws:iam::123456789012:instance-profile/web", scan.ARN{Partition: "aws", Service: "iam", AccountID: "123456789012", Resource: "instance-profile/web", ResourceType: "instance-profile", ResourceID: "web"}},
+	{"arn:aws:iam::123456789012:mfa/alice", scan.ARN{Partition: "aws", Service: "iam", AccountID: "123456789012", Resource: "mfa/alice", ResourceType: "mfa", ResourceID: "alice"}},
+	{"arn:aws:iam::123456789012:root", scan.ARN{Partition: "aws", Service: "iam", AccountID: "123456789012", Resource: "root", ResourceID: "root"}},
+	{"arn:aws:iam::123456789012:saml-provider/Okta", scan.ARN{Partition: "aws", Service: "iam", AccountID: "123456789012", Resource: "saml-provider/Okta", ResourceType: "saml-provider", ResourceID: "Okta"}},
+	{"arn:aws:iam::123456789012:oidc-provider/token.actions.githubusercontent.com", scan.ARN{Partition: "aws", Service: "iam", AccountID: "123456789012", Resource: "oidc-provider/token.actions.githubusercontent.com", ResourceType: "oidc-provider", ResourceID: "token.actions.githubusercontent.com"}},
+	{"arn:aws:sts::123456789012:assumed-role/deploy/pipeline", scan.ARN{Partition: "aws", Service: "sts", AccountID: "123456789012", Resource: "assumed-role/deploy/pipeline", ResourceType: "assumed-role", ResourceID: "deploy/pipeline"}},
+	{"arn:aws:sts::123456789012:federated-user/bob", scan.ARN{Partition: "aws", Service: "sts", AccountID: "123456789012", Resource: "federated-user/bob", ResourceType: "federated-user", ResourceID: "bob"}},
+
+	// S3 buckets and objects have neither region nor account, the key is
+	// part of the id.
+	{"arn:aws:s3:::bucket", scan.ARN{Partition: "aws", Service: "s3", Resource: "bucket", ResourceID: "bucket"}},
+	{"arn:aws:s3:::bucket/reports/2024/07/01.csv", scan.ARN{Partition: "aws", Service: "s3", Resource: "bucket/reports/2024/07/01.csv", ResourceID: "bucket/reports/2024/07/01.csv"}},
+	{"arn:aws:s3:::bucket/key:with:colons", scan.ARN{Partition: "aws", Service: "s3", Resource: "bucket/key:with:colons", ResourceID: "bucket/key:with:colons"}},
+	{"arn:aws:s3:::bucket/*", scan.ARN{Partition: "aws", Service: "s3", Resource: "bucket/*", ResourceID: "bucket/*"}},
+	{"arn:aws:s3:::bucket/folder with spaces/file name.txt", scan.ARN{Partition: "aws", Service: "s3", Resource: "bucket/folder with spaces/file name.txt", ResourceID: "bucket/folder with spaces/file name.txt"}},
+	{"arn:aws:s3:eu-west-1:123456789012:accesspoint/reports", scan.ARN{Partition: "aws", Service: "s3", Region: "eu-west-1", AccountID: "123456789012", Resource: "accesspoint/reports", ResourceType: "accesspoint", ResourceID: "reports"}},
+	{"arn:aws:s3-object-lambda:us-east-1:123456789012:accesspoint/redact", scan.ARN{Partition: "aws", Service: "s3-object-lambda", Region: "us-east-1", AccountID: "123456789012", Resource: "accesspoint/redact", ResourceType: "accesspoint", ResourceID: "redact"}},
+
+	// Regional resources, separated by "/" or ":".
+	{"arn:aws:ec2:eu-west-1:123456789012:instance/i-0123456789abcdef0", scan.ARN{Partition: "aws", Service: "ec2", Region: "eu-west-1", AccountID: "123456789012", Resource: "instance/i-0123456789abcdef0", ResourceType: "instance", ResourceID: "i-0123456789abcdef0"}},
+	{"arn:aws:ec2:eu-west-1::image/ami-0123456789abcdef0", scan.ARN{Partition: "aws", Service: "ec2", Region: "eu-west-1", Resource: "image/ami-0123456789abcdef0", ResourceType: "image", ResourceID: "ami-0123456789abcdef0"}},
+	{"arn:aws:lambda:us-east-1:123456789012:function:handler", scan.ARN{Partition: "aws", Service: "lambda", Region: "us-east-1", AccountID: "123456789012", Resource: "function:handler", ResourceType: "function", ResourceID: "handler"}},
+	{"arn:aws:lambda:us-east-1:123456789012:function:handler:live", scan.ARN{Partition: "aws", Service: "lambda", Region: "us-east-1", AccountID: "123456789012", Resource: "function:handler:live", ResourceType: "function", ResourceID: "handler:live"}},
+	{"arn:aws:sns:us-east-1:123456789012:alerts", scan.ARN{Partition: "aws", Service: "sns", Region: "us-east-1", AccountID: "123456789012", Resource: "alerts", ResourceID: "alerts"}},
+	{"arn:aws:sqs:us-east-1:123456789012:queue.fifo", scan.ARN{Partition: "aws", Service: "sqs", Region: "us-east-1", AccountID: "123456789012", Resource: "queue.fifo", ResourceID: "queue.fifo"}},
+	{"arn:aws:kms:eu-west-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab", scan.ARN{Partition: "aws", Service: "kms", Region: "eu-west-1", AccountID: "123456789012", Resource: "key/1234abcd-12ab-34cd-56ef-1234567890ab", ResourceType: "key", ResourceID: "1234abcd-12ab-34cd-56ef-1234567890ab"}},
+	{"arn:aws:dynamodb:eu-west-1:123456789012:table/orders/stream/2024-07-01T12:30:00.000", scan.ARN{Partition: "aws", Service: "dynamodb", Region: "eu-west-1", AccountID: "123456789012", Resource: "table/orders/stream/2024-07-01T12:30:00.000", ResourceType: "table", ResourceID: "orders/stream/2024-07-01T12:30:00.000"}},
+	{"arn:aws:logs:eu-west-1:123456789012:log-group:/aws/lambda/handler:*", scan.ARN{Partition: "aws", Service: "logs", Region: "eu-west-1", AccountID: "123456789012", Resource: "log-group:/aws/lambda/handler:*", ResourceType: "log-group", ResourceID: "/aws/lambda/handler:*"}},
+	{"arn:aws:ecs:eu-west-1:123456789012:task/prod/0123456789abcdef0123456789abcdef", scan.ARN{Partition: "aws", Service: "ecs", Region: "eu-west-1", AccountID: "123456789012", Resource: "task/prod/0123456789abcdef0123456789abcdef", ResourceType: "task", ResourceID: "prod/0123456789abcdef0123456789abcdef"}},
+	{"arn:aws:secretsmanager:eu-west-1:123456789012:secret:db-AbCdEf", scan.ARN{Partition: "aws", Service: "secretsmanager", Region: "eu-west-1", AccountID: "123456789012", Resource: "secret:db-AbCdEf", ResourceType: "secret", ResourceID: "db-AbCdEf"}},
+	{"arn:aws:ssm:eu-west-1:123456789012:parameter/app/db/password", scan.ARN{Partition: "aws", Service: "ssm", Region: "eu-west-1", AccountID: "123456789012", Resource: "parameter/app/db/password", ResourceType: "parameter", ResourceID: "app/db/password"}},
+	{"arn:aws:cloudformation:us-east-1:123456789012:stack/app/44444444-aaaa-4bbb-8ccc-000000000004", scan.ARN{Partition: "aws", Service: "cloudformation", Region: "us-east-1", AccountID: "123456789012", Resource: "stack/app/44444444-aaaa-4bbb-8ccc-000000000004", ResourceType: "stack", ResourceID: "app/44444444-aaaa-4bbb-8ccc-000000000004"}},
+	{"arn:aws:states:eu-west-1:123456789012:execution:flow:run-1", scan.ARN{Partition: "aws", Service: "states", Region: "eu-west-1", AccountID: "123456789012", Resource: "execution:flow:run-1", ResourceType: "execution", ResourceID: "flow:run-1"}},
+	{"arn:aws:execute-api:eu-west-1:123456789012:abc123/prod/GET/items", scan.ARN{Partition: "aws", Service: "execute-api", Region: "eu-west-1", AccountID: "123456789012", Resource: "abc123/prod/GET/items", ResourceType: "abc123", ResourceID: "prod/GET/items"}},
+	{"arn:aws:organizations::111111111111:account/o-abcdef1234/222222222222", scan.ARN{Partition: "aws", Service: "organizations", AccountID: "111111111111", Resource: "account/o-abcdef1234/222222222222", ResourceType: "account", ResourceID: "o-abcdef1234/222222222222"}},
+
+	// Other partitions.
+	{"arn:aws-us-gov:iam::123456789012:role/gov-deploy", scan.ARN{Partition: "aws-us-gov", Service: "iam", AccountID: "123456789012", Resource: "role/gov-deploy", ResourceType: "role", ResourceID: "gov-deploy"}},
+	{"arn:aws-us-gov:s3:::gov-bucket/key", scan.ARN{Partition: "aws-us-gov", Service: "s3", Resource: "gov-bucket/key", ResourceID: "gov-bucket/key"}},
+	{"arn:aws-us-gov:ec2:us-gov-west-1:123456789012:vpc/vpc-12345678", scan.ARN{Partition: "aws-us-gov", Service: "ec2", Region: "us-gov-west-1", AccountID: "123456789012", Resource: "vpc/vpc-12345678", ResourceType: "vpc", ResourceID: "vpc-12345678"}},
+	{"arn:aws-us-gov:lambda:us-gov-east-1:123456789012:function:gov", scan.ARN{Partition: "aws-us-gov", Service: "lambda", Region: "us-gov-east-1", AccountID: "123456789012", Resource: "function:gov", ResourceType: "function", ResourceID: "gov"}},
+	{"arn:aws-cn:iam::123456789012:user/path/to/wang", scan.ARN{Partition: "aws-cn", Service: "iam", AccountID: "123456789012", Resource: "user/path/to/wang", ResourceType: "user", ResourceID: "path/to/wang"}},
+	{"arn:aws-cn:s3:::cn-bucket", scan.ARN{Partition: "aws-cn", Service: "s3", Resource: "cn-bucket", ResourceID: "cn-bucket"}},
+	{"arn:aws-cn:kms:cn-north-1:123456789012:alias/app", scan.ARN{Partition: "aws-cn", Service: "kms", Region: "cn-north-1", AccountID: "123456789012", Resource: "alias/app", ResourceType: "alias", ResourceID: "app"}},
+	{"arn:aws-cn:sqs:cn-northwest-1:123456789012:jobs", scan.ARN{Partition: "aws-cn", Service: "sqs", Region: "cn-northwest-1", AccountID: "123456789012", Resource: "jobs", ResourceID: "jobs"}},
+	{"arn:aws-iso:ec2:us-iso-east-1:123456789012:instance/i-0123456789abcdef0", scan.ARN{Partition: "aws-iso", Service: "ec2", Region: "us-iso-east-1", AccountID: "123456789012", Resource: "instance/i-0123456789abcdef0", ResourceType: "instance", ResourceID: "i-0123456789abcdef0"}},
+
+	// Not ARNs.
+	{"", scan.ARN{}},
+	{"arn", scan.ARN{}},
+	{"ARN:aws:iam::123456789012:user/alice", scan.ARN{}},
+	{"arn:aws:iam::123456789012", scan.ARN{}},
+	{"arn::iam::123456789012:user/alice", scan.ARN{}},
+	{"arn:aws:::123456789012:user/alice", scan.ARN{}},
+	{"arn:aws:iam::123456789012:", scan.ARN{}},
+	{" arn:aws:iam::123456789012:user/alice", scan.ARN{}},
+}
+
+func TestParseARN(t *testing.T) {
+	for _, tt := range arnTests {
+		t.Run(tt.arn, func(t *testing.T) {
+			got, err := scan.ParseARN(tt.arn)
+			if tt.want == (scan.ARN{}) {
+				if !errors.Is(err, scan.ErrInvalidARN) {
+					t.Errorf("ParseARN returned %+v, %v, want %v", got, err, scan.ErrInvalidARN)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseARN\ngot  %+v\nwant %+v", got, tt.want)
+			}
+			if got.String() != tt.arn {
+				t.Errorf("String() = %q", got.String())
+			}
+		})
+	}
+}
+
+func FuzzParseARN(f *testing.F) {
+	for _, tt := range arnTests {
+		f.Add(tt.arn)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		arn, err := scan.ParseARN(s)
+		if err != nil {
+			if !errors.Is(err, scan.ErrInvalidARN) {
+				t.Fatalf("error %v doesn't wrap ErrInvalidARN", err)
+			}
+			if arn != (scan.ARN{}) {
+				t.Fatalf("invalid %q parsed as %+v", s, arn)
+			}
+			return
+		}
+
+		if arn.String() != s {
+			t.Fatalf("%q reads back as %q", s, arn.String())
+		}
+		if arn.Partition == "" || arn.Service == "" || arn.Resource == "" {
+			t.Fatalf("%q parsed without partition, service or resource: %+v", s, arn)
+		}
+		if strings.Contains(arn.Partition+arn.Service+arn.Region+arn.AccountID, ":") {
+			t.Fatalf("%q has a colon before the resource: %+v", s, arn)
+		}
+
+		resource := arn.ResourceID
+		if arn.ResourceType != "" {
+			sep := arn.Resource[len(arn.ResourceType)]
+			if sep != '/' && sep != ':' {
+				t.Fatalf("%q has a resource type not followed by a separator: %+v", s, arn)
+			}
+			resource = arn.ResourceType + string(sep) + arn.ResourceID
+		}
+		if resource != arn.Resource {
+			t.Fatalf("%q splits its resource into %q and %q", s, arn.ResourceType, arn.ResourceID)
+		}
+
+		again, err := scan.ParseARN(arn.String())
+		if err != nil || again != arn {
+			t.Fatalf("%q parsed again as %+v, %v", s, again, err)
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// corpusEvents reads the anonymized events of testdata/events, keyed by file
+// name without extension.
+func corpusEvents(tb testing.TB) map[string]string {
+	tb.Helper()
+
+	paths, err := filepath.Glob(filepath.Join("testdata", "events", "*.json"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	events := make(map[string]string, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		events[strings.TrimSuffix(filepath.Base(path), ".json")] = strings.TrimSpace(string(data))
+	}
+	return events
+}
+
+// deepEvent nests requestParameters depth levels deep, with an ARN at the
+// bottom.
+func deepEvent(depth int) string {
+	var b strings.Builder
+	b.WriteString(`{"eventName":"Deep","eventSource":"test.amazonaws.com","requestParameters":`)
+	for i := 0; i < depth; i++ {
+		b.WriteString(`{"level":`)
+	}
+	b.WriteString(`"arn:aws:s3:::bottom"`)
+	b.WriteString(strings.Repeat("}", depth))
+	b.WriteString("}")
+	return b.String()
+}
+
+// wideEvent has an array of n items with an id and an ARN each, all collapsed
+// into the same two keys.
+func wideEvent(n int) string {
+	var b strings.Builder
+	b.WriteString(`{"eventName":"Wide","eventSource":"test.amazonaws.com","responseElements":{"items":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(`{"id":"i-0123456789abcdef0","arn":"arn:aws:ec2:eu-west-1:123456789012:instance/i-0123456789abcdef0","index":1}`)
+	}
+	b.WriteString(`]}}`)
+	return b.String()
+}
+
+func newBenchScanner(b *testing.B) *Scanner {
+	b.Helper()
+
+	s, err := New(WithoutMatchLogs(), WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return s
+}
+
+// BenchmarkHandleEvent handles the same event over and over, so after the
+// first iteration its keys are known, as for most events of a scan.
+func BenchmarkHandleEvent(b *testing.B) {
+	events := corpusEvents(b)
+	payloads := []struct {
+		name    string
+		payload string
+	}{
+		{"small", events["s3-getobject"]},
+		{"medium", events["ec2-runinstances"]},
+		{"deep", deepEvent(500)},
+		{"wide", wideEvent(10000)},
+	}
+	for _, p := range payloads {
+		b.Run(p.name, func(b *testing.B) {
+			s := newBenchScanner(b)
+			event := RawEvent{EventID: "event", Payload: p.payload}
+			ctx := context.Background()
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(p.payload)))
+			b.ResetTimer()
+			for range b.N {
+				s.handleEvent(ctx, event)
+			}
+		})
+	}
+}
+
+// BenchmarkHandleCorpus handles every event of the corpus in turn.
+func BenchmarkHandleCorpus(b *testing.B) {
+	var events []RawEvent
+	size := 0
+	for name, payload := range corpusEvents(b) {
+		events = append(events, RawEvent{EventID: name, Payload: payload})
+		size += len(payload)
+	}
+	s := newBenchScanner(b)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size / len(events)))
+	b.ResetTimer()
+	for i := range b.N {
+		s.handleEvent(ctx, events[i%len(events)])
+	}
+}
+
+// BenchmarkHandleEventParallel handles the corpus events from every P at
+// once, as the workers of a scan do, which is where the decode buffers and
+// field maps are taken from and put back to their pools.
+func BenchmarkHandleEventParallel(b *testing.B) {
+	var events []RawEvent
+	size := 0
+	for name, payload := range corpusEvents(b) {
+		events = append(events, RawEvent{EventID: name, Payload: payload})
+		size += len(payload)
+	}
+	s := newBenchScanner(b)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size / len(events)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			s.handleEvent(ctx, events[i%len(events)])
+		}
+	})
+}
+
+// BenchmarkWalkFields builds the raw and clean keys of every field of a
+// decoded event, what cleanKey did on the flattened keys before.
+func BenchmarkWalkFields(b *testing.B) {
+	var fields any
+	if err := json.Unmarshal([]byte(corpusEvents(b)["ec2-runinstances"]), &fields); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		leaves := 0
+		walkFields(fields, func(rawKey, cleanKey string, value any) {
+			leaves++
+		})
+	}
+}
+
+// BenchmarkWalkCorpus walks every decoded event of the corpus in turn.
+func BenchmarkWalkCorpus(b *testing.B) {
+	var docs []any
+	for _, payload := range corpusEvents(b) {
+		var doc any
+		if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+			b.Fatal(err)
+		}
+		docs = append(docs, doc)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		walkFields(docs[i%len(docs)], func(rawKey, cleanKey string, value any) {})
+	}
+}
+
+func BenchmarkMatchers(b *testing.B) {
+	matchers := []struct {
+		name    string
+		matcher Matcher
+	}{
+		{"arn", ARNMatcher{}},
+		{"resource-id", ResourceIDMatcher{}},
+		{"registry", defaultRegistry},
+	}
+	values := []struct {
+		name  string
+		value string
+	}{
+		{"arn", "arn:aws:iam::123456789012:role/service-role/app/app-task"},
+		{"resource-id", "i-0123456789abcdef0"},
+		{"other", "ip-10-0-0-1.eu-west-1.compute.internal"},
+	}
+	for _, m := range matchers {
+		for _, v := range values {
+			b.Run(m.name+"/"+v.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for range b.N {
+					m.matcher.Match("requestParameters.key", v.value)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package scan
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Clock is the time source of retries and rate limiting. Tests replace
+// SystemClock with a scantest.Clock to see the delays without waiting them
+// out.
+type Clock interface {
+	Now() time.Time
+
+	// Sleep waits for d. It returns ctx.Err() as soon as ctx is done, e.g.
+	// on Ctrl-C, instead of waiting out d.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// SystemClock is the wall clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitLimiter blocks until limiter allows another event, keeping its time by
+// clock. A limiter must either always be waited for with the same clock or
+// never.
+func WaitLimiter(ctx context.Context, clock Clock, limiter *rate.Limiter) error {
+	now := clock.Now()
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return limiter.Wait(ctx)
+	}
+
+	if err := clock.Sleep(ctx, reservation.DelayFrom(now)); err != nil {
+		reservation.CancelAt(clock.Now())
+		return err
+	}
+	return nil
+}
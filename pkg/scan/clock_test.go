@@ -0,0 +1,49 @@
+package scan_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan/scantest"
+	"golang.org/x/time/rate"
+)
+
+func TestSystemClockSleepCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := scan.SystemClock.Sleep(ctx, time.Hour)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Sleep returned %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the canceled sleep took %s", elapsed)
+	}
+}
+
+// TestWaitLimiterClock waits for the limiter on the fake clock, the delays
+// only move its time.
+func TestWaitLimiterClock(t *testing.T) {
+	start := time.Now()
+	clock := scantest.NewClock(start)
+	limiter := rate.NewLimiter(rate.Every(time.Second), 1)
+
+	for range 3 {
+		if err := scan.WaitLimiter(context.Background(), clock, limiter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := clock.Now().Sub(start); got != 2*time.Second {
+		t.Errorf("the clock moved %s, want 2s", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := scan.WaitLimiter(ctx, clock, limiter); !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitLimiter returned %v, want %v", err, context.Canceled)
+	}
+}
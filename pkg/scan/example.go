@@ -0,0 +1,27 @@
+package scan
+
+// BetterExample reports whether candidate is a better example of its key
+// than current. In order it prefers the match the matcher is more confident
+// about, a value that parses as an ARN, the shorter value and the lower value
+// and event id, so the best of a set of matches is the same whatever their
+// order.
+func BetterExample(current, candidate Match) bool {
+	if candidate.Confidence != current.Confidence {
+		return candidate.Confidence > current.Confidence
+	}
+
+	_, currentProblem := parseARN(current.Value)
+	_, candidateProblem := parseARN(candidate.Value)
+	if (currentProblem == "") != (candidateProblem == "") {
+		return candidateProblem == ""
+	}
+
+	if len(candidate.Value) != len(current.Value) {
+		return len(candidate.Value) < len(current.Value)
+	}
+	if candidate.Value != current.Value {
+		return candidate.Value < current.Value
+	}
+
+	return candidate.EventID < current.EventID
+}
@@ -0,0 +1,396 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	resourcePattern *regexp.Regexp = regexp.MustCompile(`^[a-zA-Z]+-([a-zA-Z0-9]{17}|[a-zA-Z0-9]{8})$`)
+
+	// payloadBuffers and fieldMaps are reused across events to cut the
+	// allocations of decoding every payload.
+	payloadBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	fieldMaps      = sync.Pool{New: func() any { return make(map[string]any, 64) }}
+)
+
+func (s *Scanner) handleEvent(ctx context.Context, event RawEvent) {
+	s.mu.Lock()
+	s.stats.Events++
+	s.mu.Unlock()
+
+	// Skipped and failed events are handled too, with no hits. event gets
+	// the fields read from the payload below.
+	hits := 0
+	if len(s.onEvent) > 0 {
+		defer func() {
+			for _, fn := range s.onEvent {
+				fn(event, hits)
+			}
+		}()
+	}
+
+	if event.EventSource != "" && s.skipSource(event.EventSource) {
+		return
+	}
+
+	if event.EventName != "" && s.skipAction(event.EventName) {
+		return
+	}
+
+	if size := len(event.Payload); s.maxEventSize > 0 && size > s.maxEventSize {
+		s.logger.Warn("Skipping oversized event",
+			slog.String("event-id", event.EventID),
+			slog.String("action", event.EventName),
+			slog.Int("size", size),
+			slog.Int("max-event-size", s.maxEventSize),
+		)
+		s.mu.Lock()
+		s.stats.OversizedEvents++
+		s.mu.Unlock()
+		return
+	}
+
+	payload := strings.TrimSpace(event.Payload)
+	if payload == "" {
+		if !s.skipAccount(event.AccountID) {
+			hits = s.handleEnvelope(ctx, event)
+		}
+		return
+	}
+	if payload[0] != '{' {
+		if !s.skipAccount(event.AccountID) {
+			hits = s.handleNonObject(ctx, event)
+		}
+		return
+	}
+
+	buf := payloadBuffers.Get().(*bytes.Buffer)
+	defer payloadBuffers.Put(buf)
+	buf.Reset()
+	buf.WriteString(event.Payload)
+
+	fields := fieldMaps.Get().(map[string]any)
+	// Unmarshalling into a map keeps its entries, so the previous event's
+	// fields must go first.
+	clear(fields)
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		fieldMaps.Put(fields)
+		s.fail(event, err)
+		return
+	}
+
+	defer fieldMaps.Put(fields)
+
+	// For an organization trail or --org-role scan this tells the accounts
+	// apart.
+	if account, ok := fields["recipientAccountId"].(string); ok {
+		event.AccountID = account
+	}
+	if s.skipAccount(event.AccountID) {
+		return
+	}
+	if region, ok := fields["awsRegion"].(string); ok {
+		event.Region = region
+	}
+	// Sources reading the records as they are, e.g. stdin, may know neither.
+	if event.EventName == "" {
+		event.EventName, _ = fields["eventName"].(string)
+		if s.skipAction(event.EventName) {
+			return
+		}
+	}
+	if event.EventSource == "" {
+		event.EventSource, _ = fields["eventSource"].(string)
+		if s.skipSource(event.EventSource) {
+			return
+		}
+	}
+	actor := ""
+	if identity, ok := fields["userIdentity"].(map[string]any); ok {
+		actor, _ = identity["arn"].(string)
+	}
+
+	hits = s.recordFields(ctx, event, actor, fields)
+}
+
+// handleEnvelope records what the source knows of an event without payload,
+// e.g. a LookupEvents event whose CloudTrailEvent is missing. Only the first
+// one is logged, they tend to come in bulk.
+func (s *Scanner) handleEnvelope(ctx context.Context, event RawEvent) int {
+	s.mu.Lock()
+	s.stats.EmptyPayloads++
+	s.mu.Unlock()
+
+	s.emptyPayloadOnce.Do(func() {
+		s.logger.Warn("Event without payload, only its envelope is recorded, further ones are counted as emptyPayloads",
+			slog.String("event-id", event.EventID),
+			slog.String("action", event.EventName),
+		)
+	})
+
+	resources := make([]any, 0, len(event.Resources))
+	for _, resource := range event.Resources {
+		resources = append(resources, map[string]any{"ResourceType": resource.Type, "ResourceName": resource.Name})
+	}
+	return s.recordFields(ctx, event, "", map[string]any{
+		"eventName":   event.EventName,
+		"eventSource": event.EventSource,
+		"Resources":   resources,
+	})
+}
+
+// payloadKey is the key of payloads that aren't objects, e.g. $[].eventName
+// for an array of records.
+const payloadKey = "$"
+
+// handleNonObject records the payloads that are valid json but no object,
+// e.g. a truncated upstream export. Arrays are walked element by element,
+// scalars are recorded under payloadKey.
+func (s *Scanner) handleNonObject(ctx context.Context, event RawEvent) int {
+	var payload any
+	if err := json.Unmarshal([]byte(event.Payload), &payload); err != nil {
+		s.fail(event, err)
+		return 0
+	}
+
+	s.logger.Warn("Event payload is not a json object", slog.String("event-id", event.EventID), slog.String("action", event.EventName))
+
+	s.mu.Lock()
+	s.stats.NonObjectPayloads++
+	s.mu.Unlock()
+
+	return s.recordFields(ctx, event, "", map[string]any{payloadKey: payload})
+}
+
+// recordFields records the values of fields and returns the hits, the values
+// recorded under a key of the store, see WithOnHit.
+func (s *Scanner) recordFields(ctx context.Context, event RawEvent, actor string, fields map[string]any) int {
+	newKeys, hits := 0, 0
+	// The hits of the event are only collected for the WithOnEventHits hooks.
+	var collected []Hit
+	walkFields(fields, func(rawKey, cleanKey string, value any) {
+		switch castV := value.(type) {
+		case string:
+			m, added, hit := s.recordValue(event, actor, rawKey, cleanKey, castV)
+			if hit {
+				hits++
+				if len(s.onHits) > 0 {
+					collected = append(collected, Hit{Key: cleanKey, Value: castV})
+				}
+			}
+			if added {
+				newKeys++
+				s.onNewMatch(ctx, m)
+			}
+		}
+	})
+
+	if s.actions != nil {
+		s.actions.record(event.EventName, newKeys)
+	}
+	if len(collected) > 0 {
+		for _, fn := range s.onHits {
+			fn(event, collected)
+		}
+	}
+	return hits
+}
+
+// skipSource reports whether the events of source aren't handled, counting
+// them if so.
+func (s *Scanner) skipSource(source string) bool {
+	if len(s.sources) == 0 || slices.Contains(s.sources, source) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stats.SkippedSources == nil {
+		s.stats.SkippedSources = make(map[string]int)
+	}
+	s.stats.SkippedSources[source]++
+	return true
+}
+
+// skipAccount reports whether the events of account aren't handled, counting
+// them if so.
+func (s *Scanner) skipAccount(account string) bool {
+	if len(s.accounts) == 0 || slices.Contains(s.accounts, account) {
+		return false
+	}
+	if account == "" {
+		account = "unknown"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stats.SkippedAccounts == nil {
+		s.stats.SkippedAccounts = make(map[string]int)
+	}
+	s.stats.SkippedAccounts[account]++
+	return true
+}
+
+// skipAction reports whether the events of eventName stopped yielding new
+// keys, counting them if so.
+func (s *Scanner) skipAction(eventName string) bool {
+	if s.actions == nil || !s.actions.saturated(eventName) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stats.SkippedActions == nil {
+		s.stats.SkippedActions = make(map[string]int)
+	}
+	s.stats.SkippedActions[eventName]++
+	return true
+}
+
+// RecordValue records value under key if one of the matchers accepts it,
+// event being where it was found. key is taken as cleaned, e.g. the Key of a
+// previous Match, array indices aren't collapsed again. It reports whether
+// the key was new to the store. The WithOnMatch hooks aren't called.
+func (s *Scanner) RecordValue(event RawEvent, key, value string) (Match, bool) {
+	m, added, _ := s.recordValue(event, "", key, key, value)
+	return m, added
+}
+
+// recordValue reports whether the key was added to the store and whether the
+// value is a hit, recorded under a key of the store.
+func (s *Scanner) recordValue(event RawEvent, actor, rawKey, cleanKey, value string) (m Match, added, hit bool) {
+	known := s.store.Has(cleanKey)
+	if known {
+		s.addKeyHit(event, cleanKey, value)
+	}
+	if known && !s.bestExamples {
+		return Match{}, false, true
+	}
+
+	m, ok := s.matchers.Match(cleanKey, value)
+	if !ok {
+		return Match{}, false, known
+	}
+
+	m.Key = cleanKey
+	m.RawKey = rawKey
+	m.Service = strings.TrimSuffix(event.EventSource, ".amazonaws.com")
+	m.EventName = event.EventName
+	m.EventID = event.EventID
+	m.EventTime = event.EventTime
+	m.Actor = actor
+	m.AccountID = event.AccountID
+	m.Region = event.Region
+
+	if known {
+		s.replaceExample(m)
+		return Match{}, false, true
+	}
+
+	if !s.quietMatches {
+		s.logger.Info(matchMessage(m.MatchType),
+			slog.String("key", cleanKey),
+			slog.String("value", value),
+			slog.String("action", event.EventName),
+			slog.String("event-id", event.EventID),
+			slog.String("account-id", event.AccountID),
+		)
+	}
+
+	if !s.store.Add(m) {
+		// Another worker added the key in the meantime.
+		if s.bestExamples {
+			s.replaceExample(m)
+		}
+		return Match{}, false, false
+	}
+
+	s.mu.Lock()
+	s.stats.Keys++
+	if s.stats.MatcherHits == nil {
+		s.stats.MatcherHits = make(map[string]int)
+	}
+	s.stats.MatcherHits[m.MatchType]++
+	if s.stats.KeyHits == nil {
+		s.stats.KeyHits = make(map[string]int)
+	}
+	s.stats.KeyHits[cleanKey]++
+	s.mu.Unlock()
+
+	for _, fn := range s.onHit {
+		fn(event, cleanKey, value)
+	}
+	for _, fn := range s.onNewKey {
+		fn(event, m)
+	}
+
+	return m, true, true
+}
+
+func (s *Scanner) addKeyHit(event RawEvent, key, value string) {
+	s.mu.Lock()
+	if s.stats.KeyHits == nil {
+		s.stats.KeyHits = make(map[string]int)
+	}
+	s.stats.KeyHits[key]++
+	s.mu.Unlock()
+
+	for _, fn := range s.onHit {
+		fn(event, key, value)
+	}
+}
+
+func (s *Scanner) replaceExample(m Match) {
+	if !s.store.(ExampleStore).Replace(m, BetterExample) {
+		return
+	}
+
+	s.mu.Lock()
+	s.stats.ReplacedExamples++
+	s.mu.Unlock()
+}
+
+// matchMessage is the log message of a match. The analyze command reads the
+// matches back from the logs by these messages.
+func matchMessage(matchType string) string {
+	switch matchType {
+	case MatchTypeARN:
+		return "Has arn"
+	case MatchTypeResourceID:
+		return "Has resource Id"
+	default:
+		return "Has " + matchType
+	}
+}
+
+func deRef[T any](ref *T) T {
+	if ref == nil {
+		var zero T
+		return zero
+	}
+
+	return *ref
+}
+
+// fail records an event whose payload couldn't be read.
+func (s *Scanner) fail(event RawEvent, err error) {
+	s.logger.Error("Failed to unmarshall event json", slog.String("error", err.Error()), slog.String("event-id", event.EventID))
+
+	s.mu.Lock()
+	s.stats.FailedEvents++
+	s.mu.Unlock()
+
+	for _, fn := range s.onFailure {
+		fn(event, err)
+	}
+}
@@ -0,0 +1,265 @@
+package scan_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// FuzzFindIdentifiers records a single value with the default matchers. A
+// value is recorded exactly when a matcher accepts it, and as the type of
+// that matcher:
+//
+//	go test ./pkg/scan -run '^$' -fuzz FuzzFindIdentifiers
+func FuzzFindIdentifiers(f *testing.F) {
+	for _, seed := range [][2]string{
+		{"requestParameters.roleArn", "arn:aws:iam::123456789012:role/service-role/deploy"},
+		{"requestParameters.bucketName", "arn:aws:s3:::bucket/key/with:colon"},
+		{"requestParameters.instancesSet.items[].instanceId", "i-0123456789abcdef0"},
+		{"requestParameters.groupId", "sg-12345678"},
+		{"responseElements.credentials.sessionToken", "IQoJb3JpZ2luX2VjEJ"},
+		{"userIdentity.arn", "arn:aws:sts::123456789012:assumed-role/Admin/alice@example.com"},
+		{"requestParameters.name", "arn:"},
+		{"requestParameters.name", "arn:aws::::"},
+		{`requestParameters.tags.kubernetes\.io/cluster/name`, "arn:aws-cn:eks:cn-north-1:123456789012:cluster/日本"},
+		{"$", "i-0123456789abcdef0\n"},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+
+	f.Fuzz(func(t *testing.T, key, value string) {
+		sc, err := scan.New(scan.WithoutMatchLogs())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, added := sc.RecordValue(scan.RawEvent{EventName: "GetObject"}, key, value)
+
+		_, isARN := scan.ARNMatcher{}.Match(key, value)
+		_, isID := scan.ResourceIDMatcher{}.Match(key, value)
+		if added != (isARN || isID) {
+			t.Fatalf("recorded %t, the matchers accept it as ARN %t and resource id %t", added, isARN, isID)
+		}
+		if !added {
+			return
+		}
+
+		if m.Key != key || m.Value != value {
+			t.Fatalf("recorded %q=%q for %q=%q", m.Key, m.Value, key, value)
+		}
+		switch m.MatchType {
+		case scan.MatchTypeARN:
+			if _, err := scan.ParseARN(m.Value); err != nil {
+				t.Fatalf("recorded an ARN that doesn't parse: %v", err)
+			}
+		case scan.MatchTypeResourceID:
+			if isARN || !isID {
+				t.Fatalf("recorded %q as resource id, the ARN matcher comes first", m.Value)
+			}
+		default:
+			t.Fatalf("unknown match type %q", m.MatchType)
+		}
+		if sc.Store().Len() != 1 {
+			t.Fatalf("store has %d keys, want 1", sc.Store().Len())
+		}
+	})
+}
+
+// warnings is a slog.Handler keeping the messages and event ids of the
+// warnings logged, whichever worker logs them.
+type warnings struct {
+	mu       sync.Mutex
+	messages []string
+	eventIDs []string
+}
+
+func (h *warnings) Enabled(_ context.Context, level slog.Level) bool { return level >= slog.LevelWarn }
+
+func (h *warnings) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.messages = append(h.messages, r.Message)
+	r.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == "event-id" {
+			h.eventIDs = append(h.eventIDs, attr.Value.String())
+		}
+		return true
+	})
+	return nil
+}
+
+func (h *warnings) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *warnings) WithGroup(string) slog.Handler      { return h }
+
+// TestHandleEnvelope counts every event without payload in
+// Stats.EmptyPayloads, records the resources of its envelope and warns only
+// about the first one, also with several workers.
+func TestHandleEnvelope(t *testing.T) {
+	const empty = 40
+	var events []scan.RawEvent
+	for i := 0; i < empty; i++ {
+		payload := ""
+		if i%2 == 1 {
+			payload = " \n\t"
+		}
+		events = append(events, scan.RawEvent{
+			EventID:     fmt.Sprintf("empty-%d", i),
+			EventName:   "AssumeRole",
+			EventSource: "sts.amazonaws.com",
+			AccountID:   "123456789012",
+			Payload:     payload,
+			Resources: []scan.Resource{
+				{Type: "AWS::IAM::Role", Name: fmt.Sprintf("arn:aws:iam::123456789012:role/role-%d", i)},
+			},
+		})
+	}
+	// Skipped accounts aren't counted, their events aren't handled at all.
+	events = append(events, scan.RawEvent{EventID: "other-account", AccountID: "210987654321"})
+	events = append(events, arnEvents(3)...)
+	for i := empty; i < len(events); i++ {
+		if events[i].AccountID == "" {
+			events[i].AccountID = "123456789012"
+		}
+	}
+
+	for _, workers := range []int{1, 8} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			logged := &warnings{}
+			var hits []string
+			var mu sync.Mutex
+			sc, err := scan.New(
+				scan.WithSource(sliceSource(events...)),
+				scan.WithConcurrency(workers),
+				scan.WithAccounts("123456789012"),
+				scan.WithoutMatchLogs(),
+				scan.WithLogger(slog.New(logged)),
+				scan.WithOnHit(func(event scan.RawEvent, key, value string) {
+					if strings.HasPrefix(event.EventID, "empty-") {
+						mu.Lock()
+						hits = append(hits, key)
+						mu.Unlock()
+					}
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stats, err := sc.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.EmptyPayloads != empty {
+				t.Errorf("%d empty payloads, want %d", stats.EmptyPayloads, empty)
+			}
+			if stats.SkippedAccounts["210987654321"] != 1 {
+				t.Errorf("skipped accounts %v, want the other account once", stats.SkippedAccounts)
+			}
+
+			if len(logged.messages) != 1 || !strings.Contains(logged.messages[0], "emptyPayloads") {
+				t.Fatalf("warnings %q, want one about emptyPayloads", logged.messages)
+			}
+			if len(logged.eventIDs) != 1 || !strings.HasPrefix(logged.eventIDs[0], "empty-") {
+				t.Errorf("warned about events %q, want one without payload", logged.eventIDs)
+			}
+
+			// Every envelope hits its resource, the key is stored once.
+			if len(hits) != empty {
+				t.Errorf("%d hits of events without payload, want %d", len(hits), empty)
+			}
+			for _, key := range hits {
+				if key != "Resources[].ResourceName" {
+					t.Errorf("hit under %q, want Resources[].ResourceName", key)
+				}
+			}
+			if !sc.Store().Has("Resources[].ResourceName") {
+				t.Error("the resources of the envelopes aren't stored")
+			}
+			if got := sc.Store().Len(); got != 1+3 {
+				t.Errorf("store has %d keys, want the resource name and the 3 of the other events", got)
+			}
+		})
+	}
+}
+
+// TestHandleNonObject records the payloads that are json arrays or scalars
+// under $, arrays element by element.
+func TestHandleNonObject(t *testing.T) {
+	const role = "arn:aws:iam::123456789012:role/deploy"
+	tests := []struct {
+		name    string
+		payload string
+		hits    map[string]string
+		failed  bool
+	}{
+		{name: "string", payload: `"` + role + `"`, hits: map[string]string{"$": role}},
+		{name: "padded string", payload: " \n\"" + role + "\"\n", hits: map[string]string{"$": role}},
+		{name: "number", payload: `123456789012`},
+		{name: "bool", payload: `true`},
+		{name: "null", payload: `null`},
+		{name: "empty array", payload: `[]`},
+		{name: "array of strings", payload: `["not an arn", "` + role + `"]`, hits: map[string]string{"$[]": role}},
+		{
+			name:    "array of records",
+			payload: `[{"eventName":"AssumeRole","requestParameters":{"roleArn":"` + role + `"}},{"resources":[{"ARN":"arn:aws:s3:::bucket"}]}]`,
+			hits: map[string]string{
+				"$[].requestParameters.roleArn": role,
+				"$[].resources[].ARN":           "arn:aws:s3:::bucket",
+			},
+		},
+		{name: "nested arrays", payload: `[[["` + role + `"]]]`, hits: map[string]string{"$[][][]": role}},
+		{name: "dotted key", payload: `[{"a.b":"` + role + `"}]`, hits: map[string]string{`$[].a\.b`: role}},
+		{name: "truncated array", payload: `[{"roleArn":"` + role + `"}`, failed: true},
+		{name: "bare word", payload: `arn`, failed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := map[string]string{}
+			var failures int
+			sc, err := scan.New(
+				scan.WithSource(sliceSource(scan.RawEvent{EventID: "event", EventName: "AssumeRole", Payload: tt.payload})),
+				scan.WithoutMatchLogs(),
+				scan.WithLogger(slog.New(&warnings{})),
+				scan.WithOnHit(func(_ scan.RawEvent, key, value string) { hits[key] = value }),
+				scan.WithOnFailure(func(scan.RawEvent, error) { failures++ }),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stats, err := sc.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.failed {
+				if failures != 1 || stats.FailedEvents != 1 || stats.NonObjectPayloads != 0 {
+					t.Errorf("%d failures, %d failed events and %d non-object payloads, want a failure only",
+						failures, stats.FailedEvents, stats.NonObjectPayloads)
+				}
+				return
+			}
+			if failures != 0 || stats.NonObjectPayloads != 1 {
+				t.Errorf("%d failures and %d non-object payloads, want 0 and 1", failures, stats.NonObjectPayloads)
+			}
+			if len(hits) != len(tt.hits) {
+				t.Errorf("hits %q, want %q", hits, tt.hits)
+			}
+			for key, want := range tt.hits {
+				if hits[key] != want {
+					t.Errorf("hit %q=%q, want %q", key, hits[key], want)
+				}
+				if !sc.Store().Has(key) {
+					t.Errorf("%q isn't stored", key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package scan
+
+import "time"
+
+// Match types tell what kind of identifier a value is.
+const (
+	MatchTypeARN        = "arn"
+	MatchTypeResourceID = "resource-id"
+)
+
+// Match is the first value recorded under a key. It is what the WithOnMatch
+// hooks get, what a Store keeps and what every summary is written from.
+// Fields aren't known for every match, e.g. a summary read back from CSV has
+// no event time, actor or confidence.
+type Match struct {
+	// Key is the dotted path of the field, with array indices collapsed to
+	// "[]". RawKey is the path as found, e.g. "items.0.id" for "items[].id".
+	Key    string `json:"key"`
+	RawKey string `json:"rawKey,omitempty"`
+
+	Value     string `json:"value"`
+	MatchType string `json:"matchType"`
+
+	// Confidence tells how sure the matcher is that the value is an
+	// identifier, from 0 to 1.
+	Confidence float64 `json:"confidence,omitempty"`
+
+	// Service is the event source the value was found in without
+	// ".amazonaws.com", e.g. "s3".
+	Service   string    `json:"service,omitempty"`
+	EventName string    `json:"eventName"`
+	EventID   string    `json:"eventId"`
+	EventTime time.Time `json:"eventTime"`
+
+	// Actor is the ARN of the identity that made the call.
+	Actor     string `json:"actor,omitempty"`
+	AccountID string `json:"accountId,omitempty"`
+	Region    string `json:"region,omitempty"`
+
+	// EventSources are the distinct event sources the key was seen in,
+	// sorted, when the summary was written by a scan that tracked them.
+	EventSources []string `json:"eventSources,omitempty"`
+}
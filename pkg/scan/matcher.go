@@ -0,0 +1,84 @@
+package scan
+
+import "regexp"
+
+// Matcher tells whether a value is an identifier worth recording. It only
+// fills Key, Value, MatchType and Confidence of the Match, the Scanner adds
+// where the value was found.
+type Matcher interface {
+	Match(key, value string) (Match, bool)
+}
+
+// ARNMatcher matches the values ParseARN accepts.
+type ARNMatcher struct{}
+
+func (ARNMatcher) Match(key, value string) (Match, bool) {
+	if _, problem := parseARN(value); problem != "" {
+		return Match{}, false
+	}
+
+	return Match{Key: key, Value: value, MatchType: MatchTypeARN, Confidence: 1}, true
+}
+
+// ResourceIDMatcher matches EC2 style resource ids, e.g. i-0123456789abcdef0.
+// Other prefixed ids of the same length look alike, e.g. request ids, so it
+// is less confident than the ARNMatcher.
+type ResourceIDMatcher struct{}
+
+func (ResourceIDMatcher) Match(key, value string) (Match, bool) {
+	if !resourcePattern.MatchString(value) {
+		return Match{}, false
+	}
+
+	return Match{Key: key, Value: value, MatchType: MatchTypeResourceID, Confidence: 0.8}, true
+}
+
+// RegexpMatcher matches the values matching Pattern, recorded as MatchType
+// with Confidence.
+type RegexpMatcher struct {
+	MatchType  string
+	Pattern    *regexp.Regexp
+	Confidence float64
+}
+
+func (r RegexpMatcher) Match(key, value string) (Match, bool) {
+	if !r.Pattern.MatchString(value) {
+		return Match{}, false
+	}
+
+	return Match{Key: key, Value: value, MatchType: r.MatchType, Confidence: r.Confidence}, true
+}
+
+// DefaultMatchers are the matchers of a Scanner without WithMatchers.
+func DefaultMatchers() []Matcher {
+	return []Matcher{ARNMatcher{}, ResourceIDMatcher{}}
+}
+
+// Registry evaluates matchers in the order they were registered, the first
+// one matching a value wins. It is a Matcher itself.
+type Registry struct {
+	matchers []Matcher
+}
+
+// NewRegistry returns a registry of matchers.
+func NewRegistry(matchers ...Matcher) *Registry {
+	return &Registry{matchers: matchers}
+}
+
+// Register adds m after the matchers registered so far. It must not be
+// called while a scan is running.
+func (r *Registry) Register(m Matcher) {
+	r.matchers = append(r.matchers, m)
+}
+
+func (r *Registry) Match(key, value string) (Match, bool) {
+	for _, m := range r.matchers {
+		if match, ok := m.Match(key, value); ok {
+			return match, true
+		}
+	}
+
+	return Match{}, false
+}
+
+var defaultRegistry = NewRegistry(DefaultMatchers()...)
@@ -0,0 +1,548 @@
+// Package scan finds the fields of CloudTrail events that hold ARNs or
+// resource ids. A Scanner reads events from an EventSource, walks every field of
+// their CloudTrailEvent payload and records the first value seen for every
+// key in a Store.
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+)
+
+// CloudTrailClient is the part of the CloudTrail API a scan calls. It is
+// implemented by *cloudtrail.Client, tests can replace it with scripted pages.
+type CloudTrailClient interface {
+	LookupEvents(ctx context.Context, params *cloudtrail.LookupEventsInput, optFns ...func(*cloudtrail.Options)) (*cloudtrail.LookupEventsOutput, error)
+}
+
+// Stats are the counters of a scan.
+type Stats struct {
+	// Events counts the events handled.
+	Events int `json:"events"`
+
+	// Keys counts the keys new to the store.
+	Keys int `json:"keys"`
+
+	// OversizedEvents were skipped because of WithMaxEventSize.
+	OversizedEvents int `json:"oversizedEvents"`
+
+	// SkippedActions counts, per event name, the events dropped by
+	// WithSkipKnownActions.
+	SkippedActions map[string]int `json:"skippedActions,omitempty"`
+
+	// SkippedSources counts, per event source, the events dropped by
+	// WithEventSources.
+	SkippedSources map[string]int `json:"skippedSources,omitempty"`
+
+	// SkippedAccounts counts, per recipient account, the events dropped by
+	// WithAccounts, "unknown" for the events without one.
+	SkippedAccounts map[string]int `json:"skippedAccounts,omitempty"`
+
+	// MatcherHits counts the new keys per match type, i.e. per matcher.
+	MatcherHits map[string]int `json:"matcherHits,omitempty"`
+
+	// KeyHits counts, per key of the store, the values seen under it since
+	// it was added, the first one included.
+	KeyHits map[string]int `json:"keyHits,omitempty"`
+
+	// HookErrors counts the WithOnMatch calls that returned an error.
+	HookErrors int `json:"hookErrors"`
+
+	// FailedEvents counts the events whose payload couldn't be decoded, see
+	// WithOnFailure.
+	FailedEvents int `json:"failedEvents"`
+
+	// EmptyPayloads counts the events without payload, of which only the
+	// envelope fields were recorded.
+	EmptyPayloads int `json:"emptyPayloads"`
+
+	// NonObjectPayloads counts the payloads that are json arrays or scalars
+	// instead of a record.
+	NonObjectPayloads int `json:"nonObjectPayloads"`
+
+	// PanickedEvents counts the FailedEvents whose handling panicked, e.g.
+	// in a matcher. The worker recovers and handles the next event.
+	PanickedEvents int `json:"panickedEvents"`
+
+	// ReplacedExamples counts the matches that replaced the example of a
+	// known key, see WithBestExamples.
+	ReplacedExamples int `json:"replacedExamples"`
+}
+
+// FailureRate is the share of the events handled whose payload couldn't be
+// decoded, from 0 to 1.
+func (s Stats) FailureRate() float64 {
+	if s.Events == 0 {
+		return 0
+	}
+	return float64(s.FailedEvents) / float64(s.Events)
+}
+
+// Option configures a Scanner.
+type Option func(*Scanner)
+
+// Scanner finds identifiers in the events of an EventSource. Create one with
+// New.
+type Scanner struct {
+	source      EventSource
+	store       Store
+	matchers    *Registry
+	concurrency int
+	logger      *slog.Logger
+
+	// maxEventSize is the largest CloudTrailEvent payload, in bytes, that is
+	// handled. Bigger events are skipped, 0 disables the limit.
+	maxEventSize int
+
+	// actions is only set with WithSkipKnownActions.
+	actions *actionTracker
+
+	// sources are the event sources handled, all if empty.
+	sources []string
+
+	// accounts are the recipient accounts handled, all if empty.
+	accounts []string
+
+	// bestExamples keeps the best example of every key instead of the first,
+	// the store is an ExampleStore then.
+	bestExamples bool
+
+	// quietMatches skips the log line of every new key.
+	quietMatches bool
+
+	onMatch   []func(ctx context.Context, m Match) error
+	onHit     []func(event RawEvent, key, value string)
+	onEvent   []func(event RawEvent, hits int)
+	onHits    []func(event RawEvent, hits []Hit)
+	onNewKey  []func(event RawEvent, m Match)
+	onFailure []func(event RawEvent, err error)
+	wrap      func(event RawEvent, handle func())
+
+	// hookQueue is only set with WithAsyncHooks, for the duration of Run.
+	asyncHooks int
+	hookQueue  chan Match
+
+	// failFast cancels the scan on the first hook error, kept in hookErr.
+	failFast bool
+	cancel   context.CancelFunc
+
+	emptyPayloadOnce sync.Once
+
+	mu      sync.Mutex
+	stats   Stats
+	hookErr error
+}
+
+// WithSource reads the events from src.
+func WithSource(src EventSource) Option {
+	return func(s *Scanner) {
+		s.source = src
+	}
+}
+
+// WithClient reads the events of the last 90 days, or of start to end if they
+// aren't zero, from LookupEvents. Its quota of 2 requests per second and
+// account is respected.
+func WithClient(client CloudTrailClient, start, end time.Time) Option {
+	return WithSource(lookupEvents(client, start, end))
+}
+
+// WithStore records the matches in store instead of a new MemoryStore.
+func WithStore(store Store) Option {
+	return func(s *Scanner) {
+		s.store = store
+	}
+}
+
+// WithMatchers records the values matched by matchers, evaluated in order,
+// instead of DefaultMatchers. Extend the defaults with
+// WithMatchers(append(DefaultMatchers(), custom)...).
+func WithMatchers(matchers ...Matcher) Option {
+	return func(s *Scanner) {
+		s.matchers = NewRegistry(matchers...)
+	}
+}
+
+// WithConcurrency handles the events in n workers. The default of 1 handles
+// them in the order of the source.
+func WithConcurrency(n int) Option {
+	return func(s *Scanner) {
+		s.concurrency = n
+	}
+}
+
+// WithMaxEventSize skips events whose CloudTrailEvent payload is larger than
+// n bytes.
+func WithMaxEventSize(n int) Option {
+	return func(s *Scanner) {
+		s.maxEventSize = n
+	}
+}
+
+// WithSkipKnownActions skips the events of event names whose last window
+// events found no new keys. Like with WithEventSources, the event name of a
+// RawEvent without one is read from its payload, so such events are only
+// skipped once decoded.
+func WithSkipKnownActions(window int) Option {
+	return func(s *Scanner) {
+		s.actions = newActionTracker(window)
+	}
+}
+
+// WithEventSources only handles the events of these event sources, e.g.
+// s3.amazonaws.com, the others are counted in Stats.SkippedSources. The
+// source of an event is the EventSource of the RawEvent, or else the
+// eventSource of its payload, so such events are only dropped once decoded.
+func WithEventSources(sources ...string) Option {
+	return func(s *Scanner) {
+		s.sources = append(s.sources, sources...)
+	}
+}
+
+// WithAccounts only handles the events of these recipient accounts, the
+// others are counted in Stats.SkippedAccounts. The account of an event is the
+// recipientAccountId of its payload, or else the AccountID of the RawEvent,
+// e.g. when scanning an organization trail for the events of one member.
+func WithAccounts(accounts ...string) Option {
+	return func(s *Scanner) {
+		s.accounts = append(s.accounts, accounts...)
+	}
+}
+
+// WithBestExamples keeps the best value seen for every key as its example
+// instead of the first, see BetterExample. Which one is kept doesn't depend on
+// the order of the events, so runs over the same events agree. Every value of
+// a known key then goes through the matchers, which costs time. The store
+// must be an ExampleStore. Replacing an example doesn't call the WithOnMatch
+// hooks, they only see new keys.
+func WithBestExamples() Option {
+	return func(s *Scanner) {
+		s.bestExamples = true
+	}
+}
+
+// WithOnMatch calls fn for every key new to the store, once the match was
+// added to it. The option may be given more than once, the hooks of a match
+// are called in the order they were given.
+//
+// By default fn is called by the worker that found the match, before it
+// handles the next field, with the ctx of Run. With WithConcurrency it is
+// called concurrently, there is no order between the matches of different
+// workers. Errors are counted in Stats.HookErrors and logged, see
+// WithFailFastHooks to stop instead.
+func WithOnMatch(fn func(ctx context.Context, m Match) error) Option {
+	return func(s *Scanner) {
+		s.onMatch = append(s.onMatch, fn)
+	}
+}
+
+// WithOnHit calls fn for every value seen under a key of the store, the
+// first one included, with the event it was found in. These are the values
+// Stats.KeyHits counts, the values of a known key don't go through the
+// matchers again, so they need not be identifiers. fn is called by the
+// worker handling the event, so concurrently with WithConcurrency. The option
+// may be given more than once.
+func WithOnHit(fn func(event RawEvent, key, value string)) Option {
+	return func(s *Scanner) {
+		s.onHit = append(s.onHit, fn)
+	}
+}
+
+// WithOnEvent calls fn once every event was handled, with its hits, the
+// number of its values WithOnHit was called for. Events skipped, e.g. by
+// WithMaxEventSize, or whose payload couldn't be decoded have none. The
+// EventName, EventSource, AccountID and Region of event are the ones read
+// from its payload if the source didn't know them. fn is called by the worker
+// handling the event, so concurrently with WithConcurrency.
+func WithOnEvent(fn func(event RawEvent, hits int)) Option {
+	return func(s *Scanner) {
+		s.onEvent = append(s.onEvent, fn)
+	}
+}
+
+// WithOnNewKey calls fn for every key new to the store with the event that
+// introduced it, payload included, e.g. to keep the event beyond the
+// retention of its source. fn is called by the worker that found the match,
+// before the WithOnMatch hooks, so concurrently with WithConcurrency. The
+// option may be given more than once.
+func WithOnNewKey(fn func(event RawEvent, m Match)) Option {
+	return func(s *Scanner) {
+		s.onNewKey = append(s.onNewKey, fn)
+	}
+}
+
+// Hit is a value found under a key of the store, see WithOnHit.
+type Hit struct {
+	Key   string
+	Value string
+}
+
+// WithOnEventHits calls fn once per event with a hit, with all the hits of
+// the event in the order of its fields, e.g. to relate the keys of one event.
+// They are collected while the event is walked and handed over once it was,
+// after the WithOnHit hooks of each of them. fn is called by the worker
+// handling the event, so concurrently with WithConcurrency. The option may be
+// given more than once.
+func WithOnEventHits(fn func(event RawEvent, hits []Hit)) Option {
+	return func(s *Scanner) {
+		s.onHits = append(s.onHits, fn)
+	}
+}
+
+// WithAsyncHooks calls the WithOnMatch hooks from a single goroutine instead,
+// fed by a queue of size matches, so slow hooks don't hold up the workers
+// until the queue is full. The hooks are never called concurrently and see
+// the matches in the order they were recorded. Run returns once every queued
+// match went through them.
+func WithAsyncHooks(size int) Option {
+	return func(s *Scanner) {
+		s.asyncHooks = size
+	}
+}
+
+// WithFailFastHooks stops the scan on the first WithOnMatch error, which Run
+// then returns. Events already handed to the workers are still handled, but
+// their matches no longer go through the hooks.
+func WithFailFastHooks() Option {
+	return func(s *Scanner) {
+		s.failFast = true
+	}
+}
+
+// WithOnFailure calls fn for every event whose payload couldn't be decoded or
+// whose handling panicked, e.g. to keep it for handling it again once the
+// cause is fixed. fn is called by the worker handling the event, so
+// concurrently with WithConcurrency. The option may be given more than once.
+func WithOnFailure(fn func(event RawEvent, err error)) Option {
+	return func(s *Scanner) {
+		s.onFailure = append(s.onFailure, fn)
+	}
+}
+
+// WithEventWrapper runs the handling of every event through wrap, which must
+// call handle. It lets callers trace or time single events.
+func WithEventWrapper(wrap func(event RawEvent, handle func())) Option {
+	return func(s *Scanner) {
+		s.wrap = wrap
+	}
+}
+
+// WithoutMatchLogs doesn't log the new keys, which on large accounts is a
+// good part of the cost of an event. They are still added to the store and go
+// through the WithOnMatch hooks.
+func WithoutMatchLogs() Option {
+	return func(s *Scanner) {
+		s.quietMatches = true
+	}
+}
+
+// WithLogger logs the matches to logger instead of slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Scanner) {
+		s.logger = logger
+	}
+}
+
+// New returns a Scanner configured by opts. Run needs a source, given with
+// WithSource or WithClient, RecordValue doesn't.
+func New(opts ...Option) (*Scanner, error) {
+	s := &Scanner{concurrency: 1}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.concurrency < 1 {
+		return nil, errors.New("scan: concurrency must be at least 1")
+	}
+	if s.asyncHooks < 0 {
+		return nil, errors.New("scan: async hook queue size must not be negative")
+	}
+	if s.store == nil {
+		s.store = NewMemoryStore(10000)
+	}
+	if _, ok := s.store.(ExampleStore); s.bestExamples && !ok {
+		return nil, errors.New("scan: best examples need a store that implements ExampleStore")
+	}
+	if s.matchers == nil {
+		s.matchers = defaultRegistry
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+
+	return s, nil
+}
+
+// Store returns the store the matches are recorded in.
+func (s *Scanner) Store() Store {
+	return s.store
+}
+
+// Run reads the source until it is exhausted and handles every event it
+// produced. Once Run returns, all events are handled, so the store is
+// complete. The error is the one of the source, or the hook error that
+// stopped the scan with WithFailFastHooks.
+func (s *Scanner) Run(ctx context.Context) (Stats, error) {
+	if s.source == nil {
+		return Stats{}, errors.New("scan: no source, use WithSource or WithClient")
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	defer s.cancel()
+
+	events, err := s.source.Events(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var hooks sync.WaitGroup
+	if s.asyncHooks > 0 && len(s.onMatch) > 0 {
+		s.hookQueue = make(chan Match, s.asyncHooks)
+		hooks.Add(1)
+		go func() {
+			defer hooks.Done()
+			for m := range s.hookQueue {
+				s.callHooks(ctx, m)
+			}
+		}()
+	}
+
+	var workers sync.WaitGroup
+	for range s.concurrency {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+
+			s.logger.Debug("Starting worker")
+			for event := range events {
+				s.handle(ctx, event)
+			}
+			s.logger.Debug("Stopping worker")
+		}()
+	}
+
+	// Every event handed over by the source is handled before returning, the
+	// caller reads the store next.
+	workers.Wait()
+	if s.hookQueue != nil {
+		close(s.hookQueue)
+		hooks.Wait()
+		s.hookQueue = nil
+	}
+
+	if src, ok := s.source.(interface{ Err() error }); ok {
+		err = src.Err()
+	}
+
+	s.mu.Lock()
+	if s.hookErr != nil {
+		err = s.hookErr
+	}
+	s.mu.Unlock()
+
+	return s.Stats(), err
+}
+
+// Stats returns the counters so far. It is safe to call while running.
+func (s *Scanner) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	stats.SkippedActions = maps.Clone(s.stats.SkippedActions)
+	stats.SkippedSources = maps.Clone(s.stats.SkippedSources)
+	stats.SkippedAccounts = maps.Clone(s.stats.SkippedAccounts)
+	stats.MatcherHits = maps.Clone(s.stats.MatcherHits)
+	stats.KeyHits = maps.Clone(s.stats.KeyHits)
+	return stats
+}
+
+// handle handles event, recovering from a panic while doing so. A worker
+// that died would leave the source blocked on handing over the next event.
+func (s *Scanner) handle(ctx context.Context, event RawEvent) {
+	if event.Done != nil {
+		defer event.Done()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			s.recoverEvent(event, r)
+		}
+	}()
+
+	if s.wrap == nil {
+		s.handleEvent(ctx, event)
+	} else {
+		s.wrap(event, func() {
+			s.handleEvent(ctx, event)
+		})
+	}
+}
+
+// recoverEvent records an event whose handling panicked with r like one whose
+// payload couldn't be decoded, so the WithOnFailure hooks get it too.
+func (s *Scanner) recoverEvent(event RawEvent, r any) {
+	s.logger.Error("Event handling panicked",
+		slog.String("event-id", event.EventID),
+		slog.String("action", event.EventName),
+		slog.Any("panic", r),
+		slog.String("stack", string(debug.Stack())),
+	)
+
+	s.mu.Lock()
+	s.stats.FailedEvents++
+	s.stats.PanickedEvents++
+	s.mu.Unlock()
+
+	err := fmt.Errorf("scan: panic: %v", r)
+	for _, fn := range s.onFailure {
+		fn(event, err)
+	}
+}
+
+// onNewMatch hands m to the hooks, directly or through the async queue.
+func (s *Scanner) onNewMatch(ctx context.Context, m Match) {
+	if len(s.onMatch) == 0 {
+		return
+	}
+
+	if s.hookQueue != nil {
+		s.hookQueue <- m
+		return
+	}
+	s.callHooks(ctx, m)
+}
+
+func (s *Scanner) callHooks(ctx context.Context, m Match) {
+	for _, fn := range s.onMatch {
+		if s.failFast && ctx.Err() != nil {
+			return
+		}
+
+		err := fn(ctx, m)
+		if err == nil {
+			continue
+		}
+
+		s.logger.Error("On match hook failed", slog.String("key", m.Key), slog.String("error", err.Error()))
+
+		s.mu.Lock()
+		s.stats.HookErrors++
+		stop := s.failFast && s.hookErr == nil
+		if stop {
+			s.hookErr = fmt.Errorf("scan: on match hook: %w", err)
+		}
+		s.mu.Unlock()
+
+		if stop {
+			s.cancel()
+		}
+	}
+}
@@ -0,0 +1,596 @@
+package scan_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// arnEvent is an event with a single ARN under a key of its own, so every
+// event adds a key.
+func arnEvent(i int) scan.RawEvent {
+	return scan.RawEvent{
+		EventID:     fmt.Sprintf("event-%d", i),
+		EventName:   "GetObject",
+		EventSource: "s3.amazonaws.com",
+		Payload:     fmt.Sprintf(`{"requestParameters":{"bucket%d":"arn:aws:s3:::bucket-%d"}}`, i, i),
+	}
+}
+
+// sliceSource emits events in order.
+func sliceSource(events ...scan.RawEvent) scan.EventSource {
+	return scan.SourceFunc(func(ctx context.Context, emit func(scan.RawEvent)) error {
+		for _, event := range events {
+			emit(event)
+		}
+		return nil
+	})
+}
+
+func arnEvents(n int) []scan.RawEvent {
+	events := make([]scan.RawEvent, n)
+	for i := range events {
+		events[i] = arnEvent(i)
+	}
+	return events
+}
+
+func TestRunDrainsSlowWorkers(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			const events = 200
+			sc, err := scan.New(
+				scan.WithSource(sliceSource(arnEvents(events)...)),
+				scan.WithConcurrency(workers),
+				scan.WithoutMatchLogs(),
+				scan.WithEventWrapper(func(event scan.RawEvent, handle func()) {
+					time.Sleep(time.Millisecond)
+					handle()
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stats, err := sc.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Run only returns once the workers are done, the store is read
+			// right after.
+			if stats.Events != events {
+				t.Errorf("handled %d events, want %d", stats.Events, events)
+			}
+			if got := sc.Store().Len(); got != events {
+				t.Errorf("store has %d keys, want %d", got, events)
+			}
+		})
+	}
+}
+
+// TestReadWhileRunning runs with -race to show the store and the stats may be
+// read while the workers write them, e.g. when a signal writes the summary.
+func TestReadWhileRunning(t *testing.T) {
+	sc, err := scan.New(
+		scan.WithSource(sliceSource(arnEvents(2000)...)),
+		scan.WithConcurrency(8),
+		scan.WithoutMatchLogs(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	read := make(chan int)
+	go func() {
+		reads := 0
+		for {
+			select {
+			case <-done:
+				read <- reads
+				return
+			default:
+			}
+			sc.Stats()
+			sc.Store().Len()
+			sc.Store().Each(func(m scan.Match) error { return nil })
+			reads++
+		}
+	}()
+
+	stats, err := sc.Run(context.Background())
+	close(done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reads := <-read; reads == 0 {
+		t.Error("the store was never read while scanning")
+	}
+	if stats.Keys != 2000 {
+		t.Errorf("recorded %d keys, want 2000", stats.Keys)
+	}
+}
+
+// hookCounts counts the calls of the hooks by event id or key, the hooks are
+// called concurrently by the workers.
+type hookCounts struct {
+	mu     sync.Mutex
+	counts map[string]map[string]int
+}
+
+func (c *hookCounts) add(hook, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]map[string]int)
+	}
+	if c.counts[hook] == nil {
+		c.counts[hook] = make(map[string]int)
+	}
+	c.counts[hook][id]++
+}
+
+// TestHooksConcurrent runs every hook from 8 workers, run it with -race. All
+// the events share a key which several workers find at once, it must still be
+// new to only one of them.
+func TestHooksConcurrent(t *testing.T) {
+	const events, failures = 500, 50
+
+	var source []scan.RawEvent
+	for i := 0; i < events; i++ {
+		source = append(source, scan.RawEvent{
+			EventID:     fmt.Sprintf("event-%d", i),
+			EventName:   "GetObject",
+			EventSource: "s3.amazonaws.com",
+			Payload:     fmt.Sprintf(`{"requestParameters":{"bucket%d":"arn:aws:s3:::bucket-%d","roleArn":"arn:aws:iam::123456789012:role/shared"}}`, i, i),
+		})
+		if i%(events/failures) == 0 {
+			source = append(source, scan.RawEvent{EventID: fmt.Sprintf("broken-%d", i), Payload: `{"requestParameters":`})
+		}
+	}
+
+	// The WithOnMatch hooks are called by the workers or by a goroutine of
+	// their own.
+	for name, opts := range map[string][]scan.Option{
+		"workers": nil,
+		"async":   {scan.WithAsyncHooks(16)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var c hookCounts
+			sc, err := scan.New(append([]scan.Option{
+				scan.WithSource(sliceSource(source...)),
+				scan.WithConcurrency(8),
+				scan.WithoutMatchLogs(),
+				scan.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+				scan.WithOnMatch(func(ctx context.Context, m scan.Match) error {
+					c.add("match", m.Key)
+					return nil
+				}),
+				scan.WithOnNewKey(func(event scan.RawEvent, m scan.Match) {
+					c.add("new key", m.Key)
+				}),
+				scan.WithOnHit(func(event scan.RawEvent, key, value string) {
+					c.add("hit", event.EventID+" "+key)
+				}),
+				scan.WithOnEventHits(func(event scan.RawEvent, hits []scan.Hit) {
+					if len(hits) != 2 {
+						t.Errorf("%s has %d hits, want 2", event.EventID, len(hits))
+					}
+					c.add("event hits", event.EventID)
+				}),
+				scan.WithOnFailure(func(event scan.RawEvent, err error) {
+					c.add("failure", event.EventID)
+				}),
+			}, opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stats, err := sc.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Keys != events+1 || stats.FailedEvents != failures {
+				t.Fatalf("recorded %d keys and %d failed events, want %d and %d", stats.Keys, stats.FailedEvents, events+1, failures)
+			}
+
+			want := map[string]int{
+				"match":      events + 1,
+				"new key":    events + 1,
+				"hit":        2 * events,
+				"event hits": events,
+				"failure":    failures,
+			}
+			for hook, n := range want {
+				if got := len(c.counts[hook]); got != n {
+					t.Errorf("%s hook called for %d events or keys, want %d", hook, got, n)
+				}
+				for id, calls := range c.counts[hook] {
+					if calls != 1 {
+						t.Errorf("%s hook called %d times for %s", hook, calls, id)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestSourceFuncCanceled cancels the scan while its source goes on emitting,
+// the events emitted after are dropped instead of handled.
+func TestSourceFuncCanceled(t *testing.T) {
+	const events, cancelAt = 100, 10
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	done := 0
+	source := scan.SourceFunc(func(ctx context.Context, emit func(scan.RawEvent)) error {
+		// Ignores ctx, emit must not block on it.
+		for _, event := range arnEvents(events) {
+			event.Done = func() {
+				mu.Lock()
+				done++
+				mu.Unlock()
+			}
+			emit(event)
+		}
+		return nil
+	})
+
+	handled := 0
+	sc, err := scan.New(
+		scan.WithSource(source),
+		scan.WithoutMatchLogs(),
+		scan.WithEventWrapper(func(event scan.RawEvent, handle func()) {
+			handle()
+			if handled++; handled == cancelAt {
+				cancel()
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := sc.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Events < cancelAt || stats.Events == events {
+		t.Errorf("handled %d events, want from %d up to the cancelation", stats.Events, cancelAt)
+	}
+	// The dropped events weren't handled, e.g. an SQS message stays in the
+	// queue.
+	if done != stats.Events {
+		t.Errorf("Done called for %d events, %d were handled", done, stats.Events)
+	}
+}
+
+// panickingMatcher panics on the values of one key.
+type panickingMatcher struct {
+	key string
+}
+
+func (m panickingMatcher) Match(key, value string) (scan.Match, bool) {
+	if key == m.key {
+		panic("matcher bug")
+	}
+	return scan.ARNMatcher{}.Match(key, value)
+}
+
+// TestMatcherPanicRecovered records the event of a panicking matcher as a
+// failure and goes on with the next event.
+func TestMatcherPanicRecovered(t *testing.T) {
+	events := arnEvents(5)
+	events[2].Payload = `{"requestParameters":{"bad":"arn:aws:s3:::bucket-bad"}}`
+
+	var failed []string
+	sc, err := scan.New(
+		scan.WithSource(sliceSource(events...)),
+		scan.WithMatchers(panickingMatcher{key: "requestParameters.bad"}),
+		scan.WithoutMatchLogs(),
+		scan.WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		scan.WithOnFailure(func(event scan.RawEvent, err error) {
+			failed = append(failed, event.EventID)
+			if !strings.Contains(err.Error(), "matcher bug") {
+				t.Errorf("failure %v doesn't have the panic", err)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := sc.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FailedEvents != 1 || stats.PanickedEvents != 1 {
+		t.Errorf("%d failed and %d panicked events, want 1 each", stats.FailedEvents, stats.PanickedEvents)
+	}
+	if len(failed) != 1 || failed[0] != "event-2" {
+		t.Errorf("failures %q, want event-2", failed)
+	}
+	// The events after the panic were handled.
+	if got := sc.Store().Len(); got != 4 {
+		t.Errorf("store has %d keys, want the 4 of the other events", got)
+	}
+}
+
+// plainStore is a Store that can't replace examples.
+type plainStore struct {
+	scan.Store
+}
+
+func TestNewOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []scan.Option
+		err  string
+	}{
+		{"defaults", nil, ""},
+		{"no workers", []scan.Option{scan.WithConcurrency(0)}, "concurrency must be at least 1"},
+		{"negative hook queue", []scan.Option{scan.WithAsyncHooks(-1)}, "async hook queue size must not be negative"},
+		{"best examples", []scan.Option{scan.WithBestExamples()}, ""},
+		{"best examples without ExampleStore", []scan.Option{scan.WithStore(plainStore{scan.NewMemoryStore(0)}), scan.WithBestExamples()}, "need a store that implements ExampleStore"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := scan.New(tt.opts...)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("New returned %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	sc, err := scan.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "no source") {
+		t.Errorf("Run without source returned %v", err)
+	}
+}
+
+// TestScanOptions runs the same events through the filtering options.
+func TestScanOptions(t *testing.T) {
+	events := []scan.RawEvent{
+		{EventID: "s3", EventName: "GetObject", EventSource: "s3.amazonaws.com", AccountID: "111111111111", Payload: `{"requestParameters":{"bucket":"arn:aws:s3:::bucket"}}`},
+		{EventID: "iam", EventName: "GetRole", EventSource: "iam.amazonaws.com", AccountID: "222222222222", Payload: `{"requestParameters":{"roleArn":"arn:aws:iam::222222222222:role/r"}}`},
+		{EventID: "ec2", EventName: "StartInstances", EventSource: "ec2.amazonaws.com", AccountID: "111111111111", Payload: `{"requestParameters":{"instanceId":"i-0123456789abcdef0","note":"` + strings.Repeat("x", 200) + `"}}`},
+	}
+
+	tests := []struct {
+		name  string
+		opts  []scan.Option
+		keys  []string
+		check func(t *testing.T, stats scan.Stats)
+	}{
+		{
+			name: "defaults",
+			keys: []string{"requestParameters.bucket", "requestParameters.instanceId", "requestParameters.roleArn"},
+			check: func(t *testing.T, stats scan.Stats) {
+				if stats.MatcherHits[scan.MatchTypeARN] != 2 || stats.MatcherHits[scan.MatchTypeResourceID] != 1 {
+					t.Errorf("matcher hits %v", stats.MatcherHits)
+				}
+			},
+		},
+		{
+			name: "max event size",
+			opts: []scan.Option{scan.WithMaxEventSize(100)},
+			keys: []string{"requestParameters.bucket", "requestParameters.roleArn"},
+			check: func(t *testing.T, stats scan.Stats) {
+				if stats.OversizedEvents != 1 {
+					t.Errorf("%d oversized events, want 1", stats.OversizedEvents)
+				}
+			},
+		},
+		{
+			name: "event sources",
+			opts: []scan.Option{scan.WithEventSources("s3.amazonaws.com")},
+			keys: []string{"requestParameters.bucket"},
+			check: func(t *testing.T, stats scan.Stats) {
+				if stats.SkippedSources["iam.amazonaws.com"] != 1 || stats.SkippedSources["ec2.amazonaws.com"] != 1 {
+					t.Errorf("skipped sources %v", stats.SkippedSources)
+				}
+			},
+		},
+		{
+			name: "accounts",
+			opts: []scan.Option{scan.WithAccounts("111111111111")},
+			keys: []string{"requestParameters.bucket", "requestParameters.instanceId"},
+			check: func(t *testing.T, stats scan.Stats) {
+				if stats.SkippedAccounts["222222222222"] != 1 {
+					t.Errorf("skipped accounts %v", stats.SkippedAccounts)
+				}
+			},
+		},
+		{
+			name: "matchers",
+			opts: []scan.Option{scan.WithMatchers(scan.ResourceIDMatcher{})},
+			keys: []string{"requestParameters.instanceId"},
+		},
+		{
+			name: "store",
+			opts: []scan.Option{scan.WithStore(func() scan.Store {
+				store := scan.NewMemoryStore(0)
+				store.Add(scan.Match{Key: "requestParameters.known", Value: "arn:aws:s3:::known"})
+				return store
+			}())},
+			keys: []string{"requestParameters.bucket", "requestParameters.instanceId", "requestParameters.known", "requestParameters.roleArn"},
+			check: func(t *testing.T, stats scan.Stats) {
+				if stats.Keys != 3 {
+					t.Errorf("%d new keys, want 3", stats.Keys)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]scan.Option{scan.WithSource(sliceSource(events...)), scan.WithoutMatchLogs()}, tt.opts...)
+			sc, err := scan.New(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, err := sc.Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var keys []string
+			sc.Store().Each(func(m scan.Match) error {
+				keys = append(keys, m.Key)
+				return nil
+			})
+			slices.Sort(keys)
+			if !slices.Equal(keys, tt.keys) {
+				t.Errorf("keys %q, want %q", keys, tt.keys)
+			}
+			if tt.check != nil {
+				tt.check(t, stats)
+			}
+		})
+	}
+}
+
+// TestSkipKnownActionsPayloadOnly skips the events of a saturated event name
+// read from the payload, e.g. of --stdin, which sets no EventName.
+func TestSkipKnownActionsPayloadOnly(t *testing.T) {
+	known := `{"eventName":"GetObject","requestParameters":{"bucket":"arn:aws:s3:::bucket"}}`
+	events := []scan.RawEvent{
+		{EventID: "1", Payload: known},
+		{EventID: "2", Payload: known},
+		{EventID: "3", Payload: known},
+		// GetObject found no new keys in the last 2 events.
+		{EventID: "4", Payload: `{"eventName":"GetObject","requestParameters":{"key":"arn:aws:s3:::bucket/key"}}`},
+		{EventID: "5", Payload: `{"eventName":"GetRole","requestParameters":{"roleArn":"arn:aws:iam::123456789012:role/r"}}`},
+	}
+
+	sc, err := scan.New(scan.WithSource(sliceSource(events...)), scan.WithConcurrency(1), scan.WithSkipKnownActions(2), scan.WithoutMatchLogs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := sc.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	sc.Store().Each(func(m scan.Match) error {
+		keys = append(keys, m.Key)
+		return nil
+	})
+	slices.Sort(keys)
+	if want := []string{"requestParameters.bucket", "requestParameters.roleArn"}; !slices.Equal(keys, want) {
+		t.Errorf("keys %q, want %q", keys, want)
+	}
+	if want := map[string]int{"GetObject": 1}; !maps.Equal(stats.SkippedActions, want) {
+		t.Errorf("skipped actions %v, want %v", stats.SkippedActions, want)
+	}
+}
+
+// corpusEvent returns the event of testdata/events/name.json with the
+// envelope fields LookupEvents has next to it.
+func corpusEvent(t *testing.T, name, eventName, eventSource string, at time.Time) scan.RawEvent {
+	t.Helper()
+
+	payload, err := os.ReadFile(filepath.Join("testdata", "events", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scan.RawEvent{Payload: string(payload), EventID: name, EventName: eventName, EventSource: eventSource, EventTime: at}
+}
+
+// TestScanEndToEnd scans two events of the corpus through every stage and
+// checks what ended up in the store.
+func TestScanEndToEnd(t *testing.T) {
+	assumed := time.Date(2024, 7, 1, 12, 31, 0, 0, time.UTC)
+	created := assumed.Add(time.Minute)
+	sc, err := scan.New(
+		scan.WithSource(sliceSource(
+			corpusEvent(t, "sts-assumerole", "AssumeRole", "sts.amazonaws.com", assumed),
+			corpusEvent(t, "iam-createrole", "CreateRole", "iam.amazonaws.com", created),
+		)),
+		scan.WithoutMatchLogs(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := sc.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]scan.Match)
+	sc.Store().Each(func(m scan.Match) error {
+		got[m.Key] = m
+		return nil
+	})
+
+	want := map[string]scan.Match{
+		// Seen in both events, the first one is kept.
+		"userIdentity.arn": {
+			Key: "userIdentity.arn", RawKey: "userIdentity.arn", Value: "arn:aws:iam::123456789012:user/alice",
+			MatchType: scan.MatchTypeARN, Confidence: 1, Service: "sts", EventName: "AssumeRole", EventID: "sts-assumerole",
+			EventTime: assumed, Actor: "arn:aws:iam::123456789012:user/alice", AccountID: "123456789012", Region: "us-east-1",
+		},
+		"resources[].ARN": {
+			Key: "resources[].ARN", RawKey: "resources.0.ARN", Value: "arn:aws:iam::210987654321:role/OrganizationAccountAccessRole",
+			MatchType: scan.MatchTypeARN, Confidence: 1, Service: "sts", EventName: "AssumeRole", EventID: "sts-assumerole",
+			EventTime: assumed, Actor: "arn:aws:iam::123456789012:user/alice", AccountID: "123456789012", Region: "us-east-1",
+		},
+		"requestParameters.tags[].value": {
+			Key: "requestParameters.tags[].value", RawKey: "requestParameters.tags.1.value", Value: "arn:aws:cloudformation:us-east-1:123456789012:stack/app/44444444-aaaa-4bbb-8ccc-000000000004",
+			MatchType: scan.MatchTypeARN, Confidence: 1, Service: "iam", EventName: "CreateRole", EventID: "iam-createrole",
+			EventTime: created, Actor: "arn:aws:sts::123456789012:assumed-role/deploy/pipeline", AccountID: "123456789012", Region: "us-east-1",
+		},
+	}
+	for key, m := range want {
+		if !reflect.DeepEqual(got[key], m) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", key, got[key], m)
+		}
+	}
+
+	var keys []string
+	for key := range got {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	wantKeys := []string{
+		"requestParameters.permissionsBoundary",
+		"requestParameters.roleArn",
+		"requestParameters.tags[].value",
+		"resources[].ARN",
+		"responseElements.assumedRoleUser.arn",
+		"responseElements.role.arn",
+		"responseElements.role.permissionsBoundary.permissionsBoundaryArn",
+		"userIdentity.arn",
+		"userIdentity.sessionContext.sessionIssuer.arn",
+	}
+	if !slices.Equal(keys, wantKeys) {
+		t.Errorf("keys %q, want %q", keys, wantKeys)
+	}
+
+	if stats.Events != 2 || stats.Keys != len(wantKeys) || stats.FailedEvents != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+	if hits := stats.KeyHits["userIdentity.arn"]; hits != 2 {
+		t.Errorf("userIdentity.arn hit %d times, want 2", hits)
+	}
+}
@@ -0,0 +1,53 @@
+package scantest
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is a scan.Clock whose time only moves when slept on. Every Sleep
+// returns at once, advancing the time by its delay, and is recorded.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+// NewClock returns a clock starting at start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Sleep returns ctx.Err() without advancing the time if ctx is done, like an
+// interrupted sleep of the real clock.
+func (c *Clock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sleeps = append(c.sleeps, d)
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+	return nil
+}
+
+// Sleeps returns the delays of all calls of Sleep so far, including those of
+// zero, e.g. when a rate limiter had a token ready.
+func (c *Clock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]time.Duration(nil), c.sleeps...)
+}
@@ -0,0 +1,72 @@
+// Package scantest provides a scripted scan.CloudTrailClient, so scans can run
+// without AWS credentials, and a scan.Clock that doesn't wait.
+package scantest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
+)
+
+// Page is a scripted LookupEvents response. A page with Err set fails the call
+// instead, e.g. with a throttling error, and the next call is answered with the
+// following page.
+type Page struct {
+	Events []types.Event
+	Err    error
+}
+
+// CloudTrail answers LookupEvents calls with its pages in order. The pages of
+// successful calls are chained with NextToken, so a paginator stops after the
+// last one.
+type CloudTrail struct {
+	mu     sync.Mutex
+	pages  []Page
+	next   int
+	inputs []cloudtrail.LookupEventsInput
+}
+
+// NewCloudTrail returns a client serving pages.
+func NewCloudTrail(pages ...Page) *CloudTrail {
+	return &CloudTrail{pages: pages}
+}
+
+func (c *CloudTrail) LookupEvents(ctx context.Context, params *cloudtrail.LookupEventsInput, optFns ...func(*cloudtrail.Options)) (*cloudtrail.LookupEventsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.inputs = append(c.inputs, *params)
+	if c.next >= len(c.pages) {
+		return nil, fmt.Errorf("scantest: no page left for call %d", len(c.inputs))
+	}
+
+	page := c.pages[c.next]
+	c.next++
+	if page.Err != nil {
+		return nil, page.Err
+	}
+
+	out := &cloudtrail.LookupEventsOutput{Events: page.Events}
+	if c.next < len(c.pages) {
+		token := strconv.Itoa(c.next)
+		out.NextToken = &token
+	}
+	return out, nil
+}
+
+// Inputs returns the inputs of all calls so far, e.g. to check the NextToken
+// sent.
+func (c *CloudTrail) Inputs() []cloudtrail.LookupEventsInput {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]cloudtrail.LookupEventsInput(nil), c.inputs...)
+}
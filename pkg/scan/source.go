@@ -0,0 +1,129 @@
+package scan
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
+	"golang.org/x/time/rate"
+)
+
+// RawEvent is an event as a source read it: the CloudTrail record as json and
+// the envelope fields the source got next to it. Fields a source doesn't know
+// are left empty. The region and account of the payload take precedence over
+// the envelope's.
+type RawEvent struct {
+	Payload     string
+	EventID     string
+	EventName   string
+	EventSource string
+	EventTime   time.Time
+	Region      string
+	AccountID   string
+
+	// Resources are the resources LookupEvents lists for the event. They are
+	// only recorded for events without payload.
+	Resources []Resource
+
+	// Done, when set, is called once the event was handled, e.g. to only
+	// delete a queue message after its fields were recorded.
+	Done func()
+}
+
+// Resource is a resource referenced by an event.
+type Resource struct {
+	Type string
+	Name string
+}
+
+// FromLookupEvent converts an event as LookupEvents returns it.
+func FromLookupEvent(event types.Event) RawEvent {
+	raw := RawEvent{
+		Payload:     deRef(event.CloudTrailEvent),
+		EventID:     deRef(event.EventId),
+		EventName:   deRef(event.EventName),
+		EventSource: deRef(event.EventSource),
+		EventTime:   deRef(event.EventTime),
+	}
+	for _, resource := range event.Resources {
+		raw.Resources = append(raw.Resources, Resource{Type: deRef(resource.ResourceType), Name: deRef(resource.ResourceName)})
+	}
+	return raw
+}
+
+// EventSource produces the events of a scan. The channel is closed once there
+// are no more events or ctx is done. A source whose stream can break off
+// reports why from an Err() error method, which Run calls after the channel
+// was closed.
+type EventSource interface {
+	Events(ctx context.Context) (<-chan RawEvent, error)
+}
+
+// SourceFunc returns an EventSource running fn in its own goroutine. fn hands
+// every event over to emit and returns once there are no more events, its
+// error is the source's Err. Once ctx is done emit drops the event instead
+// of waiting for a worker, its Done isn't called then.
+func SourceFunc(fn func(ctx context.Context, emit func(RawEvent)) error) EventSource {
+	return &funcSource{fn: fn}
+}
+
+type funcSource struct {
+	fn  func(ctx context.Context, emit func(RawEvent)) error
+	err error
+}
+
+func (f *funcSource) Events(ctx context.Context) (<-chan RawEvent, error) {
+	events := make(chan RawEvent)
+	go func() {
+		defer close(events)
+
+		f.err = f.fn(ctx, func(event RawEvent) {
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	return events, nil
+}
+
+// Err is only read after the channel was closed, which orders it after the
+// write.
+func (f *funcSource) Err() error {
+	return f.err
+}
+
+// lookupEvents pages through LookupEvents with a limiter staying below the
+// API's quota.
+func lookupEvents(client CloudTrailClient, start, end time.Time) EventSource {
+	return SourceFunc(func(ctx context.Context, emit func(RawEvent)) error {
+		input := &cloudtrail.LookupEventsInput{}
+		if !start.IsZero() {
+			input.StartTime = &start
+		}
+		if !end.IsZero() {
+			input.EndTime = &end
+		}
+
+		limiter := rate.NewLimiter(rate.Limit(1.9), 1)
+		pages := cloudtrail.NewLookupEventsPaginator(client, input)
+		for pages.HasMorePages() {
+			if err := WaitLimiter(ctx, SystemClock, limiter); err != nil {
+				return err
+			}
+
+			page, err := pages.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+
+			for _, event := range page.Events {
+				emit(FromLookupEvent(event))
+			}
+		}
+
+		return nil
+	})
+}
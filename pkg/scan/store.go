@@ -0,0 +1,107 @@
+package scan
+
+import (
+	"sync"
+
+	"golang.org/x/exp/maps"
+)
+
+// Store records the first match seen for every cleaned key. Implementations
+// must be safe for concurrent use, the workers of a Scanner share one store.
+type Store interface {
+	// Has reports whether key is known.
+	Has(key string) bool
+
+	// Add stores m under its key unless the key is already known. It reports
+	// whether m was stored.
+	Add(m Match) bool
+
+	// Len returns the number of keys stored.
+	Len() int
+
+	// Each calls fn for every match until it returns an error.
+	Each(fn func(m Match) error) error
+}
+
+// ExampleStore is a Store that can replace the match of a known key, which
+// WithBestExamples needs.
+type ExampleStore interface {
+	Store
+
+	// Replace stores m in place of the match under its key if the key is
+	// known and better reports that m is the better of the two. It reports
+	// whether m was stored.
+	Replace(m Match, better func(current, candidate Match) bool) bool
+}
+
+// MemoryStore is the default Store, it keeps every match in memory. It may be
+// read while a scan is running, e.g. to serve the findings so far, so every
+// access goes through its lock.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]Match
+}
+
+// NewMemoryStore returns an empty MemoryStore sized for size keys.
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{entries: make(map[string]Match, size)}
+}
+
+func (c *MemoryStore) Has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, exists := c.entries[key]
+	return exists
+}
+
+func (c *MemoryStore) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+func (c *MemoryStore) Add(m Match) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[m.Key]; exists {
+		return false
+	}
+
+	c.entries[m.Key] = m
+	return true
+}
+
+func (c *MemoryStore) Replace(m Match, better func(current, candidate Match) bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current, exists := c.entries[m.Key]
+	if !exists || !better(current, m) {
+		return false
+	}
+
+	c.entries[m.Key] = m
+	return true
+}
+
+// Each iterates over a copy of the matches, so fn may call the store.
+func (c *MemoryStore) Each(fn func(m Match) error) error {
+	for _, m := range c.snapshot() {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshot returns a copy of all matches that is safe to use without the lock.
+func (c *MemoryStore) snapshot() []Match {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return maps.Values(c.entries)
+}
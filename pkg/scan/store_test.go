@@ -0,0 +1,152 @@
+package scan_test
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := scan.NewMemoryStore(0)
+	if store.Has("requestParameters.roleArn") || store.Len() != 0 {
+		t.Fatal("a new store isn't empty")
+	}
+
+	first := scan.Match{Key: "requestParameters.roleArn", Value: "arn:aws:iam::123456789012:role/first"}
+	if !store.Add(first) {
+		t.Error("the first match of a key wasn't added")
+	}
+	if store.Add(scan.Match{Key: first.Key, Value: "arn:aws:iam::123456789012:role/second"}) {
+		t.Error("the second match of a key was added")
+	}
+	if !store.Add(scan.Match{Key: "requestParameters.bucketName", Value: "arn:aws:s3:::bucket"}) {
+		t.Error("the match of another key wasn't added")
+	}
+	if !store.Has(first.Key) || store.Len() != 2 {
+		t.Errorf("the store has %d keys, want 2", store.Len())
+	}
+
+	var values []string
+	store.Each(func(m scan.Match) error {
+		values = append(values, m.Value)
+		// Each iterates over a copy, calling the store doesn't deadlock.
+		store.Has(m.Key)
+		return nil
+	})
+	slices.Sort(values)
+	if want := []string{"arn:aws:iam::123456789012:role/first", "arn:aws:s3:::bucket"}; !slices.Equal(values, want) {
+		t.Errorf("Each visited %q, want %q", values, want)
+	}
+}
+
+func TestMemoryStoreReplace(t *testing.T) {
+	store := scan.NewMemoryStore(0)
+	var _ scan.ExampleStore = store
+
+	current := scan.Match{Key: "requestParameters.instanceId", Value: "i-0123456789abcdef0", Confidence: 0.8}
+	candidate := scan.Match{Key: current.Key, Value: "arn:aws:ec2:eu-west-1:123456789012:instance/i-0123456789abcdef0", Confidence: 1}
+
+	if store.Replace(candidate, scan.BetterExample) {
+		t.Error("the match of an unknown key replaced nothing")
+	}
+	if store.Len() != 0 {
+		t.Error("Replace added an unknown key")
+	}
+
+	store.Add(current)
+	if store.Replace(current, func(scan.Match, scan.Match) bool { return false }) {
+		t.Error("Replace stored a match better rejected")
+	}
+	if !store.Replace(candidate, scan.BetterExample) {
+		t.Error("the better example wasn't stored")
+	}
+	if store.Replace(current, scan.BetterExample) {
+		t.Error("the worse example replaced the better one")
+	}
+
+	store.Each(func(m scan.Match) error {
+		if m.Value != candidate.Value {
+			t.Errorf("the example is %s, want %s", m.Value, candidate.Value)
+		}
+		return nil
+	})
+	if store.Len() != 1 {
+		t.Errorf("the store has %d keys, want 1", store.Len())
+	}
+}
+
+func TestRegistryMatch(t *testing.T) {
+	registry := scan.NewRegistry(scan.DefaultMatchers()...)
+
+	tests := []struct {
+		value     string
+		matchType string
+	}{
+		{"arn:aws:iam::123456789012:role/deploy", scan.MatchTypeARN},
+		{"i-0123456789abcdef0", scan.MatchTypeResourceID},
+		{"sg-12345678", scan.MatchTypeResourceID},
+		{"deploy", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		m, ok := registry.Match("requestParameters.value", tt.value)
+		if ok != (tt.matchType != "") || m.MatchType != tt.matchType {
+			t.Errorf("Match(%q) = %q, %v, want %q", tt.value, m.MatchType, ok, tt.matchType)
+			continue
+		}
+		if ok && (m.Key != "requestParameters.value" || m.Value != tt.value) {
+			t.Errorf("Match(%q) recorded %s=%s", tt.value, m.Key, m.Value)
+		}
+	}
+
+	if _, ok := scan.NewRegistry().Match("requestParameters.value", "arn:aws:s3:::bucket"); ok {
+		t.Error("an empty registry matched")
+	}
+}
+
+// typeMatcher matches every value as its type.
+type typeMatcher string
+
+func (m typeMatcher) Match(key, value string) (scan.Match, bool) {
+	return scan.Match{Key: key, Value: value, MatchType: string(m)}, true
+}
+
+func TestRegistryPriority(t *testing.T) {
+	accountID := scan.RegexpMatcher{MatchType: "account-id", Pattern: regexp.MustCompile(`^\d{12}$`), Confidence: 0.5}
+
+	tests := []struct {
+		name     string
+		matchers []scan.Matcher
+		value    string
+		want     string
+	}{
+		{"first registered wins", []scan.Matcher{typeMatcher("first"), typeMatcher("second")}, "anything", "first"},
+		{"order reversed", []scan.Matcher{typeMatcher("second"), typeMatcher("first")}, "anything", "second"},
+		{"custom before the defaults", append([]scan.Matcher{accountID}, scan.DefaultMatchers()...), "123456789012", "account-id"},
+		{"defaults before a catch all", append(scan.DefaultMatchers(), typeMatcher("other")), "arn:aws:s3:::bucket", scan.MatchTypeARN},
+		{"falls through to a later matcher", append(scan.DefaultMatchers(), typeMatcher("other")), "bucket", "other"},
+		{"ARN before resource id", []scan.Matcher{scan.ARNMatcher{}, scan.ResourceIDMatcher{}}, "arn:aws:ec2:eu-west-1:123456789012:instance/i-0123456789abcdef0", scan.MatchTypeARN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, ok := scan.NewRegistry(tt.matchers...).Match("requestParameters.value", tt.value)
+			if !ok || m.MatchType != tt.want {
+				t.Errorf("Match(%q) = %q, %v, want %q", tt.value, m.MatchType, ok, tt.want)
+			}
+		})
+	}
+
+	// Register appends after the matchers given to NewRegistry.
+	registry := scan.NewRegistry(typeMatcher("first"))
+	registry.Register(typeMatcher("registered"))
+	if m, _ := registry.Match("key", "value"); m.MatchType != "first" {
+		t.Errorf("Register took precedence: %q", m.MatchType)
+	}
+	registry = scan.NewRegistry(scan.ARNMatcher{})
+	registry.Register(typeMatcher("registered"))
+	if m, _ := registry.Match("key", "value"); m.MatchType != "registered" {
+		t.Errorf("the registered matcher wasn't asked: %q", m.MatchType)
+	}
+}
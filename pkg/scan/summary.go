@@ -0,0 +1,44 @@
+package scan
+
+import "context"
+
+//go:generate go run ../../internal/schemagen -o ../../schema/snapshot.schema.json
+
+// SchemaVersion is the version of the Snapshot format, raised whenever a
+// field changes meaning or is removed.
+const SchemaVersion = 1
+
+// Snapshot is the content of a Store at one point in time.
+type Snapshot struct {
+	SchemaVersion int `json:"schemaVersion"`
+
+	// Metadata describes what wrote the snapshot, e.g. the version of the
+	// tool. The scan package doesn't set it.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Counts holds the number of keys per match type.
+	Counts map[string]int `json:"counts"`
+
+	Matches []Match `json:"matches"`
+}
+
+// TakeSnapshot reads every match of store.
+func TakeSnapshot(store Store) (Snapshot, error) {
+	snapshot := Snapshot{
+		SchemaVersion: SchemaVersion,
+		Counts:        make(map[string]int),
+		Matches:       make([]Match, 0, store.Len()),
+	}
+	err := store.Each(func(m Match) error {
+		snapshot.Counts[m.MatchType]++
+		snapshot.Matches = append(snapshot.Matches, m)
+		return nil
+	})
+
+	return snapshot, err
+}
+
+// SummaryWriter writes the summary of a scan, e.g. as a file in some format.
+type SummaryWriter interface {
+	Write(ctx context.Context, snapshot Snapshot) error
+}
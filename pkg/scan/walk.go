@@ -0,0 +1,47 @@
+package scan
+
+import (
+	"strconv"
+	"strings"
+)
+
+// keyEscaper escapes the dots of a key segment, e.g. the tag key
+// "kubernetes.io/cluster/name", so they don't read as nesting. Backslashes are
+// escaped too, keys stay unambiguous.
+var keyEscaper = strings.NewReplacer(`\`, `\\`, `.`, `\.`)
+
+// walkFields calls fn for every scalar leaf of nested with two keys, the
+// dotted path to the leaf and the same path with array indices collapsed, e.g.
+// "a.b.0.c" and "a.b[].c". Only array elements are collapsed, numeric object
+// keys such as account ids stay. Dots within a segment are escaped, e.g.
+// "tags.kubernetes\.io/cluster/name".
+func walkFields(nested any, fn func(rawKey, cleanKey string, value any)) {
+	walkKeys("", "", true, nested, fn)
+}
+
+// walkKeys walks nested below rawKey and cleanKey, or from the top of the
+// document for root. An empty object key is a segment of its own, so
+// {"":{"a":1}} walks to ".a" and not to the "a" of {"a":1}.
+func walkKeys(rawKey, cleanKey string, root bool, nested any, fn func(rawKey, cleanKey string, value any)) {
+	switch node := nested.(type) {
+	case map[string]any:
+		for k, v := range node {
+			segment := keyEscaper.Replace(k)
+			walkKeys(joinKey(rawKey, segment, root), joinKey(cleanKey, segment, root), false, v, fn)
+		}
+	case []any:
+		for i, v := range node {
+			walkKeys(joinKey(rawKey, strconv.Itoa(i), root), cleanKey+"[]", false, v, fn)
+		}
+	default:
+		fn(rawKey, cleanKey, node)
+	}
+}
+
+func joinKey(prefix, segment string, root bool) string {
+	if root {
+		return segment
+	}
+
+	return prefix + "." + segment
+}
@@ -0,0 +1,282 @@
+package scan
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata with the current outputs")
+
+// leaf is a scalar walkFields found.
+type leaf struct {
+	rawKey, cleanKey string
+}
+
+func walkLeaves(doc any) []leaf {
+	var leaves []leaf
+	walkFields(doc, func(rawKey, cleanKey string, value any) {
+		leaves = append(leaves, leaf{rawKey, cleanKey})
+	})
+	slices.SortFunc(leaves, func(a, b leaf) int {
+		return strings.Compare(a.rawKey, b.rawKey)
+	})
+	return leaves
+}
+
+// TestWalkFieldsGolden lists the raw and clean key of every field of the
+// corpus events in testdata/keys, rewritten with -update.
+func TestWalkFieldsGolden(t *testing.T) {
+	for name, payload := range corpusEvents(t) {
+		t.Run(name, func(t *testing.T) {
+			var doc any
+			if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+				t.Fatal(err)
+			}
+
+			var got bytes.Buffer
+			for _, l := range walkLeaves(doc) {
+				fmt.Fprintf(&got, "%s\t%s\n", l.rawKey, l.cleanKey)
+			}
+
+			path := filepath.Join("testdata", "keys", name+".tsv")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v, run go test -run %s -update to create it", err, t.Name())
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("keys differ from %s, run go test -run %s -update if the change is intended\ngot:\n%s\nwant:\n%s", path, t.Name(), got.Bytes(), want)
+			}
+		})
+	}
+}
+
+// TestWalkFieldsEscaping escapes the dots and backslashes of object keys, so
+// a dotted key never reads as the nested keys it looks like.
+func TestWalkFieldsEscaping(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		keys map[string]string // raw key to clean key
+	}{
+		{
+			name: "dotted tag key",
+			doc:  `{"tags":{"kubernetes.io/cluster/name":"owned"}}`,
+			keys: map[string]string{`tags.kubernetes\.io/cluster/name`: `tags.kubernetes\.io/cluster/name`},
+		},
+		{
+			name: "dotted key next to nested keys",
+			doc:  `{"a.b":"dotted","a":{"b":"nested"}}`,
+			keys: map[string]string{`a\.b`: `a\.b`, `a.b`: `a.b`},
+		},
+		{
+			name: "escaped dot next to dotted key",
+			doc:  `{"a\\.b":"backslash dot","a.b":"dotted"}`,
+			keys: map[string]string{`a\\\.b`: `a\\\.b`, `a\.b`: `a\.b`},
+		},
+		{
+			name: "trailing backslash next to dotted key",
+			doc:  `{"a\\":{"b":"nested"},"a\\.b":"backslash dot"}`,
+			keys: map[string]string{`a\\.b`: `a\\.b`, `a\\\.b`: `a\\\.b`},
+		},
+		{
+			name: "leading and trailing dots",
+			doc:  `{".a":"1","a.":"2","a":{"":"3"},"":{"a":"4"}}`,
+			keys: map[string]string{`\.a`: `\.a`, `a\.`: `a\.`, `a.`: `a.`, `.a`: `.a`},
+		},
+		{
+			name: "only dots",
+			doc:  `{".":"1","..":"2","":{"":"3"}}`,
+			keys: map[string]string{`\.`: `\.`, `\.\.`: `\.\.`, `.`: `.`},
+		},
+		{
+			name: "dotted keys in arrays",
+			doc:  `{"items":[{"a.b":"1"},{"a":{"b":"2"}}]}`,
+			keys: map[string]string{`items.0.a\.b`: `items[].a\.b`, `items.1.a.b`: `items[].a.b`},
+		},
+		{
+			name: "dotted numeric key",
+			doc:  `{"versions":{"1.0":"1","1":{"0":"2"}}}`,
+			keys: map[string]string{`versions.1\.0`: `versions.1\.0`, `versions.1.0`: `versions.1.0`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc any
+			if err := json.Unmarshal([]byte(tt.doc), &doc); err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]string{}
+			for _, l := range walkLeaves(doc) {
+				if _, ok := got[l.rawKey]; ok {
+					t.Errorf("two leaves under %q", l.rawKey)
+				}
+				got[l.rawKey] = l.cleanKey
+			}
+			if len(got) != len(tt.keys) {
+				t.Errorf("keys %q, want %q", got, tt.keys)
+			}
+			for raw, clean := range tt.keys {
+				if got[raw] != clean {
+					t.Errorf("clean key of %q is %q, want %q", raw, got[raw], clean)
+				}
+			}
+		})
+	}
+}
+
+// TestWalkFieldsArrays collapses the indices of array elements, at any depth,
+// and only those: numeric object keys such as account ids stay.
+func TestWalkFieldsArrays(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		keys map[string]string // raw key to clean key
+	}{
+		{
+			name: "array of objects",
+			doc:  `{"items":[{"id":"a"},{"id":"b"}]}`,
+			keys: map[string]string{"items.0.id": "items[].id", "items.1.id": "items[].id"},
+		},
+		{
+			name: "array of scalars",
+			doc:  `{"ids":["a",1,true,null]}`,
+			keys: map[string]string{"ids.0": "ids[]", "ids.1": "ids[]", "ids.2": "ids[]", "ids.3": "ids[]"},
+		},
+		{
+			name: "nested arrays",
+			doc:  `{"matrix":[["a","b"],[["c"]]]}`,
+			keys: map[string]string{"matrix.0.0": "matrix[][]", "matrix.0.1": "matrix[][]", "matrix.1.0.0": "matrix[][][]"},
+		},
+		{
+			name: "arrays of objects of arrays",
+			doc:  `{"a":[{"b":[{"c":"x"}]},{"b":[{"c":"y"},{"c":"z"}]}]}`,
+			keys: map[string]string{"a.0.b.0.c": "a[].b[].c", "a.1.b.0.c": "a[].b[].c", "a.1.b.1.c": "a[].b[].c"},
+		},
+		{
+			name: "top level array",
+			doc:  `[{"id":"a"},["b"]]`,
+			keys: map[string]string{"0.id": "[].id", "1.0": "[][]"},
+		},
+		{
+			name: "empty arrays",
+			doc:  `{"items":[],"nested":[[]]}`,
+			keys: map[string]string{},
+		},
+		{
+			name: "account id key",
+			doc:  `{"accounts":{"123456789012":{"roleArn":"arn:aws:iam::123456789012:role/a"}}}`,
+			keys: map[string]string{"accounts.123456789012.roleArn": "accounts.123456789012.roleArn"},
+		},
+		{
+			name: "numeric keys next to an array",
+			doc:  `{"byIndex":{"0":"a","1":"b"},"list":["a","b"]}`,
+			keys: map[string]string{"byIndex.0": "byIndex.0", "byIndex.1": "byIndex.1", "list.0": "list[]", "list.1": "list[]"},
+		},
+		{
+			name: "account id key in an array",
+			doc:  `{"items":[{"123456789012":["arn:aws:iam::123456789012:role/a"]}]}`,
+			keys: map[string]string{"items.0.123456789012.0": "items[].123456789012[]"},
+		},
+		{
+			name: "brackets in a key",
+			doc:  `{"items[]":"a","items":["b"]}`,
+			keys: map[string]string{"items[]": "items[]", "items.0": "items[]"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc any
+			if err := json.Unmarshal([]byte(tt.doc), &doc); err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]string{}
+			for _, l := range walkLeaves(doc) {
+				got[l.rawKey] = l.cleanKey
+			}
+			if len(got) != len(tt.keys) {
+				t.Errorf("keys %q, want %q", got, tt.keys)
+			}
+			for raw, clean := range tt.keys {
+				if got[raw] != clean {
+					t.Errorf("clean key of %q is %q, want %q", raw, got[raw], clean)
+				}
+			}
+		})
+	}
+}
+
+// FuzzCleanKey checks the keys walkFields builds for any json document, with
+// the array indices of the clean key collapsed, e.g. items[].id:
+//
+//	go test ./pkg/scan -run '^$' -fuzz FuzzCleanKey
+func FuzzCleanKey(f *testing.F) {
+	for _, seed := range []string{
+		`{"eventName":"RunInstances","requestParameters":{"instancesSet":{"items":[{"imageId":"ami-0123456789abcdef0"}]}}}`,
+		`{"requestParameters":{"tags":{"kubernetes.io/cluster/name":"owned"}}}`,
+		`{"requestParameters":{"ipPermissions":{"items":[{"fromPort":443,"ipRanges":{"items":[{"cidrIp":"10.0.0.0/8"}]}}]}}}`,
+		`{"responseElements":{"accounts":{"123456789012":{"roleArn":"arn:aws:iam::123456789012:role/a"}}}}`,
+		`{"a\\b.c":[[["x"]],{"0":"y"}],"":{"":""}}`,
+		`{"items[]":["arn:aws:s3:::bucket"],"items":{"[]":"z"}}`,
+		`[{"eventName":"GetObject"},"scalar",1,null]`,
+		`"arn:aws:sns:us-east-1:123456789012:topic"`,
+		`{"événement":{"clé.日本":"🔑"}}`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, payload string) {
+		var doc any
+		if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+			return
+		}
+
+		leaves := walkLeaves(doc)
+		for _, l := range leaves {
+			if !utf8.ValidString(l.rawKey) || !utf8.ValidString(l.cleanKey) {
+				t.Fatalf("keys %q and %q aren't valid UTF-8", l.rawKey, l.cleanKey)
+			}
+			// Only array elements are collapsed, the clean key of a leaf
+			// outside any array is its raw key. Object keys may hold "[]"
+			// themselves, so the reverse doesn't hold.
+			if !strings.Contains(l.cleanKey, "[]") && l.rawKey != l.cleanKey {
+				t.Fatalf("clean key %q of %q collapsed more than array indices", l.cleanKey, l.rawKey)
+			}
+		}
+
+		// Cleaning is idempotent: the same document, encoded again, yields
+		// the same keys.
+		encoded, err := json.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again any
+		if err := json.Unmarshal(encoded, &again); err != nil {
+			t.Fatal(err)
+		}
+		if second := walkLeaves(again); !slices.Equal(leaves, second) {
+			t.Fatalf("keys changed after encoding the document again:\n%v\n%v", leaves, second)
+		}
+	})
+}
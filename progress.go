@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/term"
+)
+
+// progress holds the counters shared by the scanner and the worker for the
+// periodic progress log.
+type progress struct {
+	pages  atomic.Int64
+	files  atomic.Int64
+	events atomic.Int64
+
+	// totalFiles is only known by sources that list all files upfront.
+	totalFiles atomic.Int64
+
+	// lastEventTime is the time of the last event handled, in unix nanos.
+	// With lookupWindow, only set for LookupEvents scans before they start,
+	// it estimates how far the scan got.
+	lastEventTime atomic.Int64
+	lookupWindow  timeWindow
+}
+
+// reportProgress logs the scan progress every interval until ctx is done.
+// The retry budget is only logged for LookupEvents scans, budget is nil for
+// the other sources.
+func reportProgress(ctx context.Context, interval time.Duration, prog *progress, cache scan.Store, mem *memoryMonitor, budget *retryBudget) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastEvents, lastKeys := prog.events.Load(), cache.Len()
+	lastTick := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			events, keys := prog.events.Load(), cache.Len()
+			elapsed := now.Sub(lastTick).Seconds()
+
+			attrs := []any{
+				slog.Int64("events", events),
+				slog.Int64("pages", prog.pages.Load()),
+				slog.Int64("files", prog.files.Load()),
+				slog.Int64("total-files", prog.totalFiles.Load()),
+				slog.Float64("events-per-sec", float64(events-lastEvents)/elapsed),
+				slog.Int("unique-keys", keys),
+				slog.Int("new-keys", keys-lastKeys),
+			}
+			if budget != nil {
+				attrs = append(attrs, budget.logAttrs()...)
+			}
+			slog.Info("Progress", attrs...)
+
+			mem.sample(true)
+
+			lastEvents, lastKeys, lastTick = events, keys, now
+		}
+	}
+}
+
+// isTerminal reports whether f is a terminal rather than a file or a pipe.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// progressBar redraws a single progress line on a terminal. Console logs go
+// through logWriter, which clears the line before writing and draws it again
+// after, so the two never end up on the same line.
+type progressBar struct {
+	mu   sync.Mutex
+	out  io.Writer
+	line string
+	done chan struct{}
+	stop sync.Once
+}
+
+func newProgressBar(out io.Writer) *progressBar {
+	return &progressBar{out: out, done: make(chan struct{})}
+}
+
+// logWriter returns a writer for the console logs to w, usually stderr on
+// the same terminal.
+func (b *progressBar) logWriter(w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		b.clear()
+		n, err := w.Write(p)
+		fmt.Fprint(b.out, b.line)
+		return n, err
+	})
+}
+
+// run redraws the line every second until finish is called or ctx is done.
+func (b *progressBar) run(ctx context.Context, prog *progress, cache scan.Store) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			line := prog.render(now.Sub(start), now, cache.Len())
+
+			b.mu.Lock()
+			b.clear()
+			b.line = line
+			fmt.Fprint(b.out, b.line)
+			b.mu.Unlock()
+		}
+	}
+}
+
+// finish stops redrawing and removes the line. It may be called more than
+// once.
+func (b *progressBar) finish() {
+	b.stop.Do(func() {
+		close(b.done)
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.clear()
+		b.line = ""
+	})
+}
+
+func (b *progressBar) clear() {
+	if b.line != "" {
+		fmt.Fprint(b.out, "\r\033[K")
+	}
+}
+
+// render is the progress line after elapsed, e.g.
+// "pages 12 | events 3400 (120/s) | keys 87 | 1m5s | eta 3m".
+func (p *progress) render(elapsed time.Duration, now time.Time, keys int) string {
+	events := p.events.Load()
+	rate := float64(events) / max(elapsed.Seconds(), 1)
+
+	line := fmt.Sprintf("pages %d | events %d (%.0f/s) | keys %d | %s",
+		p.pages.Load(), events, rate, keys, elapsed.Truncate(time.Second))
+	if total := p.totalFiles.Load(); total > 0 {
+		line = fmt.Sprintf("files %d/%d | %s", p.files.Load(), total, line)
+	}
+
+	if done, ok := p.fraction(now); ok && done > 0 {
+		eta := time.Duration(float64(elapsed) * (1 - done) / done)
+		line += " | eta " + eta.Truncate(time.Second).String()
+	} else {
+		line += " | eta unknown"
+	}
+	return line
+}
+
+// fraction estimates the share of the scan done. It is known when the source
+// listed its files upfront, or for LookupEvents with a --start-time, which
+// returns the newest events first so the time of the last event tells how
+// far back it went.
+func (p *progress) fraction(now time.Time) (float64, bool) {
+	if total := p.totalFiles.Load(); total > 0 {
+		return float64(p.files.Load()) / float64(total), true
+	}
+
+	last := p.lastEventTime.Load()
+	if p.lookupWindow.start.IsZero() || last == 0 {
+		return 0, false
+	}
+
+	end := p.lookupWindow.end
+	if end.IsZero() {
+		end = now
+	}
+	span := end.Sub(p.lookupWindow.start)
+	if span <= 0 {
+		return 0, false
+	}
+	return min(max(float64(end.Sub(time.Unix(0, last)))/float64(span), 0), 1), true
+}
+
+// writerFunc turns a function into an io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
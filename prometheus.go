@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// The collectors are always updated, --metrics-addr only decides whether they
+// are served. They are registered once, in metricsRegistry.
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	eventsProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "events_processed_total",
+		Help: "Events handled by the workers.",
+	})
+	pagesFetched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pages_fetched_total",
+		Help: "Pages of events fetched, by source and the account or shard they were fetched from.",
+	}, []string{"source", "partition"})
+	apiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_errors_total",
+		Help: "Failed API calls by source and error code.",
+	}, []string{"source", "code"})
+	eventsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "channel_depth",
+		Help: "Events handed over to the workers that weren't handled yet.",
+	})
+	processingDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "processing_duration_seconds",
+		Help:    "Time spent looking for identifiers in a single event.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(eventsProcessed, pagesFetched, apiErrors, eventsInFlight, processingDuration)
+}
+
+// countAPIError counts err under its API error code.
+func countAPIError(source string, err error) {
+	apiErrors.WithLabelValues(source, apiErrorCode(err)).Inc()
+}
+
+// startMetrics serves the Prometheus metrics, /healthz and /readyz on addr
+// until ctx is done.
+func startMetrics(ctx context.Context, addr string, cache scan.Store, health *healthState) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	metricsRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "unique_keys",
+		Help: "Distinct keys found so far.",
+	}, func() float64 { return float64(cache.Len()) }))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	health.register(mux)
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", slog.String("error", err.Error()))
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving metrics", slog.String("address", "http://"+ln.Addr().String()+"/metrics"))
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// recapTopKeys is the number of keys listed in the recap.
+const recapTopKeys = 10
+
+// Outcomes of a scan in the recap.
+const (
+	outcomeComplete  = "complete"
+	outcomeTruncated = "truncated"
+	outcomeAborted   = "aborted"
+)
+
+// runRecap is what the scan did, printed to stderr once it finished.
+type runRecap struct {
+	outcome string
+	// why the scan wasn't complete, empty if it was.
+	detail string
+
+	reason   stopReason
+	events   int
+	pages    int
+	duration time.Duration
+
+	keysByMatchType map[string]int
+	topKeys         []keyHits
+
+	failedEvents int
+	retries      int
+	artifacts    []string
+}
+
+type keyHits struct {
+	key  string
+	hits int
+}
+
+// newRecap sums the scan up, err being what run returns.
+func newRecap(stats *scanStats, scanned scan.Stats, duration time.Duration, artifacts []string, err error) runRecap {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	r := runRecap{
+		reason:          stats.StopReason,
+		events:          stats.Events,
+		pages:           stats.Pages,
+		duration:        duration,
+		keysByMatchType: scanned.MatcherHits,
+		failedEvents:    stats.FailedEvents,
+		retries:         stats.Retries,
+		artifacts:       artifacts,
+	}
+
+	for key, hits := range scanned.KeyHits {
+		r.topKeys = append(r.topKeys, keyHits{key: key, hits: hits})
+	}
+	slices.SortFunc(r.topKeys, func(a, b keyHits) int {
+		return cmp.Or(cmp.Compare(b.hits, a.hits), cmp.Compare(a.key, b.key))
+	})
+	r.topKeys = r.topKeys[:min(len(r.topKeys), recapTopKeys)]
+
+	var exit *exitError
+	// Unmapped keys fail the run, but don't say anything about the scan.
+	if errors.As(err, &exit) && exit.code == exitUnmapped {
+		err = nil
+	}
+	switch {
+	case errors.As(err, &exit) && exit.code == exitPartial:
+		r.outcome, r.detail = outcomeTruncated, err.Error()
+	case err != nil:
+		r.outcome, r.detail = outcomeAborted, err.Error()
+	case stats.StopReason == stopSaturated:
+		r.outcome, r.detail = outcomeTruncated, "no new keys were found for --stop-after-stale-pages pages"
+	case stats.StopReason == stopNoTrail:
+		r.outcome, r.detail = outcomeTruncated, "no trail logs the region, it wasn't scanned"
+	case stats.TimeBounded:
+		r.outcome, r.detail = outcomeTruncated, "--stop-after was reached"
+	case stats.StopReason == stopCanceled:
+		r.outcome, r.detail = outcomeTruncated, "interrupted"
+	case stats.Truncated:
+		r.outcome, r.detail = outcomeTruncated, fmt.Sprintf("--max-keys was reached, %d matches were dropped", stats.DroppedMatches)
+	default:
+		r.outcome = outcomeComplete
+	}
+
+	return r
+}
+
+// existingArtifacts keeps the paths that exist, the files a run wrote only
+// exist if there was something to write.
+func existingArtifacts(paths ...string) []string {
+	var existing []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil && !slices.Contains(existing, path) {
+			existing = append(existing, path)
+		}
+	}
+	return existing
+}
+
+func (r runRecap) LogValue() slog.Value {
+	topKeys := make([]string, 0, len(r.topKeys))
+	for _, k := range r.topKeys {
+		topKeys = append(topKeys, fmt.Sprintf("%s=%d", k.key, k.hits))
+	}
+
+	return slog.GroupValue(
+		slog.String("outcome", r.outcome),
+		slog.String("detail", r.detail),
+		slog.String("stop-reason", string(r.reason)),
+		slog.Int("events", r.events),
+		slog.Int("pages", r.pages),
+		slog.Duration("duration", r.duration),
+		slog.Any("keys-by-match-type", r.keysByMatchType),
+		slog.Any("top-keys", topKeys),
+		slog.Int("failed-events", r.failedEvents),
+		slog.Int("retries", r.retries),
+		slog.Any("artifacts", r.artifacts),
+	)
+}
+
+// print writes the recap for a human, e.g. to stderr.
+func (r runRecap) print(w io.Writer) {
+	headline := "Scan " + r.outcome
+	if r.detail != "" {
+		headline += ": " + r.detail
+	}
+	fmt.Fprintf(w, "\n%s\n\n", headline)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Events\t%d\n", r.events)
+	fmt.Fprintf(tw, "Pages\t%d\n", r.pages)
+	fmt.Fprintf(tw, "Duration\t%s\n", r.duration.Truncate(time.Millisecond))
+	fmt.Fprintf(tw, "Parse failures\t%d\n", r.failedEvents)
+	fmt.Fprintf(tw, "Retries\t%d\n", r.retries)
+
+	total := 0
+	byType := make([]string, 0, len(r.keysByMatchType))
+	for matchType, n := range r.keysByMatchType {
+		total += n
+		byType = append(byType, fmt.Sprintf("%s %d", matchType, n))
+	}
+	slices.Sort(byType)
+	if len(byType) > 0 {
+		fmt.Fprintf(tw, "Unique keys\t%d (%s)\n", total, strings.Join(byType, ", "))
+	} else {
+		fmt.Fprintf(tw, "Unique keys\t0\n")
+	}
+	tw.Flush()
+
+	if len(r.topKeys) > 0 {
+		fmt.Fprintf(w, "\nTop keys by values seen\n")
+		for _, k := range r.topKeys {
+			fmt.Fprintf(tw, "  %d\t%s\n", k.hits, k.key)
+		}
+		tw.Flush()
+	}
+
+	if len(r.artifacts) > 0 {
+		fmt.Fprintf(w, "\nWritten\n")
+		for _, path := range r.artifacts {
+			fmt.Fprintf(w, "  %s\n", path)
+		}
+	}
+}
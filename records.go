@@ -0,0 +1,114 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// trailFile is the format CloudTrail delivers log files to S3 in.
+type trailFile struct {
+	Records []json.RawMessage `json:"Records"`
+}
+
+// recordEnvelope holds the record fields sources pass on next to the raw
+// record.
+type recordEnvelope struct {
+	EventID     string    `json:"eventID"`
+	EventName   string    `json:"eventName"`
+	EventSource string    `json:"eventSource"`
+	EventTime   time.Time `json:"eventTime"`
+	AwsRegion   string    `json:"awsRegion"`
+	AccountID   string    `json:"recipientAccountId"`
+}
+
+// readTrailFile decodes a CloudTrail log file, gzipped if name ends in .gz,
+// and returns its records as events. Records outside of window are left out.
+func readTrailFile(r io.Reader, name string, window timeWindow) ([]scan.RawEvent, error) {
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		r = gz
+	}
+
+	var file trailFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, err
+	}
+
+	if file.Records == nil {
+		return nil, fmt.Errorf("%s has no Records array, is it a CloudTrail log file?", name)
+	}
+
+	events := make([]scan.RawEvent, 0, len(file.Records))
+	for _, raw := range file.Records {
+		event, eventTime, err := recordToEvent(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if window.contains(eventTime) {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+func recordToEvent(raw json.RawMessage) (scan.RawEvent, time.Time, error) {
+	var envelope recordEnvelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return scan.RawEvent{}, time.Time{}, err
+	}
+
+	return scan.RawEvent{
+		Payload:     string(raw),
+		EventID:     envelope.EventID,
+		EventName:   envelope.EventName,
+		EventSource: envelope.EventSource,
+		EventTime:   envelope.EventTime,
+		Region:      envelope.AwsRegion,
+		AccountID:   envelope.AccountID,
+	}, envelope.EventTime, nil
+}
+
+// eventBridgeEnvelope is how EventBridge wraps CloudTrail records, with the
+// record in detail.
+type eventBridgeEnvelope struct {
+	DetailType string          `json:"detail-type"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// unwrapEventBridge returns the CloudTrail record of an EventBridge event. A
+// bare CloudTrail record is accepted as is.
+func unwrapEventBridge(body []byte) (scan.RawEvent, error) {
+	var envelope eventBridgeEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return scan.RawEvent{}, err
+	}
+
+	record := json.RawMessage(body)
+	if len(envelope.Detail) > 0 {
+		record = envelope.Detail
+	}
+
+	event, _, err := recordToEvent(record)
+	if err != nil {
+		return scan.RawEvent{}, err
+	}
+
+	if event.EventID == "" {
+		return scan.RawEvent{}, fmt.Errorf("message is not a CloudTrail event")
+	}
+
+	return event, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/exp/maps"
+)
+
+// unknownRegion is the region of the events without awsRegion.
+const unknownRegion = "unknown"
+
+// regionSplit keeps a store per region for --split-by-region, so the
+// per-region summaries have the first example of every key seen in the
+// region, not only of the keys first seen there. The stores are in memory
+// whatever the store of the scan is.
+type regionSplit struct {
+	matchers scan.Matcher
+
+	mu     sync.Mutex
+	stores map[string]*scan.MemoryStore
+}
+
+func newRegionSplit(matchers scan.Matcher) *regionSplit {
+	return &regionSplit{matchers: matchers, stores: make(map[string]*scan.MemoryStore)}
+}
+
+// add is a scan.WithOnHit hook. The values of known keys didn't go through
+// the matchers, the first one of a key in a region does.
+func (r *regionSplit) add(event scan.RawEvent, key, value string) {
+	region := event.Region
+	if region == "" {
+		region = unknownRegion
+	}
+
+	r.mu.Lock()
+	store, ok := r.stores[region]
+	if !ok {
+		store = scan.NewMemoryStore(1000)
+		r.stores[region] = store
+	}
+	r.mu.Unlock()
+
+	if store.Has(key) {
+		return
+	}
+	m, ok := r.matchers.Match(key, value)
+	if !ok {
+		return
+	}
+
+	m.Key = key
+	m.Service = strings.TrimSuffix(event.EventSource, ".amazonaws.com")
+	m.EventName = event.EventName
+	m.EventID = event.EventID
+	m.EventTime = event.EventTime
+	m.AccountID = event.AccountID
+	m.Region = event.Region
+	store.Add(m)
+}
+
+// len is the number of keys stored over all regions.
+func (r *regionSplit) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, store := range r.stores {
+		n += store.Len()
+	}
+	return n
+}
+
+// write writes a csv summary per region next to base, summary.csv becoming
+// summary.eu-west-1.csv, and the keys found in some regions only to
+// summary.regions.csv.
+func (r *regionSplit) write(ctx context.Context, base string, comma rune) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	regions := maps.Keys(r.stores)
+	slices.Sort(regions)
+
+	var errs []error
+	for _, region := range regions {
+		w := &csvSummaryWriter{path: regionPath(base, region), comma: comma}
+		if err := writeSummaries(ctx, r.stores[region], []scan.SummaryWriter{w}); err != nil {
+			errs = append(errs, fmt.Errorf("region %s: %w", region, err))
+		}
+	}
+
+	path := regionPath(base, "regions")
+	if err := writeRegionComparison(path, regions, r.stores, comma); err != nil {
+		errs = append(errs, fmt.Errorf("write region comparison: %w", err))
+	}
+
+	slog.Debug("Region summaries written", slog.Int("regions", len(regions)), slog.String("comparison", path))
+	return errors.Join(errs...)
+}
+
+// regionPath puts name before the extension of base.
+func regionPath(base, name string) string {
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "." + name + ext
+}
+
+// writeRegionComparison writes a row per key found in some regions but not
+// in others, with the regions it was found in and the ones it wasn't, space
+// separated.
+func writeRegionComparison(path string, regions []string, stores map[string]*scan.MemoryStore, comma rune) error {
+	present := make(map[string][]string)
+	for _, region := range regions {
+		if err := stores[region].Each(func(m scan.Match) error {
+			present[m.Key] = append(present[m.Key], region)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	keys := maps.Keys(present)
+	slices.Sort(keys)
+
+	file, err := createAtomic(path, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.abort()
+
+	wr := csv.NewWriter(file)
+	if comma != 0 {
+		wr.Comma = comma
+	}
+	if err := wr.Write([]string{"key", "presentIn", "missingIn"}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		in := present[key]
+		if len(in) == len(regions) {
+			continue
+		}
+
+		var missing []string
+		for _, region := range regions {
+			if !slices.Contains(in, region) {
+				missing = append(missing, region)
+			}
+		}
+		if err := wr.Write([]string{key, strings.Join(in, " "), strings.Join(missing, " ")}); err != nil {
+			return err
+		}
+	}
+
+	wr.Flush()
+	if err := wr.Error(); err != nil {
+		return err
+	}
+	return file.commit()
+}
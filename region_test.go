@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+func TestRegionPath(t *testing.T) {
+	tests := []struct {
+		base, name, want string
+	}{
+		{"summary.csv", "eu-west-1", "summary.eu-west-1.csv"},
+		{"out/summary.csv", "regions", "out/summary.regions.csv"},
+		{"findings", "us-east-1", "findings.us-east-1"},
+	}
+	for _, tt := range tests {
+		if got := regionPath(tt.base, tt.name); got != tt.want {
+			t.Errorf("regionPath(%q, %q) = %q, want %q", tt.base, tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestRegionSplit writes a summary per region with the keys seen there, and
+// the keys missing in some regions to the comparison.
+func TestRegionSplit(t *testing.T) {
+	split := newRegionSplit(scan.NewRegistry(scanMatchers(nil)...))
+	hits := []struct {
+		region, key, value string
+	}{
+		{"eu-west-1", "requestParameters.roleArn", "arn:aws:iam::123456789012:role/a"},
+		{"eu-west-1", "requestParameters.bucketName", "arn:aws:s3:::bucket"},
+		{"us-east-1", "requestParameters.roleArn", "arn:aws:iam::123456789012:role/b"},
+		// A known key of the scan, but not an identifier in this region.
+		{"us-east-1", "requestParameters.bucketName", "bucket"},
+		{"", "requestParameters.roleArn", "arn:aws:iam::123456789012:role/c"},
+	}
+	for _, hit := range hits {
+		split.add(scan.RawEvent{Region: hit.region, EventSource: "iam.amazonaws.com", EventName: "GetRole"}, hit.key, hit.value)
+	}
+
+	base := filepath.Join(t.TempDir(), "summary.csv")
+	if err := split.write(context.Background(), base, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(regionPath(base, "regions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "key,presentIn,missingIn\nrequestParameters.bucketName,eu-west-1,unknown us-east-1\n"
+	if string(got) != want {
+		t.Errorf("region comparison is\n%s\nwant\n%s", got, want)
+	}
+
+	for region, keys := range map[string][]string{
+		"eu-west-1": {"requestParameters.bucketName", "requestParameters.roleArn"},
+		"us-east-1": {"requestParameters.roleArn"},
+		"unknown":   {"requestParameters.roleArn"},
+	} {
+		read := scan.NewMemoryStore(0)
+		if err := readSummary(regionPath(base, region), scan.NewRegistry(scanMatchers(nil)...), read, 0); err != nil {
+			t.Fatalf("region %s: %v", region, err)
+		}
+		var found []string
+		read.Each(func(m scan.Match) error {
+			found = append(found, m.Key)
+			return nil
+		})
+		slices.Sort(found)
+		if !slices.Equal(found, keys) {
+			t.Errorf("region %s has keys %v, want %v", region, found, keys)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	ebtypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// replayResourcePrefix names everything a replay creates, so resources left
+// behind by a killed run are easy to find.
+const replayResourcePrefix = "find-cloudtrail-arn-fields-"
+
+// replaySource replays an EventBridge archive of CloudTrail events. The
+// replayed events are routed by a temporary rule to a temporary SQS queue,
+// which is consumed like --sqs-queue-url until the replay completed and the
+// queue is drained. Everything it created is removed when it returns.
+type replaySource struct {
+	eventBridge       *eventbridge.Client
+	sqs               *sqs.Client
+	archive           string
+	window            timeWindow
+	visibilityTimeout time.Duration
+	stats             *scanStats
+
+	// Set while the resources exist, so cleanup only removes what was
+	// created.
+	busARN        string
+	ruleName      string
+	ruleHasTarget bool
+	queueURL      string
+	replayName    string
+
+	replayState ebtypes.ReplayState
+}
+
+func (r *replaySource) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	defer r.cleanup(context.WithoutCancel(ctx))
+
+	if err := r.start(ctx); err != nil {
+		if ctx.Err() != nil {
+			return stopCanceled
+		}
+
+		slog.Error("Couldn't start EventBridge replay", slog.String("archive", r.archive), slog.String("error", err.Error()))
+		return stopFailed
+	}
+
+	queue := &sqsSource{
+		client:            r.sqs,
+		queueURL:          r.queueURL,
+		visibilityTimeout: r.visibilityTimeout,
+		stats:             r.stats,
+		drained:           r.finished,
+	}
+
+	reason := queue.run(ctx, emit)
+	if reason == stopComplete && r.replayState != ebtypes.ReplayStateCompleted {
+		return stopFailed
+	}
+
+	return reason
+}
+
+// start creates the queue and the rule forwarding the replayed events to it,
+// then starts the replay.
+func (r *replaySource) start(ctx context.Context) error {
+	archive, err := r.eventBridge.DescribeArchive(ctx, &eventbridge.DescribeArchiveInput{ArchiveName: &r.archive})
+	if err != nil {
+		return err
+	}
+	r.busARN = deRef(archive.EventSourceArn)
+
+	start, end := r.window.start, r.window.end
+	if start.IsZero() {
+		start = deRef(archive.CreationTime)
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+
+	name := fmt.Sprintf("%s%d", replayResourcePrefix, time.Now().Unix())
+
+	queue, err := r.sqs.CreateQueue(ctx, &sqs.CreateQueueInput{QueueName: &name})
+	if err != nil {
+		return fmt.Errorf("create queue: %w", err)
+	}
+	r.queueURL = deRef(queue.QueueUrl)
+	slog.Info("Created replay queue", slog.String("queue-url", r.queueURL))
+
+	attrs, err := r.sqs.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       &r.queueURL,
+		AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNameQueueArn},
+	})
+	if err != nil {
+		return fmt.Errorf("get queue arn: %w", err)
+	}
+	queueARN := attrs.Attributes[string(sqstypes.QueueAttributeNameQueueArn)]
+
+	// Only events of this replay match, live events on the bus are ignored.
+	pattern, _ := json.Marshal(map[string][]string{"replay-name": {name}})
+	rule, err := r.eventBridge.PutRule(ctx, &eventbridge.PutRuleInput{
+		Name:         &name,
+		EventBusName: &r.busARN,
+		EventPattern: ptr(string(pattern)),
+		Description:  ptr("Forwards a replay to " + name + ", removed once the replay was consumed"),
+	})
+	if err != nil {
+		return fmt.Errorf("create rule: %w", err)
+	}
+	r.ruleName = name
+	slog.Info("Created replay rule", slog.String("rule", name), slog.String("event-bus", r.busARN))
+
+	if err := r.allowRule(ctx, queueARN, deRef(rule.RuleArn)); err != nil {
+		return fmt.Errorf("set queue policy: %w", err)
+	}
+
+	targets, err := r.eventBridge.PutTargets(ctx, &eventbridge.PutTargetsInput{
+		Rule:         &name,
+		EventBusName: &r.busARN,
+		Targets:      []ebtypes.Target{{Id: &name, Arn: &queueARN}},
+	})
+	if err != nil {
+		return fmt.Errorf("add rule target: %w", err)
+	}
+	if targets.FailedEntryCount > 0 {
+		return fmt.Errorf("add rule target: %s", deRef(targets.FailedEntries[0].ErrorMessage))
+	}
+	r.ruleHasTarget = true
+
+	_, err = r.eventBridge.StartReplay(ctx, &eventbridge.StartReplayInput{
+		ReplayName:     &name,
+		EventSourceArn: archive.ArchiveArn,
+		EventStartTime: &start,
+		EventEndTime:   &end,
+		Destination: &ebtypes.ReplayDestination{
+			Arn:        &r.busARN,
+			FilterArns: []string{deRef(rule.RuleArn)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("start replay: %w", err)
+	}
+	r.replayName = name
+	slog.Info("Started EventBridge replay", slog.String("replay", name), slog.Time("start-time", start), slog.Time("end-time", end))
+
+	return nil
+}
+
+// allowRule lets EventBridge deliver the rule's events to the queue.
+func (r *replaySource) allowRule(ctx context.Context, queueARN, ruleARN string) error {
+	policy, _ := json.Marshal(map[string]any{
+		"Version": "2012-10-17",
+		"Statement": []map[string]any{{
+			"Effect":    "Allow",
+			"Principal": map[string]string{"Service": "events.amazonaws.com"},
+			"Action":    "sqs:SendMessage",
+			"Resource":  queueARN,
+			"Condition": map[string]any{"ArnEquals": map[string]string{"aws:SourceArn": ruleARN}},
+		}},
+	})
+
+	_, err := r.sqs.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{
+		QueueUrl:   &r.queueURL,
+		Attributes: map[string]string{string(sqstypes.QueueAttributeNamePolicy): string(policy)},
+	})
+	return err
+}
+
+// finished reports whether the replay stopped, so no more events will be
+// delivered to the queue.
+func (r *replaySource) finished(ctx context.Context) bool {
+	out, err := r.eventBridge.DescribeReplay(ctx, &eventbridge.DescribeReplayInput{ReplayName: &r.replayName})
+	if err != nil {
+		slog.Warn("Couldn't describe EventBridge replay", slog.String("replay", r.replayName), slog.String("error", err.Error()))
+		return false
+	}
+
+	r.replayState = out.State
+	switch out.State {
+	case ebtypes.ReplayStateCompleted:
+		slog.Info("EventBridge replay completed", slog.String("replay", r.replayName))
+		return true
+	case ebtypes.ReplayStateFailed, ebtypes.ReplayStateCancelled:
+		slog.Error("EventBridge replay stopped", slog.String("replay", r.replayName), slog.String("state", string(out.State)), slog.String("reason", deRef(out.StateReason)))
+		return true
+	}
+
+	return false
+}
+
+// cleanup cancels the replay if it is still running and deletes the rule and
+// queue. Resources that are already gone are fine, so it is safe to run after
+// a partial start or an interrupt.
+func (r *replaySource) cleanup(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	if r.replayName != "" && r.replayState != ebtypes.ReplayStateCompleted && r.replayState != ebtypes.ReplayStateFailed && r.replayState != ebtypes.ReplayStateCancelled {
+		_, err := r.eventBridge.CancelReplay(ctx, &eventbridge.CancelReplayInput{ReplayName: &r.replayName})
+		r.logCleanup("Couldn't cancel EventBridge replay", r.replayName, err)
+	}
+
+	if r.ruleHasTarget {
+		_, err := r.eventBridge.RemoveTargets(ctx, &eventbridge.RemoveTargetsInput{Rule: &r.ruleName, EventBusName: &r.busARN, Ids: []string{r.ruleName}})
+		r.logCleanup("Couldn't remove replay rule target", r.ruleName, err)
+		r.ruleHasTarget = false
+	}
+
+	if r.ruleName != "" {
+		_, err := r.eventBridge.DeleteRule(ctx, &eventbridge.DeleteRuleInput{Name: &r.ruleName, EventBusName: &r.busARN})
+		r.logCleanup("Couldn't delete replay rule", r.ruleName, err)
+		r.ruleName = ""
+	}
+
+	if r.queueURL != "" {
+		_, err := r.sqs.DeleteQueue(ctx, &sqs.DeleteQueueInput{QueueUrl: &r.queueURL})
+		r.logCleanup("Couldn't delete replay queue", r.queueURL, err)
+		r.queueURL = ""
+	}
+}
+
+func (r *replaySource) logCleanup(msg, resource string, err error) {
+	var notFound *ebtypes.ResourceNotFoundException
+	var illegalStatus *ebtypes.IllegalStatusException
+	var queueGone *sqstypes.QueueDoesNotExist
+	if err == nil || errors.As(err, &notFound) || errors.As(err, &illegalStatus) || errors.As(err, &queueGone) {
+		return
+	}
+
+	slog.Error(msg+", remove it manually", slog.String("resource", resource), slog.String("error", err.Error()))
+}
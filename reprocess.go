@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// runReprocess handles the events a scan recorded in failures.ndjson again,
+// e.g. after a parser fix, and adds what they hold to the existing summary.
+// Events that still fail are recorded in failures.ndjson again.
+func runReprocess(args []string) int {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	fs := newFlagSet("reprocess", "[flags] [failures.ndjson]",
+		"find-cloudtrail-arn-fields reprocess",
+		"find-cloudtrail-arn-fields reprocess --summary eu-west-1/summary.csv --format csv=eu-west-1/summary.csv eu-west-1/failures.ndjson",
+	)
+	summary := fs.String("summary", "summary.csv", "Summary the matches are added to, skipped if it doesn't exist")
+	var patterns []scan.Matcher
+	fs.Func("pattern", "Also record the values matching a regexp under a match type, like the --pattern of a scan", patternFlag(&patterns))
+	var formats []string
+	fs.Func("format", "Formats of the updated summary, like the --format of a scan (default csv)", listFlag(&formats))
+	var comma rune
+	fs.Func("delimiter", `Delimiter of the csv summaries read and written, ",", ";" or "\t" (default ",")`, delimiterFlag(&comma))
+	if err := fs.Parse(args); err != nil {
+		return parseExitCode(err)
+	}
+
+	path := failuresPath
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	writers, err := summaryWriters(formats, "csv", comma)
+	if err != nil {
+		slog.Error("Invalid arguments", slog.String("error", err.Error()))
+		return exitConfig
+	}
+
+	cache := scan.NewMemoryStore(10000)
+	if err := readSummaries([]string{*summary}, cache, comma); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Couldn't read summary", slog.String("error", err.Error()))
+		return exitFailure
+	}
+	known := cache.Len()
+
+	// The failures are read up front, the ones failing again replace them.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("Couldn't read failures", slog.String("error", err.Error()))
+		return exitFailure
+	}
+	if err := os.Remove(path); err != nil {
+		slog.Error("Couldn't remove failures", slog.String("error", err.Error()))
+		return exitOutput
+	}
+
+	stats := &scanStats{}
+	failures := newFailureWriter(path, stats)
+	defer failures.close()
+
+	src := &readerSource{reader: bytes.NewReader(data), stats: stats}
+	sc, err := scan.New(
+		scan.WithStore(cache),
+		scan.WithMatchers(scanMatchers(patterns)...),
+		scan.WithOnFailure(failures.record),
+		scan.WithSource(scan.SourceFunc(func(ctx context.Context, emit func(scan.RawEvent)) error {
+			src.run(ctx, emit)
+			return nil
+		})),
+	)
+	if err != nil {
+		slog.Error("Couldn't set up scan", slog.String("error", err.Error()))
+		return exitFailure
+	}
+
+	scanned, _ := sc.Run(context.Background())
+
+	if err := writeSummaries(context.Background(), cache, writers); err != nil {
+		slog.Error("Couldn't write summary", slog.String("error", err.Error()))
+		return exitOutput
+	}
+	slog.Info("Failures reprocessed",
+		slog.Int("events", scanned.Events),
+		slog.Int("new-keys", cache.Len()-known),
+		slog.Int("failed-again", scanned.FailedEvents),
+	)
+
+	if stats.UnrecordedFailures > 0 {
+		return exitOutput
+	}
+	return exitOK
+}
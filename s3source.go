@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+var (
+	regionPartitionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]$`)
+	yearPartitionPattern   = regexp.MustCompile(`^[0-9]{4}$`)
+)
+
+// s3Source reads CloudTrail log files delivered to an S3 bucket, e.g.
+// s3://bucket/AWSLogs/123456789012/CloudTrail/.
+type s3Source struct {
+	client      *s3.Client
+	bucket      string
+	prefix      string
+	window      timeWindow
+	concurrency int
+	stats       *scanStats
+	progress    *progress
+
+	// filter is pushed down to S3 Select when set.
+	filter eventFilter
+}
+
+func newS3Source(client *s3.Client, source string, window timeWindow, concurrency int, stats *scanStats, prog *progress) (*s3Source, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 source %q, expected s3://bucket/prefix/", source)
+	}
+
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &s3Source{
+		client:      client,
+		bucket:      u.Host,
+		prefix:      prefix,
+		window:      window,
+		concurrency: concurrency,
+		stats:       stats,
+		progress:    prog,
+	}, nil
+}
+
+// run downloads all log files under the prefix and passes their records to
+// emit. Downloads run concurrently, emit is only called from run's goroutine.
+func (s *s3Source) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	prefixes, err := s.partitionPrefixes(ctx)
+	if err != nil {
+		slog.Error("Couldn't list cloudtrail log partitions", slog.String("error", err.Error()))
+		return stopFailed
+	}
+
+	keys := make(chan string)
+	results := make(chan []scan.RawEvent)
+
+	var wg sync.WaitGroup
+	for range s.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				events, err := s.readObject(ctx, key)
+				if err != nil {
+					slog.Warn("Skipping cloudtrail log file", slog.String("key", key), slog.String("error", err.Error()))
+					s.stats.addSkippedFile()
+					continue
+				}
+
+				select {
+				case results <- events:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(keys)
+		listErr <- s.listObjects(ctx, prefixes, keys)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for events := range results {
+		for _, event := range events {
+			emit(event)
+		}
+		s.stats.addFile(len(events))
+		s.progress.files.Add(1)
+	}
+
+	if ctx.Err() != nil {
+		return stopCanceled
+	}
+
+	if err := <-listErr; err != nil {
+		slog.Error("Couldn't list cloudtrail log files", slog.String("error", err.Error()))
+		return stopFailed
+	}
+
+	return stopComplete
+}
+
+// partitionPrefixes narrows the prefix down to the region/year/month/day
+// partitions of the time window, so files outside of it aren't listed at all.
+func (s *s3Source) partitionPrefixes(ctx context.Context) ([]string, error) {
+	if s.window.start.IsZero() {
+		return []string{s.prefix}, nil
+	}
+
+	children, err := s.listChildren(ctx, s.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var regionPrefixes []string
+	switch {
+	case len(children) > 0 && allMatch(children, yearPartitionPattern):
+		regionPrefixes = []string{s.prefix}
+	case len(children) > 0 && allMatch(children, regionPartitionPattern):
+		for _, child := range children {
+			regionPrefixes = append(regionPrefixes, s.prefix+child+"/")
+		}
+	default:
+		slog.Warn("Prefix doesn't point at a CloudTrail or region folder, listing all files under it",
+			slog.String("prefix", s.prefix),
+		)
+		return []string{s.prefix}, nil
+	}
+
+	var prefixes []string
+	for _, regionPrefix := range regionPrefixes {
+		for _, day := range s.window.days(time.Now()) {
+			prefixes = append(prefixes, regionPrefix+day.Format("2006/01/02/"))
+		}
+	}
+
+	return prefixes, nil
+}
+
+// listChildren returns the names of the folders directly below prefix.
+func (s *s3Source) listChildren(ctx context.Context, prefix string) ([]string, error) {
+	var children []string
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    &s.bucket,
+		Prefix:    &prefix,
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cp := range out.CommonPrefixes {
+			children = append(children, strings.TrimSuffix(strings.TrimPrefix(deRef(cp.Prefix), prefix), "/"))
+		}
+	}
+
+	return children, nil
+}
+
+func (s *s3Source) listObjects(ctx context.Context, prefixes []string, keys chan<- string) error {
+	for _, prefix := range prefixes {
+		paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+			Bucket: &s.bucket,
+			Prefix: aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			out, err := paginator.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+
+			for _, obj := range out.Contents {
+				key := deRef(obj.Key)
+				if !strings.HasSuffix(key, ".json.gz") && !strings.HasSuffix(key, ".json") {
+					continue
+				}
+
+				select {
+				case keys <- key:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *s3Source) readObject(ctx context.Context, key string) ([]scan.RawEvent, error) {
+	if s.filter.active() {
+		events, err := s.selectObject(ctx, key)
+		if err == nil {
+			return events, nil
+		}
+
+		slog.Warn("S3 Select failed, downloading the whole file", slog.String("key", key), slog.String("error", err.Error()))
+		s.stats.addSelectFallback()
+	}
+
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	events, err := readTrailFile(out.Body, key, s.window)
+	if err != nil || !s.filter.active() {
+		return events, err
+	}
+
+	return slices.DeleteFunc(events, func(event scan.RawEvent) bool {
+		return !s.filter.matches(event.EventName, event.EventSource)
+	}), nil
+}
+
+// selectObject only fetches the records of a log file that match the filter.
+func (s *s3Source) selectObject(ctx context.Context, key string) ([]scan.RawEvent, error) {
+	compression := s3types.CompressionTypeNone
+	if strings.HasSuffix(key, ".gz") {
+		compression = s3types.CompressionTypeGzip
+	}
+
+	out, err := s.client.SelectObjectContent(ctx, &s3.SelectObjectContentInput{
+		Bucket:         &s.bucket,
+		Key:            &key,
+		Expression:     aws.String(buildSelectExpression(s.filter)),
+		ExpressionType: s3types.ExpressionTypeSql,
+		InputSerialization: &s3types.InputSerialization{
+			CompressionType: compression,
+			JSON:            &s3types.JSONInput{Type: s3types.JSONTypeDocument},
+		},
+		OutputSerialization: &s3types.OutputSerialization{
+			JSON: &s3types.JSONOutput{RecordDelimiter: aws.String("\n")},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stream := out.GetStream()
+	defer stream.Close()
+
+	// Records are returned in chunks that don't align with lines.
+	var records bytes.Buffer
+	for message := range stream.Events() {
+		switch m := message.(type) {
+		case *s3types.SelectObjectContentEventStreamMemberRecords:
+			records.Write(m.Value.Payload)
+		case *s3types.SelectObjectContentEventStreamMemberStats:
+			s.stats.addSelectBytes(deRef(m.Value.Details.BytesScanned), deRef(m.Value.Details.BytesReturned))
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []scan.RawEvent
+	for _, line := range bytes.Split(records.Bytes(), []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		event, eventTime, err := recordToEvent(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.window.contains(eventTime) {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// buildSelectExpression returns the S3 Select query of the records matching
+// filter.
+func buildSelectExpression(filter eventFilter) string {
+	var conditions []string
+	if len(filter.names) > 0 {
+		conditions = append(conditions, "s.eventName IN ("+sqlStringList(filter.names)+")")
+	}
+	if len(filter.sources) > 0 {
+		conditions = append(conditions, "s.eventSource IN ("+sqlStringList(filter.sources)+")")
+	}
+
+	return "SELECT s.* FROM S3Object[*].Records[*] s WHERE " + strings.Join(conditions, " AND ")
+}
+
+func sqlStringList(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, "'"+strings.ReplaceAll(v, "'", "''")+"'")
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+func allMatch(values []string, pattern *regexp.Regexp) bool {
+	for _, v := range values {
+		if !pattern.MatchString(v) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// stopReason tells why the scanner stopped paging.
+type stopReason string
+
+const (
+	stopComplete  stopReason = "complete"
+	stopCanceled  stopReason = "canceled"
+	stopFailed    stopReason = "failed"
+	stopSaturated stopReason = "saturated"
+
+	// stopAccessDenied means the credentials lack cloudtrail:LookupEvents.
+	stopAccessDenied stopReason = "access-denied"
+
+	// stopInvalidRequest means LookupEvents rejected the request, e.g. its
+	// time range. The same request would be rejected again.
+	stopInvalidRequest stopReason = "invalid-request"
+
+	// stopDeadline means --stop-after was reached. The pages read so far were
+	// handled in full, the checkpoint continues from the next one.
+	stopDeadline stopReason = "time-bounded"
+
+	// stopCredentialsExpired means the credentials expired and couldn't be
+	// refreshed. The scan can be resumed after logging in again.
+	stopCredentialsExpired stopReason = "credentials-expired"
+
+	// stopNoTrail means --regions-with-trails found no trail logging the
+	// region, which wasn't scanned.
+	stopNoTrail stopReason = "no-trail"
+
+	// stopCircuitOpen means the retry budget of the run was exhausted. The
+	// checkpoint continues from the page that failed.
+	stopCircuitOpen stopReason = "circuit-open"
+)
+
+// scanner pages through LookupEvents and hands every event over to emit.
+type scanner struct {
+	client  scan.CloudTrailClient
+	limiter *rate.Limiter
+	clock   scan.Clock
+
+	// credentials are refreshed once they expire.
+	credentials aws.CredentialsProvider
+
+	stats    *scanStats
+	progress *progress
+
+	// budget is shared by the scanners of a run, see retryBudget.
+	budget *retryBudget
+
+	callTimeout time.Duration
+	window      timeWindow
+
+	// cache is only read to tell whether a page found new keys.
+	cache      scan.Store
+	staleLimit int
+	stalePages int
+
+	// deadline, if set, is when the scan stops fetching pages.
+	deadline time.Time
+
+	// checkpointPath is empty when the scan can't be resumed, e.g. for the
+	// accounts of an --org-role scan.
+	checkpointPath string
+	configHash     string
+
+	// accountID is only set when scanning an account of an organization.
+	accountID string
+
+	// lookupAttribute, if set, is the attribute the events LookupEvents
+	// returns must have, e.g. an event source or an access key id.
+	lookupAttribute *types.LookupAttribute
+
+	nextToken *string
+	pages     int
+	events    int
+}
+
+// resume restores the pagination state from the checkpoint file.
+func (s *scanner) resume() error {
+	cp, err := loadCheckpoint(s.checkpointPath, s.configHash)
+	if err != nil {
+		return err
+	}
+
+	s.nextToken = &cp.NextToken
+	s.pages = cp.Pages
+	s.events = cp.Events
+	s.stats.setProgress(cp.Pages, cp.Events)
+	s.progress.pages.Store(int64(cp.Pages))
+
+	slog.Info("Resuming from checkpoint",
+		slog.String("checkpoint", s.checkpointPath),
+		slog.Int("pages", cp.Pages),
+		slog.Int("events", cp.Events),
+	)
+
+	return nil
+}
+
+// run passes all events to emit until the last page was read, retries were
+// exhausted, ctx was canceled or the cache stopped learning new keys. emit
+// either handles the event inline or sends it to the worker.
+func (s *scanner) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	input := &cloudtrail.LookupEventsInput{NextToken: s.nextToken}
+	if s.lookupAttribute != nil {
+		input.LookupAttributes = []types.LookupAttribute{*s.lookupAttribute}
+	}
+	if !s.window.start.IsZero() {
+		input.StartTime = &s.window.start
+	}
+	if !s.window.end.IsZero() {
+		input.EndTime = &s.window.end
+	}
+
+	retry := 0
+	refreshed := false
+	metrics := pageMetrics{page: s.pages + 1}
+
+	pageCtx, pageSpan := s.startPageSpan(ctx)
+	defer func() { pageSpan.End() }()
+
+	for {
+		wait, err := waitForLimiter(ctx, s.clock, s.limiter, s.stats)
+		metrics.limiter += wait
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Rate limiter wait failed", slog.String("error", err.Error()))
+			}
+			return stopCanceled
+		}
+
+		// Checked between calls, once the limiter allows the next one. The
+		// pages read before are handled and checkpointed in full.
+		if !s.deadline.IsZero() && !s.clock.Now().Before(s.deadline) {
+			slog.Info("--stop-after was reached, not fetching more pages", slog.Int("pages", s.pages))
+			s.stats.setTimeBounded()
+			return stopDeadline
+		}
+		if s.budget.isTripped() {
+			return stopCircuitOpen
+		}
+
+		slog.Info("Looking up events", slog.String("next-token", deRef(input.NextToken)))
+
+		apiStart := s.clock.Now()
+		out, err := s.lookupPage(pageCtx, input)
+		metrics.api += s.clock.Now().Sub(apiStart)
+		if err != nil {
+			slog.Error("Couldn't Lookup cloudtrail events", slog.String("error", err.Error()))
+			countAPIError("lookup-events", err)
+			if ctx.Err() != nil {
+				return stopCanceled
+			}
+			tripped := s.budget.failure(err)
+
+			if isAccessDenied(err) {
+				slog.Error("Not allowed to lookup cloudtrail events, cloudtrail:LookupEvents permission is required",
+					slog.String("required-policy", lookupEventsPolicy),
+				)
+				return stopAccessDenied
+			}
+
+			if hint := invalidRequestHint(err); hint != "" {
+				slog.Error("LookupEvents rejected the request, not retrying", slog.String("hint", hint))
+				return stopInvalidRequest
+			}
+
+			if isExpiredCredentials(err) {
+				// Refreshing doesn't use up the retries, but is only tried
+				// once per page in case the refreshed credentials are the
+				// same expired ones.
+				if tripped {
+					return stopCircuitOpen
+				}
+				if refreshed {
+					return stopCredentialsExpired
+				}
+				refreshed = true
+
+				if err := refreshCredentials(ctx, s.credentials); err != nil {
+					slog.Error("Couldn't refresh expired credentials", slog.String("error", err.Error()))
+					return stopCredentialsExpired
+				}
+
+				slog.Info("Refreshed expired credentials")
+				continue
+			}
+
+			if errors.Is(err, context.DeadlineExceeded) {
+				s.stats.addCallTimeout()
+			}
+
+			if tripped {
+				return stopCircuitOpen
+			}
+			if retry < lookupRetries {
+				if !s.budget.retry() {
+					return stopCircuitOpen
+				}
+				retry++
+				s.stats.addRetry()
+				delay := retryDelay(retry)
+				slog.Warn("Retrying request", slog.String("req-token", deRef(input.NextToken)), slog.Duration("delay", delay))
+				if err := s.clock.Sleep(ctx, delay); err != nil {
+					return stopCanceled
+				}
+				metrics.backoff += delay
+				continue
+			} else {
+				return stopFailed
+			}
+		}
+
+		s.budget.success()
+		keysBefore := s.cache.Len()
+
+		// The checkpoint of a page is only written once its events were
+		// handled, a resumed scan would skip the ones still in flight.
+		var handled *sync.WaitGroup
+		if out.NextToken != nil && s.checkpointPath != "" {
+			handled = new(sync.WaitGroup)
+		}
+
+		processStart := time.Now()
+		for _, evt := range out.Events {
+			event := scan.FromLookupEvent(evt)
+			if handled != nil {
+				handled.Add(1)
+				event.Done = handled.Done
+			}
+			emit(event)
+		}
+		metrics.handoff = time.Since(processStart)
+
+		s.pages++
+		s.events += len(out.Events)
+		s.stats.addPage(s.accountID, len(out.Events))
+		pagesFetched.WithLabelValues("lookup-events", s.accountID).Inc()
+		s.progress.pages.Add(1)
+
+		if handled != nil && waitHandled(ctx, handled) {
+			s.saveCheckpoint(deRef(out.NextToken))
+		}
+
+		metrics.events = len(out.Events)
+		metrics.process = time.Since(processStart)
+		metrics.log()
+		s.stats.addPageMetrics(metrics)
+
+		pageSpan.SetAttributes(attribute.Int("events", len(out.Events)), attribute.Int("retries", retry))
+		pageSpan.End()
+
+		if out.NextToken == nil {
+			return stopComplete
+		}
+
+		if s.saturated(s.cache.Len() - keysBefore) {
+			slog.Info("Saturation reached, no new keys were found recently",
+				slog.Int("stale-pages", s.stalePages),
+				slog.Int("pages", s.pages),
+			)
+			return stopSaturated
+		}
+
+		input.NextToken = out.NextToken
+		retry = 0
+		refreshed = false
+		metrics = pageMetrics{page: s.pages + 1}
+		pageCtx, pageSpan = s.startPageSpan(ctx)
+	}
+}
+
+func (s *scanner) startPageSpan(ctx context.Context) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "page", trace.WithAttributes(
+		attribute.Int("page", s.pages+1),
+		attribute.String("account.id", s.accountID),
+	))
+}
+
+// saturated tracks consecutive pages without new keys and reports whether
+// --stop-after-stale-pages was reached. The worker may still be handling the
+// last event of a page, its keys are then attributed to the next page.
+func (s *scanner) saturated(newKeys int) bool {
+	if newKeys > 0 {
+		s.stalePages = 0
+		return false
+	}
+
+	s.stalePages++
+	return s.staleLimit > 0 && s.stalePages >= s.staleLimit
+}
+
+// lookupPage fetches a single page, giving up after the call timeout so a
+// hanging connection is retried rather than stalling the scan.
+func (s *scanner) lookupPage(ctx context.Context, input *cloudtrail.LookupEventsInput) (*cloudtrail.LookupEventsOutput, error) {
+	callCtx, cancel := context.WithTimeout(ctx, s.callTimeout)
+	defer cancel()
+
+	return s.client.LookupEvents(callCtx, input)
+}
+
+func (s *scanner) saveCheckpoint(nextToken string) {
+	cp := checkpoint{
+		NextToken:  nextToken,
+		Pages:      s.pages,
+		Events:     s.events,
+		ConfigHash: s.configHash,
+	}
+
+	if err := writeCheckpoint(s.checkpointPath, cp); err != nil {
+		slog.Error("Couldn't write checkpoint", slog.String("error", err.Error()))
+	}
+}
+
+// waitHandled waits for the events of a page to be handled. It reports false
+// once ctx is canceled, the events emitted then may never be handled and the
+// previous checkpoint is kept, so a resumed scan reads the page again.
+func waitHandled(ctx context.Context, handled *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		handled.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return ctx.Err() == nil
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// waitForLimiter blocks until the limiter allows another LookupEvents call. The
+// same limiter must be shared by every loop scanning the same account.
+func waitForLimiter(ctx context.Context, clock scan.Clock, limiter *rate.Limiter, stats *scanStats) (time.Duration, error) {
+	start := clock.Now()
+	err := scan.WaitLimiter(ctx, clock, limiter)
+	wait := clock.Now().Sub(start)
+	stats.addLimiterWait(wait)
+	return wait, err
+}
+
+// lookupRetries is how often a failed LookupEvents call is retried.
+const lookupRetries = 3
+
+// retryDelay is the backoff before the nth retry of a call, 100ms doubling
+// with every retry. The delay is jittered down to half of that, so scans
+// throttled at the same time don't retry in lockstep.
+func retryDelay(n int) time.Duration {
+	d := 100 * time.Millisecond << (n - 1)
+	return d/2 + rand.N(d/2+1)
+}
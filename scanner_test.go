@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
+	"github.com/aws/smithy-go"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan/scantest"
+	"golang.org/x/time/rate"
+)
+
+// lookupEvents returns n events of page, their ids tell them apart.
+func lookupEvents(page, n int) []types.Event {
+	events := make([]types.Event, n)
+	for i := range events {
+		id := fmt.Sprintf("page-%d-event-%d", page, i)
+		events[i] = types.Event{
+			EventId:         aws.String(id),
+			EventName:       aws.String("GetRole"),
+			EventSource:     aws.String("iam.amazonaws.com"),
+			CloudTrailEvent: aws.String(fmt.Sprintf(`{"eventID":%q,"requestParameters":{"roleArn":"arn:aws:iam::123456789012:role/r%d"}}`, id, i)),
+		}
+	}
+	return events
+}
+
+// newTestScanner returns a scanner paging through client without waiting
+// between calls or retries.
+func newTestScanner(client scan.CloudTrailClient, clock scan.Clock) *scanner {
+	return &scanner{
+		client:      client,
+		limiter:     rate.NewLimiter(rate.Inf, 1),
+		clock:       clock,
+		stats:       &scanStats{},
+		progress:    &progress{},
+		budget:      newRetryBudget(defaultRetryBudget, defaultMaxConsecutiveFailures),
+		callTimeout: time.Minute,
+		cache:       scan.NewMemoryStore(0),
+	}
+}
+
+// TestScannerCheckpointAfterHandled hands the events over to a slow worker.
+// The checkpoint must never cover an event the worker didn't handle yet.
+func TestScannerCheckpointAfterHandled(t *testing.T) {
+	const pages, perPage = 4, 5
+
+	script := make([]scantest.Page, pages)
+	for i := range script {
+		script[i] = scantest.Page{Events: lookupEvents(i, perPage)}
+	}
+	s := newTestScanner(scantest.NewCloudTrail(script...), scantest.NewClock(time.Now()))
+	s.checkpointPath = filepath.Join(t.TempDir(), "checkpoint.json")
+
+	events := make(chan scan.RawEvent, pages*perPage)
+	worker := make(chan error, 1)
+	go func() {
+		handled := 0
+		for event := range events {
+			time.Sleep(time.Millisecond)
+			cp, err := loadCheckpoint(s.checkpointPath, "")
+			if err != nil && !os.IsNotExist(err) {
+				worker <- err
+				return
+			}
+			if err == nil && cp.Events > handled {
+				worker <- fmt.Errorf("the checkpoint covers %d events, %d were handled", cp.Events, handled)
+				return
+			}
+			handled++
+			if event.Done != nil {
+				event.Done()
+			}
+		}
+		worker <- nil
+	}()
+
+	reason := s.run(context.Background(), func(event scan.RawEvent) {
+		events <- event
+	})
+	close(events)
+
+	if err := <-worker; err != nil {
+		t.Fatal(err)
+	}
+	if reason != stopComplete {
+		t.Errorf("stop reason %s, want %s", reason, stopComplete)
+	}
+
+	cp, err := loadCheckpoint(s.checkpointPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last page has no NextToken and isn't checkpointed.
+	if cp.Pages != pages-1 || cp.Events != (pages-1)*perPage || cp.NextToken != fmt.Sprint(pages-1) {
+		t.Errorf("checkpoint %+v, want %d pages and %d events up to token %d", cp, pages-1, (pages-1)*perPage, pages-1)
+	}
+}
+
+// TestScannerCheckpointCanceled cancels the scan while the events of the first
+// page are in flight, the page mustn't be checkpointed.
+func TestScannerCheckpointCanceled(t *testing.T) {
+	client := scantest.NewCloudTrail(
+		scantest.Page{Events: lookupEvents(0, 3)},
+		scantest.Page{Events: lookupEvents(1, 3)},
+	)
+	s := newTestScanner(client, scantest.NewClock(time.Now()))
+	s.checkpointPath = filepath.Join(t.TempDir(), "checkpoint.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	emitted := 0
+	reason := s.run(ctx, func(scan.RawEvent) {
+		// Never handled, like the events a canceled source drops.
+		emitted++
+		if emitted == 3 {
+			cancel()
+		}
+	})
+
+	if reason != stopCanceled {
+		t.Errorf("stop reason %s, want %s", reason, stopCanceled)
+	}
+	if _, err := os.Stat(s.checkpointPath); !os.IsNotExist(err) {
+		t.Errorf("a checkpoint was written for events that weren't handled: %v", err)
+	}
+}
+
+func TestScannerRun(t *testing.T) {
+	throttled := errors.New("ThrottlingException: Rate exceeded")
+
+	tests := []struct {
+		name   string
+		script []scantest.Page
+		reason stopReason
+		// calls is the NextToken of every LookupEvents call, "" for none.
+		calls  []string
+		events int
+		pages  int
+	}{
+		{
+			name:   "single page",
+			script: []scantest.Page{{Events: lookupEvents(0, 2)}},
+			reason: stopComplete,
+			calls:  []string{""},
+			events: 2,
+			pages:  1,
+		},
+		{
+			name: "pages",
+			script: []scantest.Page{
+				{Events: lookupEvents(0, 3)},
+				{Events: lookupEvents(1, 2)},
+				{},
+				{Events: lookupEvents(3, 1)},
+			},
+			reason: stopComplete,
+			calls:  []string{"", "1", "2", "3"},
+			events: 6,
+			pages:  4,
+		},
+		{
+			name: "retried then succeeded",
+			script: []scantest.Page{
+				{Events: lookupEvents(0, 2)},
+				{Err: throttled},
+				{Err: throttled},
+				{Events: lookupEvents(1, 2)},
+			},
+			reason: stopComplete,
+			// The failed calls don't move the token on.
+			calls:  []string{"", "1", "1", "1"},
+			events: 4,
+			pages:  2,
+		},
+		{
+			name: "retries exhausted",
+			script: []scantest.Page{
+				{Events: lookupEvents(0, 2)},
+				{Err: throttled},
+				{Err: throttled},
+				{Err: throttled},
+				{Err: throttled},
+				{Events: lookupEvents(1, 2)},
+			},
+			reason: stopFailed,
+			calls:  []string{"", "1", "1", "1", "1"},
+			events: 2,
+			pages:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := scantest.NewCloudTrail(tt.script...)
+			s := newTestScanner(client, scantest.NewClock(time.Now()))
+
+			var ids []string
+			reason := s.run(context.Background(), func(event scan.RawEvent) {
+				ids = append(ids, event.EventID)
+			})
+
+			if reason != tt.reason {
+				t.Errorf("stop reason %s, want %s", reason, tt.reason)
+			}
+
+			var calls []string
+			for _, input := range client.Inputs() {
+				calls = append(calls, aws.ToString(input.NextToken))
+			}
+			if !slices.Equal(calls, tt.calls) {
+				t.Errorf("calls with NextToken %q, want %q", calls, tt.calls)
+			}
+
+			if len(ids) != tt.events || s.events != tt.events || s.pages != tt.pages {
+				t.Errorf("emitted %d events, counted %d events in %d pages, want %d events in %d pages", len(ids), s.events, s.pages, tt.events, tt.pages)
+			}
+			if got := s.progress.pages.Load(); got != int64(tt.pages) {
+				t.Errorf("progress has %d pages, want %d", got, tt.pages)
+			}
+			for i, id := range ids {
+				if i > 0 && id <= ids[i-1] {
+					t.Errorf("event %s emitted after %s", id, ids[i-1])
+				}
+			}
+		})
+	}
+}
+
+// TestScannerResume continues from the NextToken of the checkpoint.
+func TestScannerResume(t *testing.T) {
+	s := newTestScanner(scantest.NewCloudTrail(), scantest.NewClock(time.Now()))
+	s.checkpointPath = filepath.Join(t.TempDir(), "checkpoint.json")
+	s.configHash = "hash"
+	if err := writeCheckpoint(s.checkpointPath, checkpoint{NextToken: "token-7", Pages: 7, Events: 70, ConfigHash: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := scantest.NewCloudTrail(scantest.Page{Events: lookupEvents(7, 3)})
+	s.client = client
+	if reason := s.run(context.Background(), func(scan.RawEvent) {}); reason != stopComplete {
+		t.Errorf("stop reason %s, want %s", reason, stopComplete)
+	}
+
+	if got := aws.ToString(client.Inputs()[0].NextToken); got != "token-7" {
+		t.Errorf("first call with NextToken %q, want token-7", got)
+	}
+	if s.pages != 8 || s.events != 73 {
+		t.Errorf("counted %d events in %d pages, want 73 in 8", s.events, s.pages)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for n := 1; n <= 6; n++ {
+		d := 100 * time.Millisecond << (n - 1)
+		for range 1000 {
+			if got := retryDelay(n); got < d/2 || got > d {
+				t.Fatalf("retryDelay(%d) = %s, want between %s and %s", n, got, d/2, d)
+			}
+		}
+	}
+}
+
+// retrySleeps returns the delays slept on the clock, leaving out those of the
+// limiter, which never waits in the tests.
+func retrySleeps(clock *scantest.Clock) []time.Duration {
+	var sleeps []time.Duration
+	for _, d := range clock.Sleeps() {
+		if d > 0 {
+			sleeps = append(sleeps, d)
+		}
+	}
+	return sleeps
+}
+
+func TestScannerRetrySchedule(t *testing.T) {
+	throttled := errors.New("ThrottlingException: Rate exceeded")
+	client := scantest.NewCloudTrail(
+		scantest.Page{Err: throttled},
+		scantest.Page{Err: throttled},
+		scantest.Page{Err: throttled},
+		scantest.Page{Events: lookupEvents(0, 1)},
+	)
+	start := time.Now()
+	clock := scantest.NewClock(start)
+	s := newTestScanner(client, clock)
+
+	if reason := s.run(context.Background(), func(scan.RawEvent) {}); reason != stopComplete {
+		t.Fatalf("stop reason %s, want %s", reason, stopComplete)
+	}
+
+	sleeps := retrySleeps(clock)
+	if len(sleeps) != lookupRetries {
+		t.Fatalf("slept %v, want %d retry delays", sleeps, lookupRetries)
+	}
+	var total time.Duration
+	for i, got := range sleeps {
+		// The delay doubles with every retry, jittered down to half of it.
+		d := 100 * time.Millisecond << i
+		if got < d/2 || got > d {
+			t.Errorf("retry %d slept %s, want between %s and %s", i+1, got, d/2, d)
+		}
+		total += got
+	}
+	if got := clock.Now().Sub(start); got != total {
+		t.Errorf("the clock moved %s, want the %s slept", got, total)
+	}
+}
+
+// cancelingClock cancels the scan as soon as a retry delay is slept on.
+type cancelingClock struct {
+	*scantest.Clock
+	cancel context.CancelFunc
+}
+
+func (c cancelingClock) Sleep(ctx context.Context, d time.Duration) error {
+	if d > 0 {
+		c.cancel()
+	}
+	return c.Clock.Sleep(ctx, d)
+}
+
+func TestScannerRetryCanceled(t *testing.T) {
+	throttled := errors.New("ThrottlingException: Rate exceeded")
+	client := scantest.NewCloudTrail(
+		scantest.Page{Err: throttled},
+		scantest.Page{Events: lookupEvents(0, 1)},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := scantest.NewClock(time.Now())
+	s := newTestScanner(client, cancelingClock{Clock: clock, cancel: cancel})
+
+	if reason := s.run(ctx, func(scan.RawEvent) {}); reason != stopCanceled {
+		t.Errorf("stop reason %s, want %s", reason, stopCanceled)
+	}
+	if calls := len(client.Inputs()); calls != 1 {
+		t.Errorf("%d LookupEvents calls, the canceled retry mustn't call again", calls)
+	}
+	if sleeps := retrySleeps(clock); len(sleeps) != 0 {
+		t.Errorf("the interrupted sleep moved the clock by %v", sleeps)
+	}
+}
+
+// TestScannerAccessDenied gives up at once, retrying can't get the
+// permission.
+func TestScannerAccessDenied(t *testing.T) {
+	client := scantest.NewCloudTrail(
+		scantest.Page{Err: &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized to perform cloudtrail:LookupEvents"}},
+		scantest.Page{Events: lookupEvents(0, 1)},
+	)
+	clock := scantest.NewClock(time.Now())
+	s := newTestScanner(client, clock)
+
+	emitted := 0
+	if reason := s.run(context.Background(), func(scan.RawEvent) { emitted++ }); reason != stopAccessDenied {
+		t.Errorf("stop reason %s, want %s", reason, stopAccessDenied)
+	}
+	if calls := len(client.Inputs()); calls != 1 {
+		t.Errorf("%d LookupEvents calls, want 1", calls)
+	}
+	if sleeps := retrySleeps(clock); len(sleeps) != 0 || s.stats.Retries != 0 {
+		t.Errorf("retried %d times after %v", s.stats.Retries, sleeps)
+	}
+	if emitted != 0 || s.pages != 0 {
+		t.Errorf("emitted %d events of %d pages", emitted, s.pages)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// startServer serves the current findings and stats on addr, e.g.
+// 127.0.0.1:8080 to only accept local connections. The returned stop shuts
+// the server down gracefully, it is called once the summary was written.
+func startServer(addr string, cache scan.Store, stats *scanStats, health *healthState) (func(), error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /findings", func(w http.ResponseWriter, r *http.Request) {
+		matchType := r.URL.Query().Get("matchType")
+		section := r.URL.Query().Get("section")
+
+		findings := []scan.Match{}
+		err := cache.Each(func(m scan.Match) error {
+			if matchType != "" && m.MatchType != matchType {
+				return nil
+			}
+			if section != "" && m.Key != section && !strings.HasPrefix(m.Key, section+".") {
+				return nil
+			}
+
+			findings = append(findings, m)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data, err := json.Marshal(findings)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, r, data)
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		data, err := stats.marshal()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, r, data)
+	})
+	health.register(mux)
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server failed", slog.String("error", err.Error()))
+		}
+	}()
+
+	slog.Info("Serving findings", slog.String("address", "http://"+ln.Addr().String()+"/findings"))
+
+	return func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}, nil
+}
+
+// writeJSON writes data, gzipped if the client accepts it.
+func writeJSON(w http.ResponseWriter, r *http.Request, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Write(data)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	gz.Write(data)
+	gz.Close()
+}
+
+// runServe serves the findings of summaries written by previous runs, e.g. to
+// keep them browsable after a scan exited, until interrupted.
+func runServe(args []string) int {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
+	fs := newFlagSet("serve", "[flags] [summary.csv|summary.json|summary.ndjson|summary.yaml ...]",
+		"find-cloudtrail-arn-fields serve",
+		"find-cloudtrail-arn-fields serve --addr :8080 eu-west-1/summary.json us-east-1/summary.json",
+	)
+	addr := fs.String("addr", "127.0.0.1:8080", "Address to serve the findings on")
+	var comma rune
+	fs.Func("delimiter", `Delimiter of csv summaries, ",", ";" or "\t" (default ",")`, delimiterFlag(&comma))
+	if err := fs.Parse(args); err != nil {
+		return parseExitCode(err)
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"summary.csv"}
+	}
+
+	cache := scan.NewMemoryStore(10000)
+	if err := readSummaries(paths, cache, comma); err != nil {
+		slog.Error("Couldn't read summary", slog.String("error", err.Error()))
+		return exitFailure
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stopServer, err := startServer(*addr, cache, &scanStats{}, newHealthState(0))
+	if err != nil {
+		slog.Error("Couldn't start server", slog.String("error", err.Error()))
+		return exitConfig
+	}
+
+	<-ctx.Done()
+	stopServer()
+	return exitOK
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+const (
+	slackDigestInterval = time.Minute
+
+	// slackDigestKeys is how many keys a digest lists by name.
+	slackDigestKeys = 20
+
+	// slackMaxText is the longest text Slack accepts in a section block.
+	slackMaxText = 3000
+)
+
+// accountIDPattern finds account ids, e.g. in ARNs.
+var accountIDPattern = regexp.MustCompile(`\b[0-9]{12}\b`)
+
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type string     `json:"type"`
+	Text *slackText `json:"text,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// slackNotifier posts to a Slack incoming webhook: digests of the keys
+// discovered in the last minute when discoveries is set, and a summary at the
+// end of the run. Errors are logged and never fail the scan.
+type slackNotifier struct {
+	client      *http.Client
+	url         string
+	redact      bool
+	discoveries bool
+
+	mu      sync.Mutex
+	pending []scan.Match
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSlackNotifier(url string, discoveries, redact bool, timeout time.Duration) *slackNotifier {
+	return &slackNotifier{
+		client:      &http.Client{Timeout: timeout},
+		url:         url,
+		redact:      redact,
+		discoveries: discoveries,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func (s *slackNotifier) add(m scan.Match) {
+	if !s.discoveries {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = append(s.pending, m)
+}
+
+// run posts a digest every slackDigestInterval until close is called.
+func (s *slackNotifier) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(slackDigestInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *slackNotifier) close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *slackNotifier) flush() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	s.post(buildSlackDigest(pending, s.redact))
+}
+
+// sendSummary posts the headline stats and the first topN keys of the
+// summary.
+func (s *slackNotifier) sendSummary(stats *scanStats, cache scan.Store, topN int) {
+	snapshot, err := scan.TakeSnapshot(cache)
+	if err != nil {
+		slog.Warn("Couldn't read summary for Slack", slog.String("error", err.Error()))
+	}
+
+	stats.mu.Lock()
+	headline := fmt.Sprintf("Scan %s: %d events, %d unique keys", stats.StopReason, stats.Events, len(snapshot.Matches))
+	if stats.DroppedMatches > 0 {
+		headline += fmt.Sprintf(", %d matches dropped because of --max-keys", stats.DroppedMatches)
+	}
+	stats.mu.Unlock()
+
+	s.post(buildSlackSummary(headline, snapshot.Matches, topN, s.redact))
+}
+
+func (s *slackNotifier) post(msg slackMessage) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		slog.Warn("Couldn't build Slack message", slog.String("error", err.Error()))
+		return
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Couldn't post to Slack", slog.String("error", err.Error()))
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		slog.Warn("Couldn't post to Slack", slog.String("status", resp.Status))
+	}
+}
+
+// buildSlackDigest lists the keys discovered since the last digest.
+func buildSlackDigest(matches []scan.Match, redact bool) slackMessage {
+	var lines []string
+	for _, m := range matches[:min(len(matches), slackDigestKeys)] {
+		lines = append(lines, fmt.Sprintf("• `%s` = `%s` (%s)", redactValue(m.Key, redact), redactValue(m.Value, redact), m.EventName))
+	}
+	if len(matches) > slackDigestKeys {
+		lines = append(lines, fmt.Sprintf("…and %d more", len(matches)-slackDigestKeys))
+	}
+
+	title := fmt.Sprintf("%d new CloudTrail keys discovered", len(matches))
+	return slackMessage{
+		Text: title,
+		Blocks: []slackBlock{
+			{Type: "header", Text: &slackText{Type: "plain_text", Text: title}},
+			{Type: "section", Text: &slackText{Type: "mrkdwn", Text: strings.Join(lines, "\n")}},
+		},
+	}
+}
+
+// buildSlackSummary renders the first topN matches, sorted by key, as a table
+// in a code block.
+func buildSlackSummary(headline string, matches []scan.Match, topN int, redact bool) slackMessage {
+	matches = slices.Clone(matches)
+	slices.SortFunc(matches, func(a, b scan.Match) int { return strings.Compare(a.Key, b.Key) })
+
+	var table strings.Builder
+	tw := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "key\tvalue\taction")
+	for _, m := range matches[:min(len(matches), topN)] {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", redactValue(m.Key, redact), redactValue(m.Value, redact), m.EventName)
+	}
+	tw.Flush()
+
+	blocks := []slackBlock{
+		{Type: "header", Text: &slackText{Type: "plain_text", Text: "CloudTrail ARN field scan finished"}},
+		{Type: "section", Text: &slackText{Type: "mrkdwn", Text: headline}},
+	}
+	if len(matches) > 0 {
+		text := table.String()
+		if len(text) > slackMaxText-10 {
+			text = text[:slackMaxText-12] + "…\n"
+		}
+		blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "```\n" + text + "```"}})
+	}
+
+	return slackMessage{Text: headline, Blocks: blocks}
+}
+
+// redactValue masks account ids, so ARNs and keys such as tags named after
+// accounts can be shared in broad channels.
+func redactValue(value string, redact bool) string {
+	if !redact {
+		return value
+	}
+
+	return accountIDPattern.ReplaceAllLiteralString(value, "************")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// slackMatches are the matches of the Slack tests, with account ids in an
+// ARN, a bare value and a key.
+func slackMatches(n int) []scan.Match {
+	matches := []scan.Match{
+		{Key: "requestParameters.roleArn", Value: "arn:aws:iam::123456789012:role/deploy", EventName: "GetRole"},
+		{Key: "requestParameters.accountId", Value: "210987654321", EventName: "DescribeAccount"},
+		{Key: "requestParameters.tags.123456789012", Value: "arn:aws:s3:::bucket", EventName: "TagResource"},
+	}
+	for i := len(matches); i < n; i++ {
+		matches = append(matches, scan.Match{Key: fmt.Sprintf("requestParameters.key%02d", i), Value: fmt.Sprintf("subnet-%08d", i), EventName: "CreateSubnet"})
+	}
+	return matches
+}
+
+// slackPayload is the body posted for msg.
+func slackPayload(t *testing.T, msg slackMessage) string {
+	t.Helper()
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestBuildSlackDigest(t *testing.T) {
+	tests := []struct {
+		name      string
+		matches   int
+		redact    bool
+		wantTitle string
+		want      []string
+		notWant   []string
+	}{
+		{
+			name:      "plain",
+			matches:   3,
+			wantTitle: "3 new CloudTrail keys discovered",
+			want:      []string{"• `requestParameters.roleArn` = `arn:aws:iam::123456789012:role/deploy` (GetRole)", "`requestParameters.tags.123456789012`"},
+			notWant:   []string{"more"},
+		},
+		{
+			name:      "redacted",
+			matches:   3,
+			redact:    true,
+			wantTitle: "3 new CloudTrail keys discovered",
+			want:      []string{"• `requestParameters.roleArn` = `arn:aws:iam::************:role/deploy` (GetRole)", "`requestParameters.tags.************`"},
+			notWant:   []string{"123456789012", "210987654321", "arn:aws:iam::123456789012:role/deploy"},
+		},
+		{
+			name:      "capped",
+			matches:   slackDigestKeys + 5,
+			wantTitle: "25 new CloudTrail keys discovered",
+			want:      []string{"`requestParameters.key19`", "…and 5 more"},
+			notWant:   []string{"`requestParameters.key20`"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := buildSlackDigest(slackMatches(tt.matches), tt.redact)
+			if msg.Text != tt.wantTitle {
+				t.Errorf("text %q, want %q", msg.Text, tt.wantTitle)
+			}
+			if len(msg.Blocks) != 2 || msg.Blocks[0].Type != "header" || msg.Blocks[0].Text.Text != tt.wantTitle || msg.Blocks[1].Text.Type != "mrkdwn" {
+				t.Fatalf("blocks %+v, want a header and a mrkdwn section", msg.Blocks)
+			}
+
+			payload := slackPayload(t, msg)
+			for _, want := range tt.want {
+				if !strings.Contains(msg.Blocks[1].Text.Text, want) {
+					t.Errorf("digest misses %q:\n%s", want, msg.Blocks[1].Text.Text)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(payload, notWant) {
+					t.Errorf("payload holds %q:\n%s", notWant, payload)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildSlackSummary(t *testing.T) {
+	tests := []struct {
+		name    string
+		matches int
+		topN    int
+		redact  bool
+		blocks  int
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "plain",
+			matches: 3,
+			topN:    10,
+			blocks:  3,
+			want:    []string{"arn:aws:iam::123456789012:role/deploy", "requestParameters.tags.123456789012", "210987654321"},
+		},
+		{
+			name:    "redacted",
+			matches: 3,
+			topN:    10,
+			redact:  true,
+			blocks:  3,
+			want:    []string{"arn:aws:iam::************:role/deploy", "requestParameters.tags.************"},
+			notWant: []string{"123456789012", "210987654321", "arn:aws:iam::123456789012:role/deploy"},
+		},
+		{
+			// Sorted by key, only the first topN are listed.
+			name:    "top",
+			matches: 10,
+			topN:    2,
+			blocks:  3,
+			want:    []string{"requestParameters.accountId", "requestParameters.key03"},
+			notWant: []string{"requestParameters.key04", "requestParameters.roleArn"},
+		},
+		{
+			name:   "empty",
+			topN:   10,
+			blocks: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headline := "Scan complete: 100 events, 3 unique keys"
+			msg := buildSlackSummary(headline, slackMatches(tt.matches)[:tt.matches], tt.topN, tt.redact)
+			if msg.Text != headline {
+				t.Errorf("text %q, want %q", msg.Text, headline)
+			}
+			if len(msg.Blocks) != tt.blocks {
+				t.Fatalf("%d blocks, want %d: %+v", len(msg.Blocks), tt.blocks, msg.Blocks)
+			}
+			if msg.Blocks[1].Text.Text != headline {
+				t.Errorf("section %q, want the headline", msg.Blocks[1].Text.Text)
+			}
+			if tt.blocks < 3 {
+				return
+			}
+
+			table := msg.Blocks[2].Text.Text
+			if !strings.HasPrefix(table, "```\nkey ") || !strings.HasSuffix(table, "```") {
+				t.Errorf("table isn't a code block:\n%s", table)
+			}
+			payload := slackPayload(t, msg)
+			for _, want := range tt.want {
+				if !strings.Contains(table, want) {
+					t.Errorf("table misses %q:\n%s", want, table)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(payload, notWant) {
+					t.Errorf("payload holds %q:\n%s", notWant, payload)
+				}
+			}
+		})
+	}
+}
+
+// TestBuildSlackSummaryTruncated keeps the table within the text limit of a
+// Slack section.
+func TestBuildSlackSummaryTruncated(t *testing.T) {
+	msg := buildSlackSummary("Scan complete", slackMatches(500), 500, false)
+	table := msg.Blocks[2].Text.Text
+	if len(table) > slackMaxText {
+		t.Errorf("table is %d bytes, want at most %d", len(table), slackMaxText)
+	}
+	if !strings.HasSuffix(table, "…\n```") {
+		t.Errorf("truncated table doesn't end with an ellipsis:\n%s", table[len(table)-50:])
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// sqsSource consumes CloudTrail events that EventBridge delivers to an SQS
+// queue. It runs until ctx is canceled or drained reports the end. Messages
+// are only deleted once emit returned, which is why this source always runs
+// with --sync.
+type sqsSource struct {
+	client            *sqs.Client
+	queueURL          string
+	dlqURL            string
+	visibilityTimeout time.Duration
+	stats             *scanStats
+
+	// drained, when set, is called whenever a receive returned no messages.
+	// The source stops once it reports that no more messages will arrive.
+	drained func(context.Context) bool
+}
+
+func (q *sqsSource) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	slog.Info("Consuming events from SQS", slog.String("queue-url", q.queueURL))
+
+	for {
+		out, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            &q.queueURL,
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     20,
+			VisibilityTimeout:   int32(q.visibilityTimeout.Seconds()),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return stopCanceled
+			}
+
+			slog.Error("Couldn't receive SQS messages", slog.String("error", err.Error()))
+			countAPIError("sqs", err)
+			return stopFailed
+		}
+		pagesFetched.WithLabelValues("sqs", "").Inc()
+
+		if len(out.Messages) == 0 && q.drained != nil && q.drained(ctx) {
+			return stopComplete
+		}
+
+		received := time.Now()
+		for i, msg := range out.Messages {
+			if ctx.Err() != nil {
+				// The rest of the batch becomes visible again once its
+				// visibility timeout expires.
+				return stopCanceled
+			}
+
+			if time.Since(received) > q.visibilityTimeout/2 {
+				q.extendVisibility(ctx, out.Messages[i:])
+				received = time.Now()
+			}
+
+			event, err := unwrapEventBridge([]byte(deRef(msg.Body)))
+			if err != nil {
+				q.handleMalformed(ctx, msg, err)
+				continue
+			}
+
+			emit(event)
+			q.stats.addEvents(1)
+			q.delete(ctx, msg)
+		}
+	}
+}
+
+// handleMalformed moves a message that isn't a CloudTrail event to the dead
+// letter queue if one is configured. Otherwise it is left for the queue's own
+// redrive policy instead of being deleted.
+func (q *sqsSource) handleMalformed(ctx context.Context, msg sqstypes.Message, err error) {
+	slog.Warn("Malformed SQS message", slog.String("message-id", deRef(msg.MessageId)), slog.String("error", err.Error()))
+	q.stats.addInvalidLine()
+
+	if q.dlqURL == "" {
+		return
+	}
+
+	if _, err := q.client.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: &q.dlqURL, MessageBody: msg.Body}); err != nil {
+		slog.Error("Couldn't move SQS message to dead letter queue", slog.String("message-id", deRef(msg.MessageId)), slog.String("error", err.Error()))
+		return
+	}
+
+	q.delete(ctx, msg)
+}
+
+func (q *sqsSource) delete(ctx context.Context, msg sqstypes.Message) {
+	if _, err := q.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: &q.queueURL, ReceiptHandle: msg.ReceiptHandle}); err != nil {
+		slog.Error("Couldn't delete SQS message", slog.String("message-id", deRef(msg.MessageId)), slog.String("error", err.Error()))
+	}
+}
+
+// extendVisibility keeps the unprocessed rest of a batch hidden from other
+// consumers while it is still being worked on.
+func (q *sqsSource) extendVisibility(ctx context.Context, msgs []sqstypes.Message) {
+	entries := make([]sqstypes.ChangeMessageVisibilityBatchRequestEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		entries = append(entries, sqstypes.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                msg.MessageId,
+			ReceiptHandle:     msg.ReceiptHandle,
+			VisibilityTimeout: int32(q.visibilityTimeout.Seconds()),
+		})
+	}
+
+	if _, err := q.client.ChangeMessageVisibilityBatch(ctx, &sqs.ChangeMessageVisibilityBatchInput{QueueUrl: &q.queueURL, Entries: entries}); err != nil {
+		slog.Warn("Couldn't extend SQS message visibility", slog.String("error", err.Error()))
+	}
+}
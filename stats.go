@@ -0,0 +1,557 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+type scanStats struct {
+	mu sync.Mutex
+
+	// RunID identifies the run, e.g. in the documents of --es-export-url.
+	RunID string `json:"runId"`
+
+	// Build is the build that ran the scan.
+	Build buildInfo `json:"build"`
+
+	// StopReason is why the scan stopped, e.g. "complete" or "saturated".
+	StopReason stopReason `json:"stopReason"`
+
+	// TimeBounded is set when --stop-after stopped the scan, or some accounts
+	// of an --org-role scan, before the window was read in full.
+	TimeBounded bool `json:"timeBounded"`
+
+	// Trails are the trails logging the scanned region, only set with
+	// --regions-with-trails.
+	Trails *trailCoverage `json:"trails,omitempty"`
+
+	// EffectiveWindow is only set when --start-time was before the
+	// LookupEvents retention and was moved to it.
+	EffectiveWindow *windowStats `json:"effectiveWindow,omitempty"`
+
+	Pages         int   `json:"pages"`
+	Events        int   `json:"events"`
+	LimiterWaitMs int64 `json:"limiterWaitMs"`
+	CallTimeouts  int   `json:"callTimeouts"`
+
+	// Retries counts the LookupEvents calls retried after a failure.
+	Retries int `json:"retries,omitempty"`
+
+	// AccountEvents and FailedAccounts break an --org-role scan down per
+	// account. FailedAccounts holds the error that made an account be skipped.
+	AccountEvents  map[string]int    `json:"accountEvents,omitempty"`
+	FailedAccounts map[string]string `json:"failedAccounts,omitempty"`
+
+	// MissingEventIDs holds, per --event-id that couldn't be looked up, why:
+	// "not found" or the error of the last call.
+	MissingEventIDs map[string]string `json:"missingEventIds,omitempty"`
+
+	// Files and SkippedFiles count the log files read by file based sources.
+	Files        int `json:"files,omitempty"`
+	SkippedFiles int `json:"skippedFiles,omitempty"`
+
+	// InvalidLines counts lines read with --stdin, CloudTrail Lake rows and
+	// Kinesis records that aren't events.
+	InvalidLines int `json:"invalidLines,omitempty"`
+
+	// Lake queries are billed by bytes scanned.
+	LakeEventsScanned int64 `json:"lakeEventsScanned,omitempty"`
+	LakeBytesScanned  int64 `json:"lakeBytesScanned,omitempty"`
+
+	AthenaBytesScanned int64 `json:"athenaBytesScanned,omitempty"`
+
+	// S3 Select reads whole log files but only returns the records matching
+	// --event-name and --event-source. SelectFallbacks counts the files it
+	// failed on, which were downloaded instead.
+	SelectBytesScanned  int64 `json:"selectBytesScanned,omitempty"`
+	SelectBytesReturned int64 `json:"selectBytesReturned,omitempty"`
+	SelectFallbacks     int   `json:"selectFallbacks,omitempty"`
+
+	// ExportedMatches and ExportFailures count the matches indexed with
+	// --es-export-url.
+	ExportedMatches int `json:"exportedMatches,omitempty"`
+	ExportFailures  int `json:"exportFailures,omitempty"`
+
+	// DynamoDBWrites and DynamoDBFailures count the matches written with
+	// --dynamodb-table.
+	DynamoDBWrites   int `json:"dynamoDBWrites,omitempty"`
+	DynamoDBFailures int `json:"dynamoDBFailures,omitempty"`
+
+	// Webhook* count the notifications of --webhook-url. Dropped ones didn't
+	// fit the queue, failed ones were retried without success.
+	WebhookSent     int `json:"webhookSent,omitempty"`
+	WebhookFailures int `json:"webhookFailures,omitempty"`
+	WebhookDropped  int `json:"webhookDropped,omitempty"`
+
+	// OversizedEvents were skipped because of --max-event-size.
+	OversizedEvents int `json:"oversizedEvents"`
+
+	// SkippedActions counts, per event name, the events dropped by
+	// --skip-known-actions.
+	SkippedActions map[string]int `json:"skippedActions,omitempty"`
+
+	// SkippedSources counts, per event source, the events dropped by
+	// --event-source after they were read. The S3 source only reads the
+	// events of these sources.
+	SkippedSources map[string]int `json:"skippedSources,omitempty"`
+
+	// SkippedAccounts counts, per recipient account, the events dropped by
+	// --account-id.
+	SkippedAccounts map[string]int `json:"skippedAccounts,omitempty"`
+
+	// MatcherHits counts the keys found per match type, e.g. "arn" or the
+	// type of a --pattern.
+	MatcherHits map[string]int `json:"matcherHits,omitempty"`
+
+	// FailedEvents couldn't be decoded, they are kept in failures.ndjson but
+	// for the UnrecordedFailures that couldn't be written to it.
+	FailedEvents       int `json:"failedEvents,omitempty"`
+	UnrecordedFailures int `json:"unrecordedFailures,omitempty"`
+
+	// EmptyPayloads counts the events without CloudTrailEvent, of which only
+	// the event name, source and resources were recorded.
+	EmptyPayloads int `json:"emptyPayloads,omitempty"`
+
+	// NonObjectPayloads are json arrays or scalars, which were recorded under
+	// the key $.
+	NonObjectPayloads int `json:"nonObjectPayloads,omitempty"`
+
+	// PanickedEvents are the FailedEvents whose handling panicked, they are
+	// in failures.ndjson too.
+	PanickedEvents int `json:"panickedEvents,omitempty"`
+
+	// ReplacedExamples counts the examples replaced by a better one with
+	// --best-examples.
+	ReplacedExamples int `json:"replacedExamples,omitempty"`
+
+	// DroppedLogs counts the Warn and Error lines left out of the logs
+	// because they repeated, per message or "message: error".
+	DroppedLogs map[string]int `json:"droppedLogs,omitempty"`
+
+	// ParseFailurePercent is the share of the events handled that became
+	// FailedEvents, to alarm on a systematic parsing problem.
+	ParseFailurePercent float64 `json:"parseFailurePercent"`
+
+	// Truncated is set when keys were dropped because --max-keys or
+	// --mem-limit-soft was reached.
+	Truncated      bool `json:"truncated"`
+	DroppedMatches int  `json:"droppedMatches"`
+
+	// CappedValues counts, per key, the values --dedupe-by pair left out of
+	// the summary once the key had --max-values-per-key.
+	CappedValues map[string]int `json:"cappedValues,omitempty"`
+
+	// DroppedPairs counts the pairs of keys left out of co-occurrence.csv
+	// once it had --max-co-occurrence-pairs.
+	DroppedPairs int `json:"droppedPairs,omitempty"`
+
+	// Memory holds the high-water marks of the memory use.
+	Memory *memoryStats `json:"memory,omitempty"`
+
+	// Examples are only set with --save-examples.
+	Examples *exampleStats `json:"examples,omitempty"`
+
+	// RetryBudget is how much of the retry budget the LookupEvents calls
+	// used, only set for LookupEvents scans.
+	RetryBudget *budgetStats `json:"retryBudget,omitempty"`
+
+	// PageTimings is filled from the collected page metrics when writing.
+	PageTimings map[string]timingSummary `json:"pageTimings"`
+
+	apiTimes     []time.Duration
+	processTimes []time.Duration
+	backoffTimes []time.Duration
+}
+
+// windowStats is the time window actually scanned, an open end is omitted.
+type windowStats struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+}
+
+func (s *scanStats) setEffectiveWindow(w timeWindow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.EffectiveWindow = &windowStats{Start: w.start}
+	if !w.end.IsZero() {
+		s.EffectiveWindow.End = &w.end
+	}
+}
+
+func (s *scanStats) setDroppedLogs(dropped map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.DroppedLogs = dropped
+}
+
+func (s *scanStats) setStopReason(reason stopReason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.StopReason = reason
+}
+
+func (s *scanStats) setProgress(pages, events int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Pages = pages
+	s.Events = events
+}
+
+// addPage counts a LookupEvents page. account is empty unless scanning an
+// organization.
+func (s *scanStats) addPage(account string, events int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Pages++
+	s.Events += events
+
+	if account == "" {
+		return
+	}
+	if s.AccountEvents == nil {
+		s.AccountEvents = make(map[string]int)
+	}
+	s.AccountEvents[account] += events
+}
+
+func (s *scanStats) addFailedAccount(account string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.FailedAccounts == nil {
+		s.FailedAccounts = make(map[string]string)
+	}
+	s.FailedAccounts[account] = err.Error()
+}
+
+func (s *scanStats) setTimeBounded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.TimeBounded = true
+}
+
+func (s *scanStats) isTimeBounded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.TimeBounded
+}
+
+func (s *scanStats) addMissingEventID(id, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.MissingEventIDs == nil {
+		s.MissingEventIDs = make(map[string]string)
+	}
+	s.MissingEventIDs[id] = reason
+}
+
+func (s *scanStats) addUnrecordedFailure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.UnrecordedFailures++
+}
+
+func (s *scanStats) failedAccounts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.FailedAccounts)
+}
+
+func (s *scanStats) missingEventIDs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.MissingEventIDs)
+}
+
+func (s *scanStats) addPageMetrics(m pageMetrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apiTimes = append(s.apiTimes, m.api)
+	s.processTimes = append(s.processTimes, m.process)
+	s.backoffTimes = append(s.backoffTimes, m.backoff)
+}
+
+func (s *scanStats) addRetry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Retries++
+}
+
+func (s *scanStats) addCallTimeout() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.CallTimeouts++
+}
+
+// addScan takes over the counters kept by the scan package.
+func (s *scanStats) addScan(scanned scan.Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.OversizedEvents += scanned.OversizedEvents
+	s.FailedEvents += scanned.FailedEvents
+	s.EmptyPayloads += scanned.EmptyPayloads
+	s.NonObjectPayloads += scanned.NonObjectPayloads
+	s.PanickedEvents += scanned.PanickedEvents
+	s.ReplacedExamples += scanned.ReplacedExamples
+	s.ParseFailurePercent = 100 * scanned.FailureRate()
+	for name, n := range scanned.SkippedActions {
+		if s.SkippedActions == nil {
+			s.SkippedActions = make(map[string]int)
+		}
+		s.SkippedActions[name] += n
+	}
+	for source, n := range scanned.SkippedSources {
+		if s.SkippedSources == nil {
+			s.SkippedSources = make(map[string]int)
+		}
+		s.SkippedSources[source] += n
+	}
+	for account, n := range scanned.SkippedAccounts {
+		if s.SkippedAccounts == nil {
+			s.SkippedAccounts = make(map[string]int)
+		}
+		s.SkippedAccounts[account] += n
+	}
+	for matchType, n := range scanned.MatcherHits {
+		if s.MatcherHits == nil {
+			s.MatcherHits = make(map[string]int)
+		}
+		s.MatcherHits[matchType] += n
+	}
+}
+
+func (s *scanStats) addFile(events int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Files++
+	s.Events += events
+}
+
+func (s *scanStats) addEvents(events int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Events += events
+}
+
+func (s *scanStats) addInvalidLine() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.InvalidLines++
+}
+
+func (s *scanStats) setLakeStatistics(eventsScanned, bytesScanned int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.LakeEventsScanned = eventsScanned
+	s.LakeBytesScanned = bytesScanned
+}
+
+func (s *scanStats) setAthenaBytesScanned(bytesScanned int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.AthenaBytesScanned = bytesScanned
+}
+
+func (s *scanStats) addSelectBytes(scanned, returned int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.SelectBytesScanned += scanned
+	s.SelectBytesReturned += returned
+}
+
+func (s *scanStats) addSelectFallback() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.SelectFallbacks++
+}
+
+func (s *scanStats) addExportedMatches(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ExportedMatches += n
+}
+
+func (s *scanStats) addExportFailures(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ExportFailures += n
+}
+
+func (s *scanStats) addDynamoDBWrite() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.DynamoDBWrites++
+}
+
+func (s *scanStats) addDynamoDBFailure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.DynamoDBFailures++
+}
+
+func (s *scanStats) addWebhookSent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.WebhookSent++
+}
+
+func (s *scanStats) addWebhookFailure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.WebhookFailures++
+}
+
+func (s *scanStats) addWebhookDropped(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.WebhookDropped += n
+}
+
+func (s *scanStats) addSkippedFile() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.SkippedFiles++
+}
+
+func (s *scanStats) addLimiterWait(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.LimiterWaitMs += d.Milliseconds()
+}
+
+// addDroppedMatch records a match refused by the key cap and returns the
+// number of matches dropped so far.
+func (s *scanStats) addDroppedMatch() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Truncated = true
+	s.DroppedMatches++
+	return s.DroppedMatches
+}
+
+func (s *scanStats) addCappedValue(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.CappedValues == nil {
+		s.CappedValues = make(map[string]int)
+	}
+	s.CappedValues[key]++
+	return s.CappedValues[key]
+}
+
+func (s *scanStats) addDroppedPair() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.DroppedPairs++
+	return s.DroppedPairs
+}
+
+func (s *scanStats) setTrails(t *trailCoverage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Trails = t
+}
+
+func (s *scanStats) setExamples(e *exampleStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Examples = e
+}
+
+func (s *scanStats) setRetryBudget(b *budgetStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.RetryBudget = b
+}
+
+func (s *scanStats) setMemory(m *memoryStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Memory = m
+}
+
+func (s *scanStats) droppedMatches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.DroppedMatches
+}
+
+// newRunID returns a random version 4 UUID.
+func newRunID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// marshal returns the stats as indented json, with the page timings
+// summarized from the collected page metrics.
+func (s *scanStats) marshal() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.PageTimings = map[string]timingSummary{
+		"api":     summarizeTimings(s.apiTimes),
+		"process": summarizeTimings(s.processTimes),
+		"backoff": summarizeTimings(s.backoffTimes),
+	}
+	return json.MarshalIndent(s, "", "  ")
+}
+
+func writeStats(stats *scanStats) error {
+	data, err := stats.marshal()
+	if err != nil {
+		return fmt.Errorf("marshal stats: %w", err)
+	}
+
+	if err := writeFileAtomic("stats.json", data, 0o600); err != nil {
+		return fmt.Errorf("write stats file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// readerSource reads one event per line, either a raw CloudTrail record as
+// found in trail files or the Event shape returned by LookupEvents, e.g.
+//
+//	zcat *.json.gz | jq -c '.Records[]' | find-cloudtrail-arn-fields --stdin
+type readerSource struct {
+	reader io.Reader
+	window timeWindow
+	stats  *scanStats
+}
+
+func (r *readerSource) run(ctx context.Context, emit func(scan.RawEvent)) stopReason {
+	scanner := bufio.NewScanner(r.reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return stopCanceled
+		}
+
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		event, err := parseEventLine(scanner.Bytes())
+		if err != nil {
+			slog.Warn("Skipping invalid event line", slog.Int("line", line), slog.String("error", err.Error()))
+			r.stats.addInvalidLine()
+			continue
+		}
+
+		if !event.EventTime.IsZero() && !r.window.contains(event.EventTime) {
+			continue
+		}
+
+		emit(event)
+		r.stats.addEvents(1)
+	}
+
+	if err := scanner.Err(); err != nil {
+		slog.Error("Couldn't read events", slog.String("error", err.Error()))
+		return stopFailed
+	}
+
+	return stopComplete
+}
+
+// parseEventLine accepts both a LookupEvents Event, recognized by its
+// CloudTrailEvent field, and a raw CloudTrail record.
+func parseEventLine(line []byte) (scan.RawEvent, error) {
+	var envelope types.Event
+	if err := json.Unmarshal(line, &envelope); err != nil {
+		return scan.RawEvent{}, err
+	}
+
+	if envelope.CloudTrailEvent != nil {
+		return scan.FromLookupEvent(envelope), nil
+	}
+
+	// Copy the line, the scanner reuses its buffer.
+	event, _, err := recordToEvent(append(json.RawMessage(nil), line...))
+	return event, err
+}
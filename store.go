@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// streamingStore is the --low-memory store. Instead of keeping matches in
+// memory it appends them to an ndjson file and only remembers the keys in a bloom
+// filter. A false positive of the filter makes a new key look known, so that
+// key is dropped from the outputs.
+type streamingStore struct {
+	mu     sync.Mutex
+	seen   *bloomFilter
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	keys   int
+}
+
+func newStreamingStore(path string, expectedKeys int, fpRate float64) (*streamingStore, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamingStore{
+		seen:   newBloomFilter(expectedKeys, fpRate),
+		path:   path,
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+func (s *streamingStore) Has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.seen.mayContain(key)
+}
+
+func (s *streamingStore) Add(m scan.Match) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seen.add(m.Key) {
+		return false
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return false
+	}
+
+	s.writer.Write(data)
+	s.writer.WriteByte('\n')
+	s.keys++
+	return true
+}
+
+func (s *streamingStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.keys
+}
+
+// Each reads the matches back from the matches file. The bloom filter has no
+// false negatives, so the file never holds the same key twice.
+func (s *streamingStore) Each(fn func(m scan.Match) error) error {
+	s.mu.Lock()
+	err := s.writer.Flush()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var m scan.Match
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return err
+		}
+
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (s *streamingStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writer.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+
+	return s.file.Close()
+}
+
+// cappedStore refuses new keys once maxKeys keys are stored, so heterogeneous
+// accounts can't grow the store without bound, or once stopAccepting was
+// called. Refused matches are counted in the stats to flag the summary as
+// truncated. A maxKeys of 0 doesn't limit the keys.
+type cappedStore struct {
+	scan.Store
+	maxKeys int
+	stats   *scanStats
+
+	mu      sync.Mutex
+	keys    int
+	stopped bool
+}
+
+func newCappedStore(store scan.Store, maxKeys int, stats *scanStats) *cappedStore {
+	return &cappedStore{Store: store, maxKeys: maxKeys, stats: stats}
+}
+
+// stopAccepting refuses every new key from now on, the known keys still
+// count their hits.
+func (c *cappedStore) stopAccepting() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopped = true
+}
+
+// Replace swaps the example of a known key if the wrapped store can, which
+// doesn't count towards maxKeys.
+func (c *cappedStore) Replace(m scan.Match, better func(current, candidate scan.Match) bool) bool {
+	store, ok := c.Store.(scan.ExampleStore)
+	return ok && store.Replace(m, better)
+}
+
+func (c *cappedStore) Add(m scan.Match) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.stopped && (c.maxKeys == 0 || c.keys < c.maxKeys) {
+		if !c.Store.Add(m) {
+			return false
+		}
+
+		c.keys++
+		return true
+	}
+
+	if c.Store.Has(m.Key) {
+		return false
+	}
+
+	if c.stats.addDroppedMatch() == 1 && !c.stopped {
+		slog.Warn("!!! Maximum number of keys reached, new keys are dropped and the summary will be incomplete !!!",
+			slog.Int("max-keys", c.maxKeys),
+		)
+	}
+
+	return false
+}
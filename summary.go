@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/exp/maps"
+	"gopkg.in/yaml.v3"
+)
+
+// summaryFormats are the values of --format, with the file each writes to
+// unless a path is given.
+var summaryFormats = map[string]struct {
+	path      string
+	newWriter func(o summaryOutput) scan.SummaryWriter
+}{
+	"csv": {"summary.csv", func(o summaryOutput) scan.SummaryWriter {
+		return &csvSummaryWriter{path: o.path, out: stdoutPath(o.path), comma: o.comma}
+	}},
+	"json": {"summary.json", func(o summaryOutput) scan.SummaryWriter {
+		return &jsonSummaryWriter{path: o.path, out: stdoutPath(o.path)}
+	}},
+	"markdown": {"summary.md", func(o summaryOutput) scan.SummaryWriter {
+		return &markdownSummaryWriter{path: o.path, out: stdoutPath(o.path)}
+	}},
+	"ndjson": {"summary.ndjson", func(o summaryOutput) scan.SummaryWriter {
+		return &ndjsonSummaryWriter{path: o.path, out: stdoutPath(o.path)}
+	}},
+	"xlsx": {"summary.xlsx", func(o summaryOutput) scan.SummaryWriter {
+		return &xlsxSummaryWriter{path: o.path, out: stdoutPath(o.path)}
+	}},
+	"yaml": {"summary.yaml", func(o summaryOutput) scan.SummaryWriter {
+		return &yamlSummaryWriter{path: o.path, out: stdoutPath(o.path)}
+	}},
+}
+
+// stdoutPath is stdout for the path -, which summaries are written to instead
+// of a file, and nil for any other path.
+func stdoutPath(path string) io.Writer {
+	if path == "-" {
+		return os.Stdout
+	}
+	return nil
+}
+
+// summaryOutput is a --format value, "format" or "format=path".
+type summaryOutput struct {
+	format string
+	path   string
+	// comma is the --delimiter of csv summaries, 0 for a comma.
+	comma rune
+}
+
+func parseSummaryOutput(value string) (summaryOutput, error) {
+	format, path, _ := strings.Cut(value, "=")
+
+	f, ok := summaryFormats[format]
+	if !ok {
+		names := maps.Keys(summaryFormats)
+		slices.Sort(names)
+		return summaryOutput{}, fmt.Errorf("--format must be one of %s, got %q", strings.Join(names, ", "), format)
+	}
+
+	if path == "" {
+		path = f.path
+	}
+	return summaryOutput{format: format, path: path}, nil
+}
+
+func (o summaryOutput) writer() scan.SummaryWriter {
+	return summaryFormats[o.format].newWriter(o)
+}
+
+// csvDelimiters are the values of --delimiter.
+var csvDelimiters = map[string]rune{
+	",":         ',',
+	"comma":     ',',
+	";":         ';',
+	"semicolon": ';',
+	`\t`:        '\t',
+	"\t":        '\t',
+	"tab":       '\t',
+}
+
+// delimiterFlag sets comma to the delimiter named by a --delimiter value.
+func delimiterFlag(comma *rune) func(string) error {
+	return func(value string) error {
+		delimiter, ok := csvDelimiters[value]
+		if !ok {
+			return fmt.Errorf(`must be ",", ";" or "\t", got %q`, value)
+		}
+		*comma = delimiter
+		return nil
+	}
+}
+
+// writeSummaries writes the summary with every writer. A failing writer
+// doesn't keep the others from writing, the errors are returned together.
+func writeSummaries(ctx context.Context, cache scan.Store, writers []scan.SummaryWriter) error {
+	snapshot, err := scan.TakeSnapshot(cache)
+	if err != nil {
+		return fmt.Errorf("read matches: %w", err)
+	}
+
+	var errs []error
+	for _, w := range writers {
+		if err := w.Write(ctx, snapshot); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// csvSchemaVersion is the layout csv summaries are written with. It is put
+// on a "# schema=N" line before the header, summaries of older builds have no
+// such line and are told apart by their header.
+const csvSchemaVersion = 3
+
+// csvLayouts are the headers of every csv schema version. A version that
+// changes the columns must be added here, so older summaries stay readable.
+var csvLayouts = map[int][]string{
+	1: {"key", "value", "eventAction", "eventExampleId"},
+	2: {"key", "value", "eventAction", "eventExampleId", "accountId"},
+	3: {"key", "value", "eventAction", "eventExampleId", "accountId", "eventSources", "eventSourceCount"},
+}
+
+// csvSummaryWriter writes one row per key, the format of summary.csv.
+type csvSummaryWriter struct {
+	path string
+	// out, if set, is written to instead of the file at path.
+	out io.Writer
+	// comma separates the columns, 0 for a comma. Values holding it, a
+	// double quote or a line break are quoted.
+	comma rune
+}
+
+func (w *csvSummaryWriter) Write(ctx context.Context, snapshot scan.Snapshot) error {
+	if w.out != nil {
+		return writeCSVSummary(w.out, snapshot, w.comma)
+	}
+
+	file, err := createAtomic(w.path, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.abort()
+
+	if err := writeCSVSummary(file, snapshot, w.comma); err != nil {
+		return err
+	}
+
+	if err := file.commit(); err != nil {
+		return err
+	}
+
+	slog.Debug("Summary written", slog.String("path", w.path), slog.Int("keys", len(snapshot.Matches)))
+	return nil
+}
+
+func writeCSVSummary(out io.Writer, snapshot scan.Snapshot, comma rune) error {
+	if _, err := fmt.Fprintf(out, "# schema=%d\n", csvSchemaVersion); err != nil {
+		return err
+	}
+
+	wr := csv.NewWriter(out)
+	if comma != 0 {
+		wr.Comma = comma
+	}
+	if err := wr.Write(csvLayouts[csvSchemaVersion]); err != nil {
+		return err
+	}
+
+	for _, m := range snapshot.Matches {
+		row := []string{m.Key, m.Value, m.EventName, m.EventID, m.AccountID, strings.Join(m.EventSources, " "), strconv.Itoa(len(m.EventSources))}
+		if err := wr.Write(row); err != nil {
+			return err
+		}
+	}
+
+	wr.Flush()
+	return wr.Error()
+}
+
+// jsonSummaryWriter writes the snapshot as is, see schema/snapshot.schema.json.
+type jsonSummaryWriter struct {
+	path string
+	// out, if set, is written to instead of the file at path.
+	out io.Writer
+}
+
+func (w *jsonSummaryWriter) Write(ctx context.Context, snapshot scan.Snapshot) error {
+	snapshot.Metadata = readBuildInfo().metadata()
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if w.out != nil {
+		_, err := w.out.Write(data)
+		return err
+	}
+
+	if err := writeFileAtomic(w.path, data, 0o600); err != nil {
+		return err
+	}
+
+	slog.Debug("Summary written", slog.String("path", w.path), slog.Int("keys", len(snapshot.Matches)))
+	return nil
+}
+
+// ndjsonSummaryWriter writes one match per line, the matches of the json
+// snapshot without its counts and metadata, e.g. for jq or a log pipeline.
+type ndjsonSummaryWriter struct {
+	path string
+	// out, if set, is written to instead of the file at path.
+	out io.Writer
+}
+
+func (w *ndjsonSummaryWriter) Write(ctx context.Context, snapshot scan.Snapshot) error {
+	if w.out != nil {
+		return writeNDJSONSummary(w.out, snapshot)
+	}
+
+	file, err := createAtomic(w.path, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.abort()
+
+	if err := writeNDJSONSummary(file, snapshot); err != nil {
+		return err
+	}
+
+	if err := file.commit(); err != nil {
+		return err
+	}
+
+	slog.Debug("Summary written", slog.String("path", w.path), slog.Int("keys", len(snapshot.Matches)))
+	return nil
+}
+
+func writeNDJSONSummary(out io.Writer, snapshot scan.Snapshot) error {
+	enc := json.NewEncoder(out)
+	for _, m := range snapshot.Matches {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// yamlMatch is a match in summary.yaml, with the fields and names of the
+// json snapshot in the same order.
+type yamlMatch struct {
+	Key        string    `yaml:"key"`
+	RawKey     string    `yaml:"rawKey,omitempty"`
+	Value      string    `yaml:"value"`
+	MatchType  string    `yaml:"matchType"`
+	Confidence float64   `yaml:"confidence,omitempty"`
+	Service    string    `yaml:"service,omitempty"`
+	EventName  string    `yaml:"eventName"`
+	EventID    string    `yaml:"eventId"`
+	EventTime  time.Time `yaml:"eventTime"`
+	Actor      string    `yaml:"actor,omitempty"`
+	AccountID  string    `yaml:"accountId,omitempty"`
+	Region     string    `yaml:"region,omitempty"`
+	// EventSources are written in flow style, a key may have dozens.
+	EventSources []string `yaml:"eventSources,flow,omitempty"`
+}
+
+// yamlSummaryWriter writes the matches as a list in block style, one match
+// after the other in the order of the snapshot, so the diffs of summaries
+// kept in git stay readable. The encoder quotes the values YAML would read
+// as something else, e.g. "true", "123" or "*".
+type yamlSummaryWriter struct {
+	path string
+	// out, if set, is written to instead of the file at path.
+	out io.Writer
+}
+
+func (w *yamlSummaryWriter) Write(ctx context.Context, snapshot scan.Snapshot) error {
+	matches := make([]yamlMatch, 0, len(snapshot.Matches))
+	for _, m := range snapshot.Matches {
+		matches = append(matches, yamlMatch(m))
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(matches); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	if w.out != nil {
+		_, err := w.out.Write(buf.Bytes())
+		return err
+	}
+
+	if err := writeFileAtomic(w.path, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+
+	slog.Debug("Summary written", slog.String("path", w.path), slog.Int("keys", len(snapshot.Matches)))
+	return nil
+}
+
+// readSummary adds the matches of a summary a previous run wrote to cache,
+// a json snapshot, an ndjson, a yaml or a csv summary, told apart by the
+// extension. comma is the delimiter of a csv summary, 0 for a comma. Markdown
+// summaries are for reading only.
+func readSummary(path string, matchers scan.Matcher, cache scan.Store, comma rune) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch filepath.Ext(path) {
+	case ".json":
+	case ".ndjson":
+		return readSummaryNDJSON(file, cache)
+	case ".md":
+		return errors.New("markdown summaries can't be read back, use a csv, json, ndjson or yaml summary")
+	case ".yaml", ".yml":
+		return readSummaryYAML(file, cache)
+	default:
+		return readSummaryCSV(file, matchers, cache, comma)
+	}
+
+	var snapshot scan.Snapshot
+	if err := json.NewDecoder(file).Decode(&snapshot); err != nil {
+		return err
+	}
+	if snapshot.SchemaVersion > scan.SchemaVersion {
+		return fmt.Errorf("schema version %d is newer than the supported %d", snapshot.SchemaVersion, scan.SchemaVersion)
+	}
+
+	for _, m := range snapshot.Matches {
+		cache.Add(m)
+	}
+	return nil
+}
+
+func readSummaryNDJSON(r io.Reader, cache scan.Store) error {
+	dec := json.NewDecoder(r)
+	for {
+		var m scan.Match
+		err := dec.Decode(&m)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cache.Add(m)
+	}
+}
+
+func readSummaryYAML(r io.Reader, cache scan.Store) error {
+	var matches []yamlMatch
+	if err := yaml.NewDecoder(r).Decode(&matches); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	for _, m := range matches {
+		cache.Add(scan.Match(m))
+	}
+	return nil
+}
+
+// readSummaryCSV adds the rows of a csv summary of any schema version to
+// cache. The rows don't hold the match type, so they go through matchers
+// again, rows no matcher accepts are dropped.
+func readSummaryCSV(r io.Reader, matchers scan.Matcher, cache scan.Store, comma rune) error {
+	br := bufio.NewReader(r)
+	version, err := readCSVSchemaVersion(br)
+	if err != nil {
+		return err
+	}
+
+	rd := csv.NewReader(br)
+	rd.FieldsPerRecord = -1
+	if comma != 0 {
+		rd.Comma = comma
+	}
+	header, err := rd.Read()
+	if err != nil {
+		return err
+	}
+
+	layout, err := csvLayout(version, header)
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]int, len(layout))
+	for i, name := range layout {
+		columns[name] = i
+	}
+	column := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	for {
+		row, err := rd.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		m, ok := matchers.Match(column(row, "key"), column(row, "value"))
+		if !ok {
+			continue
+		}
+		m.EventName, m.EventID, m.AccountID = column(row, "eventAction"), column(row, "eventExampleId"), column(row, "accountId")
+		m.EventSources = strings.Fields(column(row, "eventSources"))
+		cache.Add(m)
+	}
+}
+
+// readCSVSchemaVersion reads the "# schema=N" line of a csv summary. It
+// returns 0 for summaries without one, which then only has its header.
+func readCSVSchemaVersion(br *bufio.Reader) (int, error) {
+	prefix, err := br.Peek(len("# schema="))
+	if err != nil || string(prefix) != "# schema=" {
+		// No version line, a summary too short for one is reported by the csv
+		// reader.
+		return 0, nil
+	}
+
+	line, err := br.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+
+	value := strings.TrimSpace(strings.TrimPrefix(line, "# schema="))
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid summary schema line %q", strings.TrimSpace(line))
+	}
+	return version, nil
+}
+
+// csvLayout checks header against the layout of version, or finds the
+// version whose layout it is when the summary has no version line.
+func csvLayout(version int, header []string) ([]string, error) {
+	if version == 0 {
+		for _, layout := range csvLayouts {
+			if slices.Equal(header, layout) {
+				return layout, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown summary header %q, the supported ones are %s", strings.Join(header, ","), supportedCSVLayouts())
+	}
+
+	if version > csvSchemaVersion {
+		return nil, fmt.Errorf("summary schema %d is newer than the supported %d", version, csvSchemaVersion)
+	}
+
+	layout, ok := csvLayouts[version]
+	if !ok {
+		return nil, fmt.Errorf("unknown summary schema %d", version)
+	}
+	if !slices.Equal(header, layout) {
+		return nil, fmt.Errorf("summary header %q doesn't match schema %d, expected %q", strings.Join(header, ","), version, strings.Join(layout, ","))
+	}
+	return layout, nil
+}
+
+func supportedCSVLayouts() string {
+	versions := maps.Keys(csvLayouts)
+	slices.Sort(versions)
+
+	layouts := make([]string, 0, len(versions))
+	for _, version := range versions {
+		layouts = append(layouts, fmt.Sprintf("%q (schema %d)", strings.Join(csvLayouts[version], ","), version))
+	}
+	return strings.Join(layouts, ", ")
+}
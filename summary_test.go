@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"github.com/xuri/excelize/v2"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata with the current outputs")
+
+// goldenSnapshot covers every match type and the values the writers must
+// quote or escape: commas, quotes, line breaks and unicode.
+func goldenSnapshot() scan.Snapshot {
+	at := time.Date(2024, 7, 1, 12, 30, 0, 0, time.UTC)
+	matches := []scan.Match{
+		{Key: "requestParameters.roleArn", Value: "arn:aws:iam::123456789012:role/service-role/deploy", MatchType: scan.MatchTypeARN, Confidence: 1, Service: "iam", EventName: "GetRole", EventID: "11111111-aaaa-4bbb-8ccc-000000000001", EventTime: at, Actor: "arn:aws:iam::123456789012:user/alice", AccountID: "123456789012", Region: "us-east-1", EventSources: []string{"iam.amazonaws.com", "sts.amazonaws.com"}},
+		{Key: "requestParameters.instancesSet.items[].instanceId", RawKey: "requestParameters.instancesSet.items.0.instanceId", Value: "i-0123456789abcdef0", MatchType: scan.MatchTypeResourceID, Confidence: 0.8, Service: "ec2", EventName: "StartInstances", EventID: "11111111-aaaa-4bbb-8ccc-000000000002", EventTime: at, AccountID: "123456789012", Region: "eu-west-1"},
+		{Key: "requestParameters.accountId", Value: "210987654321", MatchType: "account-id", Confidence: 0.5, Service: "organizations", EventName: "DescribeAccount", EventID: "11111111-aaaa-4bbb-8ccc-000000000003", EventTime: at},
+		{Key: "requestParameters.policyArn", Value: "arn:aws:iam::123456789012:policy/a,b", MatchType: scan.MatchTypeARN, Confidence: 1, EventName: "AttachRolePolicy", EventID: "11111111-aaaa-4bbb-8ccc-000000000004", EventTime: at},
+		{Key: `requestParameters.tags.kubernetes\.io/cluster/name`, Value: `arn:aws:eks:us-east-1:123456789012:cluster/"prod"`, MatchType: scan.MatchTypeARN, Confidence: 1, EventName: "TagResource", EventID: "11111111-aaaa-4bbb-8ccc-000000000005", EventTime: at},
+		{Key: "requestParameters.key", Value: "arn:aws:s3:::bucket/reports/2024\nline two", MatchType: scan.MatchTypeARN, Confidence: 1, Service: "s3", EventName: "PutObject", EventID: "11111111-aaaa-4bbb-8ccc-000000000006", EventTime: at},
+		{Key: "requestParameters.bucketName", Value: "arn:aws:s3:::bücket-日本", MatchType: scan.MatchTypeARN, Confidence: 1, Service: "s3", EventName: "CreateBucket", EventID: "11111111-aaaa-4bbb-8ccc-000000000007", EventTime: at},
+		{Key: "responseElements.description", Value: "arn:aws:ssm:eu-west-1:123456789012:document/\"quoted, and, commas\"", MatchType: scan.MatchTypeARN, Confidence: 1, Service: "ssm", EventName: "CreateDocument", EventID: "11111111-aaaa-4bbb-8ccc-000000000008", EventTime: at},
+		{Key: "requestParameters.subnetId", Value: "subnet-12345678", MatchType: scan.MatchTypeResourceID, Confidence: 0.8, Service: "ec2", EventName: "CreateNetworkInterface", EventID: "11111111-aaaa-4bbb-8ccc-000000000009", EventTime: at, EventSources: []string{"ec2.amazonaws.com"}},
+		{Key: "requestParameters.functionName", Value: "arn:aws-cn:lambda:cn-north-1:123456789012:function:crlf\r\nend", MatchType: scan.MatchTypeARN, Confidence: 1, Service: "lambda", EventName: "Invoke", EventID: "11111111-aaaa-4bbb-8ccc-000000000010", EventTime: at},
+		{Key: "requestParameters.topicArn", Value: "arn:aws-us-gov:sns:us-gov-west-1:123456789012:trailing space ", MatchType: scan.MatchTypeARN, Confidence: 1, Service: "sns", EventName: "Publish", EventID: "11111111-aaaa-4bbb-8ccc-000000000011", EventTime: at},
+		{Key: "$", Value: "arn:aws:kms:eu-west-1:123456789012:key/emoji-🔑|*_[x]<b>", MatchType: scan.MatchTypeARN, Confidence: 1, Service: "kms", EventName: "Decrypt", EventID: "11111111-aaaa-4bbb-8ccc-000000000012", EventTime: at},
+	}
+
+	counts := make(map[string]int)
+	for _, m := range matches {
+		counts[m.MatchType]++
+	}
+	return scan.Snapshot{SchemaVersion: scan.SchemaVersion, Counts: counts, Matches: matches}
+}
+
+// checkGolden compares got with testdata/name, or rewrites the file with
+// -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run go test -run %s -update to create it", err, t.Name())
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s, run go test -run %s -update if the change is intended\ngot:\n%s\nwant:\n%s", path, t.Name(), got, want)
+	}
+}
+
+// withVersion pins the version the json outputs record.
+func withVersion(t *testing.T, v string) {
+	t.Helper()
+
+	previous := version
+	version = v
+	t.Cleanup(func() { version = previous })
+}
+
+// writeSummaryFile writes the golden snapshot in format to a temporary file
+// and returns its path.
+func writeSummaryFile(t *testing.T, format string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), summaryFormats[format].path)
+	w := summaryFormats[format].newWriter(summaryOutput{format: format, path: path})
+	if err := w.Write(context.Background(), goldenSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// xlsxFindings dumps the Findings sheet of a workbook as tab separated rows,
+// the workbook itself holds the build of the test binary.
+func xlsxFindings(t *testing.T, workbook []byte) []byte {
+	t.Helper()
+
+	f, err := excelize.OpenReader(bytes.NewReader(workbook))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rows, err := f.GetRows("Findings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	wr := csv.NewWriter(&out)
+	wr.Comma = '\t'
+	if err := wr.WriteAll(rows); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// TestSummaryWritersGolden has a golden file per --format, a new format
+// fails it until it has one.
+func TestSummaryWritersGolden(t *testing.T) {
+	withVersion(t, "v0.0.0-golden")
+
+	tests := map[string]struct {
+		golden string
+		// dump, if set, turns the written file into the content of the
+		// golden file, e.g. for binary formats.
+		dump func(t *testing.T, written []byte) []byte
+	}{
+		"csv":      {"summary.csv", nil},
+		"json":     {"summary.json", nil},
+		"markdown": {"summary.md", nil},
+		"ndjson":   {"summary.ndjson", nil},
+		"xlsx":     {"summary.xlsx.tsv", xlsxFindings},
+		"yaml":     {"summary.yaml", nil},
+	}
+	for format := range summaryFormats {
+		if _, ok := tests[format]; !ok {
+			t.Errorf("--format %s has no golden file", format)
+		}
+	}
+
+	for format, tt := range tests {
+		t.Run(format, func(t *testing.T) {
+			written, err := os.ReadFile(writeSummaryFile(t, format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.dump != nil {
+				written = tt.dump(t, written)
+			}
+			checkGolden(t, tt.golden, written)
+		})
+	}
+}
+
+// TestSummaryRoundTrip reads the quoted values of the summaries back as they
+// were written.
+func TestSummaryRoundTrip(t *testing.T) {
+	for _, format := range []string{"csv", "json", "ndjson", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			read := scan.NewMemoryStore(0)
+			if err := readSummary(writeSummaryFile(t, format), scan.NewRegistry(scanMatchers(nil)...), read, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, m := range goldenSnapshot().Matches {
+				want := m.Value
+				if format == "csv" {
+					if m.MatchType == "account-id" {
+						// No matcher of the defaults accepts it.
+						continue
+					}
+					// encoding/csv reads the line break \r\n of a quoted
+					// value as \n.
+					want = strings.ReplaceAll(want, "\r\n", "\n")
+				}
+				found := false
+				read.Each(func(r scan.Match) error {
+					if r.Key == m.Key {
+						found = true
+						if r.Value != want {
+							t.Errorf("%s read back as %q, want %q", m.Key, r.Value, want)
+						}
+						if !slices.Equal(r.EventSources, m.EventSources) {
+							t.Errorf("%s read back with event sources %q, want %q", m.Key, r.EventSources, m.EventSources)
+						}
+					}
+					return nil
+				})
+				if !found {
+					t.Errorf("%s wasn't read back", m.Key)
+				}
+			}
+		})
+	}
+}
+
+// TestMarkdownSummaryRows keeps every match on one row of the table, whatever
+// its value holds.
+func TestMarkdownSummaryRows(t *testing.T) {
+	path := writeSummaryFile(t, "markdown")
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(got), "\n"), "\n") {
+		if strings.HasPrefix(line, "| ") {
+			rows = append(rows, line)
+		}
+	}
+	if want := len(goldenSnapshot().Matches) + 2; len(rows) != want {
+		t.Fatalf("%d table rows, want %d for the header, the delimiter and a row per match", len(rows), want)
+	}
+	for _, row := range rows {
+		// The unescaped pipes separate the 7 columns.
+		cells := strings.Count(row, "|") - strings.Count(row, `\|`)
+		if cells != 8 {
+			t.Errorf("row %q has %d separators, want 8", row, cells)
+		}
+	}
+
+	err = readSummary(path, nil, scan.NewMemoryStore(0), 0)
+	if err == nil || !strings.Contains(err.Error(), "can't be read back") {
+		t.Errorf("reading a markdown summary back failed with %v, want that it can't be", err)
+	}
+}
+
+// TestSummaryWriteError fails the scan with exitOutput if a summary can't be
+// written, the other summaries are written anyway.
+func TestSummaryWriteError(t *testing.T) {
+	err := runStdin(t, []string{stdinEvent(0)}, "--format", "csv=missing/summary.csv", "--format", "json")
+	if code := exitCode(err); code != exitOutput {
+		t.Fatalf("exit code %d (%v), want %d", code, err, exitOutput)
+	}
+	if !strings.Contains(err.Error(), "missing/summary.csv") {
+		t.Errorf("the error doesn't name the summary: %v", err)
+	}
+	if _, err := os.Stat("summary.json"); err != nil {
+		t.Errorf("the json summary wasn't written: %v", err)
+	}
+}
+
+// TestMatchStreamGolden writes the findings of --machine as the lines of the
+// ndjson summary.
+func TestMatchStreamGolden(t *testing.T) {
+	var out bytes.Buffer
+	stream := newMatchStream(&out)
+	for _, m := range goldenSnapshot().Matches {
+		stream(m)
+	}
+	checkGolden(t, "summary.ndjson", out.Bytes())
+}
+
+// TestYAMLSummaryQuoting quotes the values a YAML parser would read as
+// something else, YAML 1.1 booleans like yes included, and reads every value
+// back as it was.
+func TestYAMLSummaryQuoting(t *testing.T) {
+	tests := []struct {
+		value string
+		// want is how the value is written after "value: ".
+		want string
+	}{
+		{"arn:aws:iam::123456789012:role/a: b", "'arn:aws:iam::123456789012:role/a: b'"},
+		{"arn:aws:s3:::bucket/a:b", "arn:aws:s3:::bucket/a:b"},
+		{"a: b", "'a: b'"},
+		{"x:", "'x:'"},
+		{"a #b", "'a #b'"},
+		{"a#b", "a#b"},
+		{"#x", "'#x'"},
+		{"- x", "'- x'"},
+		{"-x", "-x"},
+		{"yes", `"yes"`},
+		{"no", `"no"`},
+		{"Yes", `"Yes"`},
+		{"on", `"on"`},
+		{"off", `"off"`},
+		{"y", `"y"`},
+		{"true", `"true"`},
+		{"null", `"null"`},
+		{"~", `"~"`},
+		{"123456789012", `"123456789012"`},
+		{"1e3", `"1e3"`},
+		{"*alias", "'*alias'"},
+		{"&anchor", "'&anchor'"},
+		{"!tag", "'!tag'"},
+		{"  leading", "'  leading'"},
+		{"trailing ", "'trailing '"},
+		{"'quoted'", `'''quoted'''`},
+		{"line one\nline two", "|-\n    line one\n    line two"},
+		{"line\n", "|\n    line"},
+	}
+
+	var matches []scan.Match
+	for i, tt := range tests {
+		matches = append(matches, scan.Match{Key: fmt.Sprintf("requestParameters.value%d", i), Value: tt.value, MatchType: scan.MatchTypeARN})
+	}
+	var out bytes.Buffer
+	if err := (&yamlSummaryWriter{out: &out}).Write(context.Background(), scan.Snapshot{Matches: matches}); err != nil {
+		t.Fatal(err)
+	}
+	written := out.String()
+
+	read := scan.NewMemoryStore(0)
+	if err := readSummaryYAML(strings.NewReader(written), read); err != nil {
+		t.Fatalf("%v\n%s", err, written)
+	}
+	values := make(map[string]string)
+	read.Each(func(m scan.Match) error {
+		values[m.Key] = m.Value
+		return nil
+	})
+
+	for i, tt := range tests {
+		key := fmt.Sprintf("requestParameters.value%d", i)
+		if want := "- key: " + key + "\n  value: " + tt.want + "\n"; !strings.Contains(written, want) {
+			t.Errorf("%q isn't written as %s:\n%s", tt.value, tt.want, written)
+		}
+		if got, ok := values[key]; !ok || got != tt.value {
+			t.Errorf("%q read back as %q", tt.value, got)
+		}
+	}
+}
+
+// TestCSVSummaryDelimiter writes and reads the summary with every --delimiter,
+// quoting the values that hold it.
+func TestCSVSummaryDelimiter(t *testing.T) {
+	at := time.Date(2024, 7, 1, 12, 30, 0, 0, time.UTC)
+	matches := []scan.Match{
+		{Key: "requestParameters.plain", Value: "arn:aws:iam::123456789012:role/plain", MatchType: scan.MatchTypeARN, EventName: "GetRole", EventID: "event-1", EventTime: at},
+		{Key: "requestParameters.comma", Value: "arn:aws:iam::123456789012:policy/a,b", MatchType: scan.MatchTypeARN, EventName: "GetPolicy", EventID: "event-2", EventTime: at},
+		{Key: "requestParameters.semicolon", Value: "arn:aws:s3:::bucket/a;b", MatchType: scan.MatchTypeARN, EventName: "GetObject", EventID: "event-3", EventTime: at},
+		{Key: "requestParameters.tab", Value: "arn:aws:s3:::bucket/a\tb", MatchType: scan.MatchTypeARN, EventName: "GetObject", EventID: "event-4", EventTime: at},
+		{Key: "requestParameters.sources", Value: "arn:aws:sns:us-east-1:123456789012:topic", MatchType: scan.MatchTypeARN, EventName: "Publish", EventID: "event-5", EventTime: at, EventSources: []string{"sns.amazonaws.com", "sqs.amazonaws.com"}},
+	}
+
+	for _, flagValue := range []string{",", ";", "semicolon", `\t`, "tab"} {
+		t.Run(flagValue, func(t *testing.T) {
+			var comma rune
+			if err := delimiterFlag(&comma)(flagValue); err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			if err := writeCSVSummary(&out, scan.Snapshot{Matches: matches}, comma); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(out.String(), "\n")
+			if header := strings.Join(csvLayouts[csvSchemaVersion], string(comma)); lines[1] != header {
+				t.Errorf("header %q, want %q", lines[1], header)
+			}
+			for i, m := range matches {
+				// Only the value holding the delimiter is quoted.
+				_, rest, _ := strings.Cut(lines[i+2], string(comma))
+				if quoted := strings.HasPrefix(rest, `"`); quoted != strings.ContainsRune(m.Value, comma) {
+					t.Errorf("%s: value quoted %t in %q", m.Key, quoted, lines[i+2])
+				}
+			}
+
+			read := scan.NewMemoryStore(0)
+			if err := readSummaryCSV(&out, scan.NewRegistry(scanMatchers(nil)...), read, comma); err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]scan.Match)
+			read.Each(func(m scan.Match) error {
+				got[m.Key] = m
+				return nil
+			})
+			for _, m := range matches {
+				r := got[m.Key]
+				if r.Value != m.Value || r.EventName != m.EventName || r.EventID != m.EventID || strings.Join(r.EventSources, " ") != strings.Join(m.EventSources, " ") {
+					t.Errorf("%s read back as %+v", m.Key, r)
+				}
+			}
+		})
+	}
+}
+
+// TestCSVSummaryWrongDelimiter fails to read a summary with another
+// delimiter than it was written with, naming the layouts it expects.
+func TestCSVSummaryWrongDelimiter(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeCSVSummary(&out, goldenSnapshot(), ';'); err != nil {
+		t.Fatal(err)
+	}
+
+	err := readSummaryCSV(&out, scan.NewRegistry(scanMatchers(nil)...), scan.NewMemoryStore(0), ',')
+	if err == nil || !strings.Contains(err.Error(), "eventSourceCount") {
+		t.Errorf("read with a comma returned %v, want an error naming the expected header", err)
+	}
+}
+
+func TestDelimiterFlag(t *testing.T) {
+	for value, want := range map[string]rune{",": ',', "comma": ',', ";": ';', "semicolon": ';', `\t`: '\t', "\t": '\t', "tab": '\t'} {
+		var comma rune
+		if err := delimiterFlag(&comma)(value); err != nil || comma != want {
+			t.Errorf("--delimiter %q set %q, %v, want %q", value, comma, err, want)
+		}
+	}
+
+	for _, value := range []string{"", "|", ",;", "pipe"} {
+		var comma rune
+		if err := delimiterFlag(&comma)(value); err == nil {
+			t.Errorf("--delimiter %q set %q, want an error", value, comma)
+		}
+	}
+}
+
+// TestScanDelimiter writes summary.csv with --delimiter.
+func TestScanDelimiter(t *testing.T) {
+	if err := runStdin(t, []string{stdinEvent(0), stdinEvent(1)}, "--delimiter", "tab", "--format", "csv"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile("summary.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("summary.csv has %d lines, want the schema, the header and 2 keys:\n%s", len(lines), data)
+	}
+	for _, line := range lines[1:] {
+		if got := strings.Count(line, "\t") + 1; got != len(csvLayouts[csvSchemaVersion]) {
+			t.Errorf("line %q has %d tab separated columns, want %d", line, got, len(csvLayouts[csvSchemaVersion]))
+		}
+	}
+}
@@ -0,0 +1,31 @@
+CREATE EXTERNAL TABLE IF NOT EXISTS db.cloudtrail_logs (
+  eventversion STRING,
+  useridentity STRUCT<accesskeyid:STRING, accountid:STRING, arn:STRING, invokedby:STRING, principalid:STRING, sessioncontext:STRUCT<attributes:STRUCT<creationdate:STRING, mfaauthenticated:STRING>, sessionissuer:STRUCT<accountid:STRING, arn:STRING, principalid:STRING, type:STRING, username:STRING>>, type:STRING, username:STRING>,
+  eventtime STRING,
+  eventsource STRING,
+  eventname STRING,
+  awsregion STRING,
+  sourceipaddress STRING,
+  useragent STRING,
+  errorcode STRING,
+  errormessage STRING,
+  requestparameters STRUCT<bucket:STRUCT<name:STRING, region:STRING>, instancesset:STRUCT<items:ARRAY<STRUCT<instanceid:STRING>>>, rolearn:STRING, `table`:STRUCT<`order`:STRING>, tags:STRUCT<`123456789012`:STRING, `a\b`:STRING, `a``b`:STRING, `kubernetes.io/cluster`:STRING>>,
+  responseelements STRUCT<matrix:ARRAY<ARRAY<STRING>>>,
+  additionaleventdata STRING,
+  requestid STRING,
+  eventid STRING,
+  resources ARRAY<STRUCT<accountid:STRING, arn:STRING, type:STRING>>,
+  eventtype STRING,
+  apiversion STRING,
+  readonly STRING,
+  recipientaccountid STRING,
+  serviceeventdetails STRUCT<snapshotid:STRING>,
+  sharedeventid STRING,
+  vpcendpointid STRING,
+  `date` STRING
+)
+COMMENT 'CloudTrail logs with the 14 keys found by find-cloudtrail-arn-fields'
+ROW FORMAT SERDE 'org.apache.hive.hcatalog.data.JsonSerDe'
+STORED AS INPUTFORMAT 'com.amazon.emr.cloudtrail.CloudTrailInputFormat'
+OUTPUTFORMAT 'org.apache.hadoop.hive.ql.io.HiveIgnoreKeyTextOutputFormat'
+LOCATION 's3://bucket/AWSLogs/o-it''s/';
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// eventSpanSampling traces one in this many handled events. Tracing every
+// event would dwarf the actual work.
+const eventSpanSampling = 100
+
+// tracer is a no-op until setupTracing installed an exporter.
+var tracer = otel.Tracer("github.com/romulets/find-cloudtrail-arn-fields")
+
+var tracedEvents atomic.Int64
+
+// setupTracing exports spans over OTLP/HTTP to endpoint, e.g.
+// http://localhost:4318. The returned shutdown flushes the pending spans.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("find-cloudtrail-arn-fields"))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// startEventSpan starts the span of a sampled event, for the others it returns
+// a span that isn't recorded.
+func startEventSpan(ctx context.Context, eventName string) trace.Span {
+	if tracedEvents.Add(1)%eventSpanSampling != 1 {
+		return trace.SpanFromContext(context.Background())
+	}
+
+	_, span := tracer.Start(ctx, "handleEvent", trace.WithAttributes(attribute.String("event.name", eventName)))
+	return span
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+)
+
+// trailCoverage is what stats.json tells of the trails with
+// --regions-with-trails. An organization trail logs the events of every
+// account of the organization to the management account's bucket.
+type trailCoverage struct {
+	Trails            []string `json:"trails"`
+	HomeRegions       []string `json:"homeRegions"`
+	MultiRegion       bool     `json:"multiRegion"`
+	OrganizationTrail bool     `json:"organizationTrail"`
+	// CoversRegion is whether a trail logs the events of the scanned region.
+	CoversRegion bool `json:"coversRegion"`
+}
+
+// describeTrailCoverage lists the trails logging the events of region,
+// shadow trails included, i.e. the trails of other regions and of the
+// organization that also log this region.
+func describeTrailCoverage(ctx context.Context, client *cloudtrail.Client, region string) (*trailCoverage, error) {
+	out, err := client.DescribeTrails(ctx, &cloudtrail.DescribeTrailsInput{IncludeShadowTrails: aws.Bool(true)})
+	if err != nil {
+		return nil, err
+	}
+
+	coverage := &trailCoverage{Trails: []string{}, HomeRegions: []string{}}
+	for _, trail := range out.TrailList {
+		home := deRef(trail.HomeRegion)
+		multiRegion := trail.IsMultiRegionTrail != nil && *trail.IsMultiRegionTrail
+		if home != region && !multiRegion {
+			continue
+		}
+
+		coverage.Trails = append(coverage.Trails, deRef(trail.TrailARN))
+		if !slices.Contains(coverage.HomeRegions, home) {
+			coverage.HomeRegions = append(coverage.HomeRegions, home)
+		}
+		coverage.MultiRegion = coverage.MultiRegion || multiRegion
+		if trail.IsOrganizationTrail != nil && *trail.IsOrganizationTrail {
+			coverage.OrganizationTrail = true
+		}
+	}
+	slices.Sort(coverage.Trails)
+	slices.Sort(coverage.HomeRegions)
+	coverage.CoversRegion = len(coverage.Trails) > 0
+
+	if coverage.OrganizationTrail {
+		slog.Info("An organization trail logs the region, the events of the member accounts are logged by the management account",
+			slog.String("region", region),
+		)
+	}
+	return coverage, nil
+}
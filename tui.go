@@ -0,0 +1,267 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// tuiSorts are the orders of the key table, cycled through with s.
+var tuiSorts = []struct {
+	name    string
+	compare func(a, b scan.Match) int
+}{
+	{"key", func(a, b scan.Match) int { return cmp.Compare(a.Key, b.Key) }},
+	{"match type", func(a, b scan.Match) int {
+		return cmp.Or(cmp.Compare(a.MatchType, b.MatchType), cmp.Compare(a.Key, b.Key))
+	}},
+	{"service", func(a, b scan.Match) int {
+		return cmp.Or(cmp.Compare(a.Service, b.Service), cmp.Compare(a.Key, b.Key))
+	}},
+}
+
+// scanTUI is the terminal UI of --tui. It lists the keys found so far, gets
+// them from the match hook, and shows the example of the selected one with
+// the scan's throughput below.
+type scanTUI struct {
+	app    *tview.Application
+	table  *tview.Table
+	detail *tview.TextView
+	filter *tview.InputField
+	status *tview.TextView
+
+	prog  *progress
+	stats *scanStats
+
+	// writeSummary writes the summary of the keys so far, stop ends the scan
+	// like Ctrl-C.
+	writeSummary func() error
+	stop         func()
+
+	// matches and message are written by the scan, the rest is only used
+	// on the UI goroutine.
+	mu      sync.Mutex
+	matches []scan.Match
+	added   bool
+	message string
+
+	shown  []scan.Match
+	sortBy int
+	query  string
+	dirty  bool
+	done   chan struct{}
+}
+
+func newScanTUI(prog *progress, stats *scanStats, writeSummary func() error, stop func()) *scanTUI {
+	t := &scanTUI{
+		app:          tview.NewApplication(),
+		table:        tview.NewTable().SetSelectable(true, false).SetFixed(1, 0),
+		detail:       tview.NewTextView().SetDynamicColors(true),
+		filter:       tview.NewInputField().SetLabel("Filter: "),
+		status:       tview.NewTextView(),
+		prog:         prog,
+		stats:        stats,
+		writeSummary: writeSummary,
+		stop:         stop,
+		done:         make(chan struct{}),
+	}
+
+	t.table.SetBorder(true).SetTitle(" Keys ")
+	t.detail.SetBorder(true).SetTitle(" Example ")
+	t.table.SetSelectionChangedFunc(func(row, _ int) {
+		t.showDetail(row)
+	})
+
+	// The filter keeps the keys of a section, e.g. requestParameters, or
+	// the ones found in a service.
+	t.filter.SetChangedFunc(func(text string) {
+		t.query = text
+		t.dirty = true
+	})
+	t.filter.SetDoneFunc(func(tcell.Key) {
+		t.app.SetFocus(t.table)
+	})
+
+	t.app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyCtrlC {
+			t.stopScan()
+			return nil
+		}
+		if t.filter.HasFocus() {
+			return event
+		}
+
+		switch event.Rune() {
+		case 'q':
+			t.stopScan()
+			return nil
+		case 's':
+			t.sortBy = (t.sortBy + 1) % len(tuiSorts)
+			t.dirty = true
+			return nil
+		case '/':
+			t.app.SetFocus(t.filter)
+			return nil
+		case 'w':
+			go t.snapshot()
+			return nil
+		}
+		return event
+	})
+
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(tview.NewFlex().
+			AddItem(t.table, 0, 3, true).
+			AddItem(t.detail, 0, 2, false), 0, 1, true).
+		AddItem(t.filter, 1, 0, false).
+		AddItem(t.status, 2, 0, false)
+	t.app.SetRoot(layout, true).SetFocus(t.table)
+
+	return t
+}
+
+// add is the match hook of the UI.
+func (t *scanTUI) add(m scan.Match) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.matches = append(t.matches, m)
+	t.added = true
+}
+
+// run shows the UI until close is called. The table is redrawn every half
+// second rather than on every match, scans find keys in bursts.
+func (t *scanTUI) run() error {
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+
+		start := time.Now()
+		for {
+			select {
+			case <-t.done:
+				return
+			case now := <-ticker.C:
+				t.app.QueueUpdateDraw(func() {
+					t.refresh(now.Sub(start))
+				})
+			}
+		}
+	}()
+
+	return t.app.Run()
+}
+
+// close ends the UI once the scan returned and restores the terminal.
+func (t *scanTUI) close() {
+	close(t.done)
+	// Queued, so a UI that didn't start running yet stops once it does.
+	t.app.QueueUpdate(t.app.Stop)
+}
+
+func (t *scanTUI) stopScan() {
+	t.setMessage("Stopping, the pending events are handled before the summary is written")
+	t.stop()
+}
+
+func (t *scanTUI) snapshot() {
+	t.setMessage("Writing summary...")
+	if err := t.writeSummary(); err != nil {
+		t.setMessage("Couldn't write summary: " + err.Error())
+		return
+	}
+	t.setMessage("Summary written at " + time.Now().Format(time.TimeOnly))
+}
+
+func (t *scanTUI) setMessage(message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.message = message
+}
+
+// refresh runs on the UI goroutine.
+func (t *scanTUI) refresh(elapsed time.Duration) {
+	t.mu.Lock()
+	matches, message := t.matches, t.message
+	t.dirty = t.dirty || t.added
+	t.added = false
+	t.mu.Unlock()
+
+	if t.dirty {
+		t.shown = t.shown[:0]
+		for _, m := range matches {
+			if t.query == "" || strings.HasPrefix(m.Key, t.query) || strings.Contains(m.Service, t.query) {
+				t.shown = append(t.shown, m)
+			}
+		}
+		slices.SortFunc(t.shown, tuiSorts[t.sortBy].compare)
+		t.dirty = false
+
+		t.table.Clear()
+		for col, title := range []string{"Key", "Match type", "Service", "Event"} {
+			t.table.SetCell(0, col, tview.NewTableCell(title).SetSelectable(false).SetAttributes(tcell.AttrBold))
+		}
+		for i, m := range t.shown {
+			t.table.SetCell(i+1, 0, tview.NewTableCell(m.Key).SetExpansion(1))
+			t.table.SetCell(i+1, 1, tview.NewTableCell(m.MatchType))
+			t.table.SetCell(i+1, 2, tview.NewTableCell(m.Service))
+			t.table.SetCell(i+1, 3, tview.NewTableCell(m.EventName))
+		}
+	}
+	row, _ := t.table.GetSelection()
+	t.showDetail(row)
+
+	t.stats.mu.Lock()
+	retries, timeouts, limiterWait := t.stats.Retries, t.stats.CallTimeouts, t.stats.LimiterWaitMs
+	t.stats.mu.Unlock()
+
+	events := t.prog.events.Load()
+	fmt.Fprintf(t.status.Clear(), "events %d (%.0f/s) | pages %d | keys %d/%d by %s | retries %d | call timeouts %d | limiter wait %s | %s\n",
+		events, float64(events)/max(elapsed.Seconds(), 1), t.prog.pages.Load(), len(t.shown), len(matches), tuiSorts[t.sortBy].name,
+		retries, timeouts, time.Duration(limiterWait)*time.Millisecond, elapsed.Truncate(time.Second))
+	if message == "" {
+		message = "[q]uit  [s]ort  [/] filter by section or service  [w]rite summary"
+	}
+	fmt.Fprint(t.status, message)
+}
+
+// showDetail shows the example of row, a row of the table.
+func (t *scanTUI) showDetail(row int) {
+	t.detail.Clear()
+	if row < 1 || row > len(t.shown) {
+		return
+	}
+
+	m := t.shown[row-1]
+	fmt.Fprintf(t.detail, "[::b]Key[::-]\n%s\n\n[::b]Value[::-]\n%s\n\n", tview.Escape(m.Key), tview.Escape(m.Value))
+	for _, field := range [][2]string{
+		{"Match type", m.MatchType},
+		{"Raw key", m.RawKey},
+		{"Service", m.Service},
+		{"Event", m.EventName},
+		{"Event id", m.EventID},
+		{"Event time", formatTime(m.EventTime)},
+		{"Actor", m.Actor},
+		{"Account", m.AccountID},
+		{"Region", m.Region},
+	} {
+		if field[1] != "" {
+			fmt.Fprintf(t.detail, "[::b]%s[::-] %s\n", field[0], tview.Escape(field[1]))
+		}
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+)
+
+// version is set by release builds, e.g.
+// go build -ldflags "-X main.version=v1.2.0". Other builds report the module
+// version of the build info, (devel) when built from a checkout.
+var version string
+
+// buildInfo identifies the build that produced an output.
+type buildInfo struct {
+	Version       string `json:"version"`
+	Revision      string `json:"revision,omitempty"`
+	Modified      bool   `json:"modified,omitempty"`
+	GoVersion     string `json:"goVersion"`
+	SchemaVersion int    `json:"schemaVersion"`
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:       version,
+		GoVersion:     runtime.Version(),
+		SchemaVersion: scan.SchemaVersion,
+	}
+
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	if info.Version == "" {
+		info.Version = build.Main.Version
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+
+	return info
+}
+
+// printVersion prints the build info as "name: value" lines.
+func printVersion(w io.Writer) {
+	info := readBuildInfo()
+	fmt.Fprintf(w, "version: %s\n", info.Version)
+	if info.Revision != "" {
+		fmt.Fprintf(w, "revision: %s\n", info.Revision)
+		fmt.Fprintf(w, "modified: %t\n", info.Modified)
+	}
+	fmt.Fprintf(w, "go: %s\n", info.GoVersion)
+	fmt.Fprintf(w, "schema: %d\n", info.SchemaVersion)
+}
+
+// metadata is what the json outputs record of the build.
+func (b buildInfo) metadata() map[string]string {
+	meta := map[string]string{
+		"generator": "find-cloudtrail-arn-fields",
+		"version":   b.Version,
+	}
+	if b.Revision != "" {
+		meta["revision"] = b.Revision
+	}
+	return meta
+}
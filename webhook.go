@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"golang.org/x/time/rate"
+)
+
+const (
+	webhookQueueSize = 1000
+	webhookRetries   = 3
+
+	// webhookDrainTimeout bounds how long the end of a run waits for queued
+	// notifications.
+	webhookDrainTimeout = 30 * time.Second
+)
+
+// webhookNotifier POSTs every match to a webhook from its own goroutine. It
+// never blocks event handling, matches are dropped once its queue is full.
+type webhookNotifier struct {
+	client  *http.Client
+	url     string
+	secret  string
+	limiter *rate.Limiter
+	stats   *scanStats
+	matches chan scan.Match
+	done    chan struct{}
+}
+
+func newWebhookNotifier(url, secret string, perMinute int, timeout time.Duration, stats *scanStats) *webhookNotifier {
+	return &webhookNotifier{
+		client:  &http.Client{Timeout: timeout},
+		url:     url,
+		secret:  secret,
+		limiter: rate.NewLimiter(rate.Limit(float64(perMinute)/60), 1),
+		stats:   stats,
+		matches: make(chan scan.Match, webhookQueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+func (w *webhookNotifier) add(m scan.Match) {
+	select {
+	case w.matches <- m:
+	default:
+		w.stats.addWebhookDropped(1)
+	}
+}
+
+func (w *webhookNotifier) run() {
+	defer close(w.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for m := range w.matches {
+		if err := w.limiter.Wait(ctx); err != nil {
+			w.stats.addWebhookDropped(1)
+			continue
+		}
+
+		if err := w.send(m); err != nil {
+			slog.Warn("Couldn't send webhook", slog.String("key", m.Key), slog.String("error", err.Error()))
+			w.stats.addWebhookFailure()
+			continue
+		}
+		w.stats.addWebhookSent()
+	}
+}
+
+// close sends the queued matches, but gives up after webhookDrainTimeout and
+// counts the rest as dropped.
+func (w *webhookNotifier) close() {
+	close(w.matches)
+
+	select {
+	case <-w.done:
+	case <-time.After(webhookDrainTimeout):
+		slog.Warn("Gave up sending queued webhooks", slog.Int("queued", len(w.matches)))
+		w.stats.addWebhookDropped(len(w.matches))
+	}
+}
+
+// send POSTs m, retrying with backoff. With a secret the body is signed with
+// HMAC-SHA256 in the X-Signature-256 header, like GitHub webhooks.
+func (w *webhookNotifier) send(m scan.Match) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for retry := 0; ; retry++ {
+		err = w.post(body)
+		if err == nil || retry == webhookRetries {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *webhookNotifier) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if w.secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import "time"
+
+// timeWindow limits the scan to events between start and end. A zero bound is
+// open.
+type timeWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// lookupRetention is how far back LookupEvents returns events.
+const lookupRetention = 90 * 24 * time.Hour
+
+// clampRetention moves the start of the window to the LookupEvents retention
+// horizon as of now if it starts before, and reports whether it did. An open
+// start isn't clamped, LookupEvents returns everything it has then.
+func (w timeWindow) clampRetention(now time.Time) (timeWindow, bool) {
+	horizon := now.UTC().Add(-lookupRetention).Truncate(time.Second)
+	if w.start.IsZero() || !w.start.Before(horizon) {
+		return w, false
+	}
+
+	w.start = horizon
+	return w, true
+}
+
+func (w timeWindow) bounded() bool {
+	return !w.start.IsZero() || !w.end.IsZero()
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	if !w.start.IsZero() && t.Before(w.start) {
+		return false
+	}
+
+	if !w.end.IsZero() && t.After(w.end) {
+		return false
+	}
+
+	return true
+}
+
+// days returns the UTC midnight of every day touched by the window. The window
+// must have a start, an open end stops at now.
+func (w timeWindow) days(now time.Time) []time.Time {
+	end := w.end
+	if end.IsZero() {
+		end = now
+	}
+	end = truncateDay(end)
+
+	var days []time.Time
+	for day := truncateDay(w.start); !day.After(end); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+
+	return days
+}
+
+func truncateDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
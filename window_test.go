@@ -0,0 +1,214 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestClampRetention(t *testing.T) {
+	// The horizon, now less 90 days, is truncated to the second.
+	now := time.Date(2024, 7, 1, 12, 30, 0, 500_000_000, time.UTC)
+	horizon := time.Date(2024, 4, 2, 12, 30, 0, 0, time.UTC)
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		window  timeWindow
+		now     time.Time
+		want    timeWindow
+		clamped bool
+	}{
+		"open start": {
+			window: timeWindow{end: now},
+			want:   timeWindow{end: now},
+		},
+		"open": {},
+		"exact horizon": {
+			window: timeWindow{start: horizon},
+			want:   timeWindow{start: horizon},
+		},
+		"within the truncated second": {
+			window: timeWindow{start: horizon.Add(200 * time.Millisecond)},
+			want:   timeWindow{start: horizon.Add(200 * time.Millisecond)},
+		},
+		"a nanosecond before the horizon": {
+			window:  timeWindow{start: horizon.Add(-time.Nanosecond)},
+			want:    timeWindow{start: horizon},
+			clamped: true,
+		},
+		"a year before the horizon": {
+			window:  timeWindow{start: horizon.AddDate(-1, 0, 0), end: now},
+			want:    timeWindow{start: horizon, end: now},
+			clamped: true,
+		},
+		"end before the horizon": {
+			window:  timeWindow{start: horizon.AddDate(0, 0, -10), end: horizon.AddDate(0, 0, -5)},
+			want:    timeWindow{start: horizon, end: horizon.AddDate(0, 0, -5)},
+			clamped: true,
+		},
+		"end before start": {
+			window: timeWindow{start: now, end: horizon},
+			want:   timeWindow{start: now, end: horizon},
+		},
+		"now in another zone": {
+			window:  timeWindow{start: horizon.Add(-time.Hour)},
+			now:     now.In(berlin),
+			want:    timeWindow{start: horizon},
+			clamped: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			at := tt.now
+			if at.IsZero() {
+				at = now
+			}
+			got, clamped := tt.window.clampRetention(at)
+			if clamped != tt.clamped {
+				t.Errorf("clamped %t, want %t", clamped, tt.clamped)
+			}
+			if !got.start.Equal(tt.want.start) || !got.end.Equal(tt.want.end) {
+				t.Errorf("window %v - %v, want %v - %v", got.start, got.end, tt.want.start, tt.want.end)
+			}
+			if clamped && got.start.Location() != time.UTC {
+				t.Errorf("horizon in %s, want UTC", got.start.Location())
+			}
+		})
+	}
+}
+
+// TestLookupWindow refuses windows ending before the retention horizon, and
+// ones starting before it with --strict-window.
+func TestLookupWindow(t *testing.T) {
+	now := time.Now()
+	tests := map[string]struct {
+		opts    options
+		err     string
+		clamped bool
+	}{
+		"within retention": {
+			opts: options{window: timeWindow{start: now.AddDate(0, 0, -10), end: now}},
+		},
+		"open start": {
+			opts: options{window: timeWindow{end: now}},
+		},
+		"start before the horizon": {
+			opts:    options{window: timeWindow{start: now.AddDate(0, 0, -200), end: now}},
+			clamped: true,
+		},
+		"end before the horizon": {
+			opts: options{window: timeWindow{start: now.AddDate(0, 0, -200), end: now.AddDate(0, 0, -100)}},
+			err:  "--end-time",
+		},
+		"strict window": {
+			opts: options{window: timeWindow{start: now.AddDate(0, 0, -200)}, strictWindow: true},
+			err:  "--start-time",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			stats := &scanStats{}
+			window, err := lookupWindow(tt.opts, stats)
+			if tt.err != "" {
+				if code := exitCode(err); code != exitConfig || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v (exit code %d), want one about %s with exit code %d", err, code, tt.err, exitConfig)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if clamped := stats.EffectiveWindow != nil; clamped != tt.clamped {
+				t.Errorf("effective window recorded %t, want %t", clamped, tt.clamped)
+			}
+			if !tt.clamped && window != tt.opts.window {
+				t.Errorf("window %v, want %v", window, tt.opts.window)
+			}
+			if tt.clamped && !window.start.After(tt.opts.window.start) {
+				t.Errorf("start %v wasn't moved to the horizon", window.start)
+			}
+		})
+	}
+}
+
+func TestWindowDays(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+	}
+	now := time.Date(2024, 7, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		window timeWindow
+		want   []time.Time
+	}{
+		"single day": {
+			window: timeWindow{start: time.Date(2024, 7, 1, 1, 0, 0, 0, time.UTC), end: time.Date(2024, 7, 1, 23, 0, 0, 0, time.UTC)},
+			want:   []time.Time{day(2024, 7, 1)},
+		},
+		"across midnight": {
+			window: timeWindow{start: time.Date(2024, 7, 1, 23, 59, 59, 0, time.UTC), end: time.Date(2024, 7, 2, 0, 0, 1, 0, time.UTC)},
+			want:   []time.Time{day(2024, 7, 1), day(2024, 7, 2)},
+		},
+		"end at midnight": {
+			window: timeWindow{start: time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC), end: day(2024, 7, 2)},
+			want:   []time.Time{day(2024, 7, 1), day(2024, 7, 2)},
+		},
+		"month end": {
+			window: timeWindow{start: time.Date(2024, 4, 29, 10, 0, 0, 0, time.UTC), end: time.Date(2024, 5, 2, 1, 0, 0, 0, time.UTC)},
+			want:   []time.Time{day(2024, 4, 29), day(2024, 4, 30), day(2024, 5, 1), day(2024, 5, 2)},
+		},
+		"leap day": {
+			window: timeWindow{start: day(2024, 2, 28), end: day(2024, 3, 1)},
+			want:   []time.Time{day(2024, 2, 28), day(2024, 2, 29), day(2024, 3, 1)},
+		},
+		"year end": {
+			window: timeWindow{start: day(2023, 12, 31), end: day(2024, 1, 1)},
+			want:   []time.Time{day(2023, 12, 31), day(2024, 1, 1)},
+		},
+		// Berlin moves to summer time on March 31st, the days stay UTC
+		// days: its local midnight is the previous UTC day.
+		"spring DST": {
+			window: timeWindow{start: time.Date(2024, 3, 31, 0, 30, 0, 0, berlin), end: time.Date(2024, 4, 1, 12, 0, 0, 0, berlin)},
+			want:   []time.Time{day(2024, 3, 30), day(2024, 3, 31), day(2024, 4, 1)},
+		},
+		// New York moves back to winter time on November 3rd, its 25 hours
+		// day doesn't add a UTC day.
+		"fall DST": {
+			window: timeWindow{start: time.Date(2024, 11, 2, 12, 0, 0, 0, newYork), end: time.Date(2024, 11, 4, 12, 0, 0, 0, newYork)},
+			want:   []time.Time{day(2024, 11, 2), day(2024, 11, 3), day(2024, 11, 4)},
+		},
+		"open end": {
+			window: timeWindow{start: time.Date(2024, 6, 29, 12, 0, 0, 0, time.UTC)},
+			want:   []time.Time{day(2024, 6, 29), day(2024, 6, 30), day(2024, 7, 1)},
+		},
+		"end before start": {
+			window: timeWindow{start: day(2024, 7, 2), end: day(2024, 7, 1)},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := tt.window.days(now)
+			if len(got) != len(tt.want) {
+				t.Fatalf("days %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) || got[i].Location() != time.UTC {
+					t.Errorf("day %d is %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
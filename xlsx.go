@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/romulets/find-cloudtrail-arn-fields/pkg/scan"
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/exp/maps"
+)
+
+// xlsxColumns are the columns of the Findings sheet with their width.
+var xlsxColumns = []struct {
+	name  string
+	width float64
+}{
+	{"key", 50}, {"rawKey", 50}, {"value", 60}, {"matchType", 14}, {"confidence", 12},
+	{"service", 16}, {"eventName", 30}, {"eventId", 38}, {"eventTime", 20},
+	{"actor", 60}, {"accountId", 14}, {"region", 14}, {"eventSources", 60}, {"eventSourceCount", 18},
+}
+
+// xlsxSummaryWriter writes a workbook for spreadsheet users: a Findings sheet
+// with a row per key and a Stats sheet with the metadata of the run. The
+// values are text cells formatted as text, so a spreadsheet doesn't read an
+// account id as a number or an id as a date. The rows are streamed, the
+// stream writer spills to a temporary file once they get big.
+type xlsxSummaryWriter struct {
+	path string
+	// out, if set, is written to instead of the file at path.
+	out io.Writer
+}
+
+func (w *xlsxSummaryWriter) Write(ctx context.Context, snapshot scan.Snapshot) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	if err := writeXLSXFindings(f, snapshot); err != nil {
+		return fmt.Errorf("write Findings sheet: %w", err)
+	}
+	if err := writeXLSXStats(f, snapshot); err != nil {
+		return fmt.Errorf("write Stats sheet: %w", err)
+	}
+
+	if w.out != nil {
+		return f.Write(w.out)
+	}
+
+	file, err := createAtomic(w.path, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.abort()
+
+	if err := f.Write(file); err != nil {
+		return err
+	}
+	if err := file.commit(); err != nil {
+		return err
+	}
+
+	slog.Debug("Summary written", slog.String("path", w.path), slog.Int("keys", len(snapshot.Matches)))
+	return nil
+}
+
+func writeXLSXFindings(f *excelize.File, snapshot scan.Snapshot) error {
+	const sheet = "Findings"
+	if err := f.SetSheetName("Sheet1", sheet); err != nil {
+		return err
+	}
+
+	text, err := f.NewStyle(&excelize.Style{NumFmt: 49})
+	if err != nil {
+		return err
+	}
+	number, err := f.NewStyle(&excelize.Style{NumFmt: 2})
+	if err != nil {
+		return err
+	}
+	integer, err := f.NewStyle(&excelize.Style{NumFmt: 1})
+	if err != nil {
+		return err
+	}
+	date, err := f.NewStyle(&excelize.Style{NumFmt: 22})
+	if err != nil {
+		return err
+	}
+	header, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}, NumFmt: 49})
+	if err != nil {
+		return err
+	}
+
+	// The filter covers the rows written below, it has to be set before the
+	// stream writer takes the sheet over.
+	last, err := excelize.CoordinatesToCellName(len(xlsxColumns), len(snapshot.Matches)+1)
+	if err != nil {
+		return err
+	}
+	if err := f.AutoFilter(sheet, "A1:"+last, nil); err != nil {
+		return err
+	}
+
+	sw, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		return err
+	}
+	if err := sw.SetPanes(&excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"}); err != nil {
+		return err
+	}
+	for i, c := range xlsxColumns {
+		if err := sw.SetColWidth(i+1, i+1, c.width); err != nil {
+			return err
+		}
+	}
+
+	names := make([]any, 0, len(xlsxColumns))
+	for _, c := range xlsxColumns {
+		names = append(names, excelize.Cell{StyleID: header, Value: c.name})
+	}
+	if err := sw.SetRow("A1", names); err != nil {
+		return err
+	}
+
+	textCell := func(s string) excelize.Cell { return excelize.Cell{StyleID: text, Value: s} }
+	for i, m := range snapshot.Matches {
+		eventTime := excelize.Cell{StyleID: text}
+		if !m.EventTime.IsZero() {
+			eventTime = excelize.Cell{StyleID: date, Value: m.EventTime.UTC()}
+		}
+
+		cell, err := excelize.CoordinatesToCellName(1, i+2)
+		if err != nil {
+			return err
+		}
+		row := []any{
+			textCell(m.Key), textCell(m.RawKey), textCell(m.Value), textCell(m.MatchType),
+			excelize.Cell{StyleID: number, Value: m.Confidence},
+			textCell(m.Service), textCell(m.EventName), textCell(m.EventID), eventTime,
+			textCell(m.Actor), textCell(m.AccountID), textCell(m.Region),
+			textCell(strings.Join(m.EventSources, " ")), excelize.Cell{StyleID: integer, Value: len(m.EventSources)},
+		}
+		if err := sw.SetRow(cell, row); err != nil {
+			return err
+		}
+	}
+	return sw.Flush()
+}
+
+// writeXLSXStats writes the metadata of the snapshot and the number of keys
+// per match type as name and value rows.
+func writeXLSXStats(f *excelize.File, snapshot scan.Snapshot) error {
+	const sheet = "Stats"
+	if _, err := f.NewSheet(sheet); err != nil {
+		return err
+	}
+
+	rows := [][]any{
+		{"schemaVersion", snapshot.SchemaVersion},
+		{"keys", len(snapshot.Matches)},
+	}
+
+	metadata := readBuildInfo().metadata()
+	keys := maps.Keys(metadata)
+	slices.Sort(keys)
+	for _, k := range keys {
+		rows = append(rows, []any{k, metadata[k]})
+	}
+
+	matchTypes := maps.Keys(snapshot.Counts)
+	slices.Sort(matchTypes)
+	for _, matchType := range matchTypes {
+		rows = append(rows, []any{"keys." + matchType, snapshot.Counts[matchType]})
+	}
+
+	if err := f.SetColWidth(sheet, "A", "B", 30); err != nil {
+		return err
+	}
+	for i, row := range rows {
+		cell, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			return err
+		}
+		if err := f.SetSheetRow(sheet, cell, &row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
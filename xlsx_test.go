@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// zipFile reads the file name of a zip archive, e.g. a sheet of a workbook.
+func zipFile(archive []byte, name string) ([]byte, error) {
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, err
+	}
+	file, err := r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// TestXLSXSummaryReadBack reads the cells of the workbook back as they were
+// written: their raw values, text cells for the ids, a date for the event
+// time, and the frozen header with its filter.
+func TestXLSXSummaryReadBack(t *testing.T) {
+	withVersion(t, "v0.0.0-xlsx")
+	snapshot := goldenSnapshot()
+
+	var out bytes.Buffer
+	if err := (&xlsxSummaryWriter{out: &out}).Write(context.Background(), snapshot); err != nil {
+		t.Fatal(err)
+	}
+	f, err := excelize.OpenReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if sheets := f.GetSheetList(); !slices.Equal(sheets, []string{"Findings", "Stats"}) {
+		t.Fatalf("sheets %v, want Findings and Stats", sheets)
+	}
+
+	rows, err := f.GetRows("Findings", excelize.Options{RawCellValue: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(snapshot.Matches)+1 {
+		t.Fatalf("%d rows, want a header and %d matches", len(rows), len(snapshot.Matches))
+	}
+	for i, c := range xlsxColumns {
+		if rows[0][i] != c.name {
+			t.Errorf("column %d is %q, want %q", i, rows[0][i], c.name)
+		}
+	}
+
+	for i, m := range snapshot.Matches {
+		row := append(rows[i+1], make([]string, len(xlsxColumns))...)[:len(xlsxColumns)]
+		for column, want := range map[int]string{0: m.Key, 1: m.RawKey, 2: m.Value, 3: m.MatchType, 7: m.EventID, 10: m.AccountID} {
+			if row[column] != want {
+				t.Errorf("row %d: %s is %q, want %q", i+2, xlsxColumns[column].name, row[column], want)
+			}
+		}
+		if confidence, err := strconv.ParseFloat(row[4], 64); err != nil || confidence != m.Confidence {
+			t.Errorf("row %d: confidence %q, want %v", i+2, row[4], m.Confidence)
+		}
+		serial, err := strconv.ParseFloat(row[8], 64)
+		if err != nil {
+			t.Fatalf("row %d: eventTime %q isn't a date", i+2, row[8])
+		}
+		if at, err := excelize.ExcelDateToTime(serial, false); err != nil || !at.Equal(m.EventTime) {
+			t.Errorf("row %d: eventTime %v, want %v", i+2, at, m.EventTime)
+		}
+		if row[13] != strconv.Itoa(len(m.EventSources)) {
+			t.Errorf("row %d: eventSourceCount %q, want %d", i+2, row[13], len(m.EventSources))
+		}
+
+		// Ids stay text, even when they look like numbers.
+		cell, _ := excelize.CoordinatesToCellName(11, i+2)
+		if m.AccountID != "" {
+			if typ, err := f.GetCellType("Findings", cell); err != nil || (typ != excelize.CellTypeInlineString && typ != excelize.CellTypeSharedString) {
+				t.Errorf("%s holding %s has type %v, want a string", cell, m.AccountID, typ)
+			}
+		}
+	}
+
+	panes, err := f.GetPanes("Findings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !panes.Freeze || panes.YSplit != 1 {
+		t.Errorf("panes %+v, want the header row frozen", panes)
+	}
+	// excelize doesn't read filters back, the sheet must have one over the
+	// header and the rows.
+	sheet, err := zipFile(out.Bytes(), "xl/worksheets/sheet1.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(sheet, []byte(`<autoFilter ref="$A$1:$N$13">`)) {
+		t.Errorf("the Findings sheet has no filter over A1:N13:\n%s", sheet)
+	}
+
+	stats, err := f.GetRows("Stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, row := range stats {
+		got[row[0]] = row[1]
+	}
+	want := map[string]string{
+		"schemaVersion":    strconv.Itoa(snapshot.SchemaVersion),
+		"keys":             "12",
+		"generator":        "find-cloudtrail-arn-fields",
+		"version":          "v0.0.0-xlsx",
+		"keys.arn":         "9",
+		"keys.resource-id": "2",
+		"keys.account-id":  "1",
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("Stats %s is %q, want %q", name, got[name], value)
+		}
+	}
+}